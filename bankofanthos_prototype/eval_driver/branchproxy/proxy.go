@@ -0,0 +1,619 @@
+// Package branchproxy is a postgres wire-protocol proxy that routes
+// connections to dbbranch branches, so that binaries whose configs point at
+// the production database can be run against a branch without touching the
+// production schema.
+package branchproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"bankofanthos_prototype/eval_driver/dbbranch"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Route sends the connections whose startup parameter Param is Value to the
+// branch in Namespace, e.g. application_name:stable=trail1.
+type Route struct {
+	Param     string
+	Value     string
+	Namespace string
+}
+
+func ParseRoute(s string) (Route, error) {
+	param, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return Route{}, fmt.Errorf("route %q is not of the form param:value=namespace", s)
+	}
+	value, namespace, ok := strings.Cut(rest, "=")
+	if !ok || param == "" || namespace == "" {
+		return Route{}, fmt.Errorf("route %q is not of the form param:value=namespace", s)
+	}
+	return Route{Param: param, Value: value, Namespace: namespace}, nil
+}
+
+// branchKey identifies a branch by its database and namespace.
+type branchKey struct {
+	database  string
+	namespace string
+}
+
+// Proxy forwards postgres connections to the upstream server, setting the
+// search_path of the routed ones to their branch. The statements sent over a
+// connection routed to a branch added with AddBranch are rewritten for the
+// branch; the rest of the session is passed through as is, authentication
+// included.
+type Proxy struct {
+	upstream *url.URL // server the connections are forwarded to, its user reads the branch catalogs
+	routes   []Route
+
+	mu       sync.Mutex
+	pools    map[string]*pgxpool.Pool // catalog connections keyed by database
+	branches map[branchKey]*dbbranch.Branch
+}
+
+func New(upstream string, routes []Route) (*Proxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream url: %w", err)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "5432")
+	}
+	return &Proxy{upstream: u, routes: routes, pools: map[string]*pgxpool.Pool{}, branches: map[branchKey]*dbbranch.Branch{}}, nil
+}
+
+// AddBranch makes the connections routed to the namespace of branch in
+// database use branch, which this process created, rather than look it up in
+// the catalog. Their schema changes are applied to the branch only, with
+// Branch.Migrate when they are executed outside of a transaction, and the
+// statements postgres cannot run against the R' views of the branch are
+// rewritten with Branch.Rewrite, so that they work as they do against the
+// production tables.
+func (p *Proxy) AddBranch(database string, branch *dbbranch.Branch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.branches[branchKey{database, branch.Namespace()}] = branch
+}
+
+func (p *Proxy) branch(database, namespace string) *dbbranch.Branch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.branches[branchKey{database, namespace}]
+}
+
+// namespace returns the branch the connection with the startup parameters
+// params is routed to, or "" if it reads and writes production. The first
+// matching route wins.
+func (p *Proxy) namespace(params map[string]string) string {
+	for _, r := range p.routes {
+		if v, ok := params[r.Param]; ok && v == r.Value {
+			return r.Namespace
+		}
+	}
+	return ""
+}
+
+// searchPath looks up the branch in the catalog of the database every time,
+// since branches come and go between runs.
+func (p *Proxy) searchPath(ctx context.Context, database, namespace string) (string, error) {
+	p.mu.Lock()
+	pool, ok := p.pools[database]
+	if !ok {
+		u := *p.upstream
+		u.Path = "/" + database
+		var err error
+		if pool, err = pgxpool.Connect(ctx, u.String()); err != nil {
+			p.mu.Unlock()
+			return "", fmt.Errorf("failed to connect to database %s: %w", database, err)
+		}
+		p.pools[database] = pool
+	}
+	p.mu.Unlock()
+	return dbbranch.LookupSearchPath(ctx, pool, namespace)
+}
+
+func (p *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := p.handle(ctx, conn); err != nil {
+				log.Printf("connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (p *Proxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pool := range p.pools {
+		pool.Close()
+	}
+}
+
+func (p *Proxy) handle(ctx context.Context, client net.Conn) error {
+	defer client.Close()
+	cr := pgproto3.NewChunkReader(client)
+	backend := pgproto3.NewBackend(cr, client)
+
+	var startup *pgproto3.StartupMessage
+	for startup == nil {
+		msg, err := backend.ReceiveStartupMessage()
+		if err != nil {
+			return fmt.Errorf("failed to receive startup message: %w", err)
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			// the proxy has to read the startup message, so it cannot
+			// encrypt; clients fall back to a plain connection
+			if _, err := client.Write([]byte("N")); err != nil {
+				return err
+			}
+		case *pgproto3.CancelRequest:
+			// the backend key data of the server is passed through, so the
+			// server knows the process to cancel
+			return p.forward(msg)
+		case *pgproto3.StartupMessage:
+			startup = msg
+		default:
+			return fmt.Errorf("unexpected startup message %T", msg)
+		}
+	}
+
+	var branch *dbbranch.Branch
+	if namespace := p.namespace(startup.Parameters); namespace != "" {
+		database := startup.Parameters["database"]
+		if database == "" {
+			database = startup.Parameters["user"]
+		}
+		var searchPath string
+		if branch = p.branch(database, namespace); branch != nil {
+			searchPath = branch.SearchPath()
+		} else {
+			var err error
+			if searchPath, err = p.searchPath(ctx, database, namespace); err != nil {
+				backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "08004", Message: err.Error()})
+				return err
+			}
+		}
+		// the server applies startup parameters it does not know as settings
+		startup.Parameters["search_path"] = searchPath
+	}
+
+	server, err := net.Dial("tcp", p.upstream.Host)
+	if err != nil {
+		backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "08001", Message: fmt.Sprintf("failed to connect to upstream: %v", err)})
+		return err
+	}
+	defer server.Close()
+	buf, err := startup.Encode(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := server.Write(buf); err != nil {
+		return fmt.Errorf("failed to forward startup message: %w", err)
+	}
+
+	// either side closing ends the session
+	var s *session
+	if branch != nil {
+		s = newSession(branch, client, server)
+	}
+	done := make(chan error, 2)
+	go func() {
+		if s == nil {
+			_, err := io.Copy(server, client)
+			done <- err
+			return
+		}
+		done <- s.forward(ctx, cr)
+	}()
+	go func() {
+		if s == nil {
+			_, err := io.Copy(client, server)
+			done <- err
+			return
+		}
+		done <- s.receive(pgproto3.NewChunkReader(server))
+	}()
+	if err := <-done; err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// session is a connection routed to a branch this process created. The
+// proxy applies the schema changes of the client to the branch with Migrate
+// and reports their outcome in the place of the server, so it keeps track of
+// the transaction status of the server and of the responses it replaces.
+type session struct {
+	branch *dbbranch.Branch
+	client io.Writer
+	server io.Writer
+
+	// used by forward only
+	statements map[string]string // the schema changes the client prepared, keyed by statement name
+	portals    map[string]string // the schema changes the client bound, keyed by portal name
+	quiet      bool              // the current batch took no locks: it only prepared and bound schema changes
+
+	mu       sync.Mutex // guards the fields below and the writes to client
+	ready    *sync.Cond // broadcast on every ReadyForQuery and when the server closes
+	status   byte       // the transaction status of the last ReadyForQuery
+	sent     int        // the batches forwarded to the server, each answered by a ReadyForQuery
+	received int        // the ReadyForQuery messages received
+	closed   bool
+	replies  []reply // the responses of the server the proxy replaces
+	markers  int
+}
+
+// reply replaces a response of the server in batch: the ErrorResponse that
+// names marker with err, or else the EmptyQueryResponse to the Execute of a
+// schema change with the CommandComplete of tag.
+type reply struct {
+	batch  int
+	marker string
+	err    *pgproto3.ErrorResponse
+	tag    string
+}
+
+func newSession(branch *dbbranch.Branch, client, server io.Writer) *session {
+	s := &session{
+		branch:     branch,
+		client:     client,
+		server:     server,
+		statements: map[string]string{},
+		portals:    map[string]string{},
+		quiet:      true,
+		sent:       1, // the server is ready for queries once the client is authenticated
+	}
+	s.ready = sync.NewCond(&s.mu)
+	return s
+}
+
+// forward forwards the messages of the client to the server until the
+// client closes the connection. The statements of Query and Parse messages
+// are rewritten for the branch, and the schema changes among them are
+// applied when they are executed; the other messages are passed through as
+// they are.
+func (s *session) forward(ctx context.Context, cr pgproto3.ChunkReader) error {
+	for {
+		typ, body, err := next(cr)
+		if err != nil {
+			return err
+		}
+		msg, err := s.intercept(ctx, typ, body)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		if _, err := s.server.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// intercept returns the message of the client to forward in the place of the
+// message typ with body, or nil if the proxy answers it.
+func (s *session) intercept(ctx context.Context, typ byte, body []byte) ([]byte, error) {
+	switch typ {
+	case 'Q':
+		var query pgproto3.Query
+		if err := query.Decode(body); err != nil {
+			return nil, err
+		}
+		return s.query(ctx, query.String)
+	case 'P':
+		var parse pgproto3.Parse
+		if err := parse.Decode(body); err != nil {
+			return nil, err
+		}
+		if dbbranch.SchemaChangeTag(parse.Query) != "" {
+			// the change is applied when the statement is executed; the
+			// server prepares an empty statement, which has no parameters
+			// and returns no rows either
+			s.statements[parse.Name] = parse.Query
+			parse.Query = ""
+			return parse.Encode(nil)
+		}
+		delete(s.statements, parse.Name)
+		s.quiet = false
+		rewritten, err := s.branch.Rewrite(parse.Query)
+		if err != nil {
+			rewritten = s.fail(err)
+		}
+		parse.Query = rewritten
+		return parse.Encode(nil)
+	case 'B':
+		var bind pgproto3.Bind
+		if err := bind.Decode(body); err != nil {
+			return nil, err
+		}
+		if sql, ok := s.statements[bind.PreparedStatement]; ok {
+			s.portals[bind.DestinationPortal] = sql
+		} else {
+			delete(s.portals, bind.DestinationPortal)
+			s.quiet = false
+		}
+	case 'E':
+		var execute pgproto3.Execute
+		if err := execute.Decode(body); err != nil {
+			return nil, err
+		}
+		sql, ok := s.portals[execute.Portal]
+		if !ok {
+			s.quiet = false
+			break
+		}
+		var err error = errNotAlone
+		if s.quiet {
+			err = s.idle()
+		}
+		if err == nil {
+			err = s.branch.Migrate(ctx, sql)
+		}
+		if err != nil {
+			execute.Portal = s.fail(err)
+		} else {
+			s.mu.Lock()
+			s.replies = append(s.replies, reply{batch: s.sent, tag: dbbranch.SchemaChangeTag(sql)})
+			s.mu.Unlock()
+		}
+		return execute.Encode(nil)
+	case 'C':
+		var c pgproto3.Close
+		if err := c.Decode(body); err != nil {
+			return nil, err
+		}
+		if c.ObjectType == 'S' {
+			delete(s.statements, c.Name)
+		} else {
+			delete(s.portals, c.Name)
+		}
+	case 'S':
+		s.mu.Lock()
+		s.sent++
+		s.mu.Unlock()
+		s.quiet = true
+	}
+	return encode(typ, body), nil
+}
+
+// query returns the Query message to forward for sql. Its schema changes are
+// applied right away, since the server runs the rest of sql as soon as it
+// gets it.
+func (s *session) query(ctx context.Context, sql string) ([]byte, error) {
+	s.quiet = true
+	tag := dbbranch.SchemaChangeTag(sql)
+	var err error
+	if tag != "" {
+		err = s.idle()
+	}
+	rewritten := ""
+	if err == nil {
+		rewritten, err = s.branch.Intercept(ctx, sql)
+	}
+	if err != nil {
+		rewritten = s.fail(err)
+	} else if tag != "" && rewritten == "" {
+		// the server has nothing left to run; it is idle, so the proxy
+		// answers in its place
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return nil, s.send(&pgproto3.CommandComplete{CommandTag: []byte(tag)}, &pgproto3.ReadyForQuery{TxStatus: s.status})
+	}
+	s.mu.Lock()
+	s.sent++
+	s.mu.Unlock()
+	return (&pgproto3.Query{String: rewritten}).Encode(nil)
+}
+
+var (
+	errInTransaction = &pgconn.PgError{Severity: "ERROR", Code: "25001", Message: "schema changes of a branch cannot run inside a transaction block"}
+	errAborted       = &pgconn.PgError{Severity: "ERROR", Code: "25P02", Message: "current transaction is aborted, commands ignored until end of transaction block"}
+	errNotAlone      = &pgconn.PgError{Severity: "ERROR", Code: "25001", Message: "schema changes of a branch cannot run in a batch with other statements"}
+)
+
+// idle waits until the server answered the batches the client sent before,
+// and fails unless the session is outside of a transaction. Migrate runs on
+// a connection of its own, and would wait for the locks of the session while
+// the session waits for it.
+func (s *session) idle() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.received < s.sent && !s.closed {
+		s.ready.Wait()
+	}
+	if s.closed {
+		return errors.New("the server closed the connection")
+	}
+	switch s.status {
+	case 'I':
+		return nil
+	case 'E':
+		return errAborted
+	default:
+		return errInTransaction
+	}
+}
+
+// fail returns a marker, a statement or portal name that the server rejects
+// with an error naming it, and makes the proxy report err in the place of
+// that error. The server fails the rest of the batch and the transaction
+// like it does for its own errors.
+func (s *session) fail(err error) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.markers++
+	marker := fmt.Sprintf("$proxy%d$", s.markers)
+	s.replies = append(s.replies, reply{batch: s.sent, marker: marker, err: errorResponse(err)})
+	return marker
+}
+
+// errorResponse returns the ErrorResponse of err: the error of the server if
+// err wraps one, e.g. from a failing schema change, or a feature_not_supported
+// error for the statements the branch cannot run.
+func errorResponse(err error) *pgproto3.ErrorResponse {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "0A000", Message: err.Error()}
+	}
+	return &pgproto3.ErrorResponse{
+		Severity:       pgErr.Severity,
+		Code:           pgErr.Code,
+		Message:        pgErr.Message,
+		Detail:         pgErr.Detail,
+		Hint:           pgErr.Hint,
+		SchemaName:     pgErr.SchemaName,
+		TableName:      pgErr.TableName,
+		ColumnName:     pgErr.ColumnName,
+		DataTypeName:   pgErr.DataTypeName,
+		ConstraintName: pgErr.ConstraintName,
+	}
+}
+
+// receive forwards the messages of the server to the client until the server
+// closes the connection, with the replies of the proxy in the place of the
+// responses they replace.
+func (s *session) receive(cr pgproto3.ChunkReader) error {
+	defer func() {
+		s.mu.Lock()
+		s.closed = true
+		s.ready.Broadcast()
+		s.mu.Unlock()
+	}()
+	for {
+		typ, body, err := next(cr)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		err = s.relay(typ, body)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// relay sends the message typ with body of the server, or the reply that
+// replaces it, to the client. s.mu must be held.
+func (s *session) relay(typ byte, body []byte) error {
+	switch typ {
+	case 'E':
+		var e pgproto3.ErrorResponse
+		if err := e.Decode(body); err != nil {
+			return err
+		}
+		for i, r := range s.replies {
+			if r.marker != "" && strings.Contains(e.Message, r.marker) {
+				s.replies = slices.Delete(s.replies, i, i+1)
+				return s.send(r.err)
+			}
+		}
+	case 'I':
+		for i, r := range s.replies {
+			if r.tag != "" && r.batch == s.received {
+				s.replies = slices.Delete(s.replies, i, i+1)
+				return s.send(&pgproto3.CommandComplete{CommandTag: []byte(r.tag)})
+			}
+		}
+	case 'Z':
+		if len(body) != 1 {
+			return fmt.Errorf("invalid ReadyForQuery message")
+		}
+		s.status = body[0]
+		s.received++
+		// the replies of a failed batch are left over
+		s.replies = slices.DeleteFunc(s.replies, func(r reply) bool { return r.batch < s.received })
+		s.ready.Broadcast()
+	}
+	_, err := s.client.Write(encode(typ, body))
+	return err
+}
+
+// send sends msgs of the proxy to the client. s.mu must be held.
+func (s *session) send(msgs ...pgproto3.BackendMessage) error {
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		if buf, err = msg.Encode(buf); err != nil {
+			return err
+		}
+	}
+	_, err := s.client.Write(buf)
+	return err
+}
+
+// next reads the next message of a started session.
+func next(cr pgproto3.ChunkReader) (byte, []byte, error) {
+	header, err := cr.Next(5)
+	if err != nil {
+		return 0, nil, err
+	}
+	typ := header[0]
+	size := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if size < 0 {
+		return 0, nil, fmt.Errorf("invalid length of message %q", typ)
+	}
+	body, err := cr.Next(size)
+	if err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// encode returns the message typ with body.
+func encode(typ byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// forward sends msg to the upstream server on a connection of its own.
+func (p *Proxy) forward(msg *pgproto3.CancelRequest) error {
+	server, err := net.Dial("tcp", p.upstream.Host)
+	if err != nil {
+		return fmt.Errorf("failed to connect to upstream: %w", err)
+	}
+	defer server.Close()
+	buf, err := msg.Encode(nil)
+	if err != nil {
+		return err
+	}
+	_, err = server.Write(buf)
+	return err
+}
+
+// ConnString rewrites a postgres connection url so that it connects through
+// the proxy listening on addr, with its application_name set to
+// applicationName, e.g. to match a route application_name:value=namespace.
+func ConnString(connString, addr, applicationName string) (string, error) {
+	u, err := url.Parse(connString)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	u.Host = addr
+	query := u.Query()
+	query.Set("application_name", applicationName)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,219 @@
+// This file persists the branches created by dbbranch in a catalog table, so
+// that branches left behind by a crashed run can be found and cleaned up.
+package dbbranch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/exp/maps"
+)
+
+const catalogSchema = "dbbranch_meta"
+
+var catalogTable = qualify(catalogSchema, "branches")
+
+type BranchState string
+
+const (
+	BranchCreating  BranchState = "creating"  // the namespace may be partially created
+	BranchActive    BranchState = "active"    // writes are redirected into the branch
+	BranchCommitted BranchState = "committed" // the branch is read only
+	BranchDeleting  BranchState = "deleting"  // the namespace may be partially dropped
+)
+
+// BranchInfo is the catalog record of a branch.
+type BranchInfo struct {
+	Namespace  string
+	Parent     string   // namespace of the parent branch, empty if cloned from the production tables
+	Schemas    []string // schemas that hold the branch, the namespace first
+	SearchPath []string // schemas of the search_path of the branch, see Branch.SearchPath
+	Tables     []string
+	Triggers   []string // "<trigger> ON <view>"
+	Functions  []string
+	State      BranchState
+}
+
+type catalog struct {
+	connPool *pgxpool.Pool
+}
+
+func newCatalog(ctx context.Context, connPool *pgxpool.Pool) (*catalog, error) {
+	_, err := connPool.Exec(ctx, fmt.Sprintf(`
+	CREATE SCHEMA IF NOT EXISTS %s;
+	CREATE TABLE IF NOT EXISTS %s (
+		namespace   TEXT PRIMARY KEY,
+		parent      TEXT,
+		schemas     TEXT[] NOT NULL DEFAULT '{}',
+		search_path TEXT[] NOT NULL DEFAULT '{}',
+		tables      TEXT[] NOT NULL DEFAULT '{}',
+		triggers    TEXT[] NOT NULL DEFAULT '{}',
+		functions   TEXT[] NOT NULL DEFAULT '{}',
+		state       TEXT NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`, quoteIdent(catalogSchema), catalogTable))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create branch catalog: %w", err)
+	}
+	return &catalog{connPool: connPool}, nil
+}
+
+// insert records a branch before any of its objects are created.
+func (c *catalog) insert(ctx context.Context, namespace, parent string, schemas []string, searchPath []string) error {
+	var parentVal *string
+	if parent != "" {
+		parentVal = &parent
+	}
+	_, err := c.connPool.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (namespace, parent, schemas, search_path, state) VALUES ($1, $2, $3, $4, $5);`, catalogTable), namespace, parentVal, nonNil(schemas), nonNil(searchPath), BranchCreating)
+	return err
+}
+
+func (c *catalog) update(ctx context.Context, info BranchInfo) error {
+	_, err := c.connPool.Exec(ctx, fmt.Sprintf(`
+	UPDATE %s SET tables = $2, triggers = $3, functions = $4, state = $5
+	WHERE namespace = $1;`, catalogTable), info.Namespace, nonNil(info.Tables), nonNil(info.Triggers), nonNil(info.Functions), info.State)
+	return err
+}
+
+func (c *catalog) delete(ctx context.Context, namespace string) error {
+	_, err := c.connPool.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE namespace = $1;`, catalogTable), namespace)
+	return err
+}
+
+func (c *catalog) list(ctx context.Context) ([]BranchInfo, error) {
+	rows, err := c.connPool.Query(ctx, fmt.Sprintf(`
+	SELECT namespace, parent, schemas, search_path, tables, triggers, functions, state
+	FROM %s ORDER BY created_at, namespace;`, catalogTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []BranchInfo
+	for rows.Next() {
+		var info BranchInfo
+		var parent *string
+		var state string
+		if err := rows.Scan(&info.Namespace, &parent, &info.Schemas, &info.SearchPath, &info.Tables, &info.Triggers, &info.Functions, &state); err != nil {
+			return nil, err
+		}
+		if parent != nil {
+			info.Parent = *parent
+		}
+		info.State = BranchState(state)
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+// recover drops every branch recorded in the catalog, forked branches before
+// the branches they are forked from. Schemas that are not in the catalog are
+// left alone.
+func (c *catalog) recover(ctx context.Context) error {
+	infos, err := c.list(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list branches: %w", err)
+	}
+
+	parents := map[string]string{}
+	for _, info := range infos {
+		parents[info.Namespace] = info.Parent
+	}
+	depth := func(namespace string) int {
+		d := 0
+		for p := parents[namespace]; p != ""; p = parents[p] {
+			d++
+		}
+		return d
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return depth(infos[i].Namespace) > depth(infos[j].Namespace)
+	})
+
+	for _, info := range infos {
+		for _, schema := range info.Schemas {
+			if err := dropSchemaCascade(ctx, c.connPool, schema); err != nil {
+				return fmt.Errorf("failed to drop branch %s: %w", info.Namespace, err)
+			}
+		}
+		if err := c.delete(ctx, info.Namespace); err != nil {
+			return fmt.Errorf("failed to remove branch %s from catalog: %w", info.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// schemas returns the schemas of all branches recorded in the catalog.
+func (c *catalog) schemas(ctx context.Context) ([]string, error) {
+	infos, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var schemas []string
+	for _, info := range infos {
+		schemas = append(schemas, info.Schemas...)
+	}
+	return schemas, nil
+}
+
+// LookupSearchPath returns the search_path of the branch in namespace, as
+// Branch.SearchPath does, from the catalog of the database connPool connects
+// to. It lets processes other than the one that created the branch, e.g. a
+// proxy, route connections to it. Branches that are still being created or
+// are being deleted are not found.
+func LookupSearchPath(ctx context.Context, connPool *pgxpool.Pool, namespace string) (string, error) {
+	var searchPath []string
+	var state string
+	err := connPool.QueryRow(ctx, fmt.Sprintf(`SELECT search_path, state FROM %s WHERE namespace = $1;`, catalogTable), namespace).Scan(&searchPath, &state)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("branch %s does not exist", namespace)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up branch %s: %w", namespace, err)
+	}
+	if state := BranchState(state); state != BranchActive && state != BranchCommitted {
+		return "", fmt.Errorf("branch %s is %s", namespace, state)
+	}
+	if len(searchPath) == 0 {
+		return "", fmt.Errorf("branch %s has no search_path in the catalog", namespace)
+	}
+
+	var path []string
+	for _, schema := range searchPath {
+		path = append(path, quoteIdent(schema))
+	}
+	return strings.Join(path, ", "), nil
+}
+
+// info returns the catalog record of the branch.
+func (b *Branch) info(state BranchState) BranchInfo {
+	info := BranchInfo{Namespace: b.namespace, Schemas: b.clonedDdl.schemas(), SearchPath: b.clonedDdl.searchPathSchemas(), State: state}
+	if b.parent != nil {
+		info.Parent = b.parent.namespace
+	}
+	info.Tables = maps.Keys(b.clonedDdl.clonedTables)
+	sort.Strings(info.Tables)
+	for _, name := range info.Tables {
+		t := b.clonedDdl.clonedTables[name]
+		for _, trigger := range t.Triggers {
+			info.Triggers = append(info.Triggers, quoteIdent(trigger)+" ON "+t.View.qualifiedName())
+		}
+		for _, trigger := range t.RouteTriggers {
+			info.Triggers = append(info.Triggers, quoteIdent(trigger)+" ON "+t.Hierarchy.qualifiedName())
+		}
+		info.Functions = append(info.Functions, t.Functions...)
+	}
+	return info
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
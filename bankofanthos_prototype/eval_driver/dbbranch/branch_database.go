@@ -3,12 +3,10 @@ package dbbranch
 import (
 	"context"
 	"fmt"
-	"slices"
-	"sort"
-	"strings"
+	"net/url"
+	"sync"
 
 	"github.com/jackc/pgx/v4/pgxpool"
-	"golang.org/x/exp/maps"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -19,76 +17,185 @@ import (
 // defer b1.Delete() // optionally
 // defer b1.Commit()
 //
-// Only one branch can be active at a time.
-// It should be hard to forget to Commit a branch.
-// Delete should maybe behave nicely even if you forget to call Commit.
+// Every branch lives in its own namespace. The production tables are shared
+// by all branches as a read-only snapshot, and each namespace owns a view R'
+// per table together with its R+/R- tables. Any number of branches can be
+// active and take writes at the same time; an application picks a branch by
+// putting its namespace first in the search_path (see Branch.ConnString).
 type Brancher struct {
-	db            *pgxpool.Pool
-	currentBranch *Branch
-	branches      map[string]*Branch
+	db       *pgxpool.Pool
+	catalog  *catalog
+	mu       sync.Mutex // guards branches
+	branches map[string]*Branch
+	rules    DiffRules // the rules of the diffs, see SetDiffRules
 }
 
 type Branch struct {
+	brancher  *Brancher
 	clonedDdl *cloneDdl
 	namespace string
 	committed bool
+	deleted   bool
+	migrated  bool // the schema was changed by Migrate
+
+	parent   *Branch   // nil if the branch is cloned from the production tables
+	children []*Branch // branches forked from this branch, guarded by brancher.mu
 }
 
 func NewBrancher(ctx context.Context, db *pgxpool.Pool) (*Brancher, error) {
-	// make sure the status is clean when creating new branches
+	catalog, err := newCatalog(ctx, db)
+	if err != nil {
+		return nil, err
+	}
 
-	// rename RSnapshot to R if find any
-	uncleanedDatabase := &database{
-		connPool: db,
-		Tables:   map[string]*table{},
+	// make sure the status is clean when creating new branches: drop the
+	// branches a previous run left behind, but nothing it did not create
+	if err := catalog.recover(ctx); err != nil {
+		return nil, fmt.Errorf("failed to recover branches: %w", err)
 	}
 
-	if err := uncleanedDatabase.getDatabaseMetadata(ctx); err != nil {
-		return nil, err
+	return &Brancher{db: db, catalog: catalog, branches: map[string]*Branch{}}, nil
+}
+
+// SetDiffRules sets the rules by which ComputeDiffAtN and ComputeDiffPerReq
+// compare the columns whose values differ between branches even if the
+// services behave the same.
+func (b *Brancher) SetDiffRules(rules DiffRules) error {
+	if err := rules.Validate(); err != nil {
+		return fmt.Errorf("invalid diff rules: %w", err)
 	}
+	b.rules = rules
+	return nil
+}
 
-	// go through the table to see if any table has *snapshot, rename that
-	for name, table := range uncleanedDatabase.Tables {
-		if strings.HasSuffix(name, snapshotSuffix) {
-			if err := dropView(ctx, db, name[:len(name)-len(snapshotSuffix)]); err != nil {
-				return nil, err
-			}
-			if err := alterTableName(ctx, db, name[:len(name)-len(snapshotSuffix)], table); err != nil {
-				return nil, err
-			}
+// ListBranches returns the branches recorded in the catalog.
+func (b *Brancher) ListBranches(ctx context.Context) ([]BranchInfo, error) {
+	return b.catalog.list(ctx)
+}
+
+// Branch creates a branch of the production tables in namespace.
+func (b *Brancher) Branch(ctx context.Context, namespace string) (*Branch, error) {
+	return b.branch(ctx, namespace, nil, false)
+}
+
+// LazyBranch creates a branch of the production tables in namespace that
+// creates the R+/R- tables of a table and their indexes only once the table is
+// first written. Until then the branch reads the production table directly.
+// The views and triggers of every table are still created with the branch,
+// so this saves the storage of the tables a trial never writes rather than
+// the time to create the branch. Diffs skip the tables neither branch wrote.
+// Forks of the branch are lazy too.
+func (b *Brancher) LazyBranch(ctx context.Context, namespace string) (*Branch, error) {
+	return b.branch(ctx, namespace, nil, true)
+}
+
+// Fork creates a child branch in namespace. The child's R' views start from
+// this branch's R' views, so the state reached in this branch can be reused by
+// many experiments. The branch must be committed, so that the state the
+// children see does not change under them.
+func (b *Branch) Fork(ctx context.Context, namespace string) (*Branch, error) {
+	if !b.committed {
+		return nil, fmt.Errorf("branch %s must be committed before it is forked", b.namespace)
+	}
+	if b.deleted {
+		return nil, fmt.Errorf("branch %s is deleted", b.namespace)
+	}
+	return b.brancher.branch(ctx, namespace, b, false)
+}
+
+// branch creates a branch in namespace, forked from parent if it is not nil.
+// lazy only applies to branches of the production tables; a fork is lazy if
+// parent is.
+func (b *Brancher) branch(ctx context.Context, namespace string, parent *Branch, lazy bool) (*Branch, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.branches[namespace]; ok {
+		return nil, fmt.Errorf("branch %s already exists", namespace)
+	}
+
+	var database *database
+	parentNamespace := ""
+	if parent != nil {
+		database = parent.clonedDdl.database
+		parentNamespace = parent.namespace
+	} else {
+		// the schemas of existing branches hold views and R+/R- tables, not
+		// production tables
+		branchSchemas, err := b.catalog.schemas(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list branches: %w", err)
+		}
+		if database, err = newDatabase(ctx, b.db, branchSchemas...); err != nil {
+			return nil, fmt.Errorf("failed to create new database: %w", err)
 		}
 	}
 
-	// TODO: here we assume users do not create schema names, need to filter out user-defined schema name
-	schemaNames, err := getAllSchemaNames(ctx, db)
-	if err != nil {
+	if err := checkSchemaNames(namespace, database); err != nil {
 		return nil, err
 	}
-	for _, name := range schemaNames {
-		if err := dropSchemaCascade(ctx, db, name); err != nil {
+	schemas := append(branchSchemas(namespace, database), hookSchemas(namespace, database)...)
+	for _, schema := range schemas {
+		exists, err := schemaExists(ctx, b.db, schema)
+		if err != nil {
 			return nil, err
 		}
+		if exists {
+			return nil, fmt.Errorf("schema %s already exists", schema)
+		}
 	}
 
-	branches := map[string]*Branch{}
-	return &Brancher{db, nil, branches}, nil
-}
+	if err := b.catalog.insert(ctx, namespace, parentNamespace, schemas, searchPathSchemas(namespace, database)); err != nil {
+		return nil, fmt.Errorf("failed to record branch %s: %w", namespace, err)
+	}
 
-func (b *Brancher) Branch(ctx context.Context, namespace string) (*Branch, error) {
-	if b.currentBranch != nil && !b.currentBranch.committed {
-		return nil, fmt.Errorf("branch %s is still pending, please commit first", b.currentBranch.namespace)
+	cloneDdl, err := b.createClonedDdl(ctx, namespace, database, parent, lazy)
+	if err != nil {
+		// if the cleanup fails too, the catalog still records the branch as
+		// creating and the next NewBrancher drops it
+		dropped := true
+		for _, schema := range schemas {
+			if dropErr := dropSchemaCascade(ctx, b.db, schema); dropErr != nil {
+				dropped = false
+			}
+		}
+		if dropped {
+			if deleteErr := b.catalog.delete(ctx, namespace); deleteErr != nil {
+				return nil, fmt.Errorf("%w; failed to delete branch %s from the catalog: %v", err, namespace, deleteErr)
+			}
+		}
+		return nil, err
 	}
-	if _, ok := b.branches[namespace]; ok {
-		return nil, fmt.Errorf("branch %s already exists", namespace)
+
+	branch := &Branch{brancher: b, clonedDdl: cloneDdl, namespace: namespace, committed: false, parent: parent}
+	if err := b.catalog.update(ctx, branch.info(BranchActive)); err != nil {
+		return nil, fmt.Errorf("failed to record branch %s: %w", namespace, err)
 	}
-	database, err := newDatabase(ctx, b.db)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new database: %w", err)
+	if parent != nil {
+		parent.children = append(parent.children, branch)
 	}
+	b.branches[namespace] = branch
+	return branch, nil
+}
 
-	cloneDdl, err := newCloneDdl(ctx, database, namespace)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new clone ddl: %w", err)
+// createClonedDdl creates the R+/R-/R' tables, redirect triggers and user
+// triggers of a branch.
+func (b *Brancher) createClonedDdl(ctx context.Context, namespace string, database *database, parent *Branch, lazy bool) (*cloneDdl, error) {
+	var cloneDdl *cloneDdl
+	if parent == nil && lazy {
+		var err error
+		if cloneDdl, err = newLazyCloneDdl(ctx, database, namespace); err != nil {
+			return nil, fmt.Errorf("failed to create new lazy clone ddl: %w", err)
+		}
+	} else if parent == nil {
+		var err error
+		if cloneDdl, err = newCloneDdl(ctx, database, namespace); err != nil {
+			return nil, fmt.Errorf("failed to create new clone ddl: %w", err)
+		}
+	} else {
+		var err error
+		if cloneDdl, err = newForkedCloneDdl(ctx, parent.clonedDdl, namespace); err != nil {
+			return nil, fmt.Errorf("failed to fork clone ddl from %s: %w", parent.namespace, err)
+		}
 	}
 
 	g, ctx := errgroup.WithContext(ctx)
@@ -105,30 +212,89 @@ func (b *Brancher) Branch(ctx context.Context, namespace string) (*Branch, error
 		return nil, err
 	}
 
-	branch := &Branch{clonedDdl: cloneDdl, namespace: namespace, committed: false}
-	b.currentBranch = branch
-	b.branches[namespace] = branch
-	return branch, nil
+	// the tables may share trigger functions, which are copied one at a time
+	for _, t := range cloneDdl.clonedTables {
+		if err := cloneDdl.attachUserTriggers(ctx, t); err != nil {
+			return nil, err
+		}
+	}
+	return cloneDdl, nil
+}
+
+// Namespace returns the schema that holds the branch.
+func (b *Branch) Namespace() string {
+	return b.namespace
+}
+
+// SearchPath returns the search_path that resolves unqualified table names to
+// the branch's R' views: the schemas of the branch followed by the schemas of
+// the production tables, e.g. "b1", "b1$billing", "public", "billing".
+func (b *Branch) SearchPath() string {
+	return b.clonedDdl.searchPath()
+}
+
+// Schema returns the schema that holds the branch's R' views of the
+// production tables in schema, e.g. to rewrite schema-qualified queries.
+func (b *Branch) Schema(schema string) string {
+	return branchSchema(b.namespace, schema)
 }
 
+// ConnString rewrites a postgres connection url so that every connection made
+// with it reads and writes the branch instead of the production tables.
+func (b *Branch) ConnString(connString string) (string, error) {
+	u, err := url.Parse(connString)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	query := u.Query()
+	query.Set("search_path", b.SearchPath())
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Parent returns the branch this branch was forked from, or nil if it was
+// cloned from the production tables.
+func (b *Branch) Parent() *Branch {
+	return b.parent
+}
+
+// Delete drops the branch schemas, together with its views, triggers and
+// R+/R- tables. The branch does not need to be committed first, but all
+// branches forked from it must be deleted before it.
 func (b *Branch) Delete(ctx context.Context) error {
-	if !b.committed {
-		fmt.Println("WARNING: this branch hasn't committed yet. Dropping all tables now...")
-		if err := b.clonedDdl.reset(ctx); err != nil {
-			return err
+	b.brancher.mu.Lock()
+	defer b.brancher.mu.Unlock()
+	for _, child := range b.children {
+		if !child.deleted {
+			return fmt.Errorf("branch %s still has forked branch %s", b.namespace, child.namespace)
 		}
-		b.committed = true
+	}
+	// proxies stop routing connections to the branch before it is dropped
+	if err := b.brancher.catalog.update(ctx, b.info(BranchDeleting)); err != nil {
+		return err
 	}
 	if err := b.clonedDdl.close(ctx); err != nil {
 		return err
 	}
+	if err := b.brancher.catalog.delete(ctx, b.namespace); err != nil {
+		return err
+	}
+	b.committed = true
+	b.deleted = true
 	return nil
 }
 
+// Commit stops redirecting writes into the branch. The branch stays readable
+// so that it can still be diffed.
 func (b *Branch) Commit(ctx context.Context) error {
+	b.brancher.mu.Lock()
+	defer b.brancher.mu.Unlock()
 	if err := b.clonedDdl.reset(ctx); err != nil {
 		return err
 	}
+	if err := b.brancher.catalog.update(ctx, b.info(BranchCommitted)); err != nil {
+		return err
+	}
 	b.committed = true
 	return nil
 }
@@ -137,14 +303,39 @@ func (b *Branch) IncrementReqId(ctx context.Context) error {
 	return b.clonedDdl.incrementCounter(ctx)
 }
 
+// RollbackTo resets the branch to the state right after request n, so that
+// the rest of a request log can be replayed from there. Writes of later
+// requests are discarded, the sequences of the branch go back to their state
+// after request n and the request counter restarts at n+1. A rollback to -1
+// discards every write. Branches forked from this branch must be deleted
+// first, since their state is built on top of it, and a branch whose schema
+// was changed by Migrate cannot be rolled back.
+func (b *Branch) RollbackTo(ctx context.Context, n int) error {
+	if n < -1 {
+		return fmt.Errorf("invalid request id %d", n)
+	}
+	b.brancher.mu.Lock()
+	defer b.brancher.mu.Unlock()
+	if b.deleted {
+		return fmt.Errorf("branch %s is deleted", b.namespace)
+	}
+	if b.migrated {
+		return fmt.Errorf("branch %s changed its schema, which RollbackTo cannot undo", b.namespace)
+	}
+	for _, child := range b.children {
+		if !child.deleted {
+			return fmt.Errorf("branch %s still has forked branch %s", b.namespace, child.namespace)
+		}
+	}
+	return b.clonedDdl.rollbackTo(ctx, n)
+}
+
 // For each two branch, compare each table and get rowDiffs for each table
 func (b *Brancher) ComputeDiffAtN(ctx context.Context, A *Branch, B *Branch, n int) (map[string]*Diff, error) {
-	aTables := maps.Keys(A.clonedDdl.clonedTables)
-	bTables := maps.Keys(B.clonedDdl.clonedTables)
-	sort.Strings(aTables)
-	sort.Strings(bTables)
-	if !slices.Equal(aTables, bTables) {
-		return nil, fmt.Errorf("two branches have different tables %s and %s, cannot compare", maps.Keys(A.clonedDdl.clonedTables), maps.Keys(B.clonedDdl.clonedTables))
+	for _, branch := range []*Branch{A, B} {
+		if err := branch.clonedDdl.refreshMaterializedViews(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	diffs := map[string]*Diff{}
@@ -154,13 +345,32 @@ func (b *Brancher) ComputeDiffAtN(ctx context.Context, A *Branch, B *Branch, n i
 	for tableName, clonedTableA := range A.clonedDdl.clonedTables {
 		tableName := tableName
 		clonedTableA := clonedTableA
+		// the rows of a child are diffed with the table it inherits from
+		if A.clonedDdl.inherits(clonedTableA) {
+			continue
+		}
+		clonedTableB, ok := B.clonedDdl.clonedTables[tableName]
+		if !ok {
+			diffs[tableName] = &Diff{SchemaDiff: &TableSchemaDiff{Table: tableName, Change: Removed}}
+			continue
+		}
 		g.Go(func() (string, *Diff, error) {
-			clonedTableB := B.clonedDdl.clonedTables[tableName]
 			dbDiff := newDbDiff(b.db, clonedTableA.Counter.Colname)
+			dbDiff.ignored = b.rules.ignored(tableName)
 			diff, err := dbDiff.getClonedTableRowDiffAtNReqs(ctx, clonedTableA, clonedTableB, n)
+			// a diff is nil if neither lazy branch wrote the table
+			if err != nil || diff == nil {
+				return tableName, nil, err
+			}
+			diff.SchemaDiff, err = tableSchemaDiff(ctx, b.db, tableName, clonedTableA, clonedTableB)
 			return tableName, diff, err
 		})
 	}
+	for tableName := range B.clonedDdl.clonedTables {
+		if _, ok := A.clonedDdl.clonedTables[tableName]; !ok {
+			diffs[tableName] = &Diff{SchemaDiff: &TableSchemaDiff{Table: tableName, Change: Added}}
+		}
+	}
 
 	res, err := g.Wait()
 	if err != nil {
@@ -168,21 +378,110 @@ func (b *Brancher) ComputeDiffAtN(ctx context.Context, A *Branch, B *Branch, n i
 	}
 
 	for k, v := range res {
-		diffs[k] = v
+		if v != nil {
+			diffs[k] = v
+		}
 	}
+	b.classify(A, diffs)
 
 	return diffs, nil
 }
 
-// For each two branch, compare each table and get rowDiffs for each table at each request id
+// classify applies the diff rules to diffs, the diffs of the tables of A, and
+// then classifies the rows of the tables with a primary key, so that the
+// change sets see the rows the rules paired and compare values by the rules.
+func (b *Brancher) classify(A *Branch, diffs map[string]*Diff) {
+	pkCols := map[string][]string{}
+	for tableName := range diffs {
+		if t, ok := A.clonedDdl.clonedTables[tableName]; ok {
+			pkCols[tableName] = A.clonedDdl.getPrimaryKeyCols(t.Snapshot)
+		}
+	}
+	b.rules.apply(diffs)
+	b.rules.matchUpdates(diffs, pkCols)
+	for tableName, diff := range diffs {
+		if len(pkCols[tableName]) > 0 && len(diff.ColNames) > 0 {
+			diff.Changes = newChangeSet(diff, pkCols[tableName])
+		}
+	}
+}
+
+// ComputeDiffPerReq returns for each of the first N requests the diff of the
+// rows the request changed, by table. Unlike ComputeDiffAtN, which diffs the
+// whole tables, it reads the R+/R- tables once and streams the diffs, see
+// database_diff_stream.go. A table only has a diff at the requests that wrote
+// it; added and removed tables and schema changes are reported at the first
+// request.
 func (b *Brancher) ComputeDiffPerReq(ctx context.Context, A *Branch, B *Branch, N int) ([]map[string]*Diff, error) {
-	var reqMaps []map[string]*Diff
-	for n := 0; n < N; n++ {
-		diffs, err := b.ComputeDiffAtN(ctx, A, B, n)
-		if err != nil {
+	if N <= 0 {
+		return nil, nil
+	}
+	for _, branch := range []*Branch{A, B} {
+		if err := branch.clonedDdl.refreshMaterializedViews(ctx); err != nil {
 			return nil, err
 		}
-		reqMaps = append(reqMaps, diffs)
+	}
+
+	reqMaps := make([]map[string]*Diff, N)
+	for n := range reqMaps {
+		reqMaps[n] = map[string]*Diff{}
+	}
+
+	g := NewGroup[string, []*Diff](context.Background())
+
+	for tableName, clonedTableA := range A.clonedDdl.clonedTables {
+		tableName := tableName
+		clonedTableA := clonedTableA
+		// the rows of a child are diffed with the table it inherits from
+		if A.clonedDdl.inherits(clonedTableA) {
+			continue
+		}
+		clonedTableB, ok := B.clonedDdl.clonedTables[tableName]
+		if !ok {
+			reqMaps[0][tableName] = &Diff{SchemaDiff: &TableSchemaDiff{Table: tableName, Change: Removed}}
+			continue
+		}
+		g.Go(func() (string, []*Diff, error) {
+			dbDiff := newDbDiff(b.db, clonedTableA.Counter.Colname)
+			dbDiff.ignored = b.rules.ignored(tableName)
+			diffs, err := dbDiff.getClonedTableRowDiffPerReq(ctx, clonedTableA, clonedTableB, N)
+			// diffs are nil if neither lazy branch wrote the table
+			if err != nil || diffs == nil {
+				return tableName, nil, err
+			}
+			schemaDiff, err := tableSchemaDiff(ctx, b.db, tableName, clonedTableA, clonedTableB)
+			if err != nil {
+				return tableName, nil, err
+			}
+			if schemaDiff != nil {
+				if diffs[0] == nil {
+					diffs[0] = &Diff{}
+				}
+				diffs[0].SchemaDiff = schemaDiff
+			}
+			return tableName, diffs, nil
+		})
+	}
+	for tableName := range B.clonedDdl.clonedTables {
+		if _, ok := A.clonedDdl.clonedTables[tableName]; !ok {
+			reqMaps[0][tableName] = &Diff{SchemaDiff: &TableSchemaDiff{Table: tableName, Change: Added}}
+		}
+	}
+
+	res, err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	for tableName, diffs := range res {
+		for n, diff := range diffs {
+			if diff != nil {
+				reqMaps[n][tableName] = diff
+			}
+		}
+	}
+	for _, diffs := range reqMaps {
+		b.classify(A, diffs)
 	}
 
 	return reqMaps, nil
@@ -0,0 +1,569 @@
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestForkBranch(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent, err := brancher.Branch(ctx, "parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO parent.users(accountid, username, passhash, birthday) VALUES
+	('101122611122', 'alice', '1234', '2000-01-01');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parent.Fork(ctx, "child1"); err == nil {
+		t.Fatal("forked a branch that is not committed")
+	}
+
+	if err := parent.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	child1, err := parent.Fork(ctx, "child1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child2, err := parent.Fork(ctx, "child2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ChildSeesParent", func(t *testing.T) {
+		var count int
+		if err := connPool.QueryRow(ctx, "SELECT COUNT(*) FROM child1.users").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := count, 1; got != want {
+			t.Errorf("child1.users row count: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("DiffSiblings", func(t *testing.T) {
+		_, err = connPool.Exec(ctx, `
+		DELETE FROM child1.users WHERE accountid = '101122611122';
+		INSERT INTO child2.users(accountid, username, passhash, birthday) VALUES
+		('102233445566', 'bob', '2345', '2001-01-01');
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diffs, err := brancher.ComputeDiffAtN(ctx, child1, child2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alice := Row{"101122611122", time.Date(2000, time.Month(1), 1, 0, 0, 0, 0, time.UTC), []byte("1234"), "alice"}
+		bob := Row{"102233445566", time.Date(2001, time.Month(1), 1, 0, 0, 0, 0, time.UTC), []byte("2345"), "bob"}
+		nilRow := Row{nil, nil, nil, nil}
+		expectedUsersDiff := &Diff{
+			Control:      []*Row{&nilRow, &nilRow},
+			Baseline:     []*Row{&alice, &nilRow},
+			Experimental: []*Row{&alice, &bob},
+			ColNames:     []string{"accountid", "birthday", "passhash", "username"},
+			Changes: &ChangeSet{KeyCols: []string{"accountid"}, Changes: []*KeyChange{
+				{Key: Row{"101122611122"}, Control: &RowChange{Change: Deleted, Columns: []ColumnChange{
+					{Name: "accountid", Old: alice[0]}, {Name: "birthday", Old: alice[1]}, {Name: "passhash", Old: alice[2]}, {Name: "username", Old: alice[3]},
+				}}},
+				{Key: Row{"102233445566"}, Experimental: &RowChange{Change: Inserted, Columns: []ColumnChange{
+					{Name: "accountid", New: bob[0]}, {Name: "birthday", New: bob[1]}, {Name: "passhash", New: bob[2]}, {Name: "username", New: bob[3]},
+				}}},
+			}},
+		}
+		if diff := cmp.Diff(expectedUsersDiff, diffs["users"]); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("DeleteParentFirst", func(t *testing.T) {
+		if err := parent.Delete(ctx); err == nil {
+			t.Fatal("deleted a branch that still has forked branches")
+		}
+	})
+
+	for _, b := range []*Branch{child1, child2, parent} {
+		if err := b.Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBranchCatalog(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `CREATE SCHEMA userschema;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := brancher.Branch(ctx, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ListBranches", func(t *testing.T) {
+		infos, err := brancher.ListBranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(infos), 1; got != want {
+			t.Fatalf("branch count: got %d, want %d", got, want)
+		}
+		if diff := cmp.Diff([]string{"contacts", "users"}, infos[0].Tables); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+		if got, want := infos[0].State, BranchActive; got != want {
+			t.Errorf("state: got %s, want %s", got, want)
+		}
+		if got, want := len(infos[0].Triggers), 6; got != want {
+			t.Errorf("trigger count: got %d, want %d", got, want)
+		}
+
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		infos, err = brancher.ListBranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := infos[0].State, BranchCommitted; got != want {
+			t.Errorf("state: got %s, want %s", got, want)
+		}
+		if got, want := len(infos[0].Triggers), 0; got != want {
+			t.Errorf("trigger count: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("LookupSearchPath", func(t *testing.T) {
+		if got, err := LookupSearchPath(ctx, connPool, "b1"); err != nil || got != b.SearchPath() {
+			t.Errorf("looked up search path: got %s, %v, want %s", got, err, b.SearchPath())
+		}
+		if _, err := LookupSearchPath(ctx, connPool, "missing"); err == nil {
+			t.Error("looked up the search path of a branch that does not exist")
+		}
+		// a branch whose deletion failed half way is not routed to
+		if err := brancher.catalog.update(ctx, b.info(BranchDeleting)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LookupSearchPath(ctx, connPool, "b1"); err == nil {
+			t.Error("looked up the search path of a deleted branch")
+		}
+	})
+
+	t.Run("BranchExistingSchema", func(t *testing.T) {
+		if _, err := brancher.Branch(ctx, "userschema"); err == nil {
+			t.Fatal("branched into a schema that already exists")
+		}
+	})
+
+	t.Run("Recover", func(t *testing.T) {
+		// a new brancher cleans up the branches the previous one left behind
+		recovered, err := NewBrancher(ctx, connPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := recovered.ListBranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(infos), 0; got != want {
+			t.Errorf("branch count: got %d, want %d", got, want)
+		}
+
+		for name, want := range map[string]bool{"b1": false, "userschema": true} {
+			got, err := schemaExists(ctx, connPool, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("schema %s exists: got %v, want %v", name, got, want)
+			}
+		}
+	})
+}
+
+func TestRollbackBranch(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := brancher.Branch(ctx, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete(ctx)
+
+	users := []string{
+		"('101122611122', 'alice', '1234', '2000-01-01')",
+		"('103362343333', 'bob', '2345', '2001-01-01')",
+		"('107744137744', 'eve', '3456', '2002-01-01')",
+	}
+	for _, user := range users {
+		_, err = connPool.Exec(ctx, "INSERT INTO b1.users(accountid, username, passhash, birthday) VALUES "+user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.IncrementReqId(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.RollbackTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := connPool.Query(ctx, "SELECT username FROM b1.users ORDER BY username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if diff := cmp.Diff([]string{"alice"}, names); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+
+	var rid int
+	if err := connPool.QueryRow(ctx, "SELECT id FROM b1.rid").Scan(&rid); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rid, 1; got != want {
+		t.Errorf("request id after rollback: got %d, want %d", got, want)
+	}
+}
+
+func TestBranchSchemas(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `
+	CREATE SCHEMA billing;
+	CREATE TABLE billing.users (
+		accountid CHAR(12) PRIMARY KEY,
+		plan      VARCHAR(16) NOT NULL
+	);
+	CREATE TABLE billing."Invoices" (
+		id        INT PRIMARY KEY,
+		accountid CHAR(12) NOT NULL REFERENCES public.users(accountid)
+	);
+	INSERT INTO public.users(accountid, username, passhash, birthday) VALUES
+	('101122611122', 'alice', '1234', '2000-01-01');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := brancher.Branch(ctx, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete(ctx)
+
+	if got, want := b.SearchPath(), `"b1", "b1$billing", "public", "billing"`; got != want {
+		t.Errorf("search path: got %s, want %s", got, want)
+	}
+	if got, err := LookupSearchPath(ctx, connPool, "b1"); err != nil || got != b.SearchPath() {
+		t.Errorf("looked up search path: got %s, %v, want %s", got, err, b.SearchPath())
+	}
+
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO "b1$billing".users(accountid, plan) VALUES ('101122611122', 'free');
+	INSERT INTO "b1$billing"."Invoices"(id, accountid) VALUES (1, '101122611122');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := connPool.Exec(ctx, `INSERT INTO "b1$billing"."Invoices"(id, accountid) VALUES (2, '109999999999');`); err == nil {
+		t.Error("inserted an invoice that refers to a missing user")
+	}
+
+	var count int
+	if err := connPool.QueryRow(ctx, `SELECT COUNT(*) FROM billing."Invoices"`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count, 0; got != want {
+		t.Errorf("production invoices: got %d, want %d", got, want)
+	}
+
+	infos, err := brancher.ListBranches(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"b1", "b1$billing"}, infos[0].Schemas); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"billing.Invoices", "billing.users", "contacts", "users"}, infos[0].Tables); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+
+	// the schemas of b1 hold no production tables
+	b2, err := brancher.Branch(ctx, "b2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Delete(ctx)
+	if got, want := len(b2.clonedDdl.clonedTables), 4; got != want {
+		t.Errorf("cloned table count: got %d, want %d", got, want)
+	}
+
+	diffs, err := brancher.ComputeDiffAtN(ctx, b, b2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(diffs["billing.Invoices"].Control), 1; got != want {
+		t.Errorf("billing.Invoices diff rows: got %d, want %d", got, want)
+	}
+}
+
+func TestBranchQuotedNames(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	// mixed case, reserved words and spaces in table and column names
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE "Order" (
+		"order"        INT PRIMARY KEY,
+		"user"         VARCHAR(64) NOT NULL,
+		"Total Amount" INT
+	);
+	CREATE TABLE "user" (
+		"select" TEXT,
+		"From"   TEXT
+	);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := brancher.Branch(ctx, "Branch A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Delete(ctx)
+	b, err := brancher.Branch(ctx, "Branch B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO "Branch A"."Order"("order", "user", "Total Amount") VALUES (1, 'alice', 10), (2, 'bob', 20);
+	UPDATE "Branch A"."Order" SET "Total Amount" = 30 WHERE "order" = 2;
+	DELETE FROM "Branch A"."Order" WHERE "order" = 1;
+	INSERT INTO "Branch A"."user"("select", "From") VALUES ('it''s', 'here');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := brancher.ComputeDiffAtN(ctx, a, b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nilRow := Row{nil, nil, nil}
+	expectedOrderDiff := &Diff{
+		Control:      []*Row{{int32(30), int32(2), "bob"}},
+		Baseline:     []*Row{&nilRow},
+		Experimental: []*Row{&nilRow},
+		ColNames:     []string{"Total Amount", "order", "user"},
+		Changes: &ChangeSet{KeyCols: []string{"order"}, Changes: []*KeyChange{{
+			Key: Row{int32(2)},
+			Control: &RowChange{Change: Inserted, Columns: []ColumnChange{
+				{Name: "Total Amount", New: int32(30)}, {Name: "order", New: int32(2)}, {Name: "user", New: "bob"},
+			}},
+		}}},
+	}
+	if diff := cmp.Diff(expectedOrderDiff, diffs["Order"]); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+	if got, want := len(diffs["user"].Control), 1; got != want {
+		t.Errorf("user diff rows: got %d, want %d", got, want)
+	}
+}
+
+func TestBranchSequences(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE accounts (id SERIAL PRIMARY KEY, name TEXT);
+	CREATE TABLE events (id BIGINT GENERATED ALWAYS AS IDENTITY, name TEXT);
+	INSERT INTO accounts(name) VALUES ('alice'), ('bob');
+	INSERT INTO events(name) VALUES ('open'), ('close');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := brancher.Branch(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Delete(ctx)
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete(ctx)
+
+	insert := func(t *testing.T, table, name string) int64 {
+		var id int64
+		if err := connPool.QueryRow(ctx, fmt.Sprintf("INSERT INTO %s(name) VALUES ($1) RETURNING id", table), name).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	// both branches continue from the production sequences
+	for _, ns := range []string{"a", "b"} {
+		if got, want := insert(t, ns+".accounts", "carol"), int64(3); got != want {
+			t.Errorf("%s.accounts id: got %d, want %d", ns, got, want)
+		}
+		if got, want := insert(t, ns+".events", "reopen"), int64(3); got != want {
+			t.Errorf("%s.events id: got %d, want %d", ns, got, want)
+		}
+	}
+
+	// production is not advanced
+	var last int64
+	if err := connPool.QueryRow(ctx, "SELECT last_value FROM public.accounts_id_seq").Scan(&last); err != nil {
+		t.Fatal(err)
+	}
+	if last != 2 {
+		t.Errorf("production sequence: got %d, want 2", last)
+	}
+
+	// a rollback restores the sequences, so replaying a request draws the
+	// same ids
+	if err := b.IncrementReqId(ctx); err != nil {
+		t.Fatal(err)
+	}
+	id := insert(t, "b.accounts", "dave")
+	if err := b.RollbackTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := insert(t, "b.accounts", "dave"); got != id {
+		t.Errorf("b.accounts id after rollback: got %d, want %d", got, id)
+	}
+
+	// a fork continues from its parent
+	if err := a.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fork, err := a.Fork(ctx, "fork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Delete(ctx)
+	if got, want := insert(t, "fork.accounts", "dave"), int64(4); got != want {
+		t.Errorf("fork.accounts id: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,440 @@
+// This file merges the R+/R- deltas of a branch back into the production tables
+package dbbranch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/exp/maps"
+)
+
+// MergeConflictError is returned by Branch.Merge when a delta of the branch
+// cannot be applied to the production table, either because it violates a
+// constraint or because the row it changes is no longer in the table.
+type MergeConflictError struct {
+	Table      string
+	ReqId      int64  // request id (rid) of the delta
+	Code       string // SQLSTATE of the violation, empty if the row is missing
+	Constraint string // name of the violated constraint, if any
+	Detail     string
+	Err        error
+}
+
+func (e *MergeConflictError) Error() string {
+	if e.Constraint != "" {
+		return fmt.Sprintf("merge conflict in table %s at request %d: constraint %s violated (SQLSTATE %s): %s", e.Table, e.ReqId, e.Constraint, e.Code, e.Detail)
+	}
+	return fmt.Sprintf("merge conflict in table %s at request %d: %s", e.Table, e.ReqId, e.Detail)
+}
+
+func (e *MergeConflictError) Unwrap() error {
+	return e.Err
+}
+
+// Merge applies the R+/R- deltas of the branch to the production tables in
+// one transaction and empties the branch afterwards, so its R' views match the
+// production tables again. The deltas are replayed request by request in rid
+// order. Within a request, deleted rows are removed first, from referencing to
+// referenced tables, then updated and inserted rows are written, from
+// referenced to referencing tables. If a delta conflicts with the production
+// data, nothing is merged and a *MergeConflictError is returned.
+//
+// Only committed branches cloned from the production tables, without schema
+// changes, can be merged. Every other branch reads the production tables
+// through its R' views, so the merge would change their rows and diffs under
+// them; a branch can only be merged once it is the last one in the catalog.
+func (b *Branch) Merge(ctx context.Context) error {
+	b.brancher.mu.Lock()
+	defer b.brancher.mu.Unlock()
+	if b.parent != nil {
+		return fmt.Errorf("branch %s is forked from %s and cannot be merged into the production tables", b.namespace, b.parent.namespace)
+	}
+	if b.deleted {
+		return fmt.Errorf("branch %s is deleted", b.namespace)
+	}
+	if !b.committed {
+		return fmt.Errorf("branch %s must be committed before it is merged", b.namespace)
+	}
+	if b.migrated {
+		return fmt.Errorf("branch %s changed its schema and cannot be merged into the production tables", b.namespace)
+	}
+	infos, err := b.brancher.catalog.list(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list branches: %w", err)
+	}
+	for _, info := range infos {
+		if info.Namespace != b.namespace {
+			return fmt.Errorf("branch %s cannot be merged while branch %s reads the production tables", b.namespace, info.Namespace)
+		}
+	}
+	return b.clonedDdl.merge(ctx)
+}
+
+// reqDeltas holds the rows one request inserted into R+ and R- of a table.
+type reqDeltas struct {
+	plus  [][]any
+	minus [][]any
+}
+
+// mergeOps are the statements that apply a request's deltas to a table.
+type mergeOps struct {
+	deletes [][]any
+	updates [][2][]any // old row, new row
+	inserts [][]any
+}
+
+func (c *cloneDdl) merge(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.database.connPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// the tables the branch never wrote have no deltas
+	order, err := c.written(ctx, c.tablesInDependencyOrder())
+	if err != nil {
+		return err
+	}
+	deltas := map[string]map[int64]*reqDeltas{}
+	rids := map[int64]bool{}
+	for _, name := range order {
+		tableDeltas, err := c.loadDeltas(ctx, tx, c.clonedTables[name])
+		if err != nil {
+			return fmt.Errorf("failed to load deltas of %s: %w", name, err)
+		}
+		deltas[name] = tableDeltas
+		for rid := range tableDeltas {
+			rids[rid] = true
+		}
+	}
+
+	sortedRids := maps.Keys(rids)
+	sort.Slice(sortedRids, func(i, j int) bool { return sortedRids[i] < sortedRids[j] })
+
+	for _, rid := range sortedRids {
+		ops := map[string]*mergeOps{}
+		for _, name := range order {
+			if d, ok := deltas[name][rid]; ok {
+				ops[name] = c.toMergeOps(c.clonedTables[name], d)
+			}
+		}
+
+		for i := len(order) - 1; i >= 0; i-- {
+			if op, ok := ops[order[i]]; ok {
+				for _, row := range op.deletes {
+					if err := c.mergeDelete(ctx, tx, c.clonedTables[order[i]], rid, row); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		for _, name := range order {
+			if op, ok := ops[name]; ok {
+				for _, rows := range op.updates {
+					if err := c.mergeUpdate(ctx, tx, c.clonedTables[name], rid, rows[0], rows[1]); err != nil {
+						return err
+					}
+				}
+				for _, row := range op.inserts {
+					if err := c.mergeInsert(ctx, tx, c.clonedTables[name], rid, row); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	// the deltas are part of the production tables now, drop them from the branch
+	for _, name := range order {
+		t := c.clonedTables[name]
+		if _, err := tx.Exec(ctx, fmt.Sprintf("TRUNCATE %s, %s;", t.Plus.qualifiedName(), t.Minus.qualifiedName())); err != nil {
+			return err
+		}
+	}
+
+	// the production tables now hold the values the branch drew from its
+	// sequences, which production must not hand out again
+	if err := c.advanceSequences(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// advanceSequences sets every production sequence the branch cloned to at
+// least the last value of the clone.
+func (c *cloneDdl) advanceSequences(ctx context.Context, tx pgx.Tx) error {
+	for prod, clone := range c.sequences {
+		ahead := ">"
+		if clone.Increment < 0 {
+			ahead = "<"
+		}
+		query := fmt.Sprintf(`SELECT setval($1::regclass, c.last_value, true) FROM %s c, %s p
+		WHERE c.is_called AND (NOT p.is_called OR c.last_value %s p.last_value);`, clone.qualifiedName(), prod, ahead)
+		if _, err := tx.Exec(ctx, query, prod); err != nil {
+			return fmt.Errorf("failed to advance sequence %s: %w", prod, err)
+		}
+	}
+	return nil
+}
+
+// tablesInDependencyOrder returns the cloned table names so that every table
+// comes after the tables its foreign keys refer to. Tables in a reference
+// cycle are appended in name order.
+func (c *cloneDdl) tablesInDependencyOrder() []string {
+	names := maps.Keys(c.clonedTables)
+	sort.Strings(names)
+
+	var order []string
+	visited := map[string]bool{}
+	visiting := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] || visiting[name] {
+			return
+		}
+		visiting[name] = true
+		for _, constraint := range c.clonedTables[name].Snapshot.ForeignKeyConstraints {
+			ref := tableKey(constraint.RefTableSchema, constraint.RefTableName)
+			if _, ok := c.clonedTables[ref]; ok {
+				visit(ref)
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+		order = append(order, name)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return order
+}
+
+// mergeColNames returns the columns a merge writes. Postgres computes the
+// generated columns of the production table itself, and refuses values for
+// them.
+func (c *cloneDdl) mergeColNames(t *clonedTable) []string {
+	var colNames []string
+	for name := range t.Plus.Cols {
+		if t.Snapshot.Cols[name].Generated == "" {
+			colNames = append(colNames, name)
+		}
+	}
+	sort.Strings(colNames)
+	return colNames
+}
+
+func (c *cloneDdl) loadDeltas(ctx context.Context, tx pgx.Tx, t *clonedTable) (map[int64]*reqDeltas, error) {
+	colNames := c.mergeColNames(t)
+	deltas := map[int64]*reqDeltas{}
+	for _, side := range []*table{t.Plus, t.Minus} {
+		query := fmt.Sprintf("SELECT %s, %s FROM %s;", identList("", colNames), quoteIdent(t.Counter.Colname), side.qualifiedName())
+		rows, err := tx.Query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			rowVal := make([]any, len(colNames))
+			rowPtr := make([]any, len(colNames)+1)
+			for i := range rowVal {
+				rowPtr[i] = &rowVal[i]
+			}
+			var rid int64
+			rowPtr[len(colNames)] = &rid
+			if err := rows.Scan(rowPtr...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			d, ok := deltas[rid]
+			if !ok {
+				d = &reqDeltas{}
+				deltas[rid] = d
+			}
+			if side == t.Plus {
+				d.plus = append(d.plus, rowVal)
+			} else {
+				d.minus = append(d.minus, rowVal)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return deltas, nil
+}
+
+// toMergeOps cancels out rows a request both inserted and deleted, and turns
+// the rest into deletes, updates and inserts. Rows are only paired into
+// updates if the table has a primary key.
+func (c *cloneDdl) toMergeOps(t *clonedTable, d *reqDeltas) *mergeOps {
+	var plus, minus [][]any
+	cancelled := make([]bool, len(d.plus))
+	for _, m := range d.minus {
+		matched := false
+		for i, p := range d.plus {
+			if !cancelled[i] && reflect.DeepEqual(m, p) {
+				cancelled[i] = true
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			minus = append(minus, m)
+		}
+	}
+	for i, p := range d.plus {
+		if !cancelled[i] {
+			plus = append(plus, p)
+		}
+	}
+
+	ops := &mergeOps{}
+	pkIdx := c.primaryKeyIndexes(t)
+	if len(pkIdx) == 0 {
+		ops.deletes = minus
+		ops.inserts = plus
+		return ops
+	}
+
+	paired := make([]bool, len(plus))
+	for _, m := range minus {
+		matched := false
+		for i, p := range plus {
+			if !paired[i] && reflect.DeepEqual(pick(m, pkIdx), pick(p, pkIdx)) {
+				paired[i] = true
+				matched = true
+				ops.updates = append(ops.updates, [2][]any{m, p})
+				break
+			}
+		}
+		if !matched {
+			ops.deletes = append(ops.deletes, m)
+		}
+	}
+	for i, p := range plus {
+		if !paired[i] {
+			ops.inserts = append(ops.inserts, p)
+		}
+	}
+	return ops
+}
+
+// primaryKeyIndexes returns the positions of the primary key columns in mergeColNames.
+func (c *cloneDdl) primaryKeyIndexes(t *clonedTable) []int {
+	colNames := c.mergeColNames(t)
+	var idx []int
+	for _, pk := range c.getPrimaryKeyCols(t.Snapshot) {
+		for i, name := range colNames {
+			if name == pk {
+				idx = append(idx, i)
+			}
+		}
+	}
+	return idx
+}
+
+func pick(row []any, idx []int) []any {
+	vals := make([]any, len(idx))
+	for i, j := range idx {
+		vals[i] = row[j]
+	}
+	return vals
+}
+
+func (c *cloneDdl) mergeInsert(ctx context.Context, tx pgx.Tx, t *clonedTable, rid int64, row []any) error {
+	colNames := c.mergeColNames(t)
+	params := make([]string, len(colNames))
+	for i := range colNames {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	overriding := ""
+	for _, col := range t.Snapshot.Cols {
+		if col.IdGenerator != nil && col.IdGenerator.IdentityGeneration == "ALWAYS" {
+			overriding = " OVERRIDING SYSTEM VALUE"
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s)%s VALUES (%s);", t.Snapshot.qualifiedName(), identList("", colNames), overriding, strings.Join(params, ", "))
+	if _, err := tx.Exec(ctx, query, row...); err != nil {
+		return newMergeConflictError(t.Snapshot.key(), rid, err)
+	}
+	return nil
+}
+
+func (c *cloneDdl) mergeUpdate(ctx context.Context, tx pgx.Tx, t *clonedTable, rid int64, oldRow, newRow []any) error {
+	colNames := c.mergeColNames(t)
+	var sets []string
+	var args []any
+	for i, name := range colNames {
+		if !reflect.DeepEqual(oldRow[i], newRow[i]) {
+			args = append(args, newRow[i])
+			sets = append(sets, fmt.Sprintf("%s = $%d", quoteIdent(name), len(args)))
+		}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	var conds []string
+	for _, i := range c.primaryKeyIndexes(t) {
+		args = append(args, oldRow[i])
+		conds = append(conds, fmt.Sprintf("%s = $%d", quoteIdent(colNames[i]), len(args)))
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s;", onlyName(t), strings.Join(sets, ", "), strings.Join(conds, " AND "))
+	tag, err := tx.Exec(ctx, query, args...)
+	if err != nil {
+		return newMergeConflictError(t.Snapshot.key(), rid, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return &MergeConflictError{Table: t.Snapshot.key(), ReqId: rid, Detail: fmt.Sprintf("updated row %v no longer exists", oldRow)}
+	}
+	return nil
+}
+
+// mergeDelete deletes exactly one production row equal to row. Tables without
+// a primary key may hold duplicate rows, so the row is picked by ctid, which
+// is unique only within the table itself.
+func (c *cloneDdl) mergeDelete(ctx context.Context, tx pgx.Tx, t *clonedTable, rid int64, row []any) error {
+	colNames := c.mergeColNames(t)
+	conds := make([]string, len(colNames))
+	for i, name := range colNames {
+		conds[i] = fmt.Sprintf("%s IS NOT DISTINCT FROM $%d", quoteIdent(name), i+1)
+	}
+
+	tableName := onlyName(t)
+	query := fmt.Sprintf("DELETE FROM %s WHERE ctid = (SELECT ctid FROM %s WHERE %s LIMIT 1);", tableName, tableName, strings.Join(conds, " AND "))
+	tag, err := tx.Exec(ctx, query, row...)
+	if err != nil {
+		return newMergeConflictError(t.Snapshot.key(), rid, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return &MergeConflictError{Table: t.Snapshot.key(), ReqId: rid, Detail: fmt.Sprintf("deleted row %v no longer exists", row)}
+	}
+	return nil
+}
+
+func newMergeConflictError(tablename string, rid int64, err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && (pgErr.Code == uniqueViolation || pgErr.Code == foreignKeyViolation) {
+		return &MergeConflictError{
+			Table:      tablename,
+			ReqId:      rid,
+			Code:       pgErr.Code,
+			Constraint: pgErr.ConstraintName,
+			Detail:     pgErr.Detail,
+			Err:        err,
+		}
+	}
+	return fmt.Errorf("failed to merge table %s at request %d: %w", tablename, rid, err)
+}
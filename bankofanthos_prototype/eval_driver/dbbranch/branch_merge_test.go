@@ -0,0 +1,222 @@
+package dbbranch
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMergeBranch(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(t *testing.T, query string) int {
+		var n int
+		if err := connPool.QueryRow(ctx, query).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	t.Run("Merge", func(t *testing.T) {
+		b, err := brancher.Branch(ctx, "canary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Delete(ctx)
+
+		_, err = connPool.Exec(ctx, `
+		INSERT INTO canary.users(accountid, username, passhash, birthday) VALUES
+		('101122611122', 'alice', '1234', '2000-01-01'),
+		('103362343333', 'eve', '2345', '2001-01-01');
+		UPDATE canary.rid SET id = id+1;
+		INSERT INTO canary.contacts(username, account_num, is_external) VALUES
+		('alice', '103362343333', false);
+		DELETE FROM canary.users WHERE accountid = '103362343333';
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Merge(ctx); err == nil {
+			t.Fatal("merged a branch that is not committed")
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Merge(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := count(t, "SELECT COUNT(*) FROM public.users WHERE username = 'alice'"), 1; got != want {
+			t.Errorf("merged users: got %d, want %d", got, want)
+		}
+		if got, want := count(t, "SELECT COUNT(*) FROM public.users WHERE username = 'eve'"), 0; got != want {
+			t.Errorf("deleted users: got %d, want %d", got, want)
+		}
+		if got, want := count(t, "SELECT COUNT(*) FROM public.contacts"), 1; got != want {
+			t.Errorf("merged contacts: got %d, want %d", got, want)
+		}
+		if got, want := count(t, "SELECT COUNT(*) FROM canary.usersplus"), 0; got != want {
+			t.Errorf("R+ rows after merge: got %d, want %d", got, want)
+		}
+		if got, want := count(t, "SELECT COUNT(*) FROM canary.users"), 1; got != want {
+			t.Errorf("R' rows after merge: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("MergeSequences", func(t *testing.T) {
+		_, err := connPool.Exec(ctx, `CREATE TABLE accounts (id SERIAL PRIMARY KEY, name TEXT);`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := brancher.Branch(ctx, "sequences")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Delete(ctx)
+
+		_, err = connPool.Exec(ctx, `INSERT INTO sequences.accounts(name) VALUES ('alice'), ('bob');`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Merge(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// production continues after the ids the branch drew
+		var id int
+		if err := connPool.QueryRow(ctx, "INSERT INTO public.accounts(name) VALUES ('carol') RETURNING id").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		if id != 3 {
+			t.Errorf("production id after merge: got %d, want 3", id)
+		}
+	})
+
+	t.Run("MergeGeneratedColumns", func(t *testing.T) {
+		_, err := connPool.Exec(ctx, `
+		CREATE TABLE prices (id INT PRIMARY KEY, net INT, gross INT GENERATED ALWAYS AS (net * 2) STORED);
+		INSERT INTO prices(id, net) VALUES (1, 10);
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := brancher.Branch(ctx, "generated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Delete(ctx)
+
+		_, err = connPool.Exec(ctx, `
+		UPDATE generated.prices SET net = 20 WHERE id = 1;
+		INSERT INTO generated.prices(id, net) VALUES (2, 30);
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Merge(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := count(t, "SELECT SUM(gross) FROM public.prices"), 100; got != want {
+			t.Errorf("generated columns after merge: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("MergeConflict", func(t *testing.T) {
+		b, err := brancher.Branch(ctx, "conflict")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Delete(ctx)
+
+		_, err = connPool.Exec(ctx, `
+		INSERT INTO conflict.users(accountid, username, passhash, birthday) VALUES
+		('107744137744', 'bob', '1234', '2000-01-01');
+		INSERT INTO public.users(accountid, username, passhash, birthday) VALUES
+		('108855248855', 'bob', '2345', '2001-01-01');
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		err = b.Merge(ctx)
+		var conflict *MergeConflictError
+		if !errors.As(err, &conflict) {
+			t.Fatalf("Merge: got %v, want a merge conflict", err)
+		}
+		if got, want := conflict.Code, uniqueViolation; got != want {
+			t.Errorf("conflict code: got %s, want %s", got, want)
+		}
+		if got, want := conflict.Constraint, "users_username_key"; got != want {
+			t.Errorf("conflict constraint: got %s, want %s", got, want)
+		}
+		if got, want := count(t, "SELECT COUNT(*) FROM conflict.usersplus"), 1; got != want {
+			t.Errorf("R+ rows after failed merge: got %d, want %d", got, want)
+		}
+	})
+	t.Run("LiveBranches", func(t *testing.T) {
+		b, err := brancher.Branch(ctx, "merged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Delete(ctx)
+		other, err := brancher.Branch(ctx, "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = connPool.Exec(ctx, `
+		INSERT INTO merged.users(accountid, username, passhash, birthday) VALUES
+		('109966359966', 'carol', '1234', '2000-01-01');
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Merge(ctx); err == nil {
+			t.Fatal("merged a branch while another branch reads the production tables")
+		}
+		if got, want := count(t, "SELECT COUNT(*) FROM other.users WHERE username = 'carol'"), 0; got != want {
+			t.Errorf("rows of the other branch: got %d, want %d", got, want)
+		}
+
+		if err := other.Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Merge(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := count(t, "SELECT COUNT(*) FROM public.users WHERE username = 'carol'"), 1; got != want {
+			t.Errorf("merged users: got %d, want %d", got, want)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package dbbranch
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// RowChangeKind tells how a branch changed a row of the baseline.
+type RowChangeKind int
+
+const (
+	Inserted RowChangeKind = iota + 1 // not in the baseline
+	Deleted                           // only in the baseline
+	Updated                           // in both, with different values
+)
+
+func (r RowChangeKind) String() string {
+	return [...]string{"Inserted", "Deleted", "Updated"}[r-1]
+}
+
+// ColumnChange is a column of a row that a branch changed. Old is nil for an
+// inserted row and New is nil for a deleted one.
+type ColumnChange struct {
+	Name string
+	Old  any
+	New  any
+}
+
+// RowChange is how a branch changed the row of a key.
+type RowChange struct {
+	Change  RowChangeKind
+	Columns []ColumnChange // in the order of Diff.ColNames; all columns of inserted and deleted rows
+}
+
+// KeyChange is the change of one primary key in A and in B.
+type KeyChange struct {
+	Key          Row        // the values of ChangeSet.KeyCols
+	Control      *RowChange // nil if A has the row of the baseline
+	Experimental *RowChange // nil if B has the row of the baseline
+}
+
+// ChangeSet classifies the rows of the diff of a table with a primary key by
+// key, as inserted, deleted or updated in A and B relative to the baseline.
+type ChangeSet struct {
+	KeyCols []string
+	Changes []*KeyChange // in the order of the rows of the diff
+}
+
+// Lines describes the changes, one line per changed column or row, e.g.
+// ("id")=(1): "balance" changed from 100 to 90 in B only.
+func (c *ChangeSet) Lines() []string {
+	var lines []string
+	for _, k := range c.Changes {
+		key := fmt.Sprintf("(%s)=(%s)", identList("", c.KeyCols), valueList(k.Key))
+		for _, line := range changeLines(k.Control, k.Experimental) {
+			lines = append(lines, key+": "+line)
+		}
+	}
+	return lines
+}
+
+// changeLines describes the changes of a key in A and B. A change both made
+// is described once.
+func changeLines(a *RowChange, b *RowChange) []string {
+	describe := func(r *RowChange) []string {
+		switch r.Change {
+		case Inserted:
+			return []string{"inserted"}
+		case Deleted:
+			return []string{"deleted"}
+		}
+		var lines []string
+		for _, c := range r.Columns {
+			lines = append(lines, fmt.Sprintf("%s changed from %v to %v", quoteIdent(c.Name), c.Old, c.New))
+		}
+		return lines
+	}
+
+	var linesA, linesB []string
+	if a != nil {
+		linesA = describe(a)
+	}
+	if b != nil {
+		linesB = describe(b)
+	}
+	inB := map[string]bool{}
+	for _, line := range linesB {
+		inB[line] = true
+	}
+	inA := map[string]bool{}
+	var lines []string
+	for _, line := range linesA {
+		inA[line] = true
+		if inB[line] {
+			lines = append(lines, line+" in A and B")
+		} else {
+			lines = append(lines, line+" in A only")
+		}
+	}
+	for _, line := range linesB {
+		if !inA[line] {
+			lines = append(lines, line+" in B only")
+		}
+	}
+	return lines
+}
+
+func valueList(values Row) string {
+	var s []string
+	for _, v := range values {
+		s = append(s, fmt.Sprintf("%v", v))
+	}
+	return strings.Join(s, ", ")
+}
+
+// newChangeSet classifies the rows of diff by the primary key keyCols. A
+// side has no row for a key if all its columns are nil, since the primary key
+// columns of a row are never null. Values are compared by the matcher of the
+// diff, so a column the diff rules make equal is not changed.
+func newChangeSet(diff *Diff, keyCols []string) *ChangeSet {
+	var keyIdx []int
+	for _, key := range keyCols {
+		keyIdx = append(keyIdx, slices.Index(diff.ColNames, key))
+	}
+
+	values := func(row *Row) Row {
+		if row == nil {
+			return nil
+		}
+		for _, v := range *row {
+			if v != nil {
+				return *row
+			}
+		}
+		return nil
+	}
+	changeSet := &ChangeSet{KeyCols: keyCols}
+	for i := range diff.Control {
+		baseline, control, experimental := values(diff.Baseline[i]), values(diff.Control[i]), values(diff.Experimental[i])
+		var key Row
+		for _, row := range []Row{baseline, control, experimental} {
+			if row != nil {
+				for _, i := range keyIdx {
+					key = append(key, row[i])
+				}
+				break
+			}
+		}
+		k := &KeyChange{
+			Key:          key,
+			Control:      rowChange(diff, baseline, control),
+			Experimental: rowChange(diff, baseline, experimental),
+		}
+		if k.Control != nil || k.Experimental != nil {
+			changeSet.Changes = append(changeSet.Changes, k)
+		}
+	}
+	return changeSet
+}
+
+// rowChange returns how row changed the baseline row, or nil if it did not.
+// Either row is nil if it does not exist.
+func rowChange(diff *Diff, baseline Row, row Row) *RowChange {
+	var r *RowChange
+	switch {
+	case baseline == nil && row == nil:
+		return nil
+	case baseline == nil:
+		r = &RowChange{Change: Inserted}
+	case row == nil:
+		r = &RowChange{Change: Deleted}
+	default:
+		r = &RowChange{Change: Updated}
+	}
+
+	for i, name := range diff.ColNames {
+		var before, after any
+		if baseline != nil {
+			before = baseline[i]
+		}
+		if row != nil {
+			after = row[i]
+		}
+		if r.Change == Updated && diff.Matcher.equal(i, before, after, false) {
+			continue
+		}
+		r.Columns = append(r.Columns, ColumnChange{Name: name, Old: before, New: after})
+	}
+	if len(r.Columns) == 0 {
+		return nil
+	}
+	return r
+}
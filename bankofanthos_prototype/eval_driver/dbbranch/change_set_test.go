@@ -0,0 +1,100 @@
+package dbbranch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChangeSet(t *testing.T) {
+	// the rows of accounts keyed by id: 1 is updated in B only, 2 in A and B
+	// alike, 3 is deleted from A and updated in B, 4 is inserted into A
+	diff := &Diff{
+		ColNames: []string{"balance", "id", "owner"},
+		Control: rows(
+			Row{100, 1, "alice"},
+			Row{50, 2, "bob"},
+			Row{nil, nil, nil},
+			Row{10, 4, "dave"},
+		),
+		Baseline: rows(
+			Row{100, 1, "alice"},
+			Row{40, 2, "bob"},
+			Row{70, 3, "carol"},
+			Row{nil, nil, nil},
+		),
+		Experimental: rows(
+			Row{90, 1, "alice"},
+			Row{50, 2, "bob"},
+			Row{70, 3, "carl"},
+			Row{nil, nil, nil},
+		),
+	}
+
+	got := newChangeSet(diff, []string{"id"})
+	want := &ChangeSet{
+		KeyCols: []string{"id"},
+		Changes: []*KeyChange{
+			{
+				Key:          Row{1},
+				Experimental: &RowChange{Change: Updated, Columns: []ColumnChange{{Name: "balance", Old: 100, New: 90}}},
+			},
+			{
+				Key:          Row{2},
+				Control:      &RowChange{Change: Updated, Columns: []ColumnChange{{Name: "balance", Old: 40, New: 50}}},
+				Experimental: &RowChange{Change: Updated, Columns: []ColumnChange{{Name: "balance", Old: 40, New: 50}}},
+			},
+			{
+				Key: Row{3},
+				Control: &RowChange{Change: Deleted, Columns: []ColumnChange{
+					{Name: "balance", Old: 70}, {Name: "id", Old: 3}, {Name: "owner", Old: "carol"},
+				}},
+				Experimental: &RowChange{Change: Updated, Columns: []ColumnChange{{Name: "owner", Old: "carol", New: "carl"}}},
+			},
+			{
+				Key: Row{4},
+				Control: &RowChange{Change: Inserted, Columns: []ColumnChange{
+					{Name: "balance", New: 10}, {Name: "id", New: 4}, {Name: "owner", New: "dave"},
+				}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+
+	wantLines := []string{
+		`("id")=(1): "balance" changed from 100 to 90 in B only`,
+		`("id")=(2): "balance" changed from 40 to 50 in A and B`,
+		`("id")=(3): deleted in A only`,
+		`("id")=(3): "owner" changed from carol to carl in B only`,
+		`("id")=(4): inserted in A only`,
+	}
+	if diff := cmp.Diff(wantLines, got.Lines()); diff != "" {
+		t.Errorf("Lines() (-want,+got):\n%s", diff)
+	}
+}
+
+func TestChangeSetWithRules(t *testing.T) {
+	at := func(sec int) time.Time { return time.Date(2024, 1, 1, 0, 0, sec, 0, time.UTC) }
+
+	// A and B both update the balance of account 1; B writes the time a
+	// second later, within the tolerance, and A a minute later
+	diffs := map[string]*Diff{"balances": {
+		ColNames:     []string{"balance", "id", "updated"},
+		Control:      rows(Row{90, 1, at(60)}),
+		Baseline:     rows(Row{100, 1, at(0)}),
+		Experimental: rows(Row{90, 1, at(1)}),
+	}}
+	DiffRules{"balances": {"updated": {Tolerance: 5}}}.apply(diffs)
+
+	got := newChangeSet(diffs["balances"], []string{"id"}).Lines()
+	want := []string{
+		`("id")=(1): "balance" changed from 100 to 90 in A and B`,
+		`("id")=(1): "updated" changed from 2024-01-01 00:00:00 +0000 UTC to 2024-01-01 00:01:00 +0000 UTC in A only`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+}
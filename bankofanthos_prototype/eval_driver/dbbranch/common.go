@@ -5,91 +5,73 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"golang.org/x/sync/errgroup"
 )
 
-const snapshotSuffix = "snapshot"
+// publicSchema is the default schema of the production tables. Branches read
+// the production tables of every schema as a shared snapshot and never modify
+// them.
+const publicSchema = "public"
 
-func alterTableName(ctx context.Context, connPool *pgxpool.Pool, newName string, table *table) error {
-	query := fmt.Sprintf("ALTER TABLE %s RENAME to %s;", table.Name, newName)
-	_, err := connPool.Exec(ctx, query)
-	if err != nil {
-		return err
-	}
-	table.Name = newName
-
-	return nil
+// queryer runs queries on a *pgxpool.Pool or in a pgx.Tx.
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
 }
 
-func alterViewName(ctx context.Context, connPool *pgxpool.Pool, newName string, view *view) error {
-	query := fmt.Sprintf("ALTER VIEW %s RENAME to %s;", view.Name, newName)
-
-	_, err := connPool.Exec(ctx, query)
-	if err != nil {
-		return err
-	}
-	view.Name = newName
-
-	return nil
+// execer runs statements on a *pgxpool.Pool or in a pgx.Tx.
+type execer interface {
+	queryer
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
 }
 
-func dropTable(ctx context.Context, connPool *pgxpool.Pool, name string) error {
+// dropTable, dropView, dropTrigger and dropFunction take names that are
+// already quoted, e.g. the result of qualify.
+
+func dropTable(ctx context.Context, conn execer, name string) error {
 	query := fmt.Sprintf("DROP TABLE IF EXISTS %s;", name)
 
-	_, err := connPool.Exec(ctx, query)
+	_, err := conn.Exec(ctx, query)
 
 	return err
 }
 
-func dropView(ctx context.Context, connPool *pgxpool.Pool, name string) error {
+func dropView(ctx context.Context, conn execer, name string) error {
 	query := fmt.Sprintf("DROP VIEW IF EXISTS %s;", name)
 
-	_, err := connPool.Exec(ctx, query)
+	_, err := conn.Exec(ctx, query)
 	return err
 }
 
-func dropTrigger(ctx context.Context, connPool *pgxpool.Pool, triggerName, tableName string) error {
+func dropTrigger(ctx context.Context, conn execer, triggerName, tableName string) error {
 	query := fmt.Sprintf("DROP TRIGGER %s ON %s CASCADE;", triggerName, tableName)
-	_, err := connPool.Exec(ctx, query)
+	_, err := conn.Exec(ctx, query)
 
 	return err
 }
 
-func dropFunction(ctx context.Context, connPool *pgxpool.Pool, name string) error {
+func dropFunction(ctx context.Context, conn execer, name string) error {
 	query := fmt.Sprintf("DROP FUNCTION %s;", name)
-	_, err := connPool.Exec(ctx, query)
+	_, err := conn.Exec(ctx, query)
 
 	return err
 }
 
-func dropSchemaCascade(ctx context.Context, connPool *pgxpool.Pool, namespace string) error {
-	query := fmt.Sprintf("DROP SCHEMA %s CASCADE;", namespace)
+func dropSchemaCascade(ctx context.Context, conn execer, namespace string) error {
+	query := fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE;", quoteIdent(namespace))
 
-	_, err := connPool.Exec(ctx, query)
+	_, err := conn.Exec(ctx, query)
 	return err
 }
 
-func getAllSchemaNames(ctx context.Context, connPool *pgxpool.Pool) ([]string, error) {
-	var schemaNames []string
-	rows, err := connPool.Query(ctx, `
-	SELECT schema_name
-	FROM information_schema.schemata
-	WHERE schema_name NOT LIKE 'pg_%' 
-	AND schema_name NOT IN ('information_schema', 'public');`)
-	if err != nil {
-		return nil, err
-	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var schemaName string
-		if err := rows.Scan(&schemaName); err != nil {
-			return nil, err
-		}
-		schemaNames = append(schemaNames, schemaName)
-	}
-	return schemaNames, nil
+func schemaExists(ctx context.Context, connPool *pgxpool.Pool, namespace string) (bool, error) {
+	var exists bool
+	err := connPool.QueryRow(ctx, `
+	SELECT EXISTS (SELECT 1 FROM information_schema.schemata WHERE schema_name = $1);`, namespace).Scan(&exists)
+	return exists, err
 }
 
 // for goroutine group
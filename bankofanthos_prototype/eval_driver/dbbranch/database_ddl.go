@@ -5,43 +5,85 @@ package dbbranch
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/exp/maps"
 )
 
 const (
-	counterColName = "rid"
-	counterName    = "rid"
+	counterColName     = "rid"
+	counterName        = "rid"
+	sequenceStatesName = "rid_sequences"
+	upsertsName        = "rid_upserts"
+	raiseName          = "rid_raise"
 )
 
 type counter struct {
+	Schema  string
 	Name    string
 	Colname string
 }
-type clonedTable struct {
-	Snapshot *table
-	Plus     *table
-	Minus    *table
-	View     *view
-	Counter  *counter
 
-	Functions []string
-	Triggers  []string
+func (c *counter) qualifiedName() string {
+	return qualify(c.Schema, c.Name)
+}
+
+type clonedTable struct {
+	Namespace string
+	Snapshot  *table
+	Plus      *table
+	Minus     *table
+	View      *view
+	Counter   *counter
+	Parent    *clonedTable         // the table of the parent branch R' reads from, nil for the production table
+	Base      *table               // empty copy of the table with the schema changes of the branch, made by the first schema change of the table
+	BaseExprs map[string]string    // the columns of Base computed from the rows R' reads from, see baseQuery
+	Sequences map[string]*sequence // sequences of the branch that generate the columns, keyed by column name
+	Hierarchy *view                // R' of the table and the tables that inherit from it, nil if none does; View then holds the rows of the table itself
+	Children  []*clonedTable       // the tables that inherit from the table directly, or its partitions
+
+	// R' of a table of a lazy branch reads Stub, which reads base until
+	// Materialize creates R+/R- on the first write and makes Stub read them
+	// too. Both are empty once R+/R- are created eagerly.
+	Stub        *view
+	Materialize string
+
+	Functions     []string
+	Triggers      []string
+	RouteTriggers []string // triggers on Hierarchy
 }
 
 type cloneDdl struct {
-	clonedTables map[string]*clonedTable
+	clonedTables map[string]*clonedTable // keyed by tableKey of the production table
 	database     *database
 	namespace    string
-	counter      *counter // tables in same database share the same counter table
+	counter      *counter             // tables in same database share the same counter table
+	parent       *cloneDdl            // set if the branch is forked from another branch
+	sequences    map[string]*sequence // cloned sequences keyed by the qualified name of the production sequence
+	views        []*dependentView     // the views of the database cloned into the branch, in creation order
+	lazy         bool                 // create R+/R- of a table on its first write, see lazy_branch.go
+	tx           pgx.Tx               // the transaction of the running schema change, see migrate
 
 	mu sync.Mutex
 }
 
+// conn returns the transaction of the running schema change, or the pool of
+// the database outside of one.
+func (c *cloneDdl) conn() execer {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.database.connPool
+}
+
 func newCloneDdl(ctx context.Context, Database *database, namespace string) (*cloneDdl, error) {
 	database := &cloneDdl{
 		clonedTables: map[string]*clonedTable{},
+		sequences:    map[string]*sequence{},
 		database:     Database,
 		namespace:    namespace,
 	}
@@ -54,14 +96,60 @@ func newCloneDdl(ctx context.Context, Database *database, namespace string) (*cl
 	return database, nil
 }
 
-func (c *cloneDdl) createClonedTables(ctx context.Context) error {
-	err := c.createSchema(ctx, c.namespace)
+// newLazyCloneDdl creates R' views in namespace whose R+/R- tables are
+// created on the first write of their table.
+func newLazyCloneDdl(ctx context.Context, Database *database, namespace string) (*cloneDdl, error) {
+	database := &cloneDdl{
+		clonedTables: map[string]*clonedTable{},
+		sequences:    map[string]*sequence{},
+		database:     Database,
+		namespace:    namespace,
+		lazy:         true,
+	}
+
+	err := database.createClonedTables(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = c.createCounter(ctx)
+	return database, nil
+}
+
+// newForkedCloneDdl creates R+/R-/R' tables in namespace on top of the R' views
+// of parent. The fork is lazy if parent is.
+func newForkedCloneDdl(ctx context.Context, parent *cloneDdl, namespace string) (*cloneDdl, error) {
+	database := &cloneDdl{
+		clonedTables: map[string]*clonedTable{},
+		sequences:    map[string]*sequence{},
+		database:     parent.database,
+		namespace:    namespace,
+		parent:       parent,
+		lazy:         parent.lazy,
+	}
+
+	err := database.createClonedTables(ctx)
 	if err != nil {
+		return nil, err
+	}
+
+	return database, nil
+}
+
+func (c *cloneDdl) createClonedTables(ctx context.Context) error {
+	for _, schema := range c.schemas() {
+		if err := c.createSchema(ctx, schema); err != nil {
+			return err
+		}
+	}
+
+	err := c.createCounter(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.createSequenceStates(ctx); err != nil {
+		return err
+	}
+	if err := c.createUpsertHelpers(ctx); err != nil {
 		return err
 	}
 
@@ -70,6 +158,10 @@ func (c *cloneDdl) createClonedTables(ctx context.Context) error {
 	for tablename, t := range c.database.Tables {
 		tablename := tablename
 		t := t
+		// a fork starts from the schema of its parent, which may have changed
+		if c.parent != nil {
+			t = c.parent.clonedTables[tablename].Snapshot
+		}
 		g.Go(func() (string, *clonedTable, error) {
 			clonedTableB, err := c.createClonedTable(ctx, t)
 			return tablename, clonedTableB, err
@@ -85,38 +177,73 @@ func (c *cloneDdl) createClonedTables(ctx context.Context) error {
 		c.clonedTables[k] = v
 	}
 
-	return nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.createHierarchyViews(ctx); err != nil {
+		return err
+	}
+	return c.cloneRelations(ctx)
 }
 
 func (c *cloneDdl) reset(ctx context.Context) error {
-	for tablename, table := range c.clonedTables {
+	for _, table := range c.clonedTables {
 		// drop all created triggers
 		for _, trigger := range table.Triggers {
-			if err := dropTrigger(ctx, c.database.connPool, trigger, tablename); err != nil {
+			if err := dropTrigger(ctx, c.conn(), quoteIdent(trigger), table.View.qualifiedName()); err != nil {
+				return err
+			}
+		}
+		for _, trigger := range table.RouteTriggers {
+			if err := dropTrigger(ctx, c.conn(), quoteIdent(trigger), table.Hierarchy.qualifiedName()); err != nil {
 				return err
 			}
 		}
 
 		for _, function := range table.Functions {
-			if err := dropFunction(ctx, c.database.connPool, function); err != nil {
+			if err := dropFunction(ctx, c.conn(), function); err != nil {
 				return err
 			}
 		}
+		table.Triggers = nil
+		table.RouteTriggers = nil
+		table.Functions = nil
+	}
 
-		if err := c.alterViewSchema(ctx, table.View); err != nil {
-			return err
-		}
+	return nil
+}
 
-		if err := alterTableName(ctx, c.database.connPool, tablename, table.Snapshot); err != nil {
+func (c *cloneDdl) close(ctx context.Context) error {
+	for _, schema := range c.schemas() {
+		if err := dropSchemaCascade(ctx, c.conn(), schema); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func (c *cloneDdl) close(ctx context.Context) error {
-	return dropSchemaCascade(ctx, c.database.connPool, c.namespace)
+// schemas returns the schemas that hold the branch, the namespace first.
+func (c *cloneDdl) schemas() []string {
+	return append(branchSchemas(c.namespace, c.database), hookSchemas(c.namespace, c.database)...)
+}
+
+// searchPath returns the search_path that resolves unqualified names to the
+// R' views of the branch: the schemas of the views followed by the schemas of
+// the production tables.
+func (c *cloneDdl) searchPath() string {
+	var schemas []string
+	for _, schema := range c.searchPathSchemas() {
+		schemas = append(schemas, quoteIdent(schema))
+	}
+	return strings.Join(schemas, ", ")
+}
+
+// searchPathSchemas returns the unquoted schemas of searchPath.
+func (c *cloneDdl) searchPathSchemas() []string {
+	return searchPathSchemas(c.namespace, c.database)
+}
+
+func searchPathSchemas(namespace string, database *database) []string {
+	return append(branchSchemas(namespace, database), database.schemas()...)
 }
 
 func (c *cloneDdl) createClonedTable(ctx context.Context, snapshot *table) (*clonedTable, error) {
@@ -125,44 +252,144 @@ func (c *cloneDdl) createClonedTable(ctx context.Context, snapshot *table) (*clo
 		return nil, fmt.Errorf("failed to create +/- tables or view: %w", err)
 	}
 
-	originalName := clonedTable.Snapshot.Name
 	err = c.applyRules(ctx, snapshot, clonedTable.View)
 	if err != nil {
 		return nil, fmt.Errorf("failed to apply rules: %w", err)
 	}
 
-	// at the end, rename original snapshot to tablesnapshot and view as the original snapshot name
-	err = alterTableName(ctx, c.database.connPool, snapshot.Name+snapshotSuffix, snapshot)
-	if err != nil {
-		return nil, fmt.Errorf("failed to alter table names: %w", err)
-	}
+	return clonedTable, nil
+}
 
-	err = alterViewName(ctx, c.database.connPool, originalName, clonedTable.View)
-	if err != nil {
-		return nil, fmt.Errorf("failed to alter view names: %w", err)
+// schemaSeparator separates the namespace of a branch from the production
+// schema in the names of the branch schemas. Neither namespaces nor the
+// schemas of branched tables may contain it, see checkSchemaNames, so every
+// pair of them names a schema of its own.
+const schemaSeparator = "$"
+
+// branchSchema returns the schema that holds the R+/R-/R' of the tables in
+// schema for the branch in namespace. Tables in public go to the namespace
+// itself and tables of any other schema to namespace$schema, so that tables
+// with the same name in different schemas do not collide. An R' view has the
+// same name as its production table, so it shadows the table once its schema
+// is put first in the search_path.
+func branchSchema(namespace, schema string) string {
+	if schema == publicSchema {
+		return namespace
 	}
+	return namespace + schemaSeparator + schema
+}
 
-	return clonedTable, nil
+// checkSchemaNames checks that namespace and the schemas of the tables of
+// database do not contain schemaSeparator, so that the branch schemas of
+// different branches and schemas cannot collide.
+func checkSchemaNames(namespace string, database *database) error {
+	if namespace == "" || strings.Contains(namespace, schemaSeparator) {
+		return fmt.Errorf("invalid branch namespace %q: it must be non-empty and must not contain %q", namespace, schemaSeparator)
+	}
+	for _, schema := range database.schemas() {
+		if strings.Contains(schema, schemaSeparator) {
+			return fmt.Errorf("schema %q cannot be branched: it contains %q", schema, schemaSeparator)
+		}
+	}
+	return nil
 }
 
-func (c *cloneDdl) alterViewSchema(ctx context.Context, view *view) error {
-	query := fmt.Sprintf("ALTER VIEW %s SET SCHEMA %s;", view.Name, c.namespace)
+// viewName returns the quoted name of the R' view of the table schema.tablename
+// in the branch in namespace.
+func viewName(namespace, schema, tablename string) string {
+	return qualify(branchSchema(namespace, schema), tablename)
+}
 
-	if _, err := c.database.connPool.Exec(ctx, query); err != nil {
-		return err
+// branchSchemas returns the schemas a branch in namespace creates for the
+// R' views of the tables of database, in the order of database.schemas.
+func branchSchemas(namespace string, database *database) []string {
+	var schemas []string
+	for _, schema := range database.schemas() {
+		schemas = append(schemas, branchSchema(namespace, schema))
 	}
+	return schemas
+}
 
-	view.Name = c.namespace + "." + view.Name
-	return nil
+// hooksSuffix ends the names of the schemas that hold the trigger hooks. A
+// branch schema holds a single schemaSeparator, so none contains it.
+const hooksSuffix = "$$hooks"
+
+// hooksSchema returns the schema that holds the hook tables and trigger
+// functions of the tables in schema for the branch in namespace. A hook table
+// has the name of its production table, which the triggers see as
+// TG_TABLE_NAME.
+func hooksSchema(namespace, schema string) string {
+	return branchSchema(namespace, schema) + hooksSuffix
+}
+
+// hookSchemas returns the schemas a branch in namespace creates for the
+// tables of database that have triggers, in the order of database.schemas.
+func hookSchemas(namespace string, database *database) []string {
+	triggered := map[string]bool{}
+	for _, t := range database.Tables {
+		if len(t.Triggers) > 0 {
+			triggered[t.Schema] = true
+		}
+	}
+	var schemas []string
+	for _, schema := range database.schemas() {
+		if triggered[schema] {
+			schemas = append(schemas, hooksSchema(namespace, schema))
+		}
+	}
+	return schemas
 }
 
 func (c *cloneDdl) createSchema(ctx context.Context, namespace string) error {
-	query := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", namespace)
+	query := fmt.Sprintf("CREATE SCHEMA %s;", quoteIdent(namespace))
 
-	_, err := c.database.connPool.Exec(ctx, query)
+	_, err := c.conn().Exec(ctx, query)
 	return err
 }
 
+// cloneSequence creates a copy of the production sequence prod in schema,
+// unless the branch already has one. The copy continues from the current value
+// of prod, or of the parent branch's copy in a forked branch, so that every
+// branch generates the same values and production is never advanced. c.mu
+// must be held.
+func (c *cloneDdl) cloneSequence(ctx context.Context, prod *sequence, schema string) (*sequence, error) {
+	key := prod.qualifiedName()
+	if clone, ok := c.sequences[key]; ok {
+		return clone, nil
+	}
+
+	clone := *prod
+	clone.Schema = schema
+	seed := prod
+	if c.parent != nil {
+		if parentClone, ok := c.parent.sequences[key]; ok {
+			seed = parentClone
+		}
+	}
+
+	cycle := "NO CYCLE"
+	if prod.Cycle {
+		cycle = "CYCLE"
+	}
+	_, err := c.conn().Exec(ctx, fmt.Sprintf("CREATE SEQUENCE %s AS %s INCREMENT BY %d MINVALUE %d MAXVALUE %d START WITH %d %s;",
+		clone.qualifiedName(), clone.DataType, clone.Increment, clone.Minimum, clone.Maximum, clone.Start, cycle))
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.conn().Exec(ctx, fmt.Sprintf("SELECT setval($1::regclass, last_value, is_called) FROM %s;", seed.qualifiedName()), clone.qualifiedName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to seed sequence %s: %w", clone.qualifiedName(), err)
+	}
+	// a rollback to before the first request restores the seed
+	_, err = c.conn().Exec(ctx, fmt.Sprintf("INSERT INTO %s SELECT $1, -1, last_value, is_called FROM %s;", c.sequenceStates(), clone.qualifiedName()), clone.qualifiedName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record sequence %s: %w", clone.qualifiedName(), err)
+	}
+
+	c.sequences[key] = &clone
+	return &clone, nil
+}
+
 func (c *cloneDdl) getPrimaryKeyCols(table *table) []string {
 	for _, idx := range table.Indexes {
 		if idx.IsUnique && strings.Contains(idx.Name, "pkey") {
@@ -177,66 +404,134 @@ func (c *cloneDdl) getPrimaryKeyCols(table *table) []string {
 func (c *cloneDdl) createPlusMinusTableAndView(ctx context.Context, prodTable *table, counter *counter) (*clonedTable, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	schema := branchSchema(c.namespace, prodTable.Schema)
 	plus := &table{
-		Name: fmt.Sprintf("%s.%splus", c.namespace, prodTable.Name),
-		Cols: map[string]column{},
+		Schema: schema,
+		Name:   prodTable.Name + "plus",
+		Cols:   map[string]column{},
 	}
 
 	minus := &table{
-		Name: fmt.Sprintf("%s.%sminus", c.namespace, prodTable.Name),
-		Cols: map[string]column{},
+		Schema: schema,
+		Name:   prodTable.Name + "minus",
+		Cols:   map[string]column{},
 	}
 
 	var columnslst []string
 	for name, col := range prodTable.Cols {
 		plus.Cols[name] = col
 		minus.Cols[name] = col
-		var column strings.Builder
-
-		column.WriteString(name + " " + col.DataType)
-		if col.CharacterMaximumLength > 0 {
-			fmt.Fprintf(&column, "(%d)", col.CharacterMaximumLength)
-		}
-		if col.Nullable == "NO" {
-			column.WriteString(" NOT NULL")
-		}
-		columnslst = append(columnslst, column.String())
+		columnslst = append(columnslst, columnDef(col))
 	}
 
 	//TODO: make sure counter col name does not exist in table and each branch have the same col name
 
-	columnslst = append(columnslst, fmt.Sprintf("%s bigint", counter.Colname))
+	columnslst = append(columnslst, quoteIdent(counter.Colname)+" bigint")
 	columns := strings.Join(columnslst, ",\n")
 
-	// create R+
-	plusQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s(\n %s \n);", plus.Name, columns)
-	_, err := c.database.connPool.Exec(ctx, plusQuery)
+	// R' of a table with children holds the rows of the table itself
+	base := prodTable.qualifiedName()
+	if len(c.database.children(prodTable)) > 0 {
+		base = "ONLY " + base
+	}
+	var parent *clonedTable
+	if c.parent != nil {
+		parent = c.parent.clonedTables[prodTable.key()]
+		base = parent.View.qualifiedName()
+	}
+
+	clonedTable := &clonedTable{
+		Namespace: c.namespace,
+		Snapshot:  prodTable,
+		Plus:      plus,
+		Minus:     minus,
+		Counter:   c.counter,
+		Parent:    parent,
+	}
+
+	// a lazy branch creates R+ and R- on the first write of the table
+	if c.lazy {
+		if err := c.createLazyView(ctx, clonedTable, base, columns); err != nil {
+			return nil, err
+		}
+	} else {
+		// create R+
+		plusQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s(\n %s \n);", plus.qualifiedName(), columns)
+		_, err := c.conn().Exec(ctx, plusQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create R+, %w", err)
+		}
+		// create R-
+		minusQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s(\n %s \n);", minus.qualifiedName(), columns)
+		_, err = c.conn().Exec(ctx, minusQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create R-, %w", err)
+		}
+		if indexes := indexQuery(prodTable, plus, minus); indexes != "" {
+			if _, err := c.conn().Exec(ctx, indexes); err != nil {
+				return nil, fmt.Errorf("failed to index R+ and R-, %w", err)
+			}
+		}
+
+		if clonedTable.View, clonedTable.Sequences, err = c.createView(ctx, prodTable, base, plus, minus); err != nil {
+			return nil, err
+		}
+	}
+	c.clonedTables[prodTable.key()] = clonedTable
+
+	return clonedTable, nil
+}
+
+// createView creates the R' view of prodTable over base, the relation R'
+// reads the rows from that the branch did not write: the production table,
+// the R' view of the parent branch, or the query of a schema change, see
+// baseQuery. c.mu must be held.
+func (c *cloneDdl) createView(ctx context.Context, prodTable *table, base string, plus *table, minus *table) (*view, map[string]*sequence, error) {
+	view := newView(c.database, prodTable, plus.Schema)
+	_, err := c.conn().Exec(ctx, fmt.Sprintf("CREATE OR REPLACE VIEW %s AS %s;", view.qualifiedName(), c.viewQuery(prodTable, base, plus, minus)))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create R+, %w", err)
+		return nil, nil, fmt.Errorf("failed to create R view, %w", err)
 	}
-	// create R-
-	minusQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s(\n %s \n);", minus.Name, columns)
-	_, err = c.database.connPool.Exec(ctx, minusQuery)
+
+	sequences, err := c.setViewDefaults(ctx, view, plus.Schema)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create R-, %w", err)
+		return nil, nil, err
 	}
+	return view, sequences, nil
+}
 
+// newView returns the R' view of prodTable in schema. R' has the name of the
+// production table, unless the table has children: the R' of the hierarchy
+// takes the name then.
+func newView(database *database, prodTable *table, schema string) *view {
 	view := &view{
-		Name: prodTable.Name + "view",
-		Cols: map[string]column{},
+		Schema: schema,
+		Name:   prodTable.Name,
+		Cols:   map[string]column{},
+	}
+	if len(database.children(prodTable)) > 0 {
+		view.Name = prodTable.Name + "only"
 	}
 
 	// for views, column is always nullable. No constraint is enforced on the view itself, but on the underlying tables.
-	var colnames []string
 	for name, col := range prodTable.Cols {
 		col.Nullable = "YES"
 		view.Cols[name] = col
-		colnames = append(colnames, name)
 	}
-	sort.Strings(colnames)
+	return view
+}
+
+// viewQuery returns the query of R': the rows of base and plus, without the
+// rows of minus.
+func (c *cloneDdl) viewQuery(prodTable *table, base string, plus *table, minus *table) string {
+	names := maps.Keys(prodTable.Cols)
+	sort.Strings(names)
+	colnames := make([]string, len(names))
+	for i, name := range names {
+		colnames[i] = quoteIdent(name)
+	}
 
 	pk_cols := c.getPrimaryKeyCols(prodTable)
-	viewQuery := ""
 
 	// Create a view prod table union all plus except all minus
 	if len(pk_cols) == 0 {
@@ -247,8 +542,7 @@ func (c *cloneDdl) createPlusMinusTableAndView(ctx context.Context, prodTable *t
 			cCols[i] = "c." + col
 		}
 
-		viewQuery = fmt.Sprintf(`
-		CREATE OR REPLACE VIEW %s AS(
+		return fmt.Sprintf(`(
 		WITH numbered_data AS (
 			SELECT %s, ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s) AS rn 
 			FROM (
@@ -265,19 +559,17 @@ func (c *cloneDdl) createPlusMinusTableAndView(ctx context.Context, prodTable *t
 		FROM numbered_data d
 		LEFT JOIN numbered_c c ON (%s) = (%s) AND d.rn = c.rn
 		WHERE (%s) IS NULL
-		);
-`, view.Name, strings.Join(colnames, ", "), strings.Join(colnames, ", "), strings.Join(colnames, ", "), strings.Join(colnames, ", "), prodTable.Name, strings.Join(colnames, ", "), plus.Name, strings.Join(colnames, ", "), strings.Join(colnames, ", "), strings.Join(colnames, ", "), minus.Name, strings.Join(dCols, ","), strings.Join(dCols, ","), strings.Join(cCols, ","), strings.Join(cCols, ","))
+		)`, strings.Join(colnames, ", "), strings.Join(colnames, ", "), strings.Join(colnames, ", "), strings.Join(colnames, ", "), base, strings.Join(colnames, ", "), plus.qualifiedName(), strings.Join(colnames, ", "), strings.Join(colnames, ", "), strings.Join(colnames, ", "), minus.qualifiedName(), strings.Join(dCols, ","), strings.Join(dCols, ","), strings.Join(cCols, ","), strings.Join(cCols, ","))
+	}
 
-	} else {
-		unionCols := make([]string, len(colnames))
-		minusCols := make([]string, len(colnames))
-		for i, col := range colnames {
-			unionCols[i] = "tmp." + col
-			minusCols[i] = minus.Name + "." + col
-		}
+	unionCols := make([]string, len(colnames))
+	minusCols := make([]string, len(colnames))
+	for i, col := range colnames {
+		unionCols[i] = "tmp." + col
+		minusCols[i] = minus.qualifiedName() + "." + col
+	}
 
-		viewQuery = fmt.Sprintf(`
-		CREATE VIEW %s AS
+	return fmt.Sprintf(`
 		SELECT %s FROM
 		( SELECT %s FROM %s
 		UNION ALL
@@ -285,69 +577,78 @@ func (c *cloneDdl) createPlusMinusTableAndView(ctx context.Context, prodTable *t
 		WHERE NOT EXISTS(
 		SELECT 1 FROM %s
 		WHERE (%s) = (%s)
-		) ;
-		`, view.Name, strings.Join(colnames, ", "), strings.Join(colnames, ", "), prodTable.Name, strings.Join(colnames, ", "), plus.Name, minus.Name, strings.Join(unionCols, ","), strings.Join(minusCols, ","))
-	}
-
-	_, err = c.database.connPool.Exec(ctx, viewQuery)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create R view, %w", err)
-	}
+		)`, strings.Join(colnames, ", "), strings.Join(colnames, ", "), base, strings.Join(colnames, ", "), plus.qualifiedName(), minus.qualifiedName(), strings.Join(unionCols, ","), strings.Join(minusCols, ","))
+}
 
-	clonedTable := &clonedTable{
-		Snapshot: prodTable,
-		Plus:     plus,
-		Minus:    minus,
-		View:     view,
-		Counter:  c.counter,
+// setViewDefaults gives the columns of view the defaults of the production
+// table. An INSERT on the view fills omitted columns with the defaults of the
+// view before the redirect trigger runs. Serial and identity columns draw
+// from the sequences of the branch, cloned into schema, instead of the
+// production sequences. c.mu must be held.
+func (c *cloneDdl) setViewDefaults(ctx context.Context, view *view, schema string) (map[string]*sequence, error) {
+	names := maps.Keys(view.Cols)
+	sort.Strings(names)
+	var sequences map[string]*sequence
+	for _, name := range names {
+		col := view.Cols[name]
+		d := columnDefault(col)
+		if col.Sequence != nil {
+			seq, err := c.cloneSequence(ctx, col.Sequence, schema)
+			if err != nil {
+				return nil, fmt.Errorf("failed to clone sequence of %s, %w", name, err)
+			}
+			if sequences == nil {
+				sequences = map[string]*sequence{}
+			}
+			sequences[name] = seq
+			d = fmt.Sprintf("nextval(%s::regclass)", quoteLiteral(seq.qualifiedName()))
+		}
+		if d == "" {
+			continue
+		}
+		_, err := c.conn().Exec(ctx, fmt.Sprintf("ALTER VIEW %s ALTER COLUMN %s SET DEFAULT %s;", view.qualifiedName(), quoteIdent(name), d))
+		if err != nil {
+			return nil, fmt.Errorf("failed to set default of %s, %w", name, err)
+		}
 	}
-	c.clonedTables[prodTable.Name] = clonedTable
-
-	return clonedTable, nil
+	return sequences, nil
 }
 
-func (c *cloneDdl) applyIndexes(ctx context.Context, prodTable *table, plus *table, minus *table) error {
-	// rename index
-	// remove UNIQUE if there is any
-	// apply index on both plus and minus tables
+// indexQuery returns the statements that index R+ and R- on the columns of
+// the indexes of prodTable, so that R' and the diffs look up the rows of a key
+// instead of scanning R+ and R-. The indexes are not unique, since R+ and R-
+// hold every row a request wrote.
+func indexQuery(prodTable *table, plus *table, minus *table) string {
+	var stmts []string
+	indexed := map[string]bool{}
 	for _, idx := range prodTable.Indexes {
-		var plusIndex, minusIndex index
-		indexDef := strings.ReplaceAll(strings.ToLower(idx.IndexDef), " unique ", " ")
-
-		plusIndexDef := strings.ReplaceAll(strings.ToLower(indexDef), prodTable.Name, plus.Name)
-		plusIndex.IndexDef = plusIndexDef
-		plusIndex.Name = strings.ReplaceAll(strings.ToLower(idx.Name), prodTable.Name, plus.Name)
-		plusIndex.IsUnique = idx.IsUnique
-		plus.Indexes = append(plus.Indexes, plusIndex)
-
-		_, err := c.database.connPool.Exec(ctx, plusIndexDef)
-		if err != nil {
-			return err
+		cols := identList("", idx.ColumnNames)
+		if len(idx.ColumnNames) == 0 || indexed[cols] {
+			continue
 		}
-
-		minusIndexDef := strings.ReplaceAll(strings.ToLower(indexDef), prodTable.Name, minus.Name)
-		minusIndex.IndexDef = minusIndexDef
-		minusIndex.Name = strings.ReplaceAll(strings.ToLower(idx.Name), prodTable.Name, minus.Name)
-		minusIndex.IsUnique = idx.IsUnique
-		minus.Indexes = append(minus.Indexes, minusIndex)
-		_, err = c.database.connPool.Exec(ctx, minusIndexDef)
-		if err != nil {
-			return err
+		indexed[cols] = true
+		for _, t := range []*table{plus, minus} {
+			stmts = append(stmts, fmt.Sprintf("CREATE INDEX ON %s (%s);", t.qualifiedName(), cols))
 		}
 	}
-	return nil
+	return strings.Join(stmts, "\n")
 }
 
 func (c *cloneDdl) applyRules(ctx context.Context, prodTable *table, view *view) error {
+	// pg_rules prints the target table qualified, and quoted only if needed
+	target := regexp.MustCompile(`(?s)^CREATE RULE (.+?) AS\s+ON (SELECT|INSERT|UPDATE|DELETE) TO ` + identPattern(prodTable.Schema) + `\.` + identPattern(prodTable.Name) + `(\s|;|$)`)
 	for _, r := range prodTable.Rules {
 		var viewRule rule
 		viewRule.Name = "view_" + r.Name
-		ruleDef := strings.ReplaceAll(strings.ToLower(r.Definition), r.Name, viewRule.Name)
-		ruleDef = strings.ReplaceAll(strings.ToLower(ruleDef), prodTable.Name, view.Name)
+		m := target.FindStringSubmatchIndex(r.Definition)
+		if m == nil {
+			return fmt.Errorf("cannot find table %s in the definition of rule %s", prodTable.qualifiedName(), r.Name)
+		}
+		ruleDef := fmt.Sprintf("CREATE RULE %s AS\n    ON %s TO %s", quoteIdent(viewRule.Name), r.Definition[m[4]:m[5]], view.qualifiedName()) + r.Definition[m[6]:]
 		viewRule.Definition = ruleDef
 		view.Rules = append(view.Rules, viewRule)
 
-		_, err := c.database.connPool.Exec(ctx, ruleDef)
+		_, err := c.conn().Exec(ctx, ruleDef)
 		if err != nil {
 			return err
 		}
@@ -357,18 +658,120 @@ func (c *cloneDdl) applyRules(ctx context.Context, prodTable *table, view *view)
 
 // TODO: check counter name does not exist
 func (c *cloneDdl) createCounter(ctx context.Context) error {
-	c.counter = &counter{Name: fmt.Sprintf("%s.%s", c.namespace, counterName), Colname: counterColName}
+	c.counter = &counter{Schema: c.namespace, Name: counterName, Colname: counterColName}
 
-	_, err := c.database.connPool.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (id BIGINT);", c.counter.Name))
+	_, err := c.conn().Exec(ctx, fmt.Sprintf("CREATE TABLE %s (id BIGINT);", c.counter.qualifiedName()))
 	if err != nil {
 		return err
 	}
 
-	_, err = c.database.connPool.Exec(ctx, fmt.Sprintf("INSERT INTO %s VALUES(0)", c.counter.Name))
+	_, err = c.conn().Exec(ctx, fmt.Sprintf("INSERT INTO %s VALUES(0)", c.counter.qualifiedName()))
 	return err
 }
 
-func (c *cloneDdl) incrementCounter(ctx context.Context) error {
-	_, err := c.database.connPool.Exec(ctx, fmt.Sprintf("UPDATE %s SET id=id+1", c.counter.Name))
+// sequenceStates returns the table that records the state of the sequences
+// of the branch at the end of each request.
+func (c *cloneDdl) sequenceStates() string {
+	return qualify(c.namespace, sequenceStatesName)
+}
+
+func (c *cloneDdl) createSequenceStates(ctx context.Context) error {
+	_, err := c.conn().Exec(ctx, fmt.Sprintf("CREATE TABLE %s (seq TEXT, rid BIGINT, last_value BIGINT, is_called BOOLEAN);", c.sequenceStates()))
 	return err
 }
+
+// upserts returns the view a rewritten upsert inserts a row into for every
+// row it inserted or updated, so that its command tag counts them the way the
+// tag of INSERT ... ON CONFLICT does. The view keeps no rows.
+func (c *cloneDdl) upserts() string {
+	return qualify(c.namespace, upsertsName)
+}
+
+// raise returns the call of the function that raises an error with SQLSTATE
+// code and message, for the rewritten statements that must fail the way the
+// original statement would.
+func (c *cloneDdl) raise(code, message string) string {
+	return fmt.Sprintf("%s(%s, %s)", qualify(c.namespace, raiseName), quoteLiteral(code), quoteLiteral(message))
+}
+
+func (c *cloneDdl) createUpsertHelpers(ctx context.Context) error {
+	upsertsFunction := qualify(c.namespace, upsertsName) + "()"
+	_, err := c.conn().Exec(ctx, fmt.Sprintf(`
+	CREATE VIEW %s AS SELECT NULL::boolean AS upserted WHERE false;
+	CREATE FUNCTION %s RETURNS trigger LANGUAGE plpgsql AS %s;
+	CREATE TRIGGER %s INSTEAD OF INSERT ON %s FOR EACH ROW EXECUTE FUNCTION %s;
+	CREATE FUNCTION %s(code text, message text) RETURNS boolean LANGUAGE plpgsql AS %s;`,
+		c.upserts(),
+		upsertsFunction, dollarQuote("BEGIN RETURN NEW; END;"),
+		quoteIdent(upsertsName), c.upserts(), upsertsFunction,
+		qualify(c.namespace, raiseName), dollarQuote("BEGIN RAISE EXCEPTION USING ERRCODE = code, MESSAGE = message; END;")))
+	if err != nil {
+		return fmt.Errorf("failed to create the upsert helpers: %w", err)
+	}
+	return nil
+}
+
+// incrementCounter ends the current request. It records the state of the
+// sequences of the branch at the end of the request, so that rollbackTo can
+// restore it.
+func (c *cloneDdl) incrementCounter(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.database.connPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, seq := range c.sequences {
+		_, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s SELECT $1, (SELECT id FROM %s), last_value, is_called FROM %s;", c.sequenceStates(), c.counter.qualifiedName(), seq.qualifiedName()), seq.qualifiedName())
+		if err != nil {
+			return fmt.Errorf("failed to record sequence %s: %w", seq.qualifiedName(), err)
+		}
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("UPDATE %s SET id=id+1", c.counter.qualifiedName())); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// rollbackTo drops the rows written after request n, restores the sequences
+// to their state at the end of request n and sets the counter so that the
+// next write is recorded as request n+1.
+func (c *cloneDdl) rollbackTo(ctx context.Context, n int) error {
+	written, err := c.written(ctx, maps.Keys(c.clonedTables))
+	if err != nil {
+		return err
+	}
+	tx, err := c.database.connPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, name := range written {
+		t := c.clonedTables[name]
+		for _, side := range []*table{t.Plus, t.Minus} {
+			if _, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s > $1;", side.qualifiedName(), quoteIdent(c.counter.Colname)), n); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE rid > $1;", c.sequenceStates()), n); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("UPDATE %s SET id=$1", c.counter.qualifiedName()), n+1); err != nil {
+		return err
+	}
+
+	// setval is not rolled back with the transaction, so the sequences are
+	// restored last
+	restore := fmt.Sprintf(`SELECT setval(seq::regclass, last_value, is_called) FROM (
+		SELECT DISTINCT ON (seq) seq, last_value, is_called FROM %s WHERE rid <= $1 ORDER BY seq, rid DESC
+	) s;`, c.sequenceStates())
+	if _, err := tx.Exec(ctx, restore, n); err != nil {
+		return fmt.Errorf("failed to restore sequences: %w", err)
+	}
+	return tx.Commit(ctx)
+}
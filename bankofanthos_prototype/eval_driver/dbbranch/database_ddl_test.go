@@ -2,6 +2,7 @@ package dbbranch
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -37,43 +38,51 @@ func TestCreateCloneDatabase(t *testing.T) {
 		}
 
 		expectedContactTable := &clonedTable{
+			Namespace: "test",
 			Snapshot: &table{
-				Name: "contactssnapshot",
+				Schema: "public",
+				Name:   "contacts",
 				Cols: map[string]column{
-					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO"},
+					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO", Type: "boolean"},
 				},
 				ForeignKeyConstraints: []foreignKeyConstraint{
 					{
 						ConstraintName: "contacts_username_fkey",
+						TableSchema:    "public",
 						TableName:      "contacts",
 						ColumnNames:    []string{"username"},
+						RefTableSchema: "public",
 						RefTableName:   "users",
-						RefColumnNames: []string{"username"}},
+						RefColumnNames: []string{"username"},
+						OnDelete:       "NO ACTION",
+						OnUpdate:       "NO ACTION"},
 				},
 			},
 			Plus: &table{
-				Name: "test.contactsplus",
+				Schema: "test",
+				Name:   "contactsplus",
 				Cols: map[string]column{
-					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO"},
+					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO", Type: "boolean"},
 				}},
-			Minus: &table{Name: "test.contactsminus",
+			Minus: &table{Schema: "test", Name: "contactsminus",
 				Cols: map[string]column{
-					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO"},
+					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO", Type: "boolean"},
 				}},
 			View: &view{
-				Name: "contacts",
+				Schema: "test",
+				Name:   "contacts",
 				Cols: map[string]column{
-					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "YES"},
-					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "YES"},
-					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "YES"},
+					"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "YES", Type: "character varying(64)"},
+					"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "YES", Type: "character(12)"},
+					"is_external": {Name: "is_external", DataType: "boolean", Nullable: "YES", Type: "boolean"},
 				}},
-			Counter: &counter{Name: "test.rid", Colname: "rid"},
+			Counter: &counter{Schema: "test", Name: "rid", Colname: "rid"},
 		}
 
 		if diff := cmp.Diff(expectedContactTable, cloneDdl.clonedTables["contacts"], idxOpt, ruleOpt, sortStringSlice); diff != "" {
@@ -81,50 +90,54 @@ func TestCreateCloneDatabase(t *testing.T) {
 		}
 
 		expectedUserTable := &clonedTable{
+			Namespace: "test",
 			Snapshot: &table{
-				Name: "userssnapshot",
+				Schema: "public",
+				Name:   "users",
 				Cols: map[string]column{
-					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO"},
-					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES"},
+					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO", Type: "bytea"},
+					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES", Type: "date"},
 				},
 				Indexes: []index{
 					{Name: "users_pkey", IndexDef: "CREATE UNIQUE INDEX users_pkey ON public.users USING btree (accountid)", IsUnique: true, ColumnNames: []string{"accountid"}},
 					{Name: "users_username_key", IndexDef: "CREATE UNIQUE INDEX users_username_key ON public.users USING btree (username)", IsUnique: true, ColumnNames: []string{"username"}}},
 				Rules: []rule{{Name: "prevent_update", Definition: "CREATE RULE prevent_update AS ON UPDATE TO public.users DO INSTEAD NOTHING;"}},
 				References: []reference{
-					{ConstraintName: "contacts_username_fkey", BeRefedTableName: "users", BeRefedColumnNames: []string{"username"}, ForeignKeyTableName: "contacts", ForeignKeyColumnNames: []string{"username"}},
+					{ConstraintName: "contacts_username_fkey", BeRefedTableSchema: "public", BeRefedTableName: "users", BeRefedColumnNames: []string{"username"}, ForeignKeyTableSchema: "public", ForeignKeyTableName: "contacts", ForeignKeyColumnNames: []string{"username"}, OnDelete: "NO ACTION", OnUpdate: "NO ACTION"},
 				},
 			},
 			Plus: &table{
-				Name: "test.usersplus",
+				Schema: "test",
+				Name:   "usersplus",
 				Cols: map[string]column{
-					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO"},
-					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES"},
+					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO", Type: "bytea"},
+					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES", Type: "date"},
 				},
 			},
-			Minus: &table{Name: "test.usersminus",
+			Minus: &table{Schema: "test", Name: "usersminus",
 				Cols: map[string]column{
-					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO"},
-					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES"},
+					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO", Type: "bytea"},
+					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES", Type: "date"},
 				},
 			},
 			View: &view{
-				Name: "users",
+				Schema: "test",
+				Name:   "users",
 				Cols: map[string]column{
-					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "YES"},
-					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "YES"},
-					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "YES"},
-					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES"},
+					"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "YES", Type: "character(12)"},
+					"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "YES", Type: "character varying(64)"},
+					"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "YES", Type: "bytea"},
+					"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES", Type: "date"},
 				},
-				Rules: []rule{{Name: "view_prevent_update", Definition: "CREATE RULE view_prevent_update AS ON UPDATE TO public.usersview DO INSTEAD NOTHING;"}},
+				Rules: []rule{{Name: "view_prevent_update", Definition: "CREATE RULE \"view_prevent_update\" AS ON UPDATE TO \"test\".\"users\" DO INSTEAD NOTHING;"}},
 			},
-			Counter: &counter{Name: "test.rid", Colname: "rid"},
+			Counter: &counter{Schema: "test", Name: "rid", Colname: "rid"},
 		}
 
 		if diff := cmp.Diff(expectedUserTable, cloneDdl.clonedTables["users"], idxOpt, ruleOpt, sortStringSlice); diff != "" {
@@ -143,3 +156,141 @@ func TestCreateCloneDatabase(t *testing.T) {
 
 	})
 }
+
+func TestCloneColumnTypes(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TYPE mood AS ENUM ('sad', 'ok', 'happy');
+	CREATE DOMAIN positive AS INT CHECK (VALUE > 0);
+	CREATE TABLE items (
+		id      INT PRIMARY KEY,
+		price   NUMERIC(12,2) NOT NULL DEFAULT 0.50,
+		tags    TEXT[],
+		feeling mood DEFAULT 'ok',
+		amount  positive,
+		created TIMESTAMPTZ(3) NOT NULL DEFAULT now(),
+		label   TEXT COLLATE "C"
+	);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := newDatabase(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneDdl, err := newCloneDdl(ctx, database, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloneDdl.close(ctx)
+	for _, table := range cloneDdl.clonedTables {
+		if err := createTriggers(ctx, connPool, table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	columns := func(t *testing.T, schema, name string) map[string]string {
+		rows, err := connPool.Query(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod), COALESCE(co.collname, ''), a.attnotnull, COALESCE(pg_get_expr(ad.adbin, ad.adrelid), '')
+		FROM pg_attribute a
+		JOIN pg_class r ON r.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = r.relnamespace
+		LEFT JOIN pg_collation co ON co.oid = a.attcollation
+		LEFT JOIN pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+		WHERE n.nspname = $1 AND r.relname = $2 AND a.attnum > 0 AND NOT a.attisdropped AND a.attname != 'rid'`, schema, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		cols := map[string]string{}
+		for rows.Next() {
+			var name, typ, collation, def string
+			var notNull bool
+			if err := rows.Scan(&name, &typ, &collation, &notNull, &def); err != nil {
+				t.Fatal(err)
+			}
+			cols[name] = fmt.Sprintf("%s collate=%s notnull=%t default=%s", typ, collation, notNull, def)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return cols
+	}
+
+	t.Run("StructuralCopy", func(t *testing.T) {
+		want := columns(t, "public", "items")
+		for _, name := range []string{"itemsplus", "itemsminus"} {
+			if diff := cmp.Diff(want, columns(t, "test", name)); diff != "" {
+				t.Errorf("%s (-want,+got):\n%s", name, diff)
+			}
+		}
+	})
+
+	t.Run("InsertDefaults", func(t *testing.T) {
+		_, err := connPool.Exec(ctx, `INSERT INTO test.items(id, tags, amount) VALUES (1, '{a,b}', 3);`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var price, feeling string
+		if err := connPool.QueryRow(ctx, `SELECT price::text, feeling::text FROM test.items WHERE id = 1`).Scan(&price, &feeling); err != nil {
+			t.Fatal(err)
+		}
+		if price != "0.50" || feeling != "ok" {
+			t.Errorf("defaults: got (%s, %s), want (0.50, ok)", price, feeling)
+		}
+		if _, err := connPool.Exec(ctx, `INSERT INTO test.items(id, amount) VALUES (2, -1);`); err == nil {
+			t.Error("inserted a value that violates the domain")
+		}
+	})
+}
+
+func TestBranchSchemaNames(t *testing.T) {
+	// the namespace and the schema of a branch schema cannot run into each other
+	if a, b := branchSchema("a", "b_c"), branchSchema("a_b", "c"); a == b {
+		t.Errorf("branch schemas of a.b_c and a_b.c are both %s", a)
+	}
+	if a, b := hooksSchema("a", publicSchema), branchSchema("a", "hooks"); a == b {
+		t.Errorf("hook schema of a and branch schema of a.hooks are both %s", a)
+	}
+
+	database := &database{Tables: map[string]*table{"users": {Schema: publicSchema, Name: "users"}}}
+	if err := checkSchemaNames("a_b", database); err != nil {
+		t.Error(err)
+	}
+	for _, namespace := range []string{"", "a$b"} {
+		if err := checkSchemaNames(namespace, database); err == nil {
+			t.Errorf("checkSchemaNames(%q) succeeded", namespace)
+		}
+	}
+	database.Tables["billing.invoices"] = &table{Schema: "bill$ing", Name: "invoices"}
+	if err := checkSchemaNames("a", database); err == nil {
+		t.Error("checkSchemaNames() of a schema with the separator succeeded")
+	}
+}
+
+func TestIndexQuery(t *testing.T) {
+	users := &table{Schema: publicSchema, Name: "users", Indexes: []index{
+		{Name: "users_pkey", IsUnique: true, ColumnNames: []string{"username"}},
+		{Name: "users_username_idx", ColumnNames: []string{"username"}},
+		{Name: "users_name_idx", ColumnNames: []string{"firstname", "lastname"}},
+	}}
+	plus := &table{Schema: "b1", Name: "usersplus"}
+	minus := &table{Schema: "b1", Name: "usersminus"}
+
+	want := `CREATE INDEX ON "b1"."usersplus" ("username");
+CREATE INDEX ON "b1"."usersminus" ("username");
+CREATE INDEX ON "b1"."usersplus" ("firstname", "lastname");
+CREATE INDEX ON "b1"."usersminus" ("firstname", "lastname");`
+	if diff := cmp.Diff(want, indexQuery(users, plus, minus)); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"golang.org/x/exp/maps"
 )
@@ -21,6 +22,9 @@ type Diff struct {
 	Baseline     []*Row // baseline
 	Experimental []*Row // experimental
 	ColNames     []string
+	SchemaDiff   *TableSchemaDiff // nil if the schemas are the same; otherwise the rows are compared on the shared columns
+	Changes      *ChangeSet       // the rows by primary key, compared by Matcher; nil if the table has none
+	Matcher      *ColumnMatcher   // compares the values by the diff rules of the table; nil if it has none
 }
 
 type diffType int
@@ -39,38 +43,101 @@ func (d diffType) String() string {
 	return [...]string{"APlusOnly", "BPlusOnly", "APlusBPlus", "AMinusOnly", "BMinusOnly", "AMinusBMinus", "PrimaryKey"}[d-1]
 }
 
+// relation is a set of rows the diff reads. The diff reads the relations it
+// derives as common table expressions of its queries, so that it creates
+// nothing in the database and concurrent diffs cannot collide.
+type relation struct {
+	Name  string // name of the common table expression, unique within a diff
+	Table string // quoted name of the table or view the relation is, instead of a query
+	Query string // query over the relations in Deps
+	Cols  map[string]column
+	Deps  []*relation
+}
+
+func (r *relation) qualifiedName() string {
+	if r.Table != "" {
+		return r.Table
+	}
+	return quoteIdent(r.Name)
+}
+
+// tableRelation returns the relation of the rows of the table or view name,
+// which is quoted.
+func tableRelation(name string, cols map[string]column) *relation {
+	return &relation{Table: name, Cols: cols}
+}
+
+// with returns the WITH clause that defines r and the relations it reads,
+// each before the relations that read it.
+func (r *relation) with() (string, error) {
+	var ctes []string
+	defined := map[string]*relation{}
+	var define func(r *relation) error
+	define = func(r *relation) error {
+		if r.Table != "" {
+			return nil
+		}
+		if other, ok := defined[r.Name]; ok {
+			if other != r {
+				return fmt.Errorf("relation %s is defined twice", r.Name)
+			}
+			return nil
+		}
+		defined[r.Name] = r
+		for _, dep := range r.Deps {
+			if err := define(dep); err != nil {
+				return err
+			}
+		}
+		ctes = append(ctes, fmt.Sprintf("%s AS (%s)", r.qualifiedName(), r.Query))
+		return nil
+	}
+	if err := define(r); err != nil {
+		return "", err
+	}
+	if len(ctes) == 0 {
+		return "", nil
+	}
+	return "WITH " + strings.Join(ctes, ",\n"), nil
+}
+
 type clonedTableAtN struct {
 	Snapshot *table
-	Plus     *view
-	Minus    *view
+	Plus     *relation
+	Minus    *relation
 	View     *view
 	Counter  *counter
 }
 
 type dbDiff struct {
 	connPool   *pgxpool.Pool
+	conn       queryer // the read-only transaction of the diff, or connPool outside of one
 	counterCol string
+	ignored    map[string]bool // the columns the diff leaves out, see DiffRules
 }
 
 func newDbDiff(connPool *pgxpool.Pool, counterCol string) *dbDiff {
-	return &dbDiff{connPool: connPool, counterCol: counterCol}
+	return &dbDiff{connPool: connPool, conn: connPool, counterCol: counterCol}
 }
 
-// dump dumps rows in view without any order.
-// if a view already be sorted, the function will dump ordered view.
-func (d *dbDiff) dumpView(ctx context.Context, view *view) ([]*Row, []string, error) {
+// dump dumps rows of the relation in the order the relation has them.
+func (d *dbDiff) dump(ctx context.Context, r *relation) ([]*Row, []string, error) {
 	var dumpRows []*Row
 	var colNames []string
 
-	for n := range view.Cols {
+	for n := range r.Cols {
 		colNames = append(colNames, n)
 	}
 
 	// TODO: sort the columns for where they defined. Sort the primary keys by orders
 	sort.Strings(colNames)
-	query := fmt.Sprintf("SELECT %s FROM %s;", strings.Join(colNames, ", "), view.Name)
+	with, err := r.with()
+	if err != nil {
+		return nil, nil, err
+	}
+	query := fmt.Sprintf("%s\nSELECT %s FROM %s;", with, identList("", colNames), r.qualifiedName())
 
-	rows, err := d.connPool.Query(ctx, query)
+	rows, err := d.conn.Query(ctx, query)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -94,15 +161,15 @@ func (d *dbDiff) dumpView(ctx context.Context, view *view) ([]*Row, []string, er
 	return dumpRows, colNames, rows.Err()
 }
 
-func (d *dbDiff) trimClonedTable(ctx context.Context, clonedTable *clonedTableAtN) (*view, *view, error) {
+func (d *dbDiff) trimClonedTable(clonedTable *clonedTableAtN) (*relation, *relation, error) {
 	trimPlusName := clonedTable.Plus.Name + "trim"
-	trimPlus, err := d.minusViews(ctx, clonedTable.Plus, clonedTable.Minus, trimPlusName)
+	trimPlus, err := d.minus(clonedTable.Plus, clonedTable.Minus, trimPlusName)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	trimMinusName := clonedTable.Minus.Name + "trim"
-	trimMinus, err := d.minusViews(ctx, clonedTable.Minus, clonedTable.Plus, trimMinusName)
+	trimMinus, err := d.minus(clonedTable.Minus, clonedTable.Plus, trimMinusName)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -110,52 +177,51 @@ func (d *dbDiff) trimClonedTable(ctx context.Context, clonedTable *clonedTableAt
 	return trimPlus, trimMinus, nil
 }
 
-func (d *dbDiff) combine(ctx context.Context, name, a string, acolumns map[string]column, operation string, b string, bcolumns map[string]column) (*view, error) {
-	if !reflect.DeepEqual(acolumns, bcolumns) {
-		return nil, fmt.Errorf("relations %s and %s have different columns and cannot be combined", a, b)
+// combine returns the relation name of the rows of a and b combined by the
+// set operation.
+func (d *dbDiff) combine(name string, a *relation, operation string, b *relation) (*relation, error) {
+	if !reflect.DeepEqual(a.Cols, b.Cols) {
+		return nil, fmt.Errorf("relations %s and %s have different columns and cannot be combined", a.qualifiedName(), b.qualifiedName())
 	}
 
-	columnNames := maps.Keys(acolumns)
+	columnNames := maps.Keys(a.Cols)
 	sort.Strings(columnNames)
-	joined := strings.Join(columnNames, ", ")
-	query := fmt.Sprintf(`                                                                                                                                                                           
-	CREATE VIEW %s AS (                                                                                                                                                                              
-		SELECT %s FROM %s                                                                                                                                                                        
-		%s                                                                                  
-		SELECT %s FROM %s                                                                                                                                                                        
-		ORDER BY %s                                                                                                                                                                              
-	);                                                                                                                                                                                               
-	`, name, joined, a, operation, joined, b, joined)
-	_, err := d.connPool.Exec(ctx, query)
-	return &view{Name: name, Cols: acolumns}, err
+	joined := identList("", columnNames)
+	query := fmt.Sprintf(`
+		SELECT %s FROM %s
+		%s
+		SELECT %s FROM %s
+		ORDER BY %s
+	`, joined, a.qualifiedName(), operation, joined, b.qualifiedName(), joined)
+	return &relation{Name: name, Query: query, Cols: a.Cols, Deps: []*relation{a, b}}, nil
 }
 
-func (d *dbDiff) minusViews(ctx context.Context, viewA *view, viewB *view, viewName string) (*view, error) {
-	return d.combine(ctx, viewName, viewA.Name, viewA.Cols, "EXCEPT ALL", viewB.Name, viewB.Cols)
+func (d *dbDiff) minus(a *relation, b *relation, name string) (*relation, error) {
+	return d.combine(name, a, "EXCEPT ALL", b)
 }
 
-func (d *dbDiff) intersectViews(ctx context.Context, viewA *view, viewB *view, viewName string) (*view, error) {
-	return d.combine(ctx, viewName, viewA.Name, viewA.Cols, "INTERSECT ALL", viewB.Name, viewB.Cols)
+func (d *dbDiff) intersect(a *relation, b *relation, name string) (*relation, error) {
+	return d.combine(name, a, "INTERSECT ALL", b)
 }
 
-func (d *dbDiff) unionViews(ctx context.Context, viewA *view, viewB *view, viewName string) (*view, error) {
-	return d.combine(ctx, viewName, viewA.Name, viewA.Cols, "UNION ALL", viewB.Name, viewB.Cols)
+func (d *dbDiff) union(a *relation, b *relation, name string) (*relation, error) {
+	return d.combine(name, a, "UNION ALL", b)
 }
 
-func (d *dbDiff) unionUniqueViews(ctx context.Context, viewA *view, viewB *view, viewName string) (*view, error) {
-	return d.combine(ctx, viewName, viewA.Name, viewA.Cols, "UNION", viewB.Name, viewB.Cols)
+func (d *dbDiff) unionUnique(a *relation, b *relation, name string) (*relation, error) {
+	return d.combine(name, a, "UNION", b)
 }
 
-func (d *dbDiff) minusTables(ctx context.Context, tableA *table, tableB *table, tableName string) (*view, error) {
-	return d.combine(ctx, tableName, tableA.Name, tableA.Cols, "EXCEPT ALL", tableB.Name, tableB.Cols)
+func (d *dbDiff) minusTables(tableA *table, tableB *table, name string) (*relation, error) {
+	return d.minus(tableRelation(tableA.qualifiedName(), tableA.Cols), tableRelation(tableB.qualifiedName(), tableB.Cols), name)
 }
 
-func (d *dbDiff) intersectTables(ctx context.Context, tableA *table, tableB *table, tableName string) (*view, error) {
-	return d.combine(ctx, tableName, tableA.Name, tableA.Cols, "INTERSECT ALL", tableB.Name, tableB.Cols)
+func (d *dbDiff) intersectTables(tableA *table, tableB *table, name string) (*relation, error) {
+	return d.intersect(tableRelation(tableA.qualifiedName(), tableA.Cols), tableRelation(tableB.qualifiedName(), tableB.Cols), name)
 }
 
-func (d *dbDiff) unionTables(ctx context.Context, tableA *table, tableB *table, tableName string) (*view, error) {
-	return d.combine(ctx, tableName, tableA.Name, tableA.Cols, "UNION ALL", tableB.Name, tableB.Cols)
+func (d *dbDiff) unionTables(tableA *table, tableB *table, name string) (*relation, error) {
+	return d.union(tableRelation(tableA.qualifiedName(), tableA.Cols), tableRelation(tableB.qualifiedName(), tableB.Cols), name)
 }
 
 // getPrimaryKeyCols returns primary key if there is any, if cannot find, it returns empty list.
@@ -169,22 +235,14 @@ func (d *dbDiff) getPrimaryKeyCols(table *table) []string {
 	return nil
 }
 
-func (d *dbDiff) getPrimarKeyRows(ctx context.Context, aPlus *view, bPlus *view, aMinus *view, bMinus *view, clonedTableA *clonedTableAtN, cloneTableB *clonedTableAtN) (*view, error) {
-	var colNames []string
+func (d *dbDiff) getPrimarKeyRows(aPlus *relation, bPlus *relation, aMinus *relation, bMinus *relation, clonedTableA *clonedTableAtN, cloneTableB *clonedTableAtN) (*relation, error) {
 	if !reflect.DeepEqual(clonedTableA.View.Cols, cloneTableB.View.Cols) {
 		return nil, fmt.Errorf("viewA %v and viewB %v have different columns, cannot union", clonedTableA.View.Cols, cloneTableB.View.Cols)
 	}
-	for n := range aPlus.Cols {
-		colNames = append(colNames, n)
-	}
-	sort.Strings(colNames)
-
-	viewName := clonedTableA.Snapshot.Name + "AUnionB"
 
 	primaryCols := d.getPrimaryKeyCols(clonedTableA.Snapshot)
 
 	query := fmt.Sprintf(`
-	CREATE VIEW %s AS (
 	SELECT DISTINCT(%s) FROM 
 	(
 		SELECT %s FROM %s
@@ -195,46 +253,37 @@ func (d *dbDiff) getPrimarKeyRows(ctx context.Context, aPlus *view, bPlus *view,
 		UNION ALL
 		SELECT %s FROM %s
 	) as keys
-	ORDER BY %s);
-	`, viewName, strings.Join(primaryCols, ","), strings.Join(primaryCols, ","), aPlus.Name, strings.Join(primaryCols, ","), aMinus.Name, strings.Join(primaryCols, ","), bPlus.Name, strings.Join(primaryCols, ","), bMinus.Name, strings.Join(primaryCols, ","))
-
-	if _, err := d.connPool.Exec(ctx, query); err != nil {
-		return nil, err
-	}
+	ORDER BY %s
+	`, identList("", primaryCols), identList("", primaryCols), aPlus.qualifiedName(), identList("", primaryCols), aMinus.qualifiedName(), identList("", primaryCols), bPlus.qualifiedName(), identList("", primaryCols), bMinus.qualifiedName(), identList("", primaryCols))
 
 	cols := map[string]column{}
 	for _, colName := range primaryCols {
 		cols[colName] = clonedTableA.View.Cols[colName]
 	}
-	return &view{Name: viewName, Cols: cols}, nil
+	return &relation{Name: clonedTableA.Snapshot.Name + "AUnionB", Query: query, Cols: cols, Deps: []*relation{aPlus, aMinus, bPlus, bMinus}}, nil
 }
 
-func (d *dbDiff) getRowsByPrimaryKey(ctx context.Context, primaryKeyView *view, sideView *view, viewName string) (*view, error) {
+func (d *dbDiff) getRowsByPrimaryKey(primaryKeys *relation, side *relation, name string) *relation {
 	var viewColQuery, primaryKeyColNames, primarySideColNames []string
-	for n := range primaryKeyView.Cols {
-		primaryKeyColNames = append(primaryKeyColNames, primaryKeyView.Name+"."+n)
-		primarySideColNames = append(primarySideColNames, sideView.Name+"."+n)
-		viewColQuery = append(viewColQuery, fmt.Sprintf("%s.%s AS %s_pkey", primaryKeyView.Name, n, n))
+	for n := range primaryKeys.Cols {
+		primaryKeyColNames = append(primaryKeyColNames, primaryKeys.qualifiedName()+"."+quoteIdent(n))
+		primarySideColNames = append(primarySideColNames, side.qualifiedName()+"."+quoteIdent(n))
+		viewColQuery = append(viewColQuery, fmt.Sprintf("%s.%s AS %s", primaryKeys.qualifiedName(), quoteIdent(n), quoteIdent(n+"_pkey")))
 	}
 
 	var sideColNames []string
-	for n := range sideView.Cols {
-		sideColNames = append(sideColNames, sideView.Name+"."+n)
+	for n := range side.Cols {
+		sideColNames = append(sideColNames, side.qualifiedName()+"."+quoteIdent(n))
 	}
 	viewColQuery = append(viewColQuery, sideColNames...)
 
 	query := fmt.Sprintf(`
-	CREATE VIEW %s AS (
 		SELECT %s
-		FROM %s LEFT JOIN %s ON %s = %s
-		ORDER BY %s);
-	`, viewName, strings.Join(viewColQuery, ","), primaryKeyView.Name, sideView.Name, strings.Join(primaryKeyColNames, ","), strings.Join(primarySideColNames, ","), strings.Join(primaryKeyColNames, ","))
-
-	if _, err := d.connPool.Exec(ctx, query); err != nil {
-		return nil, err
-	}
+		FROM %s LEFT JOIN %s ON (%s) = (%s)
+		ORDER BY %s
+	`, strings.Join(viewColQuery, ","), primaryKeys.qualifiedName(), side.qualifiedName(), strings.Join(primaryKeyColNames, ","), strings.Join(primarySideColNames, ","), strings.Join(primaryKeyColNames, ","))
 
-	return &view{Name: viewName, Cols: sideView.Cols}, nil
+	return &relation{Name: name, Query: query, Cols: side.Cols, Deps: []*relation{primaryKeys, side}}
 }
 
 func (d *dbDiff) fillRowSlices(val []any, length int) []*Row {
@@ -266,38 +315,34 @@ func (d *dbDiff) fillRowSlices(val []any, length int) []*Row {
 //	nil     | A- \cap B- | nil
 //	nil     | A- - B-    | A- - B-
 func (d *dbDiff) getNonPrimaryKeyRowDiff(ctx context.Context, clonedTableA *clonedTableAtN, clonedTableB *clonedTableAtN) (*Diff, error) {
-	if !reflect.DeepEqual(clonedTableA.View.Cols, clonedTableA.View.Cols) {
-		return nil, fmt.Errorf("viewA %v and viewB %v have different columns, cannot intersect", clonedTableA.View.Cols, clonedTableA.View.Cols)
+	if !reflect.DeepEqual(clonedTableA.View.Cols, clonedTableB.View.Cols) {
+		return nil, fmt.Errorf("viewA %v and viewB %v have different columns, cannot intersect", clonedTableA.View.Cols, clonedTableB.View.Cols)
 	}
 	rowDiffs := map[diffType]*Diff{}
 
-	var views []*view
 	// trim cloned table A
 
-	aPlus, aMinus, err := d.trimClonedTable(ctx, clonedTableA)
+	aPlus, aMinus, err := d.trimClonedTable(clonedTableA)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, aPlus, aMinus)
 
 	// trim cloned table B
-	bPlus, bMinus, err := d.trimClonedTable(ctx, clonedTableB)
+	bPlus, bMinus, err := d.trimClonedTable(clonedTableB)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, bPlus, bMinus)
 
 	prefix := clonedTableA.Snapshot.Name
 	// A+ - B+
-	aPlusOnly, err := d.minusViews(ctx, aPlus, bPlus, prefix+"aPlusOnly")
+	aPlusOnly, err := d.minus(aPlus, bPlus, prefix+"aPlusOnly")
 	if err != nil {
 		return nil, err
 	}
-	aPlusRows, colNames, err := d.dumpView(ctx, aPlusOnly)
+	aPlusRows, colNames, err := d.dump(ctx, aPlusOnly)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, aPlusOnly)
 
 	// TODO: switch to a single nil value rather than a row of nils
 	nilRow := make([]any, len(colNames))
@@ -307,87 +352,75 @@ func (d *dbDiff) getNonPrimaryKeyRowDiff(ctx context.Context, clonedTableA *clon
 	rowDiffs[APlusOnly] = aPlusDiff
 
 	// A+ intersect B+
-	aPlusBPlus, err := d.intersectViews(ctx, aPlus, bPlus, prefix+"aPlusBPlus")
+	aPlusBPlus, err := d.intersect(aPlus, bPlus, prefix+"aPlusBPlus")
 	if err != nil {
 		return nil, err
 	}
 
-	aPlusBPlusRows, colNames, err := d.dumpView(ctx, aPlusBPlus)
+	aPlusBPlusRows, colNames, err := d.dump(ctx, aPlusBPlus)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, aPlusBPlus)
 
 	nilSlices = d.fillRowSlices(nilRow, len(aPlusBPlusRows))
 	aPlusBPlusRowsRowDiff := &Diff{Control: aPlusBPlusRows, Baseline: nilSlices, Experimental: aPlusBPlusRows, ColNames: colNames}
 	rowDiffs[APlusBPlus] = aPlusBPlusRowsRowDiff
 
 	// B+ - A+
-	bPlusOnly, err := d.minusViews(ctx, bPlus, aPlus, prefix+"bPlusOnly")
+	bPlusOnly, err := d.minus(bPlus, aPlus, prefix+"bPlusOnly")
 	if err != nil {
 		return nil, err
 	}
 
-	bPlusRows, colNames, err := d.dumpView(ctx, bPlusOnly)
+	bPlusRows, colNames, err := d.dump(ctx, bPlusOnly)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, bPlusOnly)
 
 	nilSlices = d.fillRowSlices(nilRow, len(bPlusRows))
 	bPlusDiff := &Diff{Control: nilSlices, Baseline: nilSlices, Experimental: bPlusRows, ColNames: colNames}
 	rowDiffs[BPlusOnly] = bPlusDiff
 
 	// B- - A-
-	bMinusOnly, err := d.minusViews(ctx, bMinus, aMinus, prefix+"bMinusOnly")
+	bMinusOnly, err := d.minus(bMinus, aMinus, prefix+"bMinusOnly")
 	if err != nil {
 		return nil, err
 	}
-	bMinusRows, colNames, err := d.dumpView(ctx, bMinusOnly)
+	bMinusRows, colNames, err := d.dump(ctx, bMinusOnly)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, bMinusOnly)
 
 	nilSlices = d.fillRowSlices(nilRow, len(bMinusRows))
 	bMinusDiff := &Diff{Control: bMinusRows, Baseline: bMinusRows, Experimental: nilSlices, ColNames: colNames}
 	rowDiffs[BMinusOnly] = bMinusDiff
 
 	// B- intersect A-
-	aMinusBMinus, err := d.intersectViews(ctx, aMinus, bMinus, prefix+"aMinusBMinus")
+	aMinusBMinus, err := d.intersect(aMinus, bMinus, prefix+"aMinusBMinus")
 	if err != nil {
 		return nil, err
 	}
-	aMinusbMinusRows, colNames, err := d.dumpView(ctx, aMinusBMinus)
+	aMinusbMinusRows, colNames, err := d.dump(ctx, aMinusBMinus)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, aMinusBMinus)
 	nilSlices = d.fillRowSlices(nilRow, len(aMinusbMinusRows))
 	aMinusbMinusDiff := &Diff{Control: nilSlices, Baseline: aMinusbMinusRows, Experimental: nilSlices, ColNames: colNames}
 	rowDiffs[AMinusBMinus] = aMinusbMinusDiff
 
 	// A- - B-
-	aMinusOnly, err := d.minusViews(ctx, aMinus, bMinus, prefix+"aMinusOnly")
+	aMinusOnly, err := d.minus(aMinus, bMinus, prefix+"aMinusOnly")
 	if err != nil {
 		return nil, err
 	}
-	aMinusRows, colNames, err := d.dumpView(ctx, aMinusOnly)
+	aMinusRows, colNames, err := d.dump(ctx, aMinusOnly)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, aMinusOnly)
 	nilSlices = d.fillRowSlices(nilRow, len(aMinusRows))
 	aMinusDiff := &Diff{Control: nilSlices, Baseline: aMinusRows, Experimental: aMinusRows, ColNames: colNames}
 	rowDiffs[AMinusOnly] = aMinusDiff
 
-	// drop all views in reverse order because of dependency
-	for i := len(views) - 1; i >= 0; i-- {
-		if err = dropView(ctx, d.connPool, views[i].Name); err != nil {
-			return nil, err
-		}
-	}
-
 	diff := &Diff{ColNames: colNames}
 	diffTypes := []diffType{APlusOnly, BPlusOnly, APlusBPlus, AMinusOnly, BMinusOnly, AMinusBMinus}
 	for _, d := range diffTypes {
@@ -408,103 +441,72 @@ func (d *dbDiff) getNonPrimaryKeyRowDiff(ctx context.Context, clonedTableA *clon
 // because primary key is unique, so for each way there should be only one row with same primary key
 func (d *dbDiff) getPrimaryKeyRowDiff(ctx context.Context, clonedTableA *clonedTableAtN, clonedTableB *clonedTableAtN) (*Diff, error) {
 	if !reflect.DeepEqual(clonedTableA.View.Cols, clonedTableB.View.Cols) {
-		return nil, fmt.Errorf("viewA %v and viewB %v have different columns, cannot diff", clonedTableA.View.Cols, clonedTableA.View.Cols)
+		return nil, fmt.Errorf("viewA %v and viewB %v have different columns, cannot diff", clonedTableA.View.Cols, clonedTableB.View.Cols)
 	}
-	var views []*view
 
 	// trim cloned table A
-	aPlus, aMinus, err := d.trimClonedTable(ctx, clonedTableA)
+	aPlus, aMinus, err := d.trimClonedTable(clonedTableA)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, aPlus, aMinus)
 
 	// trim cloned table B
-	bPlus, bMinus, err := d.trimClonedTable(ctx, clonedTableB)
+	bPlus, bMinus, err := d.trimClonedTable(clonedTableB)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, bPlus, bMinus)
 
-	primaryKeyView, err := d.getPrimarKeyRows(ctx, aPlus, bPlus, aMinus, bMinus, clonedTableA, clonedTableB)
+	primaryKeys, err := d.getPrimarKeyRows(aPlus, bPlus, aMinus, bMinus, clonedTableA, clonedTableB)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, primaryKeyView)
 
 	prefix := clonedTableA.Snapshot.Name
 
-	bMinusAMinus, err := d.minusViews(ctx, bMinus, aMinus, prefix+"BMinusAMinus")
+	bMinusAMinus, err := d.minus(bMinus, aMinus, prefix+"BMinusAMinus")
 	if err != nil {
 		return nil, err
 	}
 
-	aMinusBMinus, err := d.minusViews(ctx, aMinus, bMinus, prefix+"AMinusBMinus")
+	aMinusBMinus, err := d.minus(aMinus, bMinus, prefix+"AMinusBMinus")
 	if err != nil {
 		return nil, err
 	}
 
-	aMinusIntersectBMinus, err := d.intersectViews(ctx, aMinus, bMinus, prefix+"AMinusIntersectBMinus")
-	if err != nil {
-		return nil, err
-	}
-	views = append(views, bMinusAMinus, aMinusBMinus, aMinusIntersectBMinus)
-
 	// Control: A+, B- - A-
-	leftSideView, err := d.unionViews(ctx, aPlus, bMinusAMinus, prefix+"leftView")
+	leftSideView, err := d.union(aPlus, bMinusAMinus, prefix+"leftView")
 	if err != nil {
 		return nil, err
 	}
 
-	leftSideDiff, err := d.getRowsByPrimaryKey(ctx, primaryKeyView, leftSideView, prefix+"leftDiff")
-	if err != nil {
-		return nil, err
-	}
-	leftSideRows, colNames, err := d.dumpView(ctx, leftSideDiff)
+	leftSideDiff := d.getRowsByPrimaryKey(primaryKeys, leftSideView, prefix+"leftDiff")
+	leftSideRows, colNames, err := d.dump(ctx, leftSideDiff)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, leftSideView, leftSideDiff)
 
 	// Experimental: B+, A- - B-
-	rightSideView, err := d.unionViews(ctx, bPlus, aMinusBMinus, prefix+"rightView")
+	rightSideView, err := d.union(bPlus, aMinusBMinus, prefix+"rightView")
 	if err != nil {
 		return nil, err
 	}
-	rightSideDiff, err := d.getRowsByPrimaryKey(ctx, primaryKeyView, rightSideView, prefix+"rightDiff")
+	rightSideDiff := d.getRowsByPrimaryKey(primaryKeys, rightSideView, prefix+"rightDiff")
+	rightSideRows, _, err := d.dump(ctx, rightSideDiff)
 	if err != nil {
 		return nil, err
 	}
-	rightSideRows, _, err := d.dumpView(ctx, rightSideDiff)
-	if err != nil {
-		return nil, err
-	}
-	views = append(views, rightSideView, rightSideDiff)
 
-	middleSideView, err := d.unionUniqueViews(ctx, aMinus, bMinus, prefix+"middleView")
-	if err != nil {
-		return nil, err
-	}
-	middleSideDiff, err := d.getRowsByPrimaryKey(ctx, primaryKeyView, middleSideView, prefix+"middleDiff")
+	middleSideView, err := d.unionUnique(aMinus, bMinus, prefix+"middleView")
 	if err != nil {
 		return nil, err
 	}
-	middleSideRows, _, err := d.dumpView(ctx, middleSideDiff)
+	middleSideDiff := d.getRowsByPrimaryKey(primaryKeys, middleSideView, prefix+"middleDiff")
+	middleSideRows, _, err := d.dump(ctx, middleSideDiff)
 	if err != nil {
 		return nil, err
 	}
-	views = append(views, middleSideView, middleSideDiff)
-
-	rowDiff := &Diff{Control: leftSideRows, Experimental: rightSideRows, Baseline: middleSideRows, ColNames: colNames}
 
-	// drop all views in reverse order because of dependency
-	for i := len(views) - 1; i >= 0; i-- {
-		if err = dropView(ctx, d.connPool, views[i].Name); err != nil {
-			return nil, err
-		}
-	}
-
-	return rowDiff, nil
+	return &Diff{Control: leftSideRows, Experimental: rightSideRows, Baseline: middleSideRows, ColNames: colNames}, nil
 }
 
 func (d *dbDiff) getClonedTableRowDiff(ctx context.Context, clonedTableA *clonedTableAtN, clonedTableB *clonedTableAtN) (*Diff, error) {
@@ -520,58 +522,204 @@ func (d *dbDiff) getClonedTableRowDiff(ctx context.Context, clonedTableA *cloned
 	return d.getPrimaryKeyRowDiff(ctx, clonedTableA, clonedTableB)
 }
 
-func (d *dbDiff) getclonedTablesAtNReqs(ctx context.Context, clonedTableA *clonedTable, clonedTableB *clonedTable, n int) (*clonedTableAtN, *clonedTableAtN, error) {
-	tables := []*table{clonedTableA.Plus, clonedTableA.Minus, clonedTableB.Plus, clonedTableB.Minus}
-	for _, t := range tables {
-		query := fmt.Sprintf(`                                                                                                                                                                           
-		CREATE OR REPLACE VIEW %s AS (                                                                                                                                                                              
-			SELECT * FROM %s                                                                                                                                                                                                                                                                                                                                           
-			where %s <= %d
-			ORDER BY %s                                                                                                                                                                              
-		);                                                                                                                                                                                               
-		`, fmt.Sprintf("%s%d", t.Name, n), t.Name, clonedTableA.Counter.Colname, n, clonedTableA.Counter.Colname)
+// commonAncestor returns the deepest cloned table that both a and b are forked
+// from, excluding a and b themselves. It returns nil if a and b only share the
+// production table.
+func commonAncestor(a *clonedTable, b *clonedTable) *clonedTable {
+	ancestors := map[*clonedTable]bool{}
+	for t := a.Parent; t != nil; t = t.Parent {
+		ancestors[t] = true
+	}
+	for t := b.Parent; t != nil; t = t.Parent {
+		if ancestors[t] {
+			return t
+		}
+	}
+	return nil
+}
 
-		if _, err := d.connPool.Exec(ctx, query); err != nil {
-			return nil, nil, err
+// inBranchOf returns the cloned table t is forked from in the branch of
+// base, or nil if base is nil or t is not forked from it.
+func inBranchOf(t *clonedTable, base *clonedTable) *clonedTable {
+	if base == nil {
+		return nil
+	}
+	for p := t.Parent; p != nil; p = p.Parent {
+		if p.Namespace == base.Namespace {
+			return p
+		}
+	}
+	return nil
+}
+
+// ancestorsUntil returns the cloned tables t is forked from, from its parent up
+// to base exclusive.
+func ancestorsUntil(t *clonedTable, base *clonedTable) []*clonedTable {
+	var ancestors []*clonedTable
+	for p := t.Parent; p != base; p = p.Parent {
+		ancestors = append(ancestors, p)
+	}
+	return ancestors
+}
+
+// deltaAtN returns the relation name of the rows of the own tables written
+// by the first n requests, together with all rows of the ancestor tables.
+// Because R' of a forked branch is its parent's R' plus its own R+ minus its
+// own R-, the union of the R+ (or R-) tables along the chain is the branch's
+// R+ (or R-) relative to the common base.
+func (d *dbDiff) deltaAtN(name string, cols map[string]column, own []*table, ancestors []*table, n int) *relation {
+	colNames := maps.Keys(cols)
+	sort.Strings(colNames)
+	colNames = append(colNames, d.counterCol)
+	selectCols := identList("", colNames)
+
+	var selects []string
+	for _, t := range own {
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM %s WHERE %s <= %d", selectCols, t.qualifiedName(), quoteIdent(d.counterCol), n))
+	}
+	// the rows of the ancestors were written before the first request
+	ancestorCols := identList("", colNames[:len(colNames)-1]) + ", -1 AS " + quoteIdent(d.counterCol)
+	for _, t := range ancestors {
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM %s", ancestorCols, t.qualifiedName()))
+	}
+	// none of the tables was written in a lazy branch
+	if len(selects) == 0 {
+		var nulls []string
+		for _, name := range colNames[:len(colNames)-1] {
+			nulls = append(nulls, fmt.Sprintf("NULL::%s AS %s", columnType(cols[name]), quoteIdent(name)))
 		}
+		nulls = append(nulls, "NULL::bigint AS "+quoteIdent(d.counterCol))
+		selects = append(selects, fmt.Sprintf("SELECT %s WHERE false", strings.Join(nulls, ", ")))
 	}
 
-	updatedA := &clonedTableAtN{
-		Counter: clonedTableA.Counter,
-		Plus: &view{
-			Name: fmt.Sprintf("%s%d", clonedTableA.Plus.Name, n),
-			Cols: clonedTableA.Plus.Cols,
-		},
-		Minus: &view{
-			Name: fmt.Sprintf("%s%d", clonedTableA.Minus.Name, n),
-			Cols: clonedTableA.Minus.Cols,
-		},
-		View:     clonedTableA.View,
-		Snapshot: clonedTableA.Snapshot,
-	}
-
-	updatedB := &clonedTableAtN{
-		Counter: clonedTableB.Counter,
-		Plus: &view{
-			Name: fmt.Sprintf("%s%d", clonedTableB.Plus.Name, n),
-			Cols: clonedTableB.Plus.Cols,
-		},
-		Minus: &view{
-			Name: fmt.Sprintf("%s%d", clonedTableB.Minus.Name, n),
-			Cols: clonedTableB.Minus.Cols,
-		},
-		View:     clonedTableB.View,
-		Snapshot: clonedTableB.Snapshot,
+	query := fmt.Sprintf(`
+		%s
+		ORDER BY %s
+	`, strings.Join(selects, "\n\t\tUNION ALL\n\t\t"), quoteIdent(d.counterCol))
+	return &relation{Name: name, Query: query, Cols: cols}
+}
+
+// getclonedTableAtNReqs returns the R+/R- of clonedTable after n requests
+// relative to base, restricted to cols. The rows of the tables that inherit
+// from clonedTable, or of its partitions, are rows of clonedTable too. The
+// names of the relations start with side, which tells the two sides of a
+// diff apart.
+func (d *dbDiff) getclonedTableAtNReqs(ctx context.Context, clonedTable *clonedTable, base *clonedTable, cols map[string]column, n int, side string) (*clonedTableAtN, error) {
+	var plusOwn, minusOwn, plusAncestors, minusAncestors []*table
+	for _, m := range members(clonedTable) {
+		// a table of a lazy branch that was never written has no R+/R-
+		if ok, err := materialized(ctx, d.conn, m); err != nil {
+			return nil, err
+		} else if ok {
+			plusOwn = append(plusOwn, m.Plus)
+			minusOwn = append(minusOwn, m.Minus)
+		}
+		for _, t := range ancestorsUntil(m, inBranchOf(m, base)) {
+			if ok, err := materialized(ctx, d.conn, t); err != nil {
+				return nil, err
+			} else if ok {
+				plusAncestors = append(plusAncestors, t.Plus)
+				minusAncestors = append(minusAncestors, t.Minus)
+			}
+		}
+	}
+
+	plus := d.deltaAtN(fmt.Sprintf("%s%s%d", side, clonedTable.Plus.Name, n), cols, plusOwn, plusAncestors, n)
+	minus := d.deltaAtN(fmt.Sprintf("%s%s%d", side, clonedTable.Minus.Name, n), cols, minusOwn, minusAncestors, n)
+
+	// the indexes on columns that are not compared do not identify the rows
+	snapshot := &table{Schema: clonedTable.Snapshot.Schema, Name: clonedTable.Snapshot.Name, Cols: cols}
+	for _, idx := range clonedTable.Snapshot.Indexes {
+		compared := true
+		for _, col := range idx.ColumnNames {
+			if _, ok := cols[col]; !ok {
+				compared = false
+			}
+		}
+		if compared {
+			snapshot.Indexes = append(snapshot.Indexes, idx)
+		}
+	}
+
+	return &clonedTableAtN{
+		Counter:  clonedTable.Counter,
+		Plus:     plus,
+		Minus:    minus,
+		View:     &view{Schema: clonedTable.View.Schema, Name: clonedTable.View.Name, Cols: cols},
+		Snapshot: snapshot,
+	}, nil
+}
+
+// getclonedTablesAtNReqs returns the R+/R- of A and B after n requests, both
+// relative to the deepest branch A and B are forked from and restricted to
+// the columns they share.
+func (d *dbDiff) getclonedTablesAtNReqs(ctx context.Context, clonedTableA *clonedTable, clonedTableB *clonedTable, base *clonedTable, cols map[string]column, n int) (*clonedTableAtN, *clonedTableAtN, error) {
+	updatedA, err := d.getclonedTableAtNReqs(ctx, clonedTableA, base, cols, n, "a")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updatedB, err := d.getclonedTableAtNReqs(ctx, clonedTableB, base, cols, n, "b")
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return updatedA, updatedB, nil
 }
 
+// comparableColumns returns the columns whose rows A and B can be compared
+// on: the columns of the same type in both, which every R+ and R- down to the
+// common base has.
+func comparableColumns(clonedTableA *clonedTable, clonedTableB *clonedTable, base *clonedTable) map[string]column {
+	var tables []*table
+	for _, t := range append(ancestorsUntil(clonedTableA, base), ancestorsUntil(clonedTableB, base)...) {
+		tables = append(tables, t.Plus, t.Minus)
+	}
+
+	cols := map[string]column{}
+	for name, a := range clonedTableA.View.Cols {
+		b, ok := clonedTableB.View.Cols[name]
+		if !ok || columnType(a) != columnType(b) || a.Collation != b.Collation {
+			continue
+		}
+		compared := true
+		for _, t := range tables {
+			if _, ok := t.Cols[name]; !ok {
+				compared = false
+			}
+		}
+		if compared {
+			cols[name] = a
+		}
+	}
+	return cols
+}
+
+// getClonedTableRowDiffAtNReqs diffs A and B after n requests. The diff reads
+// one snapshot of the branches in a read-only transaction. It returns nil if
+// neither branch wrote the table, see lazy_branch.go.
 func (d *dbDiff) getClonedTableRowDiffAtNReqs(ctx context.Context, clonedTableA *clonedTable, clonedTableB *clonedTable, n int) (*Diff, error) {
-	if !reflect.DeepEqual(clonedTableA.View.Cols, clonedTableB.View.Cols) {
-		return nil, fmt.Errorf("cannot get row diff for different cols, tableA %v, tableB %v ", clonedTableA.View.Cols, clonedTableB.View.Cols)
+	tx, err := d.connPool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
 	}
-	updatedA, updatedB, err := d.getclonedTablesAtNReqs(ctx, clonedTableA, clonedTableB, n)
+	defer tx.Rollback(ctx)
+	d = &dbDiff{connPool: d.connPool, conn: tx, counterCol: d.counterCol, ignored: d.ignored}
+
+	if written, err := diffWritten(ctx, d.conn, clonedTableA, clonedTableB); err != nil || !written {
+		return nil, err
+	}
+
+	base := commonAncestor(clonedTableA, clonedTableB)
+	cols := comparableColumns(clonedTableA, clonedTableB, base)
+	for col := range d.ignored {
+		delete(cols, col)
+	}
+	if len(cols) == 0 {
+		return &Diff{}, nil
+	}
+
+	updatedA, updatedB, err := d.getclonedTablesAtNReqs(ctx, clonedTableA, clonedTableB, base, cols, n)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cloned tables at n reqs, %w", err)
 	}
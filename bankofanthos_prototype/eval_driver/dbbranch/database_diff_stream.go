@@ -0,0 +1,302 @@
+// This file computes the diff of two branches request by request. Rather than
+// diffing the branches again after every request, it reads the R+/R- rows of
+// both branches once in rid order and keeps them by key in memory. After each
+// request it emits the diff of the keys the request wrote, computed the way
+// getPrimaryKeyRowDiff and getNonPrimaryKeyRowDiff compute it for the whole
+// table. The key of a table without a primary key is the whole row.
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/exp/maps"
+)
+
+// the R+/R- relations of a diff, in the order of diffKey.counts
+const (
+	aPlusSide = iota
+	aMinusSide
+	bPlusSide
+	bMinusSide
+)
+
+// diffSideCol names the column of the streamed rows that tells their side.
+const diffSideCol = "$side"
+
+// diffKey holds the rows of one key in R+/R- of A and B.
+type diffKey struct {
+	rows   map[string]Row    // the values of the rows by their text
+	texts  []string          // the texts of the rows in the order they were read
+	counts [4]map[string]int // the number of copies of each row text on each side
+}
+
+// trimmed returns the number of copies of the row text in R+ and R- of side
+// A (aPlusSide) or B (bPlusSide) after the rows both hold cancel out, the way
+// trimClonedTable trims them.
+func (k *diffKey) trimmed(plusSide int, text string) (int, int) {
+	plus, minus := k.counts[plusSide][text], k.counts[plusSide+1][text]
+	return max(0, plus-minus), max(0, minus-plus)
+}
+
+// diffStream applies the R+/R- rows of A and B request by request.
+type diffStream struct {
+	colNames []string
+	pkCols   []string // nil if the table has no primary key
+	keys     map[string]*diffKey
+	touched  []string // the keys the current request wrote, in the order they were read
+}
+
+// newDiffStream returns the stream of a table with colNames, whose primary
+// key is pkCols, or nil if it has none.
+func newDiffStream(colNames []string, pkCols []string) *diffStream {
+	return &diffStream{colNames: colNames, pkCols: pkCols, keys: map[string]*diffKey{}}
+}
+
+// add adds a row the current request wrote to side. key and text are the
+// texts of the key and of the row.
+func (s *diffStream) add(side int, key string, text string, row Row) {
+	k, ok := s.keys[key]
+	if !ok {
+		k = &diffKey{rows: map[string]Row{}}
+		for i := range k.counts {
+			k.counts[i] = map[string]int{}
+		}
+		s.keys[key] = k
+	}
+	if len(s.touched) == 0 || !containsKey(s.touched, key) {
+		s.touched = append(s.touched, key)
+	}
+	if _, ok := k.rows[text]; !ok {
+		k.rows[text] = row
+		k.texts = append(k.texts, text)
+	}
+	k.counts[side][text]++
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// flush returns the diff of the keys the current request wrote, or nil if
+// the request changed no row of the diff, and starts the next request.
+func (s *diffStream) flush() *Diff {
+	touched := s.touched
+	s.touched = nil
+	if len(touched) == 0 {
+		return nil
+	}
+
+	diff := &Diff{ColNames: s.colNames}
+	if len(s.pkCols) > 0 {
+		for _, key := range touched {
+			s.primaryKeyRows(diff, s.keys[key])
+		}
+		if len(diff.Control) == 0 {
+			return nil
+		}
+		return diff
+	}
+
+	s.nonPrimaryKeyRows(diff, touched)
+	if len(diff.Control) == 0 {
+		return nil
+	}
+	return diff
+}
+
+// primaryKeyRows appends the rows of the key k to diff: the row of A on the
+// left, the row of B on the right and the row both started from in the
+// middle, see getPrimaryKeyRowDiff.
+func (s *diffStream) primaryKeyRows(diff *Diff, k *diffKey) {
+	nilRow := func() *Row {
+		row := make(Row, len(s.colNames))
+		return &row
+	}
+
+	var left, middle, right []*Row
+	changed := false
+	for _, text := range k.texts {
+		row := k.rows[text]
+		ap, am := k.trimmed(aPlusSide, text)
+		bp, bm := k.trimmed(bPlusSide, text)
+		changed = changed || ap+am+bp+bm > 0
+		for i := 0; i < ap+max(0, bm-am); i++ {
+			left = append(left, &row)
+		}
+		for i := 0; i < bp+max(0, am-bm); i++ {
+			right = append(right, &row)
+		}
+		if am > 0 || bm > 0 {
+			middle = append(middle, &row)
+		}
+	}
+	if !changed {
+		return
+	}
+
+	n := max(len(left), len(middle), len(right))
+	for len(left) < n {
+		left = append(left, nilRow())
+	}
+	for len(middle) < n {
+		middle = append(middle, nilRow())
+	}
+	for len(right) < n {
+		right = append(right, nilRow())
+	}
+	diff.Control = append(diff.Control, left...)
+	diff.Baseline = append(diff.Baseline, middle...)
+	diff.Experimental = append(diff.Experimental, right...)
+}
+
+// nonPrimaryKeyRows appends the rows of the keys to diff, by the sections of
+// getNonPrimaryKeyRowDiff.
+func (s *diffStream) nonPrimaryKeyRows(diff *Diff, keys []string) {
+	nilRow := func() *Row {
+		row := make(Row, len(s.colNames))
+		return &row
+	}
+	sections := map[diffType]*Diff{}
+	for _, d := range []diffType{APlusOnly, BPlusOnly, APlusBPlus, AMinusOnly, BMinusOnly, AMinusBMinus} {
+		sections[d] = &Diff{}
+	}
+	add := func(d diffType, copies int, control, baseline, experimental func() *Row) {
+		for i := 0; i < copies; i++ {
+			section := sections[d]
+			section.Control = append(section.Control, control())
+			section.Baseline = append(section.Baseline, baseline())
+			section.Experimental = append(section.Experimental, experimental())
+		}
+	}
+
+	for _, key := range keys {
+		k := s.keys[key]
+		for _, text := range k.texts {
+			row := k.rows[text]
+			value := func() *Row { return &row }
+			ap, am := k.trimmed(aPlusSide, text)
+			bp, bm := k.trimmed(bPlusSide, text)
+			add(APlusOnly, max(0, ap-bp), value, nilRow, nilRow)
+			add(APlusBPlus, min(ap, bp), value, nilRow, value)
+			add(BPlusOnly, max(0, bp-ap), nilRow, nilRow, value)
+			add(BMinusOnly, max(0, bm-am), value, value, nilRow)
+			add(AMinusBMinus, min(am, bm), nilRow, value, nilRow)
+			add(AMinusOnly, max(0, am-bm), nilRow, value, value)
+		}
+	}
+
+	for _, d := range []diffType{APlusOnly, BPlusOnly, APlusBPlus, AMinusOnly, BMinusOnly, AMinusBMinus} {
+		diff.Control = append(diff.Control, sections[d].Control...)
+		diff.Baseline = append(diff.Baseline, sections[d].Baseline...)
+		diff.Experimental = append(diff.Experimental, sections[d].Experimental...)
+	}
+}
+
+// streamRowDiffs reads the R+/R- rows of A and B in rid order and returns
+// the diff of the rows each of the first N requests wrote. The rows of the
+// ancestors count as written by the first request.
+func (d *dbDiff) streamRowDiffs(ctx context.Context, clonedTableA *clonedTableAtN, clonedTableB *clonedTableAtN, N int) ([]*Diff, error) {
+	colNames := maps.Keys(clonedTableA.View.Cols)
+	sort.Strings(colNames)
+	cols := identList("", colNames)
+	pkCols := d.getPrimaryKeyCols(clonedTableA.Snapshot)
+	keyCols := pkCols
+	if len(keyCols) == 0 {
+		keyCols = colNames
+	}
+
+	sides := []*relation{clonedTableA.Plus, clonedTableA.Minus, clonedTableB.Plus, clonedTableB.Minus}
+	var selects []string
+	for side, r := range sides {
+		selects = append(selects, fmt.Sprintf("SELECT %d AS %s, %s, %s FROM %s", side, quoteIdent(diffSideCol), cols, quoteIdent(d.counterCol), r.qualifiedName()))
+	}
+	deltas := &relation{
+		Name:  clonedTableA.Snapshot.Name + "deltas",
+		Query: strings.Join(selects, "\n\t\tUNION ALL\n\t\t"),
+		Cols:  clonedTableA.View.Cols,
+		Deps:  sides,
+	}
+	with, err := deltas.with()
+	if err != nil {
+		return nil, err
+	}
+	rid := quoteIdent(d.counterCol)
+	query := fmt.Sprintf(`%s
+	SELECT %s, %s, ROW(%s)::text, ROW(%s)::text, %s FROM %s
+	ORDER BY %s, %s, %s;`, with, quoteIdent(diffSideCol), rid, identList("", keyCols), cols, cols, deltas.qualifiedName(), rid, identList("", keyCols), quoteIdent(diffSideCol))
+
+	rows, err := d.conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	diffs := make([]*Diff, N)
+	stream := newDiffStream(colNames, pkCols)
+	n := 0
+	for rows.Next() {
+		var side int32
+		var reqId int64
+		var key, text string
+		values := make(Row, len(colNames))
+		ptrs := []any{&side, &reqId, &key, &text}
+		for i := range values {
+			ptrs = append(ptrs, &values[i])
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for ; int64(n) < reqId; n++ {
+			diffs[n] = stream.flush()
+		}
+		stream.add(int(side), key, text, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for ; n < N; n++ {
+		diffs[n] = stream.flush()
+	}
+	return diffs, nil
+}
+
+// getClonedTableRowDiffPerReq returns the diff of the rows each of the first
+// N requests wrote to A or B, nil for the requests that wrote none. It reads
+// one snapshot of the branches in a read-only transaction, and returns nil if
+// neither branch wrote the table, see lazy_branch.go.
+func (d *dbDiff) getClonedTableRowDiffPerReq(ctx context.Context, clonedTableA *clonedTable, clonedTableB *clonedTable, N int) ([]*Diff, error) {
+	tx, err := d.connPool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	d = &dbDiff{connPool: d.connPool, conn: tx, counterCol: d.counterCol, ignored: d.ignored}
+
+	if written, err := diffWritten(ctx, d.conn, clonedTableA, clonedTableB); err != nil || !written {
+		return nil, err
+	}
+
+	base := commonAncestor(clonedTableA, clonedTableB)
+	cols := comparableColumns(clonedTableA, clonedTableB, base)
+	for col := range d.ignored {
+		delete(cols, col)
+	}
+	if len(cols) == 0 {
+		return make([]*Diff, N), nil
+	}
+
+	updatedA, updatedB, err := d.getclonedTablesAtNReqs(ctx, clonedTableA, clonedTableB, base, cols, N-1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cloned tables at n reqs, %w", err)
+	}
+	return d.streamRowDiffs(ctx, updatedA, updatedB, N)
+}
@@ -0,0 +1,183 @@
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// addRow adds the row to the stream the way streamRowDiffs reads it.
+func addRow(s *diffStream, side int, row Row) {
+	key := row
+	if len(s.pkCols) > 0 {
+		key = nil
+		for _, pk := range s.pkCols {
+			key = append(key, row[slices.Index(s.colNames, pk)])
+		}
+	}
+	s.add(side, fmt.Sprint(key), fmt.Sprint(row), row)
+}
+
+func rows(rs ...Row) []*Row {
+	var out []*Row
+	for _, r := range rs {
+		r := r
+		out = append(out, &r)
+	}
+	return out
+}
+
+func TestDiffStream(t *testing.T) {
+	t.Run("PrimaryKey", func(t *testing.T) {
+		s := newDiffStream([]string{"id", "name"}, []string{"id"})
+
+		// request 0: A and B insert the same row
+		addRow(s, aPlusSide, Row{1, "a"})
+		addRow(s, bPlusSide, Row{1, "a"})
+		got := s.flush()
+		want := &Diff{
+			ColNames:     []string{"id", "name"},
+			Control:      rows(Row{1, "a"}),
+			Baseline:     rows(Row{nil, nil}),
+			Experimental: rows(Row{1, "a"}),
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("request 0 (-want,+got):\n%s", diff)
+		}
+
+		// request 1 writes nothing
+		if got := s.flush(); got != nil {
+			t.Errorf("request 1: got %v, want nil", got)
+		}
+
+		// request 2: B updates the row, A deletes it
+		addRow(s, aMinusSide, Row{1, "a"})
+		addRow(s, bMinusSide, Row{1, "a"})
+		addRow(s, bPlusSide, Row{1, "b"})
+		got = s.flush()
+		want = &Diff{
+			ColNames:     []string{"id", "name"},
+			Control:      rows(Row{nil, nil}),
+			Baseline:     rows(Row{nil, nil}),
+			Experimental: rows(Row{1, "b"}),
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("request 2 (-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("NoPrimaryKey", func(t *testing.T) {
+		s := newDiffStream([]string{"msg"}, nil)
+
+		// request 0: A inserts two rows, B one of them
+		addRow(s, aPlusSide, Row{"x"})
+		addRow(s, aPlusSide, Row{"y"})
+		addRow(s, bPlusSide, Row{"y"})
+		got := s.flush()
+		want := &Diff{
+			ColNames:     []string{"msg"},
+			Control:      rows(Row{"x"}, Row{"y"}),
+			Baseline:     rows(Row{nil}, Row{nil}),
+			Experimental: rows(Row{nil}, Row{"y"}),
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("request 0 (-want,+got):\n%s", diff)
+		}
+
+		// request 1: A deletes the row it inserted, which cancels out
+		addRow(s, aMinusSide, Row{"x"})
+		if got := s.flush(); got != nil {
+			t.Errorf("request 1: got %v, want nil", got)
+		}
+	})
+}
+
+func TestComputeDiffPerReq(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := brancher.Branch(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// request 0 inserts alice into both branches, request 1 writes nothing
+	// and request 2 inserts bob into a
+	reqs := [][]string{
+		{
+			"INSERT INTO a.users(accountid, username, passhash, birthday) VALUES ('101122611122', 'alice', '1234', '2000-01-01')",
+			"INSERT INTO b.users(accountid, username, passhash, birthday) VALUES ('101122611122', 'alice', '1234', '2000-01-01')",
+		},
+		nil,
+		{
+			"INSERT INTO a.users(accountid, username, passhash, birthday) VALUES ('103362343333', 'bob', '2345', '2001-01-01')",
+		},
+	}
+	for _, stmts := range reqs {
+		for _, stmt := range stmts {
+			if _, err := connPool.Exec(ctx, stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, branch := range []*Branch{a, b} {
+			if err := branch.IncrementReqId(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	reqMaps, err := brancher.ComputeDiffPerReq(ctx, a, b, len(reqs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reqMaps), len(reqs); got != want {
+		t.Fatalf("diffs: got %d, want %d", got, want)
+	}
+	for n, want := range []int{1, 0, 1} {
+		got := 0
+		if diff, ok := reqMaps[n]["users"]; ok {
+			got = len(diff.Control)
+		}
+		if got != want {
+			t.Errorf("rows of users at request %d: got %d, want %d", n, got, want)
+		}
+	}
+
+	diff, ok := reqMaps[2]["users"]
+	if !ok {
+		t.Fatal("no diff of users at request 2")
+	}
+	for i, name := range diff.ColNames {
+		if name != "username" {
+			continue
+		}
+		if got := (*diff.Control[0])[i]; got != "bob" {
+			t.Errorf("username in a at request 2: got %v, want bob", got)
+		}
+		if got := (*diff.Experimental[0])[i]; got != nil {
+			t.Errorf("username in b at request 2: got %v, want nil", got)
+		}
+	}
+}
@@ -8,6 +8,47 @@ import (
 	"github.com/google/go-cmp/cmp"
 )
 
+func TestRelationWith(t *testing.T) {
+	cols := map[string]column{"id": {Name: "id", DataType: "integer"}}
+	plus := &relation{Name: "plus", Query: "SELECT id FROM t", Cols: cols}
+	minus := tableRelation(`"b"."tminus"`, cols)
+	trim := &relation{Name: "trim", Query: `SELECT id FROM plus EXCEPT ALL SELECT id FROM "b"."tminus"`, Cols: cols, Deps: []*relation{plus, minus}}
+	both := &relation{Name: "both", Query: "SELECT id FROM trim UNION ALL SELECT id FROM plus", Cols: cols, Deps: []*relation{trim, plus}}
+
+	got, err := both.with()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `WITH "plus" AS (SELECT id FROM t),
+"trim" AS (SELECT id FROM plus EXCEPT ALL SELECT id FROM "b"."tminus"),
+"both" AS (SELECT id FROM trim UNION ALL SELECT id FROM plus)`
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+
+	if got, err := minus.with(); err != nil || got != "" {
+		t.Errorf("with() of a table = %q, %v, want no WITH clause", got, err)
+	}
+
+	other := &relation{Name: "plus", Query: "SELECT id FROM u", Cols: cols}
+	collide := &relation{Name: "collide", Query: "SELECT id FROM plus", Cols: cols, Deps: []*relation{plus, other}}
+	if _, err := collide.with(); err == nil {
+		t.Error("with() of two relations with the same name succeeded")
+	}
+}
+
+func TestRowDiffColumnMismatch(t *testing.T) {
+	a := &clonedTableAtN{View: &view{Name: "users", Cols: map[string]column{"id": {Name: "id", DataType: "integer"}}}}
+	b := &clonedTableAtN{View: &view{Name: "users", Cols: map[string]column{"id": {Name: "id", DataType: "bigint"}}}}
+	d := &dbDiff{}
+	if _, err := d.getNonPrimaryKeyRowDiff(context.Background(), a, b); err == nil {
+		t.Error("getNonPrimaryKeyRowDiff of views with different columns succeeded")
+	}
+	if _, err := d.getPrimaryKeyRowDiff(context.Background(), a, b); err == nil {
+		t.Error("getPrimaryKeyRowDiff of views with different columns succeeded")
+	}
+}
+
 func TestCloneDatabaseDiffs(t *testing.T) {
 	ctx := context.Background()
 
@@ -42,7 +83,7 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 
 		_, err = connPool.Exec(ctx,
 			`
-		INSERT INTO users(accountid, username, passhash, birthday) VALUES
+		INSERT INTO test.users(accountid, username, passhash, birthday) VALUES
 		('101122611122', 'testuser', '1234', '2000-01-01'),
 		('103362343333', 'alice', '2345', '2001-01-01'),
 		('107744137744', 'eve', '3456', '2002-01-01');
@@ -51,7 +92,7 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		rows, colNames, err := dbDiff.dumpView(ctx, cloneDdl.clonedTables["users"].View)
+		rows, colNames, err := dbDiff.dump(ctx, tableRelation(cloneDdl.clonedTables["users"].View.qualifiedName(), cloneDdl.clonedTables["users"].View.Cols))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -96,7 +137,7 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 			t.Fatal(err)
 		}
 		tableA := &table{
-			Name: "tableA",
+			Name: "tablea",
 			Cols: map[string]column{
 				"name": {Name: "name", DataType: "character varying", Nullable: "YES"},
 				"id":   {Name: "id", DataType: "INTEGER", Nullable: "YES"},
@@ -104,23 +145,18 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 		}
 
 		tableB := &table{
-			Name: "tableB",
+			Name: "tableb",
 			Cols: map[string]column{
 				"name": {Name: "name", DataType: "character varying", Nullable: "YES"},
 				"id":   {Name: "id", DataType: "INTEGER", Nullable: "YES"},
 			},
 		}
 
-		AminusBView, err := dbDiff.minusTables(ctx, tableA, tableB, "AMinusB")
+		AminusBView, err := dbDiff.minusTables(tableA, tableB, "AMinusB")
 		if err != nil {
 			t.Fatal(err)
 		}
-		AminusBViewRows, AminusBColNames, err := dbDiff.dumpView(ctx, AminusBView)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		err = dropView(ctx, connPool, AminusBView.Name)
+		AminusBViewRows, AminusBColNames, err := dbDiff.dump(ctx, AminusBView)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -134,16 +170,12 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 			t.Errorf("(-want,+got):\n%s", diff)
 		}
 
-		BminusAsView, err := dbDiff.minusTables(ctx, tableB, tableA, "BMinusA")
+		BminusAsView, err := dbDiff.minusTables(tableB, tableA, "BMinusA")
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		BminusAViewRows, BminusAColNames, err := dbDiff.dumpView(ctx, BminusAsView)
-		if err != nil {
-			t.Fatal(err)
-		}
-		err = dropView(ctx, connPool, BminusAsView.Name)
+		BminusAViewRows, BminusAColNames, err := dbDiff.dump(ctx, BminusAsView)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -158,7 +190,7 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 
 	t.Run("TableIntersect", func(t *testing.T) {
 		tableA := &table{
-			Name: "tableA",
+			Name: "tablea",
 			Cols: map[string]column{
 				"name": {Name: "name", DataType: "character varying", Nullable: "YES"},
 				"id":   {Name: "id", DataType: "INTEGER", Nullable: "YES"},
@@ -166,38 +198,28 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 		}
 
 		tableB := &table{
-			Name: "tableB",
+			Name: "tableb",
 			Cols: map[string]column{
 				"name": {Name: "name", DataType: "character varying", Nullable: "YES"},
 				"id":   {Name: "id", DataType: "INTEGER", Nullable: "YES"},
 			},
 		}
 
-		AintersectB, err := dbDiff.intersectTables(ctx, tableA, tableB, "AintersectB")
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		AintersectBRows, AintersectBColNames, err := dbDiff.dumpView(ctx, AintersectB)
+		AintersectB, err := dbDiff.intersectTables(tableA, tableB, "AintersectB")
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		err = dropView(ctx, connPool, AintersectB.Name)
+		AintersectBRows, AintersectBColNames, err := dbDiff.dump(ctx, AintersectB)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		BintersectA, err := dbDiff.intersectTables(ctx, tableB, tableA, "BintersectA")
+		BintersectA, err := dbDiff.intersectTables(tableB, tableA, "BintersectA")
 		if err != nil {
 			t.Fatal(err)
 		}
-		BintersectARows, BintersectAColNames, err := dbDiff.dumpView(ctx, BintersectA)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		err = dropView(ctx, connPool, BintersectA.Name)
+		BintersectARows, BintersectAColNames, err := dbDiff.dump(ctx, BintersectA)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -266,17 +288,18 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		updatedA, _, err := dbDiff.getclonedTablesAtNReqs(ctx, cloneDdl.clonedTables["users"], cloneDdl.clonedTables["users"], 0)
+		users := cloneDdl.clonedTables["users"]
+		updatedA, _, err := dbDiff.getclonedTablesAtNReqs(ctx, users, users, nil, users.View.Cols, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		trimPlus, trimMinus, err := dbDiff.trimClonedTable(ctx, updatedA)
+		trimPlus, trimMinus, err := dbDiff.trimClonedTable(updatedA)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		trimPlusRows, trimPlusColNames, err := dbDiff.dumpView(ctx, trimPlus)
+		trimPlusRows, trimPlusColNames, err := dbDiff.dump(ctx, trimPlus)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -294,7 +317,7 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 			t.Errorf("(-want,+got):\n%s", diff)
 		}
 
-		trimMinusRows, trimMinusColNames, err := dbDiff.dumpView(ctx, trimMinus)
+		trimMinusRows, trimMinusColNames, err := dbDiff.dump(ctx, trimMinus)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -309,16 +332,6 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 			t.Errorf("(-want,+got):\n%s", diff)
 		}
 
-		err = dropView(ctx, connPool, trimPlus.Name)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		err = dropView(ctx, connPool, trimMinus.Name)
-		if err != nil {
-			t.Fatal(err)
-		}
-
 		err = cloneDdl.reset(ctx)
 		if err != nil {
 			t.Fatal(err)
@@ -376,22 +389,23 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 
 		_, err = connPool.Exec(ctx,
 			`
-		INSERT INTO A(id, name) VALUES(3,'C');
-		INSERT INTO A(id, name) VALUES(2,'B');
-		DELETE FROM A WHERE (id, name) = (0,'O');
-		DELETE FROM A WHERE (id, name) = (4,'D');
-		DELETE FROM A WHERE (id, name) = (1,'A');
-		INSERT INTO a(id, name) VALUES(1,'A');
-		INSERT INTO B(id, name) VALUES(3,'C');
-		UPDATE B SET (id, name) = (1,'D') where (id, name) = (1,'A');
-		DELETE FROM B WHERE (id, name) = (0,'O');
+		INSERT INTO test.a(id, name) VALUES(3,'C');
+		INSERT INTO test.a(id, name) VALUES(2,'B');
+		DELETE FROM test.a WHERE (id, name) = (0,'O');
+		DELETE FROM test.a WHERE (id, name) = (4,'D');
+		DELETE FROM test.a WHERE (id, name) = (1,'A');
+		INSERT INTO test.a(id, name) VALUES(1,'A');
+		INSERT INTO test.b(id, name) VALUES(3,'C');
+		UPDATE test.b SET (id, name) = (1,'D') where (id, name) = (1,'A');
+		DELETE FROM test.b WHERE (id, name) = (0,'O');
 		`)
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		dbDiff := newDbDiff(connPool, "rid")
-		updatedA, updatedB, err := dbDiff.getclonedTablesAtNReqs(ctx, cloneDdl.clonedTables["a"], cloneDdl.clonedTables["b"], 1)
+		a, b := cloneDdl.clonedTables["a"], cloneDdl.clonedTables["b"]
+		updatedA, updatedB, err := dbDiff.getclonedTablesAtNReqs(ctx, a, b, nil, a.View.Cols, 1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -503,22 +517,22 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 
 		_, err = connPool.Exec(ctx,
 			`
-		DELETE FROM B WHERE (id, name) = (0,'O');
-		UPDATE B SET (id, name) = (1,'AA') where (id, name) = (1, 'A');
-		DELETE FROM A WHERE (id, name) = (2,'B');
-		UPDATE A SET (id, name) = (3,'CC') where (id, name) = (3, 'C');
-		DELETE FROM A WHERE (id, name) = (4,'D');
-		DELETE FROM B WHERE (id, name) = (4,'D');
-		DELETE FROM A WHERE (id, name) = (5,'E');
-		UPDATE B SET (id, name) = (5,'EE') where (id, name) = (5, 'E');
-		DELETE FROM B WHERE (id, name) = (6,'F');
-		UPDATE A SET (id, name) = (6,'FF') where (id, name) = (6, 'F');
-		UPDATE A SET (id, name) = (7,'GG') where (id, name) = (7, 'G');
-		UPDATE B SET (id, name) = (7,'GGG') where (id, name) = (7, 'G');
-		INSERT INTO B(id, name) VALUES(8, 'H');
-		INSERT INTO A(id, name) VALUES(9, 'I');
-		INSERT INTO A(id, name) VALUES(10, 'J');
-		INSERT INTO B(id, name) VALUES(10, 'J');
+		DELETE FROM test.b WHERE (id, name) = (0,'O');
+		UPDATE test.b SET (id, name) = (1,'AA') where (id, name) = (1, 'A');
+		DELETE FROM test.a WHERE (id, name) = (2,'B');
+		UPDATE test.a SET (id, name) = (3,'CC') where (id, name) = (3, 'C');
+		DELETE FROM test.a WHERE (id, name) = (4,'D');
+		DELETE FROM test.b WHERE (id, name) = (4,'D');
+		DELETE FROM test.a WHERE (id, name) = (5,'E');
+		UPDATE test.b SET (id, name) = (5,'EE') where (id, name) = (5, 'E');
+		DELETE FROM test.b WHERE (id, name) = (6,'F');
+		UPDATE test.a SET (id, name) = (6,'FF') where (id, name) = (6, 'F');
+		UPDATE test.a SET (id, name) = (7,'GG') where (id, name) = (7, 'G');
+		UPDATE test.b SET (id, name) = (7,'GGG') where (id, name) = (7, 'G');
+		INSERT INTO test.b(id, name) VALUES(8, 'H');
+		INSERT INTO test.a(id, name) VALUES(9, 'I');
+		INSERT INTO test.a(id, name) VALUES(10, 'J');
+		INSERT INTO test.b(id, name) VALUES(10, 'J');
 		`)
 		if err != nil {
 			t.Fatal(err)
@@ -526,7 +540,8 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 
 		dbDiff := newDbDiff(connPool, "rid")
 
-		updatedA, updatedB, err := dbDiff.getclonedTablesAtNReqs(ctx, cloneDdl.clonedTables["a"], cloneDdl.clonedTables["b"], 1)
+		a, b := cloneDdl.clonedTables["a"], cloneDdl.clonedTables["b"]
+		updatedA, updatedB, err := dbDiff.getclonedTablesAtNReqs(ctx, a, b, nil, a.View.Cols, 1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -647,36 +662,59 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 
 		_, err = connPool.Exec(ctx,
 			`
-		DELETE FROM B WHERE (id, name) = (0,'O');
+		DELETE FROM test.b WHERE (id, name) = (0,'O');
 		UPDATE test.rid SET id = id+1;
 
-		INSERT INTO B (id, name) VALUES (0, 'O');
-		UPDATE B SET (id, name) = (1,'AA') where (id, name) = (1, 'A');
+		INSERT INTO test.b (id, name) VALUES (0, 'O');
+		UPDATE test.b SET (id, name) = (1,'AA') where (id, name) = (1, 'A');
 		UPDATE test.rid SET id = id+1;
 
-		DELETE FROM A WHERE (id, name) = (2,'B');
+		DELETE FROM test.a WHERE (id, name) = (2,'B');
 		UPDATE test.rid SET id = id+1;
 
-		UPDATE A SET (id, name) = (3,'CC') where (id, name) = (3, 'C');
+		UPDATE test.a SET (id, name) = (3,'CC') where (id, name) = (3, 'C');
 		UPDATE test.rid SET id = id+1;
 
-		DELETE FROM A WHERE (id, name) = (4,'D');
-		DELETE FROM B WHERE (id, name) = (4,'D');
+		DELETE FROM test.a WHERE (id, name) = (4,'D');
+		DELETE FROM test.b WHERE (id, name) = (4,'D');
 		UPDATE test.rid SET id = id+1;
 
-		DELETE FROM A WHERE (id, name) = (5,'E');
-		UPDATE B SET (id, name) = (5,'EE') where (id, name) = (5, 'E');
+		DELETE FROM test.a WHERE (id, name) = (5,'E');
+		UPDATE test.b SET (id, name) = (5,'EE') where (id, name) = (5, 'E');
 		UPDATE test.rid SET id = id+1;
 		`)
 		if err != nil {
 			t.Fatal(err)
 		}
 
+		views := func() []string {
+			t.Helper()
+			rows, err := connPool.Query(ctx, "SELECT viewname FROM pg_views WHERE schemaname = 'test' ORDER BY 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var names []string
+			for rows.Next() {
+				var name string
+				if err := rows.Scan(&name); err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, name)
+			}
+			return names
+		}
+		before := views()
+
 		dbDiff := newDbDiff(connPool, "rid")
 		rowDiffs, err := dbDiff.getClonedTableRowDiffAtNReqs(ctx, cloneDdl.clonedTables["a"], cloneDdl.clonedTables["b"], 3)
 		if err != nil {
 			t.Fatal(err)
 		}
+		// the diff reads the intermediate relations as CTEs
+		if diff := cmp.Diff(before, views()); diff != "" {
+			t.Errorf("views changed by the diff (-before,+after):\n%s", diff)
+		}
 
 		expectedRowDiffs := &Diff{
 			Control: []*Row{
@@ -701,6 +739,15 @@ func TestCloneDatabaseDiffs(t *testing.T) {
 			t.Errorf("(-want,+got):\n%s", diff)
 		}
 
+		expectedChanges := []string{
+			`("id")=(1): "name" changed from A to AA in B only`,
+			`("id")=(2): deleted in A only`,
+			`("id")=(3): "name" changed from C to CC in A only`,
+		}
+		if diff := cmp.Diff(expectedChanges, newChangeSet(rowDiffs, []string{"id"}).Lines()); diff != "" {
+			t.Errorf("changes (-want,+got):\n%s", diff)
+		}
+
 		err = cloneDdl.reset(ctx)
 		if err != nil {
 			t.Fatal(err)
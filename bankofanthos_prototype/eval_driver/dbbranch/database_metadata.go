@@ -4,6 +4,8 @@ package dbbranch
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -18,12 +20,33 @@ type idGenerator struct {
 	IdentityMinimum    int64
 }
 
+// a sequence that generates the values of a column
+type sequence struct {
+	Schema    string
+	Name      string
+	DataType  string
+	Start     int64
+	Increment int64
+	Minimum   int64
+	Maximum   int64
+	Cycle     bool
+}
+
+func (s *sequence) qualifiedName() string {
+	return qualify(s.Schema, s.Name)
+}
+
 type column struct {
 	Name                   string
 	DataType               string
 	CharacterMaximumLength int64 // default is 0 if not sepcify
 	Nullable               string
 	IdGenerator            *idGenerator
+	Type                   string    // complete type as rendered by format_type, e.g. numeric(12,2)
+	Collation              string    // quoted collation, empty if it is the default of the type
+	Default                string    // DEFAULT expression, empty if there is none
+	Sequence               *sequence // set for serial and identity columns and nextval defaults
+	Generated              string    // expression of a stored generated column
 }
 
 type index struct {
@@ -36,21 +59,51 @@ type index struct {
 // a BeRefedTableName(BeRefedColumnName) is referenced by ForeignKeyTableName(ForeignKeyColumnName)
 type reference struct {
 	ConstraintName        string
+	BeRefedTableSchema    string
 	BeRefedTableName      string
 	BeRefedColumnNames    []string
+	ForeignKeyTableSchema string
 	ForeignKeyTableName   string
 	ForeignKeyColumnNames []string
-	Action                string // TODO: Get actions from table metadata.Set default to no action
+	OnDelete              string // referential action, e.g. NO ACTION or CASCADE
+	OnUpdate              string
 }
 
 // a TableName(ColumnName) has a foreign key constraint which refers another RefTableName(RefColumnName)
 type foreignKeyConstraint struct {
 	ConstraintName string
+	TableSchema    string
 	TableName      string
 	ColumnNames    []string
+	RefTableSchema string
 	RefTableName   string
 	RefColumnNames []string
-	Action         string // TODO: Get actions from table metadata. set default to no action
+	OnDelete       string // referential action, e.g. NO ACTION or CASCADE
+	OnUpdate       string
+}
+
+// referentialActions maps the confdeltype and confupdtype codes of
+// pg_constraint to the referential actions.
+var referentialActions = map[string]string{
+	"a": "NO ACTION",
+	"r": "RESTRICT",
+	"c": "CASCADE",
+	"n": "SET NULL",
+	"d": "SET DEFAULT",
+}
+
+// a CHECK constraint of a table
+type checkConstraint struct {
+	Name       string
+	Expression string // boolean expression over the columns, e.g. (price > (0)::numeric)
+}
+
+// an EXCLUDE constraint of a table. Two rows conflict if every column pair
+// compares true with its operator.
+type exclusionConstraint struct {
+	Name        string
+	ColumnNames []string
+	Operators   []string // e.g. OPERATOR("pg_catalog".&&), one per column
 }
 
 type rule struct {
@@ -73,7 +126,22 @@ type trigger struct {
 	Procedure *procedure // stored_procedure definition
 }
 
+// a BEFORE or AFTER trigger of a table, other than the ones postgres creates
+// for constraints
+type tableTrigger struct {
+	Name           string
+	Definition     string   // CREATE TRIGGER statement, as printed by pg_get_triggerdef
+	Row            bool     // FOR EACH ROW, else FOR EACH STATEMENT
+	Before         bool     // BEFORE, else AFTER
+	Events         []string // INSERT, UPDATE, DELETE or TRUNCATE
+	Transition     bool     // REFERENCING OLD TABLE or NEW TABLE
+	FunctionSchema string
+	FunctionName   string
+	FunctionDef    string // CREATE FUNCTION statement, as printed by pg_get_functiondef
+}
+
 type view struct {
+	Schema   string // empty for views resolved through the search_path
 	Name     string
 	Cols     map[string]column
 	Rules    []rule
@@ -81,23 +149,72 @@ type view struct {
 }
 
 type table struct {
+	Schema                string
 	Name                  string
 	Cols                  map[string]column
 	Indexes               []index
 	Rules                 []rule
 	References            []reference
 	ForeignKeyConstraints []foreignKeyConstraint
+	CheckConstraints      []checkConstraint
+	ExclusionConstraints  []exclusionConstraint
+	Triggers              []tableTrigger
+	Inherits              []string // tableKey of the tables it inherits from, or of the table it is a partition of
+	Partitioned           bool     // rows are stored in the partitions, none in the table itself
+	PartitionBound        string   // the condition the rows of a partition satisfy, empty if the table is not a partition
+	DefaultPartition      bool     // the partition that takes the rows no other partition takes
+}
+
+// tableKey identifies a table among the tables of all schemas. Tables in
+// public are identified by their name alone, the way postgres prints them
+// with the default search_path.
+func tableKey(schema, name string) string {
+	if schema == publicSchema {
+		return name
+	}
+	return schema + "." + name
+}
+
+func (t *table) key() string {
+	return tableKey(t.Schema, t.Name)
+}
+
+func (t *table) qualifiedName() string {
+	return qualify(t.Schema, t.Name)
+}
+
+func (v *view) qualifiedName() string {
+	return qualify(v.Schema, v.Name)
+}
+
+// a view or materialized view that reads from the tables, directly or
+// through other views
+type dependentView struct {
+	Schema       string
+	Name         string
+	Definition   string // the query, with every relation schema qualified
+	Materialized bool
+	Indexes      []string // CREATE INDEX statements of a materialized view
+	Depth        int      // 1 for views over tables only, else one more than the deepest view read from
+}
+
+func (v *dependentView) qualifiedName() string {
+	return qualify(v.Schema, v.Name)
 }
 
 type database struct {
-	Tables   map[string]*table
-	connPool *pgxpool.Pool
+	Tables          map[string]*table // keyed by tableKey
+	Views           []*dependentView  // in the order they can be created in
+	Sequences       []*sequence       // all sequences, owned by a column or not
+	connPool        *pgxpool.Pool
+	excludedSchemas []string // schemas whose tables are not cloned, e.g. existing branches
 }
 
-func newDatabase(ctx context.Context, connPool *pgxpool.Pool) (*database, error) {
+func newDatabase(ctx context.Context, connPool *pgxpool.Pool, excludedSchemas ...string) (*database, error) {
 	database := &database{
-		connPool: connPool,
-		Tables:   map[string]*table{},
+		connPool:        connPool,
+		Tables:          map[string]*table{},
+		excludedSchemas: excludedSchemas,
 	}
 	err := database.getDatabaseMetadata(ctx)
 
@@ -111,11 +228,11 @@ func (d *database) getDatabaseMetadata(ctx context.Context) error {
 	}
 
 	g := NewGroup[string, *table](context.Background())
-	for _, tablename := range tables {
-		tablename := tablename
+	for _, t := range tables {
+		t := t
 		g.Go(func() (string, *table, error) {
-			t, err := d.getTable(ctx, tablename)
-			return tablename, t, err
+			table, err := d.getTable(ctx, t.Schema, t.Name)
+			return t.key(), table, err
 		})
 	}
 
@@ -128,74 +245,238 @@ func (d *database) getDatabaseMetadata(ctx context.Context) error {
 		d.Tables[k] = v
 	}
 
+	if d.Views, err = d.listDependentViews(ctx); err != nil {
+		return fmt.Errorf("failed to list views: %w", err)
+	}
+	if d.Sequences, err = d.listSequences(ctx); err != nil {
+		return fmt.Errorf("failed to list sequences: %w", err)
+	}
+
 	constraints, err := d.getForeignKeyConstraints(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get foreign key constraints: %w", err)
 	}
 	for _, constraint := range constraints {
-		constraintTable := d.Tables[constraint.TableName]
+		constraintTable, ok := d.Tables[tableKey(constraint.TableSchema, constraint.TableName)]
+		if !ok {
+			continue
+		}
+		refTable, ok := d.Tables[tableKey(constraint.RefTableSchema, constraint.RefTableName)]
+		if !ok {
+			continue
+		}
 		constraintTable.ForeignKeyConstraints = append(constraintTable.ForeignKeyConstraints, constraint)
-
-		refTable := d.Tables[constraint.RefTableName]
 		refTable.References = append(refTable.References, reference{
 			ConstraintName:        constraint.ConstraintName,
+			BeRefedTableSchema:    constraint.RefTableSchema,
 			BeRefedTableName:      constraint.RefTableName,
 			BeRefedColumnNames:    constraint.RefColumnNames,
+			ForeignKeyTableSchema: constraint.TableSchema,
 			ForeignKeyTableName:   constraint.TableName,
-			ForeignKeyColumnNames: constraint.ColumnNames})
+			ForeignKeyColumnNames: constraint.ColumnNames,
+			OnDelete:              constraint.OnDelete,
+			OnUpdate:              constraint.OnUpdate})
 	}
 
 	return nil
 }
 
-// TODO: now only list all tables in public, handle schemaname is not public.
-func (d *database) listTables(ctx context.Context) ([]string, error) {
-	var tables []string
-	query := `SELECT tablename 
-	FROM pg_catalog.pg_tables 
-	WHERE schemaname != 'pg_catalog' AND schemaname != 'information_schema' AND schemaname = 'public'`
+// listTables lists the tables of every schema except the system schemas, the
+// branch catalog and the excluded schemas. Only Schema and Name are set.
+func (d *database) listTables(ctx context.Context) ([]*table, error) {
+	var tables []*table
+	query := `SELECT schemaname, tablename
+	FROM pg_catalog.pg_tables
+	WHERE schemaname NOT IN ('pg_catalog', 'information_schema') AND schemaname NOT LIKE 'pg\_%' AND schemaname != ALL($1)
+	ORDER BY schemaname, tablename`
 
-	rows, err := d.connPool.Query(ctx, query)
+	rows, err := d.connPool.Query(ctx, query, append([]string{catalogSchema}, d.excludedSchemas...))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var tablename string
 	for rows.Next() {
-		if err := rows.Scan(&tablename); err != nil {
+		var t table
+		if err := rows.Scan(&t.Schema, &t.Name); err != nil {
 			return nil, err
 		}
-		tables = append(tables, tablename)
+		tables = append(tables, &t)
 	}
 
 	return tables, rows.Err()
 }
 
-func (d *database) getTable(ctx context.Context, tablename string) (*table, error) {
+// listDependentViews lists the views and materialized views that read from
+// the tables listTables lists, directly or through other views, views before
+// the views that read from them. pg_depend records which relations the
+// rewrite rule of a view reads from.
+func (d *database) listDependentViews(ctx context.Context) ([]*dependentView, error) {
+	tx, err := d.connPool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// with an empty search_path the definitions qualify every relation
+	if _, err := tx.Exec(ctx, "SET LOCAL search_path TO pg_catalog"); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, `
+	WITH RECURSIVE relations AS (
+		SELECT c.oid, c.relkind FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_%' AND n.nspname != ALL($1)
+	), deps(oid, depth) AS (
+		SELECT oid, 0 FROM relations WHERE relkind IN ('r', 'p')
+		UNION ALL
+		SELECT r.ev_class, deps.depth + 1
+		FROM deps
+		JOIN pg_depend d ON d.classid = 'pg_rewrite'::regclass AND d.refclassid = 'pg_class'::regclass AND d.refobjid = deps.oid
+		JOIN pg_rewrite r ON r.oid = d.objid
+		JOIN relations v ON v.oid = r.ev_class AND v.relkind IN ('v', 'm')
+		WHERE r.ev_class <> deps.oid
+	)
+	SELECT n.nspname, c.relname, c.relkind = 'm', pg_get_viewdef(c.oid),
+		ARRAY(SELECT pg_get_indexdef(i.indexrelid) FROM pg_index i WHERE i.indrelid = c.oid ORDER BY i.indexrelid),
+		max(deps.depth)
+	FROM deps
+	JOIN pg_class c ON c.oid = deps.oid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('v', 'm')
+	GROUP BY c.oid, n.nspname, c.relname, c.relkind
+	ORDER BY max(deps.depth), n.nspname, c.relname`, append([]string{catalogSchema}, d.excludedSchemas...))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []*dependentView
+	for rows.Next() {
+		var v dependentView
+		if err := rows.Scan(&v.Schema, &v.Name, &v.Materialized, &v.Definition, &v.Indexes, &v.Depth); err != nil {
+			return nil, err
+		}
+		v.Definition = strings.TrimSuffix(strings.TrimSpace(v.Definition), ";")
+		views = append(views, &v)
+	}
+	return views, rows.Err()
+}
+
+// listSequences lists the sequences of the schemas listTables lists.
+func (d *database) listSequences(ctx context.Context) ([]*sequence, error) {
+	rows, err := d.connPool.Query(ctx, `
+	SELECT n.nspname, s.relname, format_type(q.seqtypid, NULL), q.seqstart, q.seqincrement, q.seqmin, q.seqmax, q.seqcycle
+	FROM pg_class s
+	JOIN pg_namespace n ON n.oid = s.relnamespace
+	JOIN pg_sequence q ON q.seqrelid = s.oid
+	WHERE s.relkind = 'S' AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_%' AND n.nspname != ALL($1)
+	ORDER BY n.nspname, s.relname`, append([]string{catalogSchema}, d.excludedSchemas...))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sequences []*sequence
+	for rows.Next() {
+		var seq sequence
+		if err := rows.Scan(&seq.Schema, &seq.Name, &seq.DataType, &seq.Start, &seq.Increment, &seq.Minimum, &seq.Maximum, &seq.Cycle); err != nil {
+			return nil, err
+		}
+		sequences = append(sequences, &seq)
+	}
+	return sequences, rows.Err()
+}
+
+// schemas returns the schemas of the tables, views and sequences, public
+// first.
+func (d *database) schemas() []string {
+	schemas := []string{publicSchema}
+	seen := map[string]bool{publicSchema: true}
+	add := func(schema string) {
+		if !seen[schema] {
+			seen[schema] = true
+			schemas = append(schemas, schema)
+		}
+	}
+	for _, t := range d.Tables {
+		add(t.Schema)
+	}
+	for _, v := range d.Views {
+		add(v.Schema)
+	}
+	for _, seq := range d.Sequences {
+		add(seq.Schema)
+	}
+	sort.Strings(schemas[1:])
+	return schemas
+}
+
+func (d *database) getTable(ctx context.Context, schema, tablename string) (*table, error) {
 	var table table
+	table.Schema = schema
 	table.Name = tablename
 	var err error
-	if table.Cols, err = d.getTableCols(ctx, tablename); err != nil {
+	if table.Cols, err = d.getTableCols(ctx, d.connPool, schema, tablename); err != nil {
 		return nil, fmt.Errorf("failed to get table cols: %w", err)
 	}
 
-	if table.Indexes, err = d.getTableIndexes(ctx, tablename); err != nil {
+	sequences, err := d.getTableSequences(ctx, schema, tablename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get table sequences: %w", err)
+	}
+	for name, seq := range sequences {
+		col := table.Cols[name]
+		col.Sequence = seq
+		table.Cols[name] = col
+	}
+
+	if table.Indexes, err = d.getTableIndexes(ctx, schema, tablename); err != nil {
 		return nil, fmt.Errorf("failed to get table indexes: %w", err)
 	}
 
-	if table.Rules, err = d.getTableRules(ctx, tablename); err != nil {
+	if table.Rules, err = d.getTableRules(ctx, schema, tablename); err != nil {
 		return nil, fmt.Errorf("failed to get table rules: %w", err)
 	}
 
+	if table.CheckConstraints, err = d.getTableCheckConstraints(ctx, d.connPool, schema, tablename); err != nil {
+		return nil, fmt.Errorf("failed to get table check constraints: %w", err)
+	}
+
+	if table.ExclusionConstraints, err = d.getTableExclusionConstraints(ctx, schema, tablename); err != nil {
+		return nil, fmt.Errorf("failed to get table exclusion constraints: %w", err)
+	}
+
+	if table.Triggers, err = d.getTableUserTriggers(ctx, schema, tablename); err != nil {
+		return nil, fmt.Errorf("failed to get table triggers: %w", err)
+	}
+
+	if err = d.getTableInheritance(ctx, &table); err != nil {
+		return nil, fmt.Errorf("failed to get table inheritance: %w", err)
+	}
+
 	return &table, nil
 }
 
-// TODO: Now we assume all table schema is public, revisit this
-func (d *database) getTableCols(ctx context.Context, tablename string) (map[string]column, error) {
-	rows, err := d.connPool.Query(ctx, `
-		SELECT column_name,  is_nullable, data_type, character_maximum_length, identity_generation, identity_start, identity_increment, identity_maximum, identity_minimum 
-		FROM information_schema.columns WHERE table_schema = 'public' AND table_name = $1
-	`, tablename)
+func (d *database) getTableCols(ctx context.Context, conn queryer, schema, tablename string) (map[string]column, error) {
+	// information_schema.columns only knows the base data type, so the
+	// complete type, collation, default and generation expression are read
+	// from pg_attribute
+	rows, err := conn.Query(ctx, `
+		SELECT c.column_name, c.is_nullable, c.data_type, c.character_maximum_length, c.identity_generation, c.identity_start, c.identity_increment, c.identity_maximum, c.identity_minimum,
+			format_type(a.atttypid, a.atttypmod),
+			CASE WHEN a.attcollation <> t.typcollation THEN quote_ident(cn.nspname) || '.' || quote_ident(co.collname) ELSE '' END,
+			CASE WHEN a.attgenerated = '' THEN COALESCE(pg_get_expr(ad.adbin, ad.adrelid), '') ELSE '' END,
+			CASE WHEN a.attgenerated = 's' THEN pg_get_expr(ad.adbin, ad.adrelid) ELSE '' END
+		FROM information_schema.columns c
+		JOIN pg_namespace n ON n.nspname = c.table_schema
+		JOIN pg_class r ON r.relnamespace = n.oid AND r.relname = c.table_name
+		JOIN pg_attribute a ON a.attrelid = r.oid AND a.attname = c.column_name AND a.attnum > 0 AND NOT a.attisdropped
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_collation co ON co.oid = a.attcollation
+		LEFT JOIN pg_namespace cn ON cn.oid = co.collnamespace
+		LEFT JOIN pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+		WHERE c.table_schema = $1 AND c.table_name = $2
+	`, schema, tablename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run query: %w", err)
 	}
@@ -210,7 +491,7 @@ func (d *database) getTableCols(ctx context.Context, tablename string) (map[stri
 		var indentityIncrement *string
 		var identityMaximum *string
 		var identityMinimum *string
-		if err := rows.Scan(&col.Name, &col.Nullable, &col.DataType, &CharacterMaximumLength, &identityGeneration, &identityStart, &indentityIncrement, &identityMaximum, &identityMinimum); err != nil {
+		if err := rows.Scan(&col.Name, &col.Nullable, &col.DataType, &CharacterMaximumLength, &identityGeneration, &identityStart, &indentityIncrement, &identityMaximum, &identityMinimum, &col.Type, &col.Collation, &col.Default, &col.Generated); err != nil {
 			return nil, fmt.Errorf("failed to scan rows: %w", err)
 		}
 		if CharacterMaximumLength != nil {
@@ -248,13 +529,76 @@ func (d *database) getTableCols(ctx context.Context, tablename string) (map[stri
 	return cols, rows.Err()
 }
 
-// TODO: Handle more exotic indexes, e.g. indexes on expression
-func (d *database) getTableIndexes(ctx context.Context, tablename string) ([]index, error) {
+// getTableSequences returns the sequences that generate the columns of a
+// table, keyed by column name. A column is generated by the sequence it owns,
+// as serial and identity columns do, or by the sequence its default calls.
+func (d *database) getTableSequences(ctx context.Context, schema, tablename string) (map[string]*sequence, error) {
+	sequences := map[string]*sequence{}
+	rows, err := d.connPool.Query(
+		ctx,
+		`WITH t AS (
+			SELECT r.oid FROM pg_class r
+			JOIN pg_namespace n ON n.oid = r.relnamespace
+			WHERE n.nspname = $1 AND r.relname = $2
+		), deps AS (
+			SELECT d.refobjsubid AS attnum, d.objid AS seqid
+			FROM pg_depend d JOIN t ON d.refobjid = t.oid
+			WHERE d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass
+				AND d.refobjsubid > 0 AND d.deptype IN ('a', 'i')
+			UNION
+			SELECT ad.adnum, d.refobjid
+			FROM pg_attrdef ad JOIN t ON ad.adrelid = t.oid
+			JOIN pg_depend d ON d.classid = 'pg_attrdef'::regclass AND d.objid = ad.oid AND d.refclassid = 'pg_class'::regclass
+		)
+		SELECT DISTINCT ON (a.attname) a.attname, sn.nspname, s.relname, format_type(q.seqtypid, NULL),
+			q.seqstart, q.seqincrement, q.seqmin, q.seqmax, q.seqcycle
+		FROM deps
+		JOIN t ON true
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = deps.attnum
+		JOIN pg_class s ON s.oid = deps.seqid AND s.relkind = 'S'
+		JOIN pg_namespace sn ON sn.oid = s.relnamespace
+		JOIN pg_sequence q ON q.seqrelid = s.oid
+		ORDER BY a.attname, s.relname`,
+		schema, tablename,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var colname string
+		var seq sequence
+		if err := rows.Scan(&colname, &seq.Schema, &seq.Name, &seq.DataType, &seq.Start, &seq.Increment, &seq.Minimum, &seq.Maximum, &seq.Cycle); err != nil {
+			return nil, err
+		}
+		sequences[colname] = &seq
+	}
+
+	return sequences, rows.Err()
+}
+
+// TODO: Handle indexes on expressions and with a WHERE predicate, which are
+// skipped for now, like in getTableExclusionConstraints
+func (d *database) getTableIndexes(ctx context.Context, schema, tablename string) ([]index, error) {
 	var indexes []index
+	// the column names are read from the catalog rather than parsed from the
+	// index definition, where they may be quoted
 	rows, err := d.connPool.Query(
 		ctx,
-		`SELECT indexname, indexdef FROM pg_indexes WHERE schemaname = 'public' AND tablename = $1`,
-		tablename,
+		`SELECT i.relname, pg_get_indexdef(ix.indexrelid), ix.indisunique,
+			ARRAY(
+				SELECT a.attname
+				FROM unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = ix.indrelid AND a.attnum = k.attnum
+				ORDER BY k.ord
+			)
+		FROM pg_index ix
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = $1 AND t.relname = $2
+			AND ix.indpred IS NULL AND ix.indexprs IS NULL`,
+		schema, tablename,
 	)
 	if err != nil {
 		return nil, err
@@ -263,30 +607,21 @@ func (d *database) getTableIndexes(ctx context.Context, tablename string) ([]ind
 
 	for rows.Next() {
 		var index index
-		if err := rows.Scan(&index.Name, &index.IndexDef); err != nil {
+		if err := rows.Scan(&index.Name, &index.IndexDef, &index.IsUnique, &index.ColumnNames); err != nil {
 			return nil, err
 		}
-		if strings.Contains(strings.ToLower(index.IndexDef), "unique") {
-			index.IsUnique = true
-		}
-
-		colFrom := strings.Index(index.IndexDef, "(")
-		colEnd := strings.Index(index.IndexDef, ")")
-		cols := strings.ToLower(index.IndexDef[colFrom+1 : colEnd])
-
-		index.ColumnNames = append(index.ColumnNames, cols)
 		indexes = append(indexes, index)
 	}
 
 	return indexes, rows.Err()
 }
 
-func (d *database) getTableRules(ctx context.Context, tablename string) ([]rule, error) {
+func (d *database) getTableRules(ctx context.Context, schema, tablename string) ([]rule, error) {
 	var rules []rule
 	rows, err := d.connPool.Query(
 		ctx,
-		`SELECT rulename,definition FROM pg_rules WHERE schemaname = 'public' AND tablename = $1`,
-		tablename,
+		`SELECT rulename,definition FROM pg_rules WHERE schemaname = $1 AND tablename = $2`,
+		schema, tablename,
 	)
 	if err != nil {
 		return nil, err
@@ -303,41 +638,124 @@ func (d *database) getTableRules(ctx context.Context, tablename string) ([]rule,
 	return rules, rows.Err()
 }
 
+// getTableCheckConstraints returns the CHECK constraints of a table in the
+// order postgres checks them, which is by name.
+func (d *database) getTableCheckConstraints(ctx context.Context, conn queryer, schema, tablename string) ([]checkConstraint, error) {
+	var constraints []checkConstraint
+	rows, err := conn.Query(
+		ctx,
+		`SELECT c.conname, pg_get_expr(c.conbin, c.conrelid)
+		FROM pg_constraint c
+		JOIN pg_class r ON r.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = r.relnamespace
+		WHERE n.nspname = $1 AND r.relname = $2 AND c.contype = 'c'
+		ORDER BY c.conname`,
+		schema, tablename,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var constraint checkConstraint
+		if err := rows.Scan(&constraint.Name, &constraint.Expression); err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, constraint)
+	}
+
+	return constraints, rows.Err()
+}
+
+// TODO: Handle exclusion constraints on expressions and with a WHERE predicate
+func (d *database) getTableExclusionConstraints(ctx context.Context, schema, tablename string) ([]exclusionConstraint, error) {
+	var constraints []exclusionConstraint
+	rows, err := d.connPool.Query(
+		ctx,
+		`SELECT c.conname, a.attname, 'OPERATOR(' || quote_ident(opn.nspname) || '.' || o.oprname || ')'
+		FROM pg_constraint c
+		JOIN pg_class r ON r.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = r.relnamespace
+		JOIN pg_index ix ON ix.indexrelid = c.conindid
+		CROSS JOIN LATERAL unnest(c.conkey, c.conexclop) WITH ORDINALITY AS k(attnum, opid, ord)
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+		JOIN pg_operator o ON o.oid = k.opid
+		JOIN pg_namespace opn ON opn.oid = o.oprnamespace
+		WHERE n.nspname = $1 AND r.relname = $2 AND c.contype = 'x'
+			AND ix.indpred IS NULL AND ix.indexprs IS NULL
+		ORDER BY c.conname, k.ord`,
+		schema, tablename,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, column, operator string
+		if err := rows.Scan(&name, &column, &operator); err != nil {
+			return nil, err
+		}
+		if n := len(constraints); n > 0 && constraints[n-1].Name == name {
+			constraints[n-1].ColumnNames = append(constraints[n-1].ColumnNames, column)
+			constraints[n-1].Operators = append(constraints[n-1].Operators, operator)
+			continue
+		}
+		constraints = append(constraints, exclusionConstraint{Name: name, ColumnNames: []string{column}, Operators: []string{operator}})
+	}
+
+	return constraints, rows.Err()
+}
+
 func (d *database) getForeignKeyConstraints(ctx context.Context) ([]foreignKeyConstraint, error) {
 	constraintsMap := make(map[string]foreignKeyConstraint)
 	rows, err := d.connPool.Query(
 		ctx, `
 	SELECT
-		c.constraint_name, 
+		c.constraint_schema,
+		c.constraint_name,
+		x.table_schema,
 		x.table_name,
 		x.column_name,
+		y.table_schema as referenced_table_schema,
 		y.table_name as referenced_table_name,
-		y.column_name as referenced_column_name
+		y.column_name as referenced_column_name,
+		p.confdeltype::text,
+		p.confupdtype::text
 	FROM information_schema.referential_constraints c
+	JOIN pg_namespace n
+		on n.nspname = c.constraint_schema
+	JOIN pg_constraint p
+		on p.connamespace = n.oid
+		and p.conname = c.constraint_name
+		and p.contype = 'f'
 	JOIN information_schema.key_column_usage x
-		on x.constraint_name = c.constraint_name
+		on x.constraint_schema = c.constraint_schema
+		and x.constraint_name = c.constraint_name
 	JOIN information_schema.key_column_usage y
 		on y.ordinal_position = x.position_in_unique_constraint
+		and y.constraint_schema = c.unique_constraint_schema
 		and y.constraint_name = c.unique_constraint_name
-	ORDER BY c.constraint_name, x.ordinal_position;`)
+	ORDER BY c.constraint_schema, c.constraint_name, x.ordinal_position;`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var constraintName, tableName, columnName, refTableName, refColumnName string
-		if err := rows.Scan(&constraintName, &tableName, &columnName, &refTableName, &refColumnName); err != nil {
+		var constraintSchema, constraintName, tableSchema, tableName, columnName, refTableSchema, refTableName, refColumnName, delType, updType string
+		if err := rows.Scan(&constraintSchema, &constraintName, &tableSchema, &tableName, &columnName, &refTableSchema, &refTableName, &refColumnName, &delType, &updType); err != nil {
 			return nil, err
 		}
-		if constraint, ok := constraintsMap[constraintName]; ok {
+		// constraint names are only unique within a schema
+		key := constraintSchema + "." + constraintName
+		if constraint, ok := constraintsMap[key]; ok {
 			constraint.ColumnNames = append(constraint.ColumnNames, columnName)
 			constraint.RefColumnNames = append(constraint.RefColumnNames, refColumnName)
-			if refTableName != constraint.RefTableName || tableName != constraint.TableName {
+			if refTableSchema != constraint.RefTableSchema || refTableName != constraint.RefTableName || tableSchema != constraint.TableSchema || tableName != constraint.TableName {
 				return nil, fmt.Errorf("same constraint name %s contains different table/ref tables name", constraintName)
 			}
-			constraintsMap[constraintName] = constraint
+			constraintsMap[key] = constraint
 		} else {
-			constraintsMap[constraintName] = foreignKeyConstraint{ConstraintName: constraintName, TableName: tableName, ColumnNames: []string{columnName}, RefTableName: refTableName, RefColumnNames: []string{refColumnName}}
+			constraintsMap[key] = foreignKeyConstraint{ConstraintName: constraintName, TableSchema: tableSchema, TableName: tableName, ColumnNames: []string{columnName}, RefTableSchema: refTableSchema, RefTableName: refTableName, RefColumnNames: []string{refColumnName}, OnDelete: referentialActions[delType], OnUpdate: referentialActions[updType]}
 		}
 
 	}
@@ -350,13 +768,101 @@ func (d *database) getForeignKeyConstraints(ctx context.Context) ([]foreignKeyCo
 	return constraints, rows.Err()
 }
 
-func (d *database) getTableTriggers(ctx context.Context, tablename string) (map[string]trigger, error) {
+// getTableUserTriggers returns the BEFORE and AFTER triggers of a table
+// together with their functions, ordered by name as postgres fires them.
+func (d *database) getTableUserTriggers(ctx context.Context, schema, tablename string) ([]tableTrigger, error) {
+	rows, err := d.connPool.Query(ctx, `
+	SELECT t.tgname, pg_get_triggerdef(t.oid), (t.tgtype & 1) <> 0, (t.tgtype & 2) <> 0,
+		array_remove(ARRAY[
+			CASE WHEN (t.tgtype & 4) <> 0 THEN 'INSERT' END,
+			CASE WHEN (t.tgtype & 16) <> 0 THEN 'UPDATE' END,
+			CASE WHEN (t.tgtype & 8) <> 0 THEN 'DELETE' END,
+			CASE WHEN (t.tgtype & 32) <> 0 THEN 'TRUNCATE' END
+		], NULL),
+		t.tgoldtable IS NOT NULL OR t.tgnewtable IS NOT NULL,
+		fn.nspname, p.proname, pg_get_functiondef(p.oid)
+	FROM pg_trigger t
+	JOIN pg_class c ON c.oid = t.tgrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	JOIN pg_proc p ON p.oid = t.tgfoid
+	JOIN pg_namespace fn ON fn.oid = p.pronamespace
+	WHERE n.nspname = $1 AND c.relname = $2 AND NOT t.tgisinternal AND (t.tgtype & 64) = 0
+	ORDER BY t.tgname`, schema, tablename)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var triggers []tableTrigger
+	for rows.Next() {
+		var t tableTrigger
+		if err := rows.Scan(&t.Name, &t.Definition, &t.Row, &t.Before, &t.Events, &t.Transition, &t.FunctionSchema, &t.FunctionName, &t.FunctionDef); err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, t)
+	}
+	return triggers, rows.Err()
+}
+
+// getTableInheritance fills in the tables t inherits from, whether it is
+// partitioned and the bound of the partition it is.
+func (d *database) getTableInheritance(ctx context.Context, t *table) error {
+	var schemas, names []string
+	err := d.connPool.QueryRow(ctx, `
+	SELECT c.relkind = 'p',
+		coalesce(pg_get_partition_constraintdef(c.oid), ''),
+		coalesce(pg_get_expr(c.relpartbound, c.oid) = 'DEFAULT', false),
+		ARRAY(SELECT pn.nspname::text FROM pg_inherits i JOIN pg_class p ON p.oid = i.inhparent JOIN pg_namespace pn ON pn.oid = p.relnamespace WHERE i.inhrelid = c.oid ORDER BY i.inhseqno),
+		ARRAY(SELECT p.relname::text FROM pg_inherits i JOIN pg_class p ON p.oid = i.inhparent WHERE i.inhrelid = c.oid ORDER BY i.inhseqno)
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE n.nspname = $1 AND c.relname = $2 AND c.relkind IN ('r', 'p')`, t.Schema, t.Name).Scan(&t.Partitioned, &t.PartitionBound, &t.DefaultPartition, &schemas, &names)
+	if err != nil {
+		return err
+	}
+	t.Inherits = nil
+	for i := range names {
+		t.Inherits = append(t.Inherits, tableKey(schemas[i], names[i]))
+	}
+	return nil
+}
+
+// children returns the tables that inherit from t directly, or its
+// partitions, ordered by tableKey with the default partition last.
+func (d *database) children(t *table) []*table {
+	var children []*table
+	for _, child := range d.Tables {
+		if slices.Contains(child.Inherits, t.key()) {
+			children = append(children, child)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].DefaultPartition != children[j].DefaultPartition {
+			return children[j].DefaultPartition
+		}
+		return children[i].key() < children[j].key()
+	})
+	return children
+}
+
+// depth returns the length of the longest chain of tables t inherits from.
+func (d *database) depth(t *table) int {
+	depth := 0
+	for _, key := range t.Inherits {
+		if parent, ok := d.Tables[key]; ok {
+			depth = max(depth, d.depth(parent)+1)
+		}
+	}
+	return depth
+}
+
+func (d *database) getTableTriggers(ctx context.Context, schema, tablename string) (map[string]trigger, error) {
 	triggers := map[string]trigger{}
 	rows, err := d.connPool.Query(
 		ctx,
 		`select trigger_name, event_manipulation, action_statement, action_orientation, action_timing from information_schema.triggers
-		WHERE event_object_table=$1`,
-		tablename,
+		WHERE event_object_schema=$1 AND event_object_table=$2`,
+		schema, tablename,
 	)
 	if err != nil {
 		return nil, err
@@ -383,7 +889,7 @@ func (d *database) getTableTriggers(ctx context.Context, tablename string) (map[
 func (d *database) getStoredProcedure(ctx context.Context, funcName string) (string, error) {
 	var prosrc string
 	d.connPool.QueryRow(ctx, `
-	SELECT prosrc FROM pg_proc WHERE proname = $1;
+	SELECT prosrc FROM pg_proc WHERE oid = $1::regproc;
 	`, funcName).Scan(&prosrc)
 	return prosrc, nil
 }
@@ -116,14 +116,18 @@ func TestListTableMetadata(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		var tableKeys []string
+		for _, t := range tables {
+			tableKeys = append(tableKeys, t.key())
+		}
 		expectedTables := []string{"users", "contacts"}
-		if diff := cmp.Diff(expectedTables, tables, sortStringSlice); diff != "" {
+		if diff := cmp.Diff(expectedTables, tableKeys, sortStringSlice); diff != "" {
 			t.Errorf("(-want,+got):\n%s", diff)
 		}
 	})
 
 	t.Run("GetTableColumns", func(t *testing.T) {
-		cols, err := database.getTableCols(ctx, "users")
+		cols, err := database.getTableCols(ctx, database.connPool, "public", "users")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -134,23 +138,27 @@ func TestListTableMetadata(t *testing.T) {
 				DataType:               "character",
 				CharacterMaximumLength: 12,
 				Nullable:               "NO",
+				Type:                   "character(12)",
 			},
 			"username": {
 				Name:                   "username",
 				DataType:               "character varying",
 				CharacterMaximumLength: 64,
 				Nullable:               "NO",
+				Type:                   "character varying(64)",
 			},
 			"passhash": {
 				Name:     "passhash",
 				DataType: "bytea",
 				Nullable: "NO",
+				Type:     "bytea",
 			},
 			"birthday": {
 				Name:                   "birthday",
 				DataType:               "date",
 				CharacterMaximumLength: 0,
 				Nullable:               "YES",
+				Type:                   "date",
 			},
 		}
 		if diff := cmp.Diff(cols, want); diff != "" {
@@ -159,7 +167,7 @@ func TestListTableMetadata(t *testing.T) {
 	})
 
 	t.Run("GetTableIndexes", func(t *testing.T) {
-		indexes, err := database.getTableIndexes(ctx, "users")
+		indexes, err := database.getTableIndexes(ctx, "public", "users")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -172,8 +180,31 @@ func TestListTableMetadata(t *testing.T) {
 		}
 	})
 
+	t.Run("GetTableIndexesSkipsExpressionAndPartialIndexes", func(t *testing.T) {
+		_, err := connPool.Exec(ctx, `
+		CREATE UNIQUE INDEX users_lower_username ON users (lower(username));
+		CREATE UNIQUE INDEX users_birthday_known ON users (birthday) WHERE birthday IS NOT NULL;
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer connPool.Exec(ctx, `DROP INDEX users_lower_username, users_birthday_known`)
+
+		indexes, err := database.getTableIndexes(ctx, "public", "users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, idx := range indexes {
+			names = append(names, idx.Name)
+		}
+		if diff := cmp.Diff([]string{"users_pkey", "users_username_key"}, names, sortStringSlice); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
 	t.Run("GetTableRules", func(t *testing.T) {
-		rules, err := database.getTableRules(ctx, "users")
+		rules, err := database.getTableRules(ctx, "public", "users")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -193,10 +224,14 @@ func TestListTableMetadata(t *testing.T) {
 		expectedConstraints := []foreignKeyConstraint{
 			{
 				ConstraintName: "contacts_username_fkey",
+				TableSchema:    "public",
 				TableName:      "contacts",
 				ColumnNames:    []string{"username"},
+				RefTableSchema: "public",
 				RefTableName:   "users",
 				RefColumnNames: []string{"username"},
+				OnDelete:       "NO ACTION",
+				OnUpdate:       "NO ACTION",
 			},
 		}
 
@@ -228,7 +263,7 @@ func TestListTableMetadata(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		triggers, err := database.getTableTriggers(ctx, "users")
+		triggers, err := database.getTableTriggers(ctx, "public", "users")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -268,19 +303,20 @@ func TestListTableMetadata(t *testing.T) {
 		}
 
 		expectedUserTable := &table{
-			Name: "users",
+			Schema: "public",
+			Name:   "users",
 			Cols: map[string]column{
-				"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-				"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-				"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO"},
-				"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES"},
+				"accountid": {Name: "accountid", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+				"username":  {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+				"passhash":  {Name: "passhash", DataType: "bytea", Nullable: "NO", Type: "bytea"},
+				"birthday":  {Name: "birthday", DataType: "date", Nullable: "YES", Type: "date"},
 			},
 			Indexes: []index{
 				{Name: "users_pkey", ColumnNames: []string{"accountid"}, IndexDef: "CREATE UNIQUE INDEX users_pkey ON public.users USING btree (accountid)", IsUnique: true},
 				{Name: "users_username_key", ColumnNames: []string{"username"}, IndexDef: "CREATE UNIQUE INDEX users_username_key ON public.users USING btree (username)", IsUnique: true}},
 			Rules: []rule{{Name: "prevent_update", Definition: "CREATE RULE prevent_update AS ON UPDATE TO public.users DO INSTEAD NOTHING;"}},
 			References: []reference{
-				{ConstraintName: "contacts_username_fkey", BeRefedTableName: "users", BeRefedColumnNames: []string{"username"}, ForeignKeyTableName: "contacts", ForeignKeyColumnNames: []string{"username"}},
+				{ConstraintName: "contacts_username_fkey", BeRefedTableSchema: "public", BeRefedTableName: "users", BeRefedColumnNames: []string{"username"}, ForeignKeyTableSchema: "public", ForeignKeyTableName: "contacts", ForeignKeyColumnNames: []string{"username"}, OnDelete: "NO ACTION", OnUpdate: "NO ACTION"},
 			},
 		}
 		if diff := cmp.Diff(expectedUserTable, database.Tables["users"], idxOpt, ruleOpt, sortStringSlice); diff != "" {
@@ -288,15 +324,16 @@ func TestListTableMetadata(t *testing.T) {
 		}
 
 		expectedContactTable := &table{
-			Name: "contacts",
+			Schema: "public",
+			Name:   "contacts",
 			Cols: map[string]column{
-				"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO"},
-				"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"},
-				"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO"},
+				"account_num": {Name: "account_num", DataType: "character", CharacterMaximumLength: 12, Nullable: "NO", Type: "character(12)"},
+				"username":    {Name: "username", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO", Type: "character varying(64)"},
+				"is_external": {Name: "is_external", DataType: "boolean", Nullable: "NO", Type: "boolean"},
 			},
 			ForeignKeyConstraints: []foreignKeyConstraint{
 				{
-					ConstraintName: "contacts_username_fkey", TableName: "contacts", ColumnNames: []string{"username"}, RefTableName: "users", RefColumnNames: []string{"username"}},
+					ConstraintName: "contacts_username_fkey", TableSchema: "public", TableName: "contacts", ColumnNames: []string{"username"}, RefTableSchema: "public", RefTableName: "users", RefColumnNames: []string{"username"}, OnDelete: "NO ACTION", OnUpdate: "NO ACTION"},
 			},
 		}
 		if diff := cmp.Diff(expectedContactTable, database.Tables["contacts"], idxOpt, ruleOpt, sortStringSlice); diff != "" {
@@ -336,10 +373,14 @@ func TestListTableMetadata(t *testing.T) {
 		expectedConstraints := []foreignKeyConstraint{
 			{
 				ConstraintName: "testb_c_d_fkey",
+				TableSchema:    "public",
 				TableName:      "testb",
 				ColumnNames:    []string{"c", "d"},
+				RefTableSchema: "public",
 				RefTableName:   "testa",
 				RefColumnNames: []string{"a", "b"},
+				OnDelete:       "NO ACTION",
+				OnUpdate:       "NO ACTION",
 			},
 		}
 
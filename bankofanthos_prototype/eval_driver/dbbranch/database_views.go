@@ -0,0 +1,105 @@
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// cloneRelations creates the sequences and the views of the database in the
+// branch. The views read from the R' views of the branch instead of the
+// production tables, so that they show the rows of the branch. Views that
+// exist already are left alone, so that it also recreates the views dropped
+// together with an R' view. c.mu must be held.
+func (c *cloneDdl) cloneRelations(ctx context.Context) error {
+	// unqualified names in queries of the branch, e.g. nextval('ids'), resolve
+	// to the copies through the search_path
+	for _, seq := range c.database.Sequences {
+		if _, err := c.cloneSequence(ctx, seq, branchSchema(c.namespace, seq.Schema)); err != nil {
+			return fmt.Errorf("failed to clone sequence %s: %w", seq.qualifiedName(), err)
+		}
+	}
+
+	relations := map[string]bool{}
+	for key := range c.clonedTables {
+		relations[key] = true
+	}
+	for _, v := range c.database.Views {
+		relations[tableKey(v.Schema, v.Name)] = true
+	}
+
+	c.views = nil
+	for _, v := range c.database.Views {
+		clone := *v
+		clone.Schema = branchSchema(c.namespace, v.Schema)
+		clone.Definition = relocate(v.Definition, c.namespace, relations)
+		clone.Indexes = nil
+		for _, idx := range v.Indexes {
+			idx = strings.Replace(relocate(idx, c.namespace, relations), " INDEX ", " INDEX IF NOT EXISTS ", 1)
+			clone.Indexes = append(clone.Indexes, idx)
+		}
+
+		query := fmt.Sprintf("CREATE OR REPLACE VIEW %s AS %s;", clone.qualifiedName(), clone.Definition)
+		if clone.Materialized {
+			query = fmt.Sprintf("CREATE MATERIALIZED VIEW IF NOT EXISTS %s AS %s;", clone.qualifiedName(), clone.Definition)
+		}
+		if _, err := c.conn().Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to clone view %s: %w", v.qualifiedName(), err)
+		}
+		for _, idx := range clone.Indexes {
+			if _, err := c.conn().Exec(ctx, idx); err != nil {
+				return fmt.Errorf("failed to index view %s: %w", clone.qualifiedName(), err)
+			}
+		}
+		c.views = append(c.views, &clone)
+	}
+	return nil
+}
+
+// refreshMaterializedViews recomputes the materialized views of the branch
+// from the rows of the branch, views before the views that read from them.
+func (c *cloneDdl) refreshMaterializedViews(ctx context.Context) error {
+	for _, v := range c.views {
+		if !v.Materialized {
+			continue
+		}
+		if _, err := c.conn().Exec(ctx, fmt.Sprintf("REFRESH MATERIALIZED VIEW %s;", v.qualifiedName())); err != nil {
+			return fmt.Errorf("failed to refresh %s: %w", v.qualifiedName(), err)
+		}
+	}
+	return nil
+}
+
+// relocate rewrites the schema qualified references in sql to the relations
+// in relations, keyed by tableKey, to their copies in the branch in namespace.
+// The copies have the names of the production relations.
+func relocate(sql, namespace string, relations map[string]bool) string {
+	var tokens []token
+	for _, t := range lex(sql) {
+		if t.kind != tokSpace {
+			tokens = append(tokens, t)
+		}
+	}
+
+	var b strings.Builder
+	last := 0
+	for i := 0; i+2 < len(tokens); i++ {
+		// b in a.b.c is a relation, not a schema
+		if i > 0 && tokens[i-1].is(".") {
+			continue
+		}
+		schema, ok := tokens[i].ident()
+		if !ok || !tokens[i+1].is(".") {
+			continue
+		}
+		name, ok := tokens[i+2].ident()
+		if !ok || !relations[tableKey(schema, name)] {
+			continue
+		}
+		b.WriteString(sql[last:tokens[i].start])
+		b.WriteString(quoteIdent(branchSchema(namespace, schema)))
+		last = tokens[i].start + len(tokens[i].text)
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
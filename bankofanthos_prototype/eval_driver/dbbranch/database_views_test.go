@@ -0,0 +1,184 @@
+package dbbranch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRelocate(t *testing.T) {
+	relations := map[string]bool{"users": true, "billing.invoices": true, "adults": true}
+	for _, test := range []struct {
+		sql  string
+		want string
+	}{
+		{
+			" SELECT users.username FROM public.users WHERE users.birthday < '2000-01-01'::date",
+			` SELECT users.username FROM "b1".users WHERE users.birthday < '2000-01-01'::date`,
+		},
+		{
+			" SELECT i.id FROM billing.invoices i JOIN public.adults a ON a.accountid = i.accountid",
+			` SELECT i.id FROM "b1$billing".invoices i JOIN "b1".adults a ON a.accountid = i.accountid`,
+		},
+		{
+			// relations that are not branched and names in strings stay
+			" SELECT 'public.users' AS s FROM public.other, \"public\".\"users\"",
+			` SELECT 'public.users' AS s FROM public.other, "b1"."users"`,
+		},
+		{
+			"CREATE UNIQUE INDEX adults_idx ON public.adults USING btree (accountid)",
+			`CREATE UNIQUE INDEX adults_idx ON "b1".adults USING btree (accountid)`,
+		},
+	} {
+		if diff := cmp.Diff(test.want, relocate(test.sql, "b1", relations)); diff != "" {
+			t.Errorf("relocate(%q) (-want,+got):\n%s", test.sql, diff)
+		}
+	}
+}
+
+func TestCloneViews(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO users(accountid, username, passhash, birthday) VALUES
+	('101122611122', 'alice', '1234', '2000-01-01');
+
+	CREATE VIEW names AS SELECT username FROM users;
+	CREATE VIEW long_names AS SELECT username FROM names WHERE length(username) > 3;
+	CREATE MATERIALIZED VIEW name_count AS SELECT count(*) AS n FROM names;
+	CREATE UNIQUE INDEX name_count_idx ON name_count (n);
+	CREATE SEQUENCE ticket_ids;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO b.users(accountid, username, passhash) VALUES
+	('103362343333', 'bob', '2345'),
+	('107744137744', 'eve', '3456');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Views", func(t *testing.T) {
+		rows, err := connPool.Query(ctx, `SELECT username FROM b.long_names ORDER BY username`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"alice"}, names); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+
+		var n int
+		if err := connPool.QueryRow(ctx, `SELECT count(*) FROM b.names`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("rows of the branch view: got %d, want 3", n)
+		}
+		if err := connPool.QueryRow(ctx, `SELECT count(*) FROM public.names`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("rows of the production view: got %d, want 1", n)
+		}
+	})
+
+	t.Run("MaterializedViews", func(t *testing.T) {
+		a, err := brancher.Branch(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := brancher.ComputeDiffAtN(ctx, a, b, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			view string
+			want int
+		}{
+			{"public.name_count", 1},
+			{"a.name_count", 1},
+			{"b.name_count", 3},
+		} {
+			var n int
+			if err := connPool.QueryRow(ctx, "SELECT n FROM "+test.view).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != test.want {
+				t.Errorf("%s: got %d, want %d", test.view, n, test.want)
+			}
+		}
+	})
+
+	t.Run("Sequences", func(t *testing.T) {
+		conn, err := connPool.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Release()
+		if _, err := conn.Exec(ctx, "SET search_path TO "+b.SearchPath()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Exec(ctx, "SELECT nextval('ticket_ids')"); err != nil {
+			t.Fatal(err)
+		}
+
+		var called bool
+		if err := connPool.QueryRow(ctx, "SELECT is_called FROM public.ticket_ids").Scan(&called); err != nil {
+			t.Fatal(err)
+		}
+		if called {
+			t.Error("the branch advanced the production sequence")
+		}
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		if err := b.Migrate(ctx, `ALTER TABLE users ADD COLUMN email TEXT`); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := connPool.QueryRow(ctx, `SELECT count(*) FROM b.long_names`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("rows of the recreated view: got %d, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,292 @@
+// This file applies the rules for the columns whose values differ between
+// branches even if the services behave the same, like timestamps, UUIDs and
+// generated ids. An ignored column is left out of the comparison altogether.
+// The values of the other columns with a rule are equal if they are within a
+// tolerance, or if a key mapping maps the value of A onto the value of B.
+// Rows that A and B inserted and that only differ by such values are shown
+// side by side as one row, like the rows both inserted.
+package dbbranch
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ColumnRule tells the diff how to compare a column.
+type ColumnRule struct {
+	Ignore    bool     // leave the column out of the diff
+	Tolerance float64  // numbers that differ by at most Tolerance are equal, and so are times that differ by at most Tolerance seconds
+	MapBy     []string // the values of rows of the table in A and B that agree on the MapBy columns are equal
+	MapLike   string   // the values are equal if the mapping of column MapLike, as table.column, maps them onto each other
+	Key       bool     // the column is part of the logical key of a table without a primary key, see row_matching.go
+}
+
+// DiffRules holds the column rules of a database by table key and column
+// name, e.g. rules["transactions"]["timestamp"].
+type DiffRules map[string]map[string]ColumnRule
+
+// ignored returns the columns of table the diff leaves out.
+func (r DiffRules) ignored(table string) map[string]bool {
+	ignored := map[string]bool{}
+	for col, rule := range r[table] {
+		if rule.Ignore {
+			ignored[col] = true
+		}
+	}
+	return ignored
+}
+
+// compares reports whether table has columns that are compared by a rule
+// rather than ignored.
+func (r DiffRules) compares(table string) bool {
+	for _, rule := range r[table] {
+		if rule.Tolerance > 0 || len(rule.MapBy) > 0 || rule.MapLike != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that no column is both ignored and compared by a rule, and
+// that every MapLike names a column with MapBy.
+func (r DiffRules) Validate() error {
+	for table, cols := range r {
+		for col, rule := range cols {
+			if rule.Ignore && (rule.Tolerance != 0 || len(rule.MapBy) > 0 || rule.MapLike != "" || rule.Key) {
+				return fmt.Errorf("column %s.%s is ignored and compared", table, col)
+			}
+			if rule.MapLike == "" {
+				continue
+			}
+			other, ok := r.rule(rule.MapLike)
+			if !ok || len(other.MapBy) == 0 {
+				return fmt.Errorf("column %s.%s maps like %s, which has no mapping", table, col, rule.MapLike)
+			}
+		}
+	}
+	return nil
+}
+
+// rule returns the rule of the column table.column.
+func (r DiffRules) rule(column string) (ColumnRule, bool) {
+	i := strings.LastIndex(column, ".")
+	if i < 0 {
+		return ColumnRule{}, false
+	}
+	rule, ok := r[column[:i]][column[i+1:]]
+	return rule, ok
+}
+
+// apply sets the matchers of the diffs of the tables with rules, and pairs
+// the rows A and B inserted that only differ by the values the rules make
+// equal.
+func (r DiffRules) apply(diffs map[string]*Diff) {
+	mappings := map[string]map[string]string{}
+	for table, cols := range r {
+		for col, rule := range cols {
+			if diff, ok := diffs[table]; ok && len(rule.MapBy) > 0 {
+				mappings[table+"."+col] = keyMapping(diff, col, rule.MapBy)
+			}
+		}
+	}
+
+	for table, cols := range r {
+		diff, ok := diffs[table]
+		if !ok || len(diff.ColNames) == 0 || !r.compares(table) {
+			continue
+		}
+		m := &ColumnMatcher{Rules: make([]ColumnRule, len(diff.ColNames)), Mappings: make([]map[string]string, len(diff.ColNames))}
+		for i, name := range diff.ColNames {
+			rule := cols[name]
+			m.Rules[i] = rule
+			switch {
+			case len(rule.MapBy) > 0:
+				m.Mappings[i] = mappings[table+"."+name]
+			case rule.MapLike != "":
+				m.Mappings[i] = mappings[rule.MapLike]
+			}
+		}
+		diff.Matcher = m
+		diff.pairInserted()
+	}
+}
+
+// keyMapping maps the values of col in A onto those in B of the rows that
+// agree on the by columns.
+func keyMapping(diff *Diff, col string, by []string) map[string]string {
+	index := func(name string) int {
+		for i, n := range diff.ColNames {
+			if n == name {
+				return i
+			}
+		}
+		return -1
+	}
+	colIdx := index(col)
+	var byIdx []int
+	for _, name := range by {
+		byIdx = append(byIdx, index(name))
+	}
+	if colIdx < 0 || len(diff.ColNames) == 0 {
+		return nil
+	}
+
+	key := func(row Row) (string, bool) {
+		var values Row
+		for _, i := range byIdx {
+			if i < 0 {
+				return "", false
+			}
+			values = append(values, row[i])
+		}
+		return valueList(values), true
+	}
+	valuesA := map[string]any{}
+	for _, row := range diff.Control {
+		if row.empty() {
+			continue
+		}
+		if k, ok := key(*row); ok {
+			valuesA[k] = (*row)[colIdx]
+		}
+	}
+	mapping := map[string]string{}
+	for _, row := range diff.Experimental {
+		if row.empty() {
+			continue
+		}
+		if k, ok := key(*row); ok {
+			if a, ok := valuesA[k]; ok {
+				mapping[fmt.Sprint(a)] = fmt.Sprint((*row)[colIdx])
+			}
+		}
+	}
+	return mapping
+}
+
+// empty reports whether the row stands for no row, like the rows that a side
+// of a diff misses.
+func (r *Row) empty() bool {
+	if r == nil {
+		return true
+	}
+	for _, v := range *r {
+		if v != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ColumnMatcher compares the values of the columns of a diff by their rules.
+type ColumnMatcher struct {
+	Rules    []ColumnRule        // by position in Diff.ColNames
+	Mappings []map[string]string // the texts of the values of A onto those of B, by position
+}
+
+// equal reports whether a and b, the values of column col, are equal. The
+// key mapping only applies if a is the value in A and b the value in B.
+func (m *ColumnMatcher) equal(col int, a any, b any, mapped bool) bool {
+	if fmt.Sprint(a) == fmt.Sprint(b) {
+		return true
+	}
+	if m == nil || a == nil || b == nil {
+		return false
+	}
+	rule := m.Rules[col]
+	if mapped && m.Mappings[col] != nil {
+		if to, ok := m.Mappings[col][fmt.Sprint(a)]; ok && to == fmt.Sprint(b) {
+			return true
+		}
+	}
+	if rule.Tolerance > 0 {
+		if ta, ok := a.(time.Time); ok {
+			if tb, ok := b.(time.Time); ok {
+				return math.Abs(ta.Sub(tb).Seconds()) <= rule.Tolerance
+			}
+		}
+		fa, okA := toFloat(a)
+		fb, okB := toFloat(b)
+		return okA && okB && math.Abs(fa-fb) <= rule.Tolerance
+	}
+	return false
+}
+
+// toFloat converts a number scanned from postgres to a float64.
+func toFloat(v any) (float64, bool) {
+	if assigner, ok := v.(interface{ AssignTo(dst any) error }); ok {
+		var f float64
+		return f, assigner.AssignTo(&f) == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.CanInt():
+		return float64(rv.Int()), true
+	case rv.CanUint():
+		return float64(rv.Uint()), true
+	case rv.CanFloat():
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// rowsEqual reports whether the rows a of A and b of B are equal by the rules.
+func (m *ColumnMatcher) rowsEqual(a Row, b Row) bool {
+	for i := range a {
+		if !m.equal(i, a[i], b[i], true) {
+			return false
+		}
+	}
+	return true
+}
+
+// pairInserted shows a row only A inserted and a row only B inserted as one
+// row if they are equal by the rules.
+func (d *Diff) pairInserted() {
+	insertedBy := func(side []*Row, other []*Row, i int) bool {
+		return !side[i].empty() && d.Baseline[i].empty() && other[i].empty()
+	}
+	paired := map[int]bool{}
+	for i := range d.Control {
+		if !insertedBy(d.Control, d.Experimental, i) {
+			continue
+		}
+		for j := range d.Experimental {
+			if paired[j] || !insertedBy(d.Experimental, d.Control, j) {
+				continue
+			}
+			if d.Matcher.rowsEqual(*d.Control[i], *d.Experimental[j]) {
+				d.Experimental[i] = d.Experimental[j]
+				paired[j] = true
+				break
+			}
+		}
+	}
+	d.removeRows(paired)
+}
+
+// Equal reports whether the values of column col in the rows at position row
+// are equal, by the rules of the table if the diff has any. The rows a side
+// misses are not compared.
+func (d *Diff) Equal(row int, col int) bool {
+	baseline, control, experimental := d.Baseline[row], d.Control[row], d.Experimental[row]
+	for _, pair := range []struct {
+		a, b   *Row
+		mapped bool
+	}{
+		{baseline, control, false},
+		{baseline, experimental, false},
+		{control, experimental, true},
+	} {
+		if pair.a.empty() || pair.b.empty() {
+			continue
+		}
+		if !d.Matcher.equal(col, (*pair.a)[col], (*pair.b)[col], pair.mapped) {
+			return false
+		}
+	}
+	return true
+}
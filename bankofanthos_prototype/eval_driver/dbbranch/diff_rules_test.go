@@ -0,0 +1,157 @@
+package dbbranch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffRules(t *testing.T) {
+	at := func(sec int) time.Time { return time.Date(2024, 1, 1, 0, 0, sec, 0, time.UTC) }
+	nilRow := func() Row { return Row{nil, nil, nil, nil} }
+
+	// A and B both record a transfer of 10 and of 20 under their own ids and
+	// at slightly different times; only B records a transfer of 30
+	diffs := map[string]*Diff{"transactions": {
+		ColNames: []string{"amount", "from_acct", "timestamp", "transaction_id"},
+		Control: rows(
+			Row{int32(10), "alice", at(0), int64(1)},
+			Row{int32(20), "bob", at(10), int64(2)},
+			nilRow(),
+			nilRow(),
+			nilRow(),
+		),
+		Baseline: rows(nilRow(), nilRow(), nilRow(), nilRow(), nilRow()),
+		Experimental: rows(
+			nilRow(),
+			nilRow(),
+			Row{int32(10), "alice", at(2), int64(7)},
+			Row{int32(20), "bob", at(30), int64(8)},
+			Row{int32(30), "carol", at(40), int64(9)},
+		),
+	}}
+	rules := DiffRules{"transactions": {
+		"timestamp":      {Tolerance: 5},
+		"transaction_id": {MapBy: []string{"amount", "from_acct"}},
+	}}
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rules.apply(diffs)
+
+	diff := diffs["transactions"]
+	want := &Diff{
+		ColNames: diff.ColNames,
+		Control: rows(
+			Row{int32(10), "alice", at(0), int64(1)},
+			Row{int32(20), "bob", at(10), int64(2)},
+			nilRow(),
+			nilRow(),
+		),
+		Baseline: rows(nilRow(), nilRow(), nilRow(), nilRow()),
+		Experimental: rows(
+			Row{int32(10), "alice", at(2), int64(7)},
+			nilRow(),
+			Row{int32(20), "bob", at(30), int64(8)},
+			Row{int32(30), "carol", at(40), int64(9)},
+		),
+		Matcher: diff.Matcher,
+	}
+	if d := cmp.Diff(want, diff); d != "" {
+		t.Errorf("(-want,+got):\n%s", d)
+	}
+
+	for _, test := range []struct {
+		row, col int
+		want     bool
+	}{
+		{0, 0, true},
+		{0, 2, true}, // within the tolerance
+		{0, 3, true}, // mapped
+		{2, 2, true}, // a side misses the row
+		{3, 0, true}, // only B has the row
+	} {
+		if got := diff.Equal(test.row, test.col); got != test.want {
+			t.Errorf("Equal(%d, %d) = %t, want %t", test.row, test.col, got, test.want)
+		}
+	}
+	paired := &Diff{
+		ColNames:     diff.ColNames,
+		Control:      rows(Row{int32(20), "bob", at(10), int64(2)}),
+		Baseline:     rows(nilRow()),
+		Experimental: rows(Row{int32(20), "bob", at(30), int64(8)}),
+		Matcher:      diff.Matcher,
+	}
+	if paired.Equal(0, 2) {
+		t.Error("Equal() of times beyond the tolerance")
+	}
+	if !paired.Equal(0, 3) {
+		t.Error("Equal() of mapped ids")
+	}
+
+	for _, invalid := range []DiffRules{
+		{"contacts": {"account_num": {MapLike: "users.accountid"}}},
+		{"users": {"accountid": {Ignore: true, Tolerance: 1}}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%v) succeeded", invalid)
+		}
+	}
+}
+
+func TestIgnoreColumns(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `CREATE TABLE events (msg TEXT, at TIMESTAMP)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := brancher.SetDiffRules(DiffRules{"events": {"at": {Ignore: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := brancher.Branch(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO a.events VALUES ('start', '2024-01-01 00:00:00');
+	INSERT INTO b.events VALUES ('start', '2024-01-01 00:00:01');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := brancher.ComputeDiffAtN(ctx, a, b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := Row{"start"}
+	want := &Diff{
+		ColNames:     []string{"msg"},
+		Control:      []*Row{&start},
+		Baseline:     []*Row{{nil}},
+		Experimental: []*Row{&start},
+	}
+	if diff := cmp.Diff(want, diffs["events"]); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+}
@@ -53,7 +53,7 @@ func TestRaceCondition(t *testing.T) {
 		defer tx1.Rollback(ctx)
 
 		acctId := "111111111111"
-		insertSql := fmt.Sprintf(`INSERT INTO users(accountid, username, passhash, birthday) VALUES
+		insertSql := fmt.Sprintf(`INSERT INTO test.users(accountid, username, passhash, birthday) VALUES
 		('%s', 'eve', '1234', '2002-01-01');`, acctId)
 		_, err = tx1.Exec(ctx, insertSql)
 		if err != nil {
@@ -67,14 +67,14 @@ func TestRaceCondition(t *testing.T) {
 		defer tx2.Rollback(ctx)
 
 		_, err = tx2.Exec(ctx, insertSql)
-		if err != nil && !strings.Contains(err.Error(), "already exists") {
+		if err != nil && !strings.Contains(err.Error(), "duplicate key value") {
 			t.Fatal(err)
 		}
 
 		tx2.Commit(ctx)
 		tx1.Commit(ctx)
 
-		rows, err := connPool.Query(ctx, "SELECT accountid,username FROM users")
+		rows, err := connPool.Query(ctx, "SELECT accountid,username FROM test.users")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -0,0 +1,152 @@
+// This file creates the tables of a lazy branch, which only get R+/R- and
+// their indexes once they are written. Until then R' reads a stub view over
+// the rows of the snapshot. The views, defaults and triggers of R' are still
+// created with the branch, so creating it costs about as many statements as
+// an eager branch; it only saves the tables and indexes. The redirect triggers call a function of the table first, which
+// creates R+/R- in the transaction of the write and replaces the stub with
+// the query of R'. R' itself is never replaced, since postgres does not allow
+// that while the write on it runs; the stub is only read by the write.
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"golang.org/x/exp/maps"
+)
+
+// createLazyView creates the R' view of t over a stub that reads base, and
+// the function that creates the R+/R- tables with columns and their indexes. c.mu must be held.
+func (c *cloneDdl) createLazyView(ctx context.Context, t *clonedTable, base string, columns string) error {
+	r := newView(c.database, t.Snapshot, t.Plus.Schema)
+	stub := &view{Schema: r.Schema, Name: r.Name + "rows", Cols: r.Cols}
+	names := maps.Keys(r.Cols)
+	sort.Strings(names)
+	cols := identList("", names)
+
+	_, err := c.conn().Exec(ctx, fmt.Sprintf(`
+	CREATE VIEW %s AS SELECT %s FROM %s;
+	CREATE VIEW %s AS SELECT %s FROM %s;`, stub.qualifiedName(), cols, base, r.qualifiedName(), cols, stub.qualifiedName()))
+	if err != nil {
+		return fmt.Errorf("failed to create R view, %w", err)
+	}
+	sequences, err := c.setViewDefaults(ctx, r, t.Plus.Schema)
+	if err != nil {
+		return err
+	}
+
+	// the lock makes concurrent first writes wait for the one that creates
+	// R+/R-, after which they find the tables
+	plus := quoteLiteral(t.Plus.qualifiedName())
+	body := fmt.Sprintf(`
+	BEGIN
+	IF to_regclass(%s) IS NOT NULL THEN
+		RETURN;
+	END IF;
+	PERFORM pg_advisory_xact_lock(hashtext(%s));
+	IF to_regclass(%s) IS NOT NULL THEN
+		RETURN;
+	END IF;
+	CREATE TABLE %s(
+ %s
+);
+	CREATE TABLE %s(
+ %s
+);
+	%s
+	CREATE OR REPLACE VIEW %s AS %s;
+	END;
+	`, plus, plus, plus, t.Plus.qualifiedName(), columns, t.Minus.qualifiedName(), columns, indexQuery(t.Snapshot, t.Plus, t.Minus), stub.qualifiedName(), c.viewQuery(t.Snapshot, base, t.Plus, t.Minus))
+	materialize := qualify(r.Schema, t.Snapshot.Name+"_materialize") + "()"
+	_, err = c.conn().Exec(ctx, fmt.Sprintf(`
+	CREATE OR REPLACE FUNCTION %s
+	RETURNS void
+	LANGUAGE plpgsql
+	AS %s;
+	`, materialize, dollarQuote(body)))
+	if err != nil {
+		return fmt.Errorf("failed to create the function that materializes %s: %w", t.Snapshot.qualifiedName(), err)
+	}
+
+	t.View, t.Stub, t.Materialize, t.Sequences = r, stub, materialize, sequences
+	return nil
+}
+
+// materializeCall returns the statement of a redirect trigger function that
+// creates R+/R- of t before the function writes them, or "" if t has them.
+func materializeCall(t *clonedTable) string {
+	if t.Materialize == "" {
+		return ""
+	}
+	return fmt.Sprintf(`
+	PERFORM %s;`, t.Materialize)
+}
+
+// materialized reports whether t has R+/R-: always if the branch created them
+// eagerly, else once t was written.
+func materialized(ctx context.Context, conn queryer, t *clonedTable) (bool, error) {
+	if t.Materialize == "" {
+		return true, nil
+	}
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL;", t.Plus.qualifiedName()).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to look up %s: %w", t.Plus.qualifiedName(), err)
+	}
+	return exists, nil
+}
+
+// materialize creates R+/R- of t, unless it has them already. R' keeps its
+// rows, since R+/R- start empty.
+func materialize(ctx context.Context, conn execer, t *clonedTable) error {
+	if t.Materialize == "" {
+		return nil
+	}
+	if _, err := conn.Exec(ctx, "SELECT "+t.Materialize+";"); err != nil {
+		return fmt.Errorf("failed to materialize %s: %w", t.Snapshot.qualifiedName(), err)
+	}
+	return nil
+}
+
+// written returns the names of the tables of the branch, in the order of
+// names, that have R+/R-. The others were never written and have no deltas.
+func (c *cloneDdl) written(ctx context.Context, names []string) ([]string, error) {
+	var written []string
+	for _, name := range names {
+		ok, err := materialized(ctx, c.database.connPool, c.clonedTables[name])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			written = append(written, name)
+		}
+	}
+	return written, nil
+}
+
+// diffWritten reports whether any table the diff of a and b reads, down to
+// their common base, was written. If none was, a and b hold the rows of the
+// base and the diff skips them.
+func diffWritten(ctx context.Context, conn queryer, a *clonedTable, b *clonedTable) (bool, error) {
+	base := commonAncestor(a, b)
+	for _, t := range []*clonedTable{a, b} {
+		for _, m := range members(t) {
+			for _, t := range append([]*clonedTable{m}, ancestorsUntil(m, inBranchOf(m, base))...) {
+				if ok, err := materialized(ctx, conn, t); err != nil || ok {
+					return ok, err
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// dropStubStmt returns the statement that drops the stub of the lazy table t
+// and its function once R+/R- exist and R' is recreated over them directly,
+// or "" if t is not lazy.
+func dropStubStmt(t *clonedTable) string {
+	if t.Materialize == "" {
+		return ""
+	}
+	return fmt.Sprintf("DROP VIEW %s; DROP FUNCTION %s;", t.Stub.qualifiedName(), t.Materialize)
+}
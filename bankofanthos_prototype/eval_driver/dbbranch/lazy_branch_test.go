@@ -0,0 +1,225 @@
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLazyBranch(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE accounts (id SERIAL PRIMARY KEY, balance INT NOT NULL);
+	CREATE TABLE logs (msg TEXT);
+	CREATE TABLE settings (name TEXT PRIMARY KEY, value TEXT);
+
+	INSERT INTO accounts (balance) VALUES (10), (20);
+	INSERT INTO logs VALUES ('start');
+	INSERT INTO settings VALUES ('mode', 'test');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := brancher.LazyBranch(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := brancher.LazyBranch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(relation string, args ...any) int {
+		t.Helper()
+		var n int
+		if err := connPool.QueryRow(ctx, "SELECT count(*) FROM "+relation, args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	exists := func(relation string) bool {
+		t.Helper()
+		var ok bool
+		if err := connPool.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", relation).Scan(&ok); err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	t.Run("Stub", func(t *testing.T) {
+		for _, relation := range []string{"b.accountsplus", "b.accountsminus", "b.logsplus", "b.settingsplus"} {
+			if exists(relation) {
+				t.Errorf("%s exists before the first write", relation)
+			}
+		}
+		if got, want := count("b.accounts"), 2; got != want {
+			t.Errorf("rows of b.accounts: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("Storage", func(t *testing.T) {
+		eager, err := brancher.Branch(ctx, "eager")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer eager.Delete(ctx)
+
+		// tables and indexes are the relations with storage. Both branches
+		// have the counter tables; the eager one has R+ and R- of the three
+		// tables too, and of accounts and settings their indexes.
+		storage := "pg_class WHERE relnamespace = $1::regnamespace AND relkind IN ('r', 'i')"
+		if got, want := count(storage, "eager")-count(storage, "b"), 10; got != want {
+			t.Errorf("tables and indexes the lazy branch saves: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("FirstWrite", func(t *testing.T) {
+		_, err := connPool.Exec(ctx, `
+		INSERT INTO b.accounts (balance) VALUES (30);
+		UPDATE b.accounts SET balance = 11 WHERE id = 1;
+		DELETE FROM b.logs;
+		INSERT INTO b.logs VALUES ('stop');
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			relation string
+			want     bool
+		}{
+			{"b.accountsplus", true},
+			{"b.accountsminus", true},
+			{"b.logsplus", true},
+			{"b.settingsplus", false},
+			{"a.accountsplus", false},
+		} {
+			if got := exists(test.relation); got != test.want {
+				t.Errorf("%s exists: got %t, want %t", test.relation, got, test.want)
+			}
+		}
+		for _, test := range []struct {
+			relation string
+			want     int
+		}{
+			{"b.accounts", 3},
+			{"b.accounts WHERE balance = 11", 1},
+			{"b.logs WHERE msg = 'stop'", 1},
+			{"public.accounts", 2},
+			{"public.logs WHERE msg = 'start'", 1},
+		} {
+			if got := count(test.relation); got != test.want {
+				t.Errorf("rows of %s: got %d, want %d", test.relation, got, test.want)
+			}
+		}
+		// the first write indexes R+ and R- like the eager branch does
+		if got, want := count("pg_indexes WHERE schemaname = 'b' AND tablename IN ('accountsplus', 'accountsminus')"), 2; got != want {
+			t.Errorf("indexes of R+ and R- of b.accounts: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		diffs, err := brancher.ComputeDiffAtN(ctx, a, b, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := diffs["settings"]; ok {
+			t.Error("diff of a table neither branch wrote")
+		}
+		for _, name := range []string{"accounts", "logs"} {
+			if _, ok := diffs[name]; !ok {
+				t.Errorf("no diff of %s", name)
+			}
+		}
+	})
+
+	t.Run("Fork", func(t *testing.T) {
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		c, err := b.Fork(ctx, "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists("c.accountsplus") {
+			t.Error("c.accountsplus exists before the first write")
+		}
+		if _, err := connPool.Exec(ctx, `INSERT INTO c.settings VALUES ('debug', 'on')`); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := count("c.settings"), 2; got != want {
+			t.Errorf("rows of c.settings: got %d, want %d", got, want)
+		}
+		if got, want := count("c.accounts"), 3; got != want {
+			t.Errorf("rows of c.accounts: got %d, want %d", got, want)
+		}
+		if exists("b.settingsplus") {
+			t.Error("the write to c created b.settingsplus")
+		}
+		diffs, err := brancher.ComputeDiffAtN(ctx, b, c, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := diffs["settings"]; !ok {
+			t.Error("no diff of the table the fork wrote")
+		}
+	})
+}
+
+// BenchmarkBranch compares the time to create an eager and a lazy branch of a
+// database with many tables.
+func BenchmarkBranch(b *testing.B) {
+	ctx := context.Background()
+
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	for i := 0; i < 50; i++ {
+		if _, err := connPool.Exec(ctx, fmt.Sprintf("CREATE TABLE t%d (id SERIAL PRIMARY KEY, name TEXT UNIQUE, value INT)", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name   string
+		branch func(context.Context, string) (*Branch, error)
+	}{
+		{"Eager", brancher.Branch},
+		{"Lazy", brancher.LazyBranch},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				branch, err := bench.branch(ctx, fmt.Sprintf("%s%d", strings.ToLower(bench.name), i))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if err := branch.Delete(ctx); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -7,113 +7,107 @@ import (
 	"sort"
 	"strings"
 
-	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/exp/maps"
 )
 
-func createTriggers(ctx context.Context, connPool *pgxpool.Pool, clonedTable *clonedTable) error {
-	if err := createInsertTriggers(ctx, connPool, clonedTable); err != nil {
+// SQLSTATE codes of the constraint violations the redirect triggers raise
+// and a merge can run into.
+const (
+	notNullViolation    = "23502"
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+	checkViolation      = "23514"
+	exclusionViolation  = "23P01"
+)
+
+func createTriggers(ctx context.Context, conn execer, clonedTable *clonedTable) error {
+	if err := createInsertTriggers(ctx, conn, clonedTable); err != nil {
 		return fmt.Errorf("failed to create insert triggers: %w", err)
 	}
-	if err := createUpdateTriggers(ctx, connPool, clonedTable); err != nil {
+	if err := createUpdateTriggers(ctx, conn, clonedTable); err != nil {
 		return fmt.Errorf("failed to create update triggers: %w", err)
 	}
-	if err := createDeleteTriggers(ctx, connPool, clonedTable); err != nil {
+	if err := createDeleteTriggers(ctx, conn, clonedTable); err != nil {
 		return fmt.Errorf("failed to create delete triggers: %w", err)
 	}
+	if clonedTable.Hierarchy != nil {
+		if err := createRouteTriggers(ctx, conn, clonedTable); err != nil {
+			return fmt.Errorf("failed to create route triggers: %w", err)
+		}
+	}
 
 	return nil
 }
 
-func createInsertTriggers(ctx context.Context, connPool *pgxpool.Pool, clonedTable *clonedTable) error {
-	var cols []string
-	var newCols []string
-	idGeneratorQuery := ""
-	for colname, col := range clonedTable.Plus.Cols {
-		cols = append(cols, colname)
-		newCols = append(newCols, "NEW."+colname)
-		if col.IdGenerator != nil {
-			idGeneratorQuery += fmt.Sprintf(`
-	IF NEW.%s IS NULL THEN
-	NEW.%s := (SELECT COALESCE(MAX(%s)+%d, %d) FROM %s);
-	END IF;`, colname, colname, colname, col.IdGenerator.IndentityIncrement, col.IdGenerator.IdentityMinimum, clonedTable.View.Name)
-		}
-	}
+// redirectColNames returns the sorted column names of the R+/R- tables
+// without the counter column.
+func redirectColNames(clonedTable *clonedTable) []string {
+	cols := maps.Keys(clonedTable.Plus.Cols)
 	sort.Strings(cols)
-	sort.Strings(newCols)
-
-	functionName := fmt.Sprintf("%s_redirect_insert()", clonedTable.View.Name)
+	return cols
+}
 
-	storedProcedureQuery := fmt.Sprintf(`
-	CREATE OR REPLACE FUNCTION %s
-	RETURNS TRIGGER
-	LANGUAGE plpgsql
-	AS $$
+// counterPrologue declares the counter variable and reads the current request
+// id into it. R+/R- of a lazy table are created first.
+func counterPrologue(clonedTable *clonedTable) string {
+	colname := quoteIdent(clonedTable.Counter.Colname)
+	return fmt.Sprintf(`
 	DECLARE %s BIGINT;
-	BEGIN
-	%s := (SELECT id FROM %s);`, functionName, clonedTable.Counter.Colname, clonedTable.Counter.Colname, clonedTable.Counter.Name)
+	BEGIN%s
+	%s := (SELECT id FROM %s);`, colname, materializeCall(clonedTable), colname, clonedTable.Counter.qualifiedName())
+}
 
-	// TODO: make it more generic way for auto-generate id
-	if idGeneratorQuery != "" {
-		storedProcedureQuery += idGeneratorQuery
-	}
+func createInsertTriggers(ctx context.Context, conn execer, clonedTable *clonedTable) error {
+	cols := redirectColNames(clonedTable)
+
+	functionName := qualify(clonedTable.View.Schema, clonedTable.Snapshot.Name+"_redirect_insert") + "()"
+
+	// serial and identity columns are filled by the defaults of the view,
+	// which draw from the sequences of the branch
+	body := counterPrologue(clonedTable)
+	body += hookPhase(clonedTable, "BEFORE", "INSERT")
+	body += generatedColumns(clonedTable)
+	body += constraintChecks(clonedTable, false)
 
 	// TODO: NULL can also be duplicate when we insert into unique columns
 	// check unique columns
 	for _, index := range clonedTable.Snapshot.Indexes {
 		if index.IsUnique {
-			var newColumns []string
-			for _, col := range index.ColumnNames {
-				newColumns = append(newColumns, "NEW."+col)
-			}
-			storedProcedureQuery += fmt.Sprintf(`
+			body += fmt.Sprintf(`
 	IF EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) THEN
-		RAISE EXCEPTION 'column %% already exists', %s;
-	END IF;`, clonedTable.View.Name, strings.Join(index.ColumnNames, ","), strings.Join(newColumns, ","), strings.Join(newColumns, ","))
+		%s
+	END IF;`, clonedTable.View.qualifiedName(), identList("", index.ColumnNames), identList("NEW.", index.ColumnNames), duplicateKey(clonedTable.Snapshot, index))
 		}
 	}
 
 	// if it has foreign key, check if the key exists in reference table
 	for _, constraint := range clonedTable.Snapshot.ForeignKeyConstraints {
 		//TODO: check if foreign key constraint is valid, for example, sometimes refer to the same table
-		if constraint.RefTableName != constraint.TableName {
-			var newRefColumns []string
-			for _, col := range constraint.RefColumnNames {
-				newRefColumns = append(newRefColumns, "NEW."+col)
-			}
-			storedProcedureQuery += fmt.Sprintf(`
-				IF NOT EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) THEN
-				RAISE EXCEPTION 'violates foreign key constraint, forigen key does not exist in %s table';
-				END IF;`, constraint.RefTableName, strings.Join(constraint.RefColumnNames, ","), strings.Join(newRefColumns, ","), constraint.RefTableName)
+		if tableKey(constraint.RefTableSchema, constraint.RefTableName) != tableKey(constraint.TableSchema, constraint.TableName) {
+			body += fmt.Sprintf(`
+				IF (%s) IS NOT NULL AND NOT EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) THEN
+				%s
+				END IF;`, identList("NEW.", constraint.ColumnNames), viewName(clonedTable.Namespace, constraint.RefTableSchema, constraint.RefTableName), identList("", constraint.RefColumnNames), identList("NEW.", constraint.ColumnNames), missingKey(constraint))
 
 		}
 	}
 
 	// insert id to cols
-	cols = append(cols, clonedTable.Counter.Colname)
-	newCols = append(newCols, clonedTable.Counter.Colname)
-	storedProcedureQuery += fmt.Sprintf(`
-	INSERT INTO %s (%s) 
-	VALUES (%s);
+	body += fmt.Sprintf(`
+	INSERT INTO %s (%s, %s)
+	VALUES (%s, %s);%s
 	RETURN NEW;
 	END;
-	$$;
-	`, clonedTable.Plus.Name, strings.Join(cols, ", "), strings.Join(newCols, ", "))
-
-	triggerName := fmt.Sprintf("%s_redirect_insert_trigger", clonedTable.View.Name)
+	`, clonedTable.Plus.qualifiedName(), identList("", cols), quoteIdent(clonedTable.Counter.Colname), identList("NEW.", cols), quoteIdent(clonedTable.Counter.Colname), hookPhase(clonedTable, "AFTER", "INSERT"))
 
-	triggerQuery := fmt.Sprintf(`
-	CREATE OR REPLACE TRIGGER %s
-	INSTEAD OF INSERT ON %s
-	FOR EACH ROW
-	EXECUTE PROCEDURE %s_redirect_insert();
-`, triggerName, clonedTable.View.Name, clonedTable.View.Name)
+	triggerName := fmt.Sprintf("%s_redirect_insert_trigger", clonedTable.Snapshot.Name)
 
-	_, err := connPool.Exec(ctx, storedProcedureQuery)
+	_, err := conn.Exec(ctx, createTriggerFunctionStmt(functionName, body))
 	if err != nil {
 		return err
 	}
 
-	_, err = connPool.Exec(ctx, triggerQuery)
+	_, err = conn.Exec(ctx, createTriggerStmt(triggerName, "INSERT", clonedTable.View.qualifiedName(), functionName))
 	if err != nil {
 		return err
 	}
@@ -123,106 +117,73 @@ func createInsertTriggers(ctx context.Context, connPool *pgxpool.Pool, clonedTab
 	return nil
 }
 
-func createUpdateTriggers(ctx context.Context, connPool *pgxpool.Pool, clonedTable *clonedTable) error {
-	var cols []string
-	var newCols []string
-	var oldCols []string
-	for colname := range clonedTable.Plus.Cols {
-		cols = append(cols, colname)
-		oldCols = append(oldCols, "OLD."+colname)
-		newCols = append(newCols, "NEW."+colname)
-	}
-	sort.Strings(cols)
-	sort.Strings(oldCols)
-	sort.Strings(newCols)
+func createUpdateTriggers(ctx context.Context, conn execer, clonedTable *clonedTable) error {
+	cols := redirectColNames(clonedTable)
 
-	functionName := fmt.Sprintf("%s_redirect_update()", clonedTable.View.Name)
+	functionName := qualify(clonedTable.View.Schema, clonedTable.Snapshot.Name+"_redirect_update") + "()"
 
-	storedProcedureQuery := fmt.Sprintf(`
-	CREATE OR REPLACE FUNCTION %s
-	RETURNS TRIGGER
-	LANGUAGE plpgsql
-	AS $$
-	DECLARE %s BIGINT;
-	BEGIN
-	%s := (SELECT id FROM %s);`, functionName, clonedTable.Counter.Colname, clonedTable.Counter.Colname, clonedTable.Counter.Name)
+	body := counterPrologue(clonedTable)
+	body += hookPhase(clonedTable, "BEFORE", "UPDATE")
+	body += generatedColumns(clonedTable)
+	body += constraintChecks(clonedTable, true)
 
 	for _, index := range clonedTable.Snapshot.Indexes {
 		if index.IsUnique {
-			var newColumns []string
-			var oldColumns []string
-			for _, col := range index.ColumnNames {
-				newColumns = append(newColumns, "NEW."+col)
-				oldColumns = append(oldColumns, "OLD."+col)
-			}
-			storedProcedureQuery += fmt.Sprintf(`
+			body += fmt.Sprintf(`
 	IF EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) AND (%s) != (%s) THEN
-		RAISE EXCEPTION 'column %% already exists', %s;
-	END IF;`, clonedTable.View.Name, strings.Join(index.ColumnNames, ","), strings.Join(newColumns, ","), strings.Join(newColumns, ","), strings.Join(oldColumns, ","), strings.Join(newColumns, ","))
+		%s
+	END IF;`, clonedTable.View.qualifiedName(), identList("", index.ColumnNames), identList("NEW.", index.ColumnNames), identList("NEW.", index.ColumnNames), identList("OLD.", index.ColumnNames), duplicateKey(clonedTable.Snapshot, index))
 		}
 	}
 
 	// if it has foreign key, check if the key exists in reference table
 	for _, constraint := range clonedTable.Snapshot.ForeignKeyConstraints {
-		if constraint.RefTableName != constraint.TableName {
-			var newRefColumns []string
-			for _, col := range constraint.RefColumnNames {
-				newRefColumns = append(newRefColumns, "NEW."+col)
-			}
-			storedProcedureQuery += fmt.Sprintf(`
-	IF NOT EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) THEN
-		RAISE EXCEPTION 'violates foreign key constraint, forigen key does not exist in %s table';
-	END IF;`, constraint.RefTableName, strings.Join(constraint.RefColumnNames, ","), strings.Join(newRefColumns, ","), constraint.RefTableName)
+		if tableKey(constraint.RefTableSchema, constraint.RefTableName) != tableKey(constraint.TableSchema, constraint.TableName) {
+			body += fmt.Sprintf(`
+	IF (%s) IS NOT NULL AND NOT EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) THEN
+		%s
+	END IF;`, identList("NEW.", constraint.ColumnNames), viewName(clonedTable.Namespace, constraint.RefTableSchema, constraint.RefTableName), identList("", constraint.RefColumnNames), identList("NEW.", constraint.ColumnNames), missingKey(constraint))
 		}
 	}
 
-	// TODO: Add other foreign key actions
-	// check if the key is referenced by other table
+	// check if the key is referenced by other table, or cascade the new key
+	actions := ""
 	for _, ref := range clonedTable.Snapshot.References {
-		if ref.Action == "" {
-			if len(ref.ForeignKeyColumnNames) != len(ref.BeRefedColumnNames) {
-				return fmt.Errorf("different length for forign key column names %v and be refed columns names %v", ref.ForeignKeyColumnNames, ref.BeRefedColumnNames)
-			}
-			var oldRefColumns []string
-			var newRefColumns []string
-			for _, col := range ref.BeRefedColumnNames {
-				oldRefColumns = append(oldRefColumns, "OLD."+col)
-				newRefColumns = append(newRefColumns, "NEW."+col)
-			}
-			storedProcedureQuery += fmt.Sprintf(`
-	IF EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) AND (%s) != (%s) THEN
-		RAISE EXCEPTION 'violates foreign key constraint';
-	END IF;`, ref.ForeignKeyTableName, strings.Join(ref.ForeignKeyColumnNames, ","), strings.Join(oldRefColumns, ","), strings.Join(newRefColumns, ","), strings.Join(oldRefColumns, ","))
+		if len(ref.ForeignKeyColumnNames) != len(ref.BeRefedColumnNames) {
+			return fmt.Errorf("different length for forign key column names %v and be refed columns names %v", ref.ForeignKeyColumnNames, ref.BeRefedColumnNames)
 		}
+		if action := referentialAction(clonedTable.Namespace, ref, ref.OnUpdate, "NEW."); action != "" {
+			actions += fmt.Sprintf(`
+	IF (%s) IS DISTINCT FROM (%s) THEN%s
+	END IF;`, identList("NEW.", ref.BeRefedColumnNames), identList("OLD.", ref.BeRefedColumnNames), action)
+			continue
+		}
+		body += fmt.Sprintf(`
+	IF EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) AND (%s) != (%s) THEN
+		%s
+	END IF;`, viewName(clonedTable.Namespace, ref.ForeignKeyTableSchema, ref.ForeignKeyTableName), identList("", ref.ForeignKeyColumnNames), identList("OLD.", ref.BeRefedColumnNames), identList("NEW.", ref.BeRefedColumnNames), identList("OLD.", ref.BeRefedColumnNames), referencedKey(ref))
 	}
 
 	// insert id to cols
-	cols = append(cols, clonedTable.Counter.Colname)
-	newCols = append(newCols, clonedTable.Counter.Colname)
-	oldCols = append(oldCols, clonedTable.Counter.Colname)
+	counterCol := quoteIdent(clonedTable.Counter.Colname)
+	body += fmt.Sprintf(`
+	INSERT INTO %s (%s, %s) VALUES (%s, %s);
+	INSERT INTO %s (%s, %s) VALUES (%s, %s);`, clonedTable.Minus.qualifiedName(), identList("", cols), counterCol, identList("OLD.", cols), counterCol, clonedTable.Plus.qualifiedName(), identList("", cols), counterCol, identList("NEW.", cols), counterCol)
 
-	storedProcedureQuery += fmt.Sprintf(`
-	INSERT INTO %s (%s) VALUES (%s);
-	INSERT INTO %s (%s) VALUES (%s);
+	// the referencing rows are changed once the new key is visible in R'
+	body += actions + hookPhase(clonedTable, "AFTER", "UPDATE") + `
 	RETURN NEW;
 	END;
-	$$;
-	`, clonedTable.Minus.Name, strings.Join(cols, ", "), strings.Join(oldCols, ", "), clonedTable.Plus.Name, strings.Join(cols, ", "), strings.Join(newCols, ", "))
-
-	triggerName := fmt.Sprintf("%s_redirect_update_trigger", clonedTable.View.Name)
-	triggerQuery := fmt.Sprintf(`
-	CREATE OR REPLACE TRIGGER %s
-	INSTEAD OF UPDATE ON %s
-	FOR EACH ROW
-	EXECUTE PROCEDURE %s_redirect_update();
-`, triggerName, clonedTable.View.Name, clonedTable.View.Name)
-
-	_, err := connPool.Exec(ctx, storedProcedureQuery)
+	`
+
+	triggerName := fmt.Sprintf("%s_redirect_update_trigger", clonedTable.Snapshot.Name)
+
+	_, err := conn.Exec(ctx, createTriggerFunctionStmt(functionName, body))
 	if err != nil {
 		return err
 	}
 
-	_, err = connPool.Exec(ctx, triggerQuery)
+	_, err = conn.Exec(ctx, createTriggerStmt(triggerName, "UPDATE", clonedTable.View.qualifiedName(), functionName))
 	if err != nil {
 		return err
 	}
@@ -233,71 +194,49 @@ func createUpdateTriggers(ctx context.Context, connPool *pgxpool.Pool, clonedTab
 	return nil
 }
 
-func createDeleteTriggers(ctx context.Context, connPool *pgxpool.Pool, clonedTable *clonedTable) error {
-	var cols []string
-	var oldCols []string
-	for colname := range clonedTable.Plus.Cols {
-		cols = append(cols, colname)
-		oldCols = append(oldCols, "OLD."+colname)
-	}
-	sort.Strings(cols)
-	sort.Strings(oldCols)
+func createDeleteTriggers(ctx context.Context, conn execer, clonedTable *clonedTable) error {
+	cols := redirectColNames(clonedTable)
 
-	functionName := fmt.Sprintf("%s_redirect_delete()", clonedTable.View.Name)
+	functionName := qualify(clonedTable.View.Schema, clonedTable.Snapshot.Name+"_redirect_delete") + "()"
 
-	storedProcedureQuery := fmt.Sprintf(`
-	CREATE OR REPLACE FUNCTION %s
-	RETURNS TRIGGER
-	LANGUAGE plpgsql
-	AS $$
-	DECLARE %s BIGINT;
-	BEGIN
-	%s := (SELECT id FROM %s);`, functionName, clonedTable.Counter.Colname, clonedTable.Counter.Colname, clonedTable.Counter.Name)
+	body := counterPrologue(clonedTable)
+	body += hookPhase(clonedTable, "BEFORE", "DELETE")
 
-	// TODO: Add other foreign key actions
-	// check if the key is referenced by other table
+	// check if the key is referenced by other table, or cascade the delete
+	actions := ""
 	for _, ref := range clonedTable.Snapshot.References {
-		if ref.Action == "" {
-			if len(ref.ForeignKeyColumnNames) != len(ref.BeRefedColumnNames) {
-				return fmt.Errorf("different length for forign key column names %v and be refed columns names %v", ref.ForeignKeyColumnNames, ref.BeRefedColumnNames)
-			}
-			var oldRefColumns []string
-			for _, col := range ref.BeRefedColumnNames {
-				oldRefColumns = append(oldRefColumns, "OLD."+col)
-			}
-			storedProcedureQuery += fmt.Sprintf(`
-	IF EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) THEN
-		RAISE EXCEPTION 'violates foreign key constraint';
-	END IF;`, ref.ForeignKeyTableName, strings.Join(ref.ForeignKeyColumnNames, ","), strings.Join(oldRefColumns, ","))
+		if len(ref.ForeignKeyColumnNames) != len(ref.BeRefedColumnNames) {
+			return fmt.Errorf("different length for forign key column names %v and be refed columns names %v", ref.ForeignKeyColumnNames, ref.BeRefedColumnNames)
 		}
-
+		if action := referentialAction(clonedTable.Namespace, ref, ref.OnDelete, ""); action != "" {
+			actions += action
+			continue
+		}
+		body += fmt.Sprintf(`
+	IF EXISTS (SELECT * FROM %s WHERE (%s) = (%s)) THEN
+		%s
+	END IF;`, viewName(clonedTable.Namespace, ref.ForeignKeyTableSchema, ref.ForeignKeyTableName), identList("", ref.ForeignKeyColumnNames), identList("OLD.", ref.BeRefedColumnNames), referencedKey(ref))
 	}
 
 	// insert id to cols
-	cols = append(cols, clonedTable.Counter.Colname)
-	oldCols = append(oldCols, clonedTable.Counter.Colname)
+	counterCol := quoteIdent(clonedTable.Counter.Colname)
+	body += fmt.Sprintf(`
+	INSERT INTO %s (%s, %s) VALUES (%s, %s);`, clonedTable.Minus.qualifiedName(), identList("", cols), counterCol, identList("OLD.", cols), counterCol)
 
-	storedProcedureQuery += fmt.Sprintf(`
-	INSERT INTO %s (%s) VALUES (%s);
+	// the referencing rows are changed once the row is gone from R'
+	body += actions + hookPhase(clonedTable, "AFTER", "DELETE") + `
 	RETURN OLD;
 	END;
-	$$;
-	`, clonedTable.Minus.Name, strings.Join(cols, ", "), strings.Join(oldCols, ", "))
-
-	triggerName := fmt.Sprintf("%s_redirect_delete_trigger", clonedTable.View.Name)
-	triggerQuery := fmt.Sprintf(`
-	CREATE OR REPLACE TRIGGER %s
-	INSTEAD OF DELETE ON %s
-	FOR EACH ROW
-	EXECUTE PROCEDURE %s_redirect_delete();
-`, triggerName, clonedTable.View.Name, clonedTable.View.Name)
-
-	_, err := connPool.Exec(ctx, storedProcedureQuery)
+	`
+
+	triggerName := fmt.Sprintf("%s_redirect_delete_trigger", clonedTable.Snapshot.Name)
+
+	_, err := conn.Exec(ctx, createTriggerFunctionStmt(functionName, body))
 	if err != nil {
 		return err
 	}
 
-	_, err = connPool.Exec(ctx, triggerQuery)
+	_, err = conn.Exec(ctx, createTriggerStmt(triggerName, "DELETE", clonedTable.View.qualifiedName(), functionName))
 	if err != nil {
 		return err
 	}
@@ -307,3 +246,164 @@ func createDeleteTriggers(ctx context.Context, connPool *pgxpool.Pool, clonedTab
 
 	return nil
 }
+
+// duplicateKey returns the error raised when the NEW row duplicates the key of
+// a unique index of t.
+func duplicateKey(t *table, index index) string {
+	return violation{
+		Code:       uniqueViolation,
+		Message:    fmt.Sprintf("duplicate key value violates unique constraint \"%s\"", index.Name),
+		Schema:     t.Schema,
+		Table:      t.Name,
+		Constraint: index.Name,
+		Detail:     keyDetail("NEW", index.ColumnNames, "already exists."),
+	}.raise()
+}
+
+// missingKey returns the error raised when the NEW row references a key that
+// does not exist.
+func missingKey(constraint foreignKeyConstraint) string {
+	return violation{
+		Code:       foreignKeyViolation,
+		Message:    fmt.Sprintf("insert or update on table \"%s\" violates foreign key constraint \"%s\"", constraint.TableName, constraint.ConstraintName),
+		Schema:     constraint.TableSchema,
+		Table:      constraint.TableName,
+		Constraint: constraint.ConstraintName,
+		Detail:     keyDetail("NEW", constraint.ColumnNames, fmt.Sprintf("is not present in table \"%s\".", constraint.RefTableName)),
+	}.raise()
+}
+
+// referencedKey returns the error raised when the OLD row is still referenced
+// and ref forbids changing it. Like postgres, it names the referencing table.
+func referencedKey(ref reference) string {
+	return violation{
+		Code:       foreignKeyViolation,
+		Message:    fmt.Sprintf("update or delete on table \"%s\" violates foreign key constraint \"%s\" on table \"%s\"", ref.BeRefedTableName, ref.ConstraintName, ref.ForeignKeyTableName),
+		Schema:     ref.ForeignKeyTableSchema,
+		Table:      ref.ForeignKeyTableName,
+		Constraint: ref.ConstraintName,
+		Detail:     keyDetail("OLD", ref.BeRefedColumnNames, fmt.Sprintf("is still referenced from table \"%s\".", ref.ForeignKeyTableName)),
+	}.raise()
+}
+
+// generatedColumns returns the assignments that compute the stored generated
+// columns of the NEW row, which R+ stores as plain columns. Like postgres, it
+// overwrites whatever the statement put there, so that RETURNING sees the
+// computed values.
+func generatedColumns(clonedTable *clonedTable) string {
+	assignments := ""
+	for _, colname := range redirectColNames(clonedTable) {
+		expr := clonedTable.Snapshot.Cols[colname].Generated
+		if expr == "" {
+			continue
+		}
+		assignments += fmt.Sprintf(`
+	NEW.%s := (SELECT %s FROM (SELECT NEW.*) AS t);`, quoteIdent(colname), expr)
+	}
+	return assignments
+}
+
+// constraintChecks returns the checks of the NOT NULL, CHECK and EXCLUDE
+// constraints of the production table for the NEW row, in the order postgres
+// runs them. The R+ table enforces NOT NULL as well, but it would report R+
+// rather than the production table. On update, the OLD row does not conflict
+// with the NEW row.
+func constraintChecks(clonedTable *clonedTable, update bool) string {
+	snapshot := clonedTable.Snapshot
+	checks := ""
+	for _, colname := range redirectColNames(clonedTable) {
+		if snapshot.Cols[colname].Nullable != "NO" {
+			continue
+		}
+		checks += fmt.Sprintf(`
+	IF NEW.%s IS NULL THEN
+		%s
+	END IF;`, quoteIdent(colname), violation{
+			Code:    notNullViolation,
+			Message: fmt.Sprintf("null value in column \"%s\" of relation \"%s\" violates not-null constraint", colname, snapshot.Name),
+			Schema:  snapshot.Schema,
+			Table:   snapshot.Name,
+			Column:  colname,
+		}.raise())
+	}
+
+	if check := partitionCheck(clonedTable); check != "" {
+		checks += fmt.Sprintf(`
+	IF NOT %s THEN
+		%s
+	END IF;`, check, violation{
+			Code:    checkViolation,
+			Message: fmt.Sprintf("new row for relation \"%s\" violates partition constraint", snapshot.Name),
+			Schema:  snapshot.Schema,
+			Table:   snapshot.Name,
+		}.raise())
+	}
+
+	// a CHECK constraint is satisfied unless it evaluates to false
+	for _, constraint := range snapshot.CheckConstraints {
+		checks += fmt.Sprintf(`
+	IF (SELECT %s FROM (SELECT NEW.*) AS t) IS FALSE THEN
+		%s
+	END IF;`, constraint.Expression, violation{
+			Code:       checkViolation,
+			Message:    fmt.Sprintf("new row for relation \"%s\" violates check constraint \"%s\"", snapshot.Name, constraint.Name),
+			Schema:     snapshot.Schema,
+			Table:      snapshot.Name,
+			Constraint: constraint.Name,
+		}.raise())
+	}
+
+	for _, constraint := range snapshot.ExclusionConstraints {
+		conds := make([]string, len(constraint.ColumnNames))
+		for i, col := range constraint.ColumnNames {
+			conds[i] = fmt.Sprintf("t.%s %s NEW.%s", quoteIdent(col), constraint.Operators[i], quoteIdent(col))
+		}
+		if update {
+			conds = append(conds, "ROW(t.*) IS DISTINCT FROM ROW(OLD.*)")
+		}
+		checks += fmt.Sprintf(`
+	IF EXISTS (SELECT * FROM %s AS t WHERE %s) THEN
+		%s
+	END IF;`, clonedTable.View.qualifiedName(), strings.Join(conds, " AND "), violation{
+			Code:       exclusionViolation,
+			Message:    fmt.Sprintf("conflicting key value violates exclusion constraint \"%s\"", constraint.Name),
+			Schema:     snapshot.Schema,
+			Table:      snapshot.Name,
+			Constraint: constraint.Name,
+		}.raise())
+	}
+	return checks
+}
+
+// referentialAction returns the statements that apply the ON DELETE or ON
+// UPDATE action of ref to the rows that reference the OLD key, or an empty
+// string if the action forbids the change instead. The rows are changed
+// through the R' view of the referencing table, so that its own triggers
+// record the change and cascade it further. newPrefix is the record that holds
+// the new key of an update, empty for a delete.
+func referentialAction(namespace string, ref reference, action, newPrefix string) string {
+	view := viewName(namespace, ref.ForeignKeyTableSchema, ref.ForeignKeyTableName)
+	var set []string
+	switch action {
+	case "CASCADE":
+		if newPrefix == "" {
+			return fmt.Sprintf(`
+	DELETE FROM %s WHERE (%s) = (%s);`, view, identList("", ref.ForeignKeyColumnNames), identList("OLD.", ref.BeRefedColumnNames))
+		}
+		for i, col := range ref.ForeignKeyColumnNames {
+			set = append(set, quoteIdent(col)+" = "+newPrefix+quoteIdent(ref.BeRefedColumnNames[i]))
+		}
+	case "SET NULL":
+		for _, col := range ref.ForeignKeyColumnNames {
+			set = append(set, quoteIdent(col)+" = NULL")
+		}
+	case "SET DEFAULT":
+		for _, col := range ref.ForeignKeyColumnNames {
+			set = append(set, quoteIdent(col)+" = DEFAULT")
+		}
+	default:
+		return ""
+	}
+	return fmt.Sprintf(`
+	UPDATE %s SET %s WHERE (%s) = (%s);`, view, strings.Join(set, ", "), identList("", ref.ForeignKeyColumnNames), identList("OLD.", ref.BeRefedColumnNames))
+}
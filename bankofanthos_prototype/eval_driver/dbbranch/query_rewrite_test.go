@@ -2,9 +2,12 @@ package dbbranch
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/jackc/pgconn"
 )
 
 func TestQueryRewrite(t *testing.T) {
@@ -41,30 +44,39 @@ func TestQueryRewrite(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		triggers, err := database.getTableTriggers(ctx, "users")
+		triggers, err := database.getTableTriggers(ctx, "test", "users")
 		if err != nil {
 			t.Fatal(err)
 		}
 		expectedTriggers := trigger{
 			Name:              "users_redirect_insert_trigger",
 			EventManipulation: "INSERT",
-			ActionStatement:   "EXECUTE FUNCTION users_redirect_insert()",
+			ActionStatement:   "EXECUTE FUNCTION test.users_redirect_insert()",
 			ActionOrientation: "ROW",
 			ActionTiming:      "INSTEAD OF",
 			Procedure: &procedure{
-				Name: "users_redirect_insert",
+				Name: "test.users_redirect_insert",
 				ProSrc: `
-				DECLARE rid BIGINT;
+				DECLARE "rid" BIGINT;
 				BEGIN
-				rid := (SELECT id FROM test.rid);
-				IF EXISTS (SELECT * FROM users WHERE (accountid) = (NEW.accountid)) THEN
-					RAISE EXCEPTION 'column % already exists', NEW.accountid;
+				"rid" := (SELECT id FROM "test"."rid");
+				IF NEW."accountid" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "accountid" of relation "users" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'users', COLUMN = 'accountid';
 				END IF;
-				IF EXISTS (SELECT * FROM users WHERE (username) = (NEW.username)) THEN
-					RAISE EXCEPTION 'column % already exists', NEW.username;
+				IF NEW."passhash" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "passhash" of relation "users" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'users', COLUMN = 'passhash';
 				END IF;
-				INSERT INTO test.usersplus (accountid, birthday, passhash, username, rid)    
-				VALUES (NEW.accountid, NEW.birthday, NEW.passhash, NEW.username, rid);
+				IF NEW."username" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "username" of relation "users" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'users', COLUMN = 'username';
+				END IF;
+				IF EXISTS (SELECT * FROM "test"."users" WHERE ("accountid") = (NEW."accountid")) THEN
+					RAISE EXCEPTION 'duplicate key value violates unique constraint "users_pkey"' USING ERRCODE = '23505', SCHEMA = 'public', TABLE = 'users', CONSTRAINT = 'users_pkey', DETAIL = 'Key (' || concat_ws(', ', quote_ident('accountid')) || ')=(' || concat_ws(', ', COALESCE(NEW."accountid"::text, 'null')) || ')' || ' already exists.';
+				END IF;
+				IF EXISTS (SELECT * FROM "test"."users" WHERE ("username") = (NEW."username")) THEN
+					RAISE EXCEPTION 'duplicate key value violates unique constraint "users_username_key"' USING ERRCODE = '23505', SCHEMA = 'public', TABLE = 'users', CONSTRAINT = 'users_username_key', DETAIL = 'Key (' || concat_ws(', ', quote_ident('username')) || ')=(' || concat_ws(', ', COALESCE(NEW."username"::text, 'null')) || ')' || ' already exists.';
+				END IF;
+				INSERT INTO "test"."usersplus" ("accountid", "birthday", "passhash", "username", "rid")    
+				VALUES (NEW."accountid", NEW."birthday", NEW."passhash", NEW."username", "rid");
 				RETURN NEW;
 				END;
 				`,
@@ -82,27 +94,36 @@ func TestQueryRewrite(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		triggers, err := database.getTableTriggers(ctx, "contacts")
+		triggers, err := database.getTableTriggers(ctx, "test", "contacts")
 		if err != nil {
 			t.Fatal(err)
 		}
 		expectedTriggers := trigger{
 			Name:              "contacts_redirect_insert_trigger",
 			EventManipulation: "INSERT",
-			ActionStatement:   "EXECUTE FUNCTION contacts_redirect_insert()",
+			ActionStatement:   "EXECUTE FUNCTION test.contacts_redirect_insert()",
 			ActionOrientation: "ROW",
 			ActionTiming:      "INSTEAD OF",
 			Procedure: &procedure{
-				Name: "contacts_redirect_insert",
+				Name: "test.contacts_redirect_insert",
 				ProSrc: `
-				DECLARE rid BIGINT;
+				DECLARE "rid" BIGINT;
 				BEGIN
-				rid := (SELECT id FROM test.rid);
-				IF NOT EXISTS (SELECT * FROM users WHERE (username) = (NEW.username)) THEN
-				RAISE EXCEPTION 'violates foreign key constraint, forigen key does not exist in  users table';
+				"rid" := (SELECT id FROM "test"."rid");
+				IF NEW."account_num" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "account_num" of relation "contacts" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'contacts', COLUMN = 'account_num';
+				END IF;
+				IF NEW."is_external" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "is_external" of relation "contacts" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'contacts', COLUMN = 'is_external';
 				END IF;
-				INSERT INTO test.contactsplus (account_num, is_external, username, rid)    
-				VALUES (NEW.account_num, NEW.is_external, NEW.username, rid);
+				IF NEW."username" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "username" of relation "contacts" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'contacts', COLUMN = 'username';
+				END IF;
+				IF (NEW."username") IS NOT NULL AND NOT EXISTS (SELECT * FROM "test"."users" WHERE ("username") = (NEW."username")) THEN
+				RAISE EXCEPTION 'insert or update on table "contacts" violates foreign key constraint "contacts_username_fkey"' USING ERRCODE = '23503', SCHEMA = 'public', TABLE = 'contacts', CONSTRAINT = 'contacts_username_fkey', DETAIL = 'Key (' || concat_ws(', ', quote_ident('username')) || ')=(' || concat_ws(', ', COALESCE(NEW."username"::text, 'null')) || ')' || ' is not present in table "users".';
+				END IF;
+				INSERT INTO "test"."contactsplus" ("account_num", "is_external", "username", "rid")    
+				VALUES (NEW."account_num", NEW."is_external", NEW."username", "rid");
 				RETURN NEW;
 				END;
 				`,
@@ -120,33 +141,42 @@ func TestQueryRewrite(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		triggers, err := database.getTableTriggers(ctx, "users")
+		triggers, err := database.getTableTriggers(ctx, "test", "users")
 		if err != nil {
 			t.Fatal(err)
 		}
 		expectedTriggers := trigger{
 			Name:              "users_redirect_update_trigger",
 			EventManipulation: "UPDATE",
-			ActionStatement:   "EXECUTE FUNCTION users_redirect_update()",
+			ActionStatement:   "EXECUTE FUNCTION test.users_redirect_update()",
 			ActionOrientation: "ROW",
 			ActionTiming:      "INSTEAD OF",
 			Procedure: &procedure{
-				Name: "users_redirect_update",
+				Name: "test.users_redirect_update",
 				ProSrc: `
-				DECLARE rid BIGINT;
+				DECLARE "rid" BIGINT;
 				BEGIN
-				rid := (SELECT id FROM test.rid);
-				IF EXISTS (SELECT * FROM users WHERE (accountid) = (NEW.accountid)) AND (NEW.accountid) != (OLD.accountid) THEN
-					RAISE EXCEPTION 'column % already exists', NEW.accountid;
+				"rid" := (SELECT id FROM "test"."rid");
+				IF NEW."accountid" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "accountid" of relation "users" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'users', COLUMN = 'accountid';
+				END IF;
+				IF NEW."passhash" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "passhash" of relation "users" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'users', COLUMN = 'passhash';
+				END IF;
+				IF NEW."username" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "username" of relation "users" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'users', COLUMN = 'username';
 				END IF;
-				IF EXISTS (SELECT * FROM users WHERE (username) = (NEW.username)) AND (NEW.username) != (OLD.username) THEN
-                	RAISE EXCEPTION 'column % already exists', NEW.username;
+				IF EXISTS (SELECT * FROM "test"."users" WHERE ("accountid") = (NEW."accountid")) AND (NEW."accountid") != (OLD."accountid") THEN
+					RAISE EXCEPTION 'duplicate key value violates unique constraint "users_pkey"' USING ERRCODE = '23505', SCHEMA = 'public', TABLE = 'users', CONSTRAINT = 'users_pkey', DETAIL = 'Key (' || concat_ws(', ', quote_ident('accountid')) || ')=(' || concat_ws(', ', COALESCE(NEW."accountid"::text, 'null')) || ')' || ' already exists.';
+				END IF;
+				IF EXISTS (SELECT * FROM "test"."users" WHERE ("username") = (NEW."username")) AND (NEW."username") != (OLD."username") THEN
+                	RAISE EXCEPTION 'duplicate key value violates unique constraint "users_username_key"' USING ERRCODE = '23505', SCHEMA = 'public', TABLE = 'users', CONSTRAINT = 'users_username_key', DETAIL = 'Key (' || concat_ws(', ', quote_ident('username')) || ')=(' || concat_ws(', ', COALESCE(NEW."username"::text, 'null')) || ')' || ' already exists.';
        			END IF;
-				IF EXISTS (SELECT * FROM contacts WHERE (username) = (OLD.username)) AND (NEW.username) != (OLD.username) THEN
-				RAISE EXCEPTION 'violates foreign key constraint';
+				IF EXISTS (SELECT * FROM "test"."contacts" WHERE ("username") = (OLD."username")) AND (NEW."username") != (OLD."username") THEN
+				RAISE EXCEPTION 'update or delete on table "users" violates foreign key constraint "contacts_username_fkey" on table "contacts"' USING ERRCODE = '23503', SCHEMA = 'public', TABLE = 'contacts', CONSTRAINT = 'contacts_username_fkey', DETAIL = 'Key (' || concat_ws(', ', quote_ident('username')) || ')=(' || concat_ws(', ', COALESCE(OLD."username"::text, 'null')) || ')' || ' is still referenced from table "contacts".';
 				END IF;
-				INSERT INTO test.usersminus (accountid, birthday, passhash, username, rid) VALUES (OLD.accountid, OLD.birthday, OLD.passhash, OLD.username, rid);
-				INSERT INTO test.usersplus (accountid, birthday, passhash, username, rid) VALUES (NEW.accountid, NEW.birthday, NEW.passhash, NEW.username, rid);
+				INSERT INTO "test"."usersminus" ("accountid", "birthday", "passhash", "username", "rid") VALUES (OLD."accountid", OLD."birthday", OLD."passhash", OLD."username", "rid");
+				INSERT INTO "test"."usersplus" ("accountid", "birthday", "passhash", "username", "rid") VALUES (NEW."accountid", NEW."birthday", NEW."passhash", NEW."username", "rid");
 				RETURN NEW;
 				END;
 				`,
@@ -164,27 +194,36 @@ func TestQueryRewrite(t *testing.T) {
 			t.Error(err)
 		}
 
-		triggers, err := database.getTableTriggers(ctx, "contacts")
+		triggers, err := database.getTableTriggers(ctx, "test", "contacts")
 		if err != nil {
 			t.Fatal(err)
 		}
 		expectedTriggers := trigger{
 			Name:              "contacts_redirect_update_trigger",
 			EventManipulation: "UPDATE",
-			ActionStatement:   "EXECUTE FUNCTION contacts_redirect_update()",
+			ActionStatement:   "EXECUTE FUNCTION test.contacts_redirect_update()",
 			ActionOrientation: "ROW",
 			ActionTiming:      "INSTEAD OF",
 			Procedure: &procedure{
-				Name: "contacts_redirect_update",
+				Name: "test.contacts_redirect_update",
 				ProSrc: `
-				DECLARE rid BIGINT;
+				DECLARE "rid" BIGINT;
 				BEGIN
-				rid := (SELECT id FROM test.rid);
-				IF NOT EXISTS (SELECT * FROM users WHERE (username) = (NEW.username)) THEN
-				RAISE EXCEPTION 'violates foreign key constraint, forigen key does not exist in users table';
+				"rid" := (SELECT id FROM "test"."rid");
+				IF NEW."account_num" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "account_num" of relation "contacts" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'contacts', COLUMN = 'account_num';
+				END IF;
+				IF NEW."is_external" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "is_external" of relation "contacts" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'contacts', COLUMN = 'is_external';
+				END IF;
+				IF NEW."username" IS NULL THEN
+					RAISE EXCEPTION 'null value in column "username" of relation "contacts" violates not-null constraint' USING ERRCODE = '23502', SCHEMA = 'public', TABLE = 'contacts', COLUMN = 'username';
+				END IF;
+				IF (NEW."username") IS NOT NULL AND NOT EXISTS (SELECT * FROM "test"."users" WHERE ("username") = (NEW."username")) THEN
+				RAISE EXCEPTION 'insert or update on table "contacts" violates foreign key constraint "contacts_username_fkey"' USING ERRCODE = '23503', SCHEMA = 'public', TABLE = 'contacts', CONSTRAINT = 'contacts_username_fkey', DETAIL = 'Key (' || concat_ws(', ', quote_ident('username')) || ')=(' || concat_ws(', ', COALESCE(NEW."username"::text, 'null')) || ')' || ' is not present in table "users".';
 				END IF;
-				INSERT INTO test.contactsminus (account_num, is_external, username, rid) VALUES (OLD.account_num, OLD.is_external, OLD.username, rid);
-				INSERT INTO test.contactsplus (account_num, is_external, username, rid) VALUES (NEW.account_num, NEW.is_external, NEW.username, rid);
+				INSERT INTO "test"."contactsminus" ("account_num", "is_external", "username", "rid") VALUES (OLD."account_num", OLD."is_external", OLD."username", "rid");
+				INSERT INTO "test"."contactsplus" ("account_num", "is_external", "username", "rid") VALUES (NEW."account_num", NEW."is_external", NEW."username", "rid");
 				RETURN NEW;
 				END;
 				`,
@@ -202,26 +241,26 @@ func TestQueryRewrite(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		triggers, err := database.getTableTriggers(ctx, "users")
+		triggers, err := database.getTableTriggers(ctx, "test", "users")
 		if err != nil {
 			t.Fatal(err)
 		}
 		expectedTriggers := trigger{
 			Name:              "users_redirect_delete_trigger",
 			EventManipulation: "DELETE",
-			ActionStatement:   "EXECUTE FUNCTION users_redirect_delete()",
+			ActionStatement:   "EXECUTE FUNCTION test.users_redirect_delete()",
 			ActionOrientation: "ROW",
 			ActionTiming:      "INSTEAD OF",
 			Procedure: &procedure{
-				Name: "users_redirect_delete",
+				Name: "test.users_redirect_delete",
 				ProSrc: `
-				DECLARE rid BIGINT;
+				DECLARE "rid" BIGINT;
 				BEGIN
-				rid := (SELECT id FROM test.rid);
-				IF EXISTS (SELECT * FROM contacts WHERE (username) = (OLD.username)) THEN
-				RAISE EXCEPTION 'violates foreign key constraint';
+				"rid" := (SELECT id FROM "test"."rid");
+				IF EXISTS (SELECT * FROM "test"."contacts" WHERE ("username") = (OLD."username")) THEN
+				RAISE EXCEPTION 'update or delete on table "users" violates foreign key constraint "contacts_username_fkey" on table "contacts"' USING ERRCODE = '23503', SCHEMA = 'public', TABLE = 'contacts', CONSTRAINT = 'contacts_username_fkey', DETAIL = 'Key (' || concat_ws(', ', quote_ident('username')) || ')=(' || concat_ws(', ', COALESCE(OLD."username"::text, 'null')) || ')' || ' is still referenced from table "contacts".';
 				END IF;
-				INSERT INTO test.usersminus (accountid, birthday, passhash, username, rid) VALUES (OLD.accountid, OLD.birthday, OLD.passhash, OLD.username, rid);
+				INSERT INTO "test"."usersminus" ("accountid", "birthday", "passhash", "username", "rid") VALUES (OLD."accountid", OLD."birthday", OLD."passhash", OLD."username", "rid");
 				RETURN OLD;
 				END;
 				`,
@@ -239,23 +278,23 @@ func TestQueryRewrite(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		triggers, err := database.getTableTriggers(ctx, "contacts")
+		triggers, err := database.getTableTriggers(ctx, "test", "contacts")
 		if err != nil {
 			t.Fatal(err)
 		}
 		expectedTriggers := trigger{
 			Name:              "contacts_redirect_delete_trigger",
 			EventManipulation: "DELETE",
-			ActionStatement:   "EXECUTE FUNCTION contacts_redirect_delete()",
+			ActionStatement:   "EXECUTE FUNCTION test.contacts_redirect_delete()",
 			ActionOrientation: "ROW",
 			ActionTiming:      "INSTEAD OF",
 			Procedure: &procedure{
-				Name: "contacts_redirect_delete",
+				Name: "test.contacts_redirect_delete",
 				ProSrc: `
-				DECLARE rid BIGINT;
+				DECLARE "rid" BIGINT;
 				BEGIN
-				rid := (SELECT id FROM test.rid);
-				INSERT INTO test.contactsminus (account_num, is_external, username, rid) VALUES (OLD.account_num, OLD.is_external, OLD.username, rid);
+				"rid" := (SELECT id FROM "test"."rid");
+				INSERT INTO "test"."contactsminus" ("account_num", "is_external", "username", "rid") VALUES (OLD."account_num", OLD."is_external", OLD."username", "rid");
 				RETURN OLD;
 				END;
 				`,
@@ -267,3 +306,237 @@ func TestQueryRewrite(t *testing.T) {
 		}
 	})
 }
+
+func TestReferentialActions(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE parent (id INT PRIMARY KEY);
+	CREATE TABLE cascade_child (id INT PRIMARY KEY, pid INT REFERENCES parent ON DELETE CASCADE ON UPDATE CASCADE);
+	CREATE TABLE null_child (id INT PRIMARY KEY, pid INT REFERENCES parent ON DELETE SET NULL);
+	CREATE TABLE default_child (id INT PRIMARY KEY, pid INT DEFAULT 0 REFERENCES parent ON DELETE SET DEFAULT);
+	INSERT INTO parent VALUES (0), (1), (2);
+	INSERT INTO cascade_child VALUES (1, 1), (2, 2);
+	INSERT INTO null_child VALUES (1, 1);
+	INSERT INTO default_child VALUES (1, 1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := newDatabase(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneDdl, err := newCloneDdl(ctx, database, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloneDdl.close(ctx)
+	for _, table := range cloneDdl.clonedTables {
+		if err := createTriggers(ctx, connPool, table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pids := func(t *testing.T, table string) map[int32]*int32 {
+		rows, err := connPool.Query(ctx, "SELECT id, pid FROM "+table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		got := map[int32]*int32{}
+		for rows.Next() {
+			var id int32
+			var pid *int32
+			if err := rows.Scan(&id, &pid); err != nil {
+				t.Fatal(err)
+			}
+			got[id] = pid
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	ptr := func(i int32) *int32 { return &i }
+
+	_, err = connPool.Exec(ctx, `
+	UPDATE test.parent SET id = 3 WHERE id = 2;
+	DELETE FROM test.parent WHERE id = 1;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		table string
+		want  map[int32]*int32
+	}{
+		{"test.cascade_child", map[int32]*int32{2: ptr(3)}},
+		{"test.null_child", map[int32]*int32{1: nil}},
+		{"test.default_child", map[int32]*int32{1: ptr(0)}},
+		{"public.cascade_child", map[int32]*int32{1: ptr(1), 2: ptr(2)}},
+	} {
+		if diff := cmp.Diff(test.want, pids(t, test.table)); diff != "" {
+			t.Errorf("%s (-want,+got):\n%s", test.table, diff)
+		}
+	}
+}
+
+func TestConstraintChecks(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE bookings (
+		id     INT PRIMARY KEY,
+		guest  TEXT NOT NULL,
+		price  NUMERIC(8,2) CONSTRAINT positive_price CHECK (price > 0),
+		during TSRANGE,
+		EXCLUDE USING gist (during WITH &&)
+	);
+	INSERT INTO bookings VALUES (1, 'alice', 10, '[2024-01-01, 2024-01-05)');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := newDatabase(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneDdl, err := newCloneDdl(ctx, database, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloneDdl.close(ctx)
+	for _, table := range cloneDdl.clonedTables {
+		if err := createTriggers(ctx, connPool, table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name       string
+		query      string
+		code       string
+		constraint string
+	}{
+		{"NotNull", `INSERT INTO test.bookings(id, price) VALUES (2, 5)`, notNullViolation, ""},
+		{"Check", `INSERT INTO test.bookings(id, guest, price) VALUES (2, 'bob', -1)`, checkViolation, "positive_price"},
+		{"CheckOnUpdate", `UPDATE test.bookings SET price = 0 WHERE id = 1`, checkViolation, "positive_price"},
+		{"Exclusion", `INSERT INTO test.bookings VALUES (2, 'bob', 5, '[2024-01-04, 2024-01-06)')`, exclusionViolation, "bookings_during_excl"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := connPool.Exec(ctx, test.query)
+			var pgErr *pgconn.PgError
+			if !errors.As(err, &pgErr) {
+				t.Fatalf("got %v, want a postgres error", err)
+			}
+			if pgErr.Code != test.code || pgErr.ConstraintName != test.constraint || pgErr.TableName != "bookings" {
+				t.Errorf("got (%s, %s, %s), want (%s, %s, bookings)", pgErr.Code, pgErr.ConstraintName, pgErr.TableName, test.code, test.constraint)
+			}
+		})
+	}
+
+	// rows that satisfy the constraints are written, and the updated row does
+	// not conflict with itself
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO test.bookings VALUES (2, 'bob', NULL, '[2024-01-05, 2024-01-06)');
+	UPDATE test.bookings SET during = '[2024-01-01, 2024-01-04)' WHERE id = 1;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTriggerErrors(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO users(accountid, username, passhash, birthday) VALUES ('101122611122', 'alice', '1234', '2000-01-01');
+	INSERT INTO contacts(username, account_num, is_external) VALUES ('alice', '103362343333', false);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := newDatabase(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneDdl, err := newCloneDdl(ctx, database, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloneDdl.close(ctx)
+	for _, table := range cloneDdl.clonedTables {
+		if err := createTriggers(ctx, connPool, table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the branch raises the errors production raises for the same statements;
+	// the update rule on users keeps updates from failing in either
+	for _, test := range []struct {
+		name  string
+		query string
+	}{
+		{"UniqueViolation", `INSERT INTO %s.users(accountid, username, passhash) VALUES ('107744137744', 'alice', '2345')`},
+		{"MissingKey", `INSERT INTO %s.contacts(username, account_num, is_external) VALUES ('bob', '103362343333', true)`},
+		{"ReferencedKeyOnDelete", `DELETE FROM %s.users WHERE username = 'alice'`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var want, got *pgconn.PgError
+			tx, err := connPool.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = tx.Exec(ctx, fmt.Sprintf(test.query, "public"))
+			tx.Rollback(ctx)
+			if !errors.As(err, &want) {
+				t.Fatalf("production: got %v, want a postgres error", err)
+			}
+			_, err = connPool.Exec(ctx, fmt.Sprintf(test.query, "test"))
+			if !errors.As(err, &got) {
+				t.Fatalf("branch: got %v, want a postgres error", err)
+			}
+			for _, field := range []struct{ name, want, got string }{
+				{"code", want.Code, got.Code},
+				{"message", want.Message, got.Message},
+				{"detail", want.Detail, got.Detail},
+				{"constraint", want.ConstraintName, got.ConstraintName},
+				{"table", want.TableName, got.TableName},
+			} {
+				if field.got != field.want {
+					t.Errorf("%s: got %q, want %q", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
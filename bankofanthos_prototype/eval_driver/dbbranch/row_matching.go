@@ -0,0 +1,116 @@
+// This file matches the rows of the diff of a table without a primary key
+// that a branch updated. The diff compares such rows by exact equality, so an
+// update shows up as the old row deleted and the new row inserted, in rows of
+// the diff of their own. A deleted row and an inserted row are the same row
+// if they agree on the logical key of the table, which the diff rules
+// declare, or else if most of their columns are equal. The diff then shows
+// them as one row, with the old row in the middle.
+package dbbranch
+
+// matchUpdates matches the updated rows of the diffs of the tables without a
+// primary key, i.e. the tables pkCols has no columns for.
+func (r DiffRules) matchUpdates(diffs map[string]*Diff, pkCols map[string][]string) {
+	for table, diff := range diffs {
+		if len(pkCols[table]) > 0 || len(diff.ColNames) == 0 {
+			continue
+		}
+		var key []int
+		for i, name := range diff.ColNames {
+			if r[table][name].Key {
+				key = append(key, i)
+			}
+		}
+		diff.matchUpdates(key)
+	}
+}
+
+// matchUpdates shows the rows a side inserted in place of the baseline rows it
+// deleted next to them. If key is not empty, the rows must agree on the
+// columns at positions key; either way the row with the most equal columns is
+// chosen.
+func (d *Diff) matchUpdates(key []int) {
+	// similarity returns the number of columns of the inserted row that equal
+	// those of the baseline row, or -1 if the rows do not match
+	similarity := func(baseline Row, inserted Row) int {
+		for _, i := range key {
+			if !d.Matcher.equal(i, baseline[i], inserted[i], false) {
+				return -1
+			}
+		}
+		equal := 0
+		for i := range baseline {
+			if d.Matcher.equal(i, baseline[i], inserted[i], false) {
+				equal++
+			}
+		}
+		if len(key) == 0 && 2*equal <= len(baseline) {
+			return -1
+		}
+		return equal
+	}
+
+	matched := map[int]bool{}
+	// match returns the row that inserted into the sides, and only them, and
+	// best matches baseline, or -1
+	match := func(baseline Row, control bool, experimental bool) int {
+		best, bestSimilarity := -1, -1
+		for j := range d.Baseline {
+			if matched[j] || !d.Baseline[j].empty() || d.Control[j].empty() == control || d.Experimental[j].empty() == experimental {
+				continue
+			}
+			inserted := d.Control[j]
+			if !control {
+				inserted = d.Experimental[j]
+			}
+			if s := similarity(baseline, *inserted); s > bestSimilarity {
+				best, bestSimilarity = j, s
+			}
+		}
+		return best
+	}
+
+	for i := range d.Baseline {
+		if d.Baseline[i].empty() {
+			continue
+		}
+		baseline := *d.Baseline[i]
+		missingA, missingB := d.Control[i].empty(), d.Experimental[i].empty()
+		if missingA && missingB {
+			// both updated the row
+			if j := match(baseline, true, true); j >= 0 {
+				d.Control[i], d.Experimental[i] = d.Control[j], d.Experimental[j]
+				matched[j] = true
+				continue
+			}
+		}
+		if missingA {
+			if j := match(baseline, true, false); j >= 0 {
+				d.Control[i] = d.Control[j]
+				matched[j] = true
+			}
+		}
+		if missingB {
+			if j := match(baseline, false, true); j >= 0 {
+				d.Experimental[i] = d.Experimental[j]
+				matched[j] = true
+			}
+		}
+	}
+	d.removeRows(matched)
+}
+
+// removeRows removes the rows at the positions in rows.
+func (d *Diff) removeRows(rows map[int]bool) {
+	if len(rows) == 0 {
+		return
+	}
+	var control, baseline, experimental []*Row
+	for i := range d.Control {
+		if !rows[i] {
+			control = append(control, d.Control[i])
+			baseline = append(baseline, d.Baseline[i])
+			experimental = append(experimental, d.Experimental[i])
+		}
+	}
+	d.Control, d.Baseline, d.Experimental = control, baseline, experimental
+}
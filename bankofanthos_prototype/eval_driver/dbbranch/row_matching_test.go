@@ -0,0 +1,66 @@
+package dbbranch
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatchUpdates(t *testing.T) {
+	none := Row{nil, nil, nil}
+	r1, r2, r3 := Row{10, "alice", "bob"}, Row{20, "carol", "dave"}, Row{30, "eve", "frank"}
+
+	t.Run("Similarity", func(t *testing.T) {
+		// A updated r1, A and B updated r2 alike, B deleted r3 and inserted
+		// an unrelated row
+		a1, b2, u := Row{11, "alice", "bob"}, Row{21, "carol", "dave"}, Row{99, "x", "y"}
+		diff := &Diff{
+			ColNames:     []string{"amount", "from_acct", "to_acct"},
+			Control:      rows(a1, none, b2, none, r3, none),
+			Baseline:     rows(none, none, none, r1, r3, r2),
+			Experimental: rows(none, u, b2, r1, none, none),
+		}
+		diff.matchUpdates(nil)
+
+		want := &Diff{
+			ColNames:     diff.ColNames,
+			Control:      rows(none, a1, r3, b2),
+			Baseline:     rows(none, r1, r3, r2),
+			Experimental: rows(u, r1, none, b2),
+		}
+		if d := cmp.Diff(want, diff); d != "" {
+			t.Errorf("(-want,+got):\n%s", d)
+		}
+	})
+
+	t.Run("LogicalKey", func(t *testing.T) {
+		// B moved the transfer of eve to another account and amount
+		b3 := Row{31, "eve", "zed"}
+		newDiff := func() *Diff {
+			return &Diff{
+				ColNames:     []string{"amount", "from_acct", "to_acct"},
+				Control:      rows(none, r3),
+				Baseline:     rows(none, r3),
+				Experimental: rows(b3, none),
+			}
+		}
+
+		diff := newDiff()
+		diff.matchUpdates(nil)
+		if got, want := len(diff.Control), 2; got != want {
+			t.Errorf("rows without a key: got %d, want %d", got, want)
+		}
+
+		diff = newDiff()
+		diff.matchUpdates([]int{1})
+		want := &Diff{
+			ColNames:     diff.ColNames,
+			Control:      rows(r3),
+			Baseline:     rows(r3),
+			Experimental: rows(b3),
+		}
+		if d := cmp.Diff(want, diff); d != "" {
+			t.Errorf("(-want,+got):\n%s", d)
+		}
+	})
+}
@@ -0,0 +1,834 @@
+// This file applies schema changes, e.g. the migration of a canary release, to
+// a single branch. The first change of a table copies its structure, without
+// its rows, into the branch, and the change is applied to that copy and to R+
+// and R-, so that the production table and the other branches are left alone.
+// R' reads the production rows through a query that gives them the changed
+// columns.
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// alterAction is one column change of an ALTER TABLE statement.
+type alterAction struct {
+	sql     string // the action as written, e.g. ADD COLUMN "age" int NOT NULL DEFAULT 0
+	kind    string // ADD, DROP or RENAME
+	column  string
+	newName string // the new name of a renamed column
+	cascade bool   // DROP ... CASCADE drops the foreign keys that reference the column
+	ifNot   bool   // ADD ... IF NOT EXISTS and DROP ... IF EXISTS
+}
+
+// Migrate applies the schema changes in sql to the branch only. It supports
+//
+//	ALTER TABLE name ADD [COLUMN] ..., DROP [COLUMN] ... [, ...]
+//	ALTER TABLE name RENAME [COLUMN] column TO new_name
+//	CREATE [UNIQUE] INDEX [name] ON name [USING method] (column [, ...])
+//
+// Tables are resolved through the search_path of the branch. The redirect
+// triggers enforce the changed schema, and ComputeDiffAtN reports it next to
+// the row differences. The views of the branch are recreated over the changed
+// tables, so a change fails if a view reads a dropped or renamed column. An
+// added column takes its default once for the production rows, so volatile
+// defaults are not supported.
+//
+// The statements of sql are applied in one transaction: if one fails, none
+// is. Schema changes cannot be undone, so RollbackTo refuses a branch with
+// schema changes, and such a branch cannot be merged either.
+func (b *Branch) Migrate(ctx context.Context, sql string) error {
+	b.brancher.mu.Lock()
+	defer b.brancher.mu.Unlock()
+	if b.deleted {
+		return fmt.Errorf("branch %s is deleted", b.namespace)
+	}
+	if b.committed {
+		return fmt.Errorf("branch %s is committed and cannot be changed", b.namespace)
+	}
+
+	var stmts []statement
+	for _, stmt := range splitStatements(sql) {
+		if len(stmt.tokens) == 0 {
+			continue
+		}
+		if !isAlterTable(stmt) && !isCreateIndex(stmt) {
+			return fmt.Errorf("unsupported schema change %q", stmt.sql)
+		}
+		stmts = append(stmts, stmt)
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+	err := b.clonedDdl.migrate(ctx, func() error {
+		for _, stmt := range stmts {
+			var err error
+			if isAlterTable(stmt) {
+				err = b.alterTable(ctx, stmt)
+			} else {
+				err = b.createIndex(ctx, stmt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.migrated = true
+	return b.brancher.catalog.update(ctx, b.info(BranchActive))
+}
+
+// migrate runs apply with the DDL of c in one transaction. If apply or the
+// commit fails, the metadata of the tables is restored, since the objects it
+// describes were rolled back.
+func (c *cloneDdl) migrate(ctx context.Context, apply func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.database.connPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tables := map[string]clonedTable{}
+	for key, t := range c.clonedTables {
+		tables[key] = *t
+	}
+	sequences, views := maps.Clone(c.sequences), slices.Clone(c.views)
+
+	c.tx = tx
+	err = apply()
+	c.tx = nil
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		for key, t := range tables {
+			*c.clonedTables[key] = t
+		}
+		c.sequences, c.views = sequences, views
+	}
+	return err
+}
+
+func isAlterTable(stmt statement) bool {
+	return len(stmt.tokens) > 1 && stmt.tokens[0].is("ALTER") && stmt.tokens[1].is("TABLE")
+}
+
+func isCreateIndex(stmt statement) bool {
+	return len(stmt.tokens) > 0 && stmt.tokens[0].is("CREATE") && stmt.find(1, "INDEX") < min(len(stmt.tokens), 3)
+}
+
+// SchemaChangeTag returns the command tag postgres completes the last schema
+// change in sql with, e.g. ALTER TABLE, or "" if sql changes no schema.
+func SchemaChangeTag(sql string) string {
+	tag := ""
+	for _, stmt := range splitStatements(sql) {
+		switch {
+		case isAlterTable(stmt):
+			tag = "ALTER TABLE"
+		case isCreateIndex(stmt):
+			tag = "CREATE INDEX"
+		}
+	}
+	return tag
+}
+
+// Intercept applies the schema changes in sql to the branch with Migrate and
+// returns the rest of sql rewritten with Rewrite, for a client that sends
+// both over a connection to the branch. The schema changes are applied before
+// the rest runs, when the statements are intercepted; the result is empty if
+// sql only changes the schema. Migrate runs on a connection of its own and
+// waits for the locks the client holds, so the client must not be in a
+// transaction.
+func (b *Branch) Intercept(ctx context.Context, sql string) (string, error) {
+	var changes, rest []string
+	for _, stmt := range splitStatements(sql) {
+		if isAlterTable(stmt) || isCreateIndex(stmt) {
+			changes = append(changes, stmt.sql)
+		} else if len(stmt.tokens) > 0 {
+			rest = append(rest, stmt.sql)
+		}
+	}
+	if len(changes) == 0 {
+		return b.Rewrite(sql)
+	}
+	if err := b.Migrate(ctx, strings.Join(changes, ";")); err != nil {
+		return "", err
+	}
+	return b.Rewrite(strings.Join(rest, ";"))
+}
+
+func (b *Branch) alterTable(ctx context.Context, stmt statement) error {
+	i := 2
+	ifExists := false
+	if i+1 < len(stmt.tokens) && stmt.tokens[i].is("IF") && stmt.tokens[i+1].is("EXISTS") {
+		ifExists = true
+		i += 2
+	}
+	if i < len(stmt.tokens) && stmt.tokens[i].is("ONLY") {
+		i++
+	}
+	schema, name, i, ok := stmt.name(i)
+	if !ok {
+		return fmt.Errorf("failed to parse %q", stmt.sql)
+	}
+	t := b.resolveTable(schema, name)
+	if t == nil {
+		if ifExists {
+			return nil
+		}
+		return fmt.Errorf("table %s is not branched", name)
+	}
+
+	actions, err := parseAlterActions(stmt, i)
+	if err != nil {
+		return err
+	}
+	if err := b.clonedDdl.alterTable(ctx, t, actions); err != nil {
+		return fmt.Errorf("failed to alter table %s in branch %s: %w", name, b.namespace, err)
+	}
+	return nil
+}
+
+// parseAlterActions parses the column changes of an ALTER TABLE statement
+// that start at token i.
+func parseAlterActions(stmt statement, i int) ([]alterAction, error) {
+	unsupported := func(what string) ([]alterAction, error) {
+		return nil, fmt.Errorf("%s is not supported in a branch: %q", what, stmt.sql)
+	}
+	word := func(k int, w string) bool {
+		return k < len(stmt.tokens) && stmt.tokens[k].is(w)
+	}
+
+	if word(i, "RENAME") {
+		k := i + 1
+		if word(k, "TO") || word(k, "CONSTRAINT") {
+			return unsupported("renaming tables and constraints")
+		}
+		if word(k, "COLUMN") {
+			k++
+		}
+		if k+3 != len(stmt.tokens) || !word(k+1, "TO") {
+			return nil, fmt.Errorf("failed to parse %q", stmt.sql)
+		}
+		column, ok1 := stmt.tokens[k].ident()
+		newName, ok2 := stmt.tokens[k+2].ident()
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("failed to parse %q", stmt.sql)
+		}
+		return []alterAction{{sql: stmt.span(i, len(stmt.tokens)), kind: "RENAME", column: column, newName: newName}}, nil
+	}
+
+	var actions []alterAction
+	for start := i; start < len(stmt.tokens); {
+		end := stmt.find(start, ",")
+		a := alterAction{sql: stmt.span(start, end)}
+		k := start + 1
+		switch {
+		case word(start, "ADD"):
+			a.kind = "ADD"
+			if word(k, "CONSTRAINT") || word(k, "CHECK") || word(k, "PRIMARY") || word(k, "UNIQUE") || word(k, "FOREIGN") || word(k, "EXCLUDE") {
+				return unsupported("adding table constraints")
+			}
+			if word(k, "COLUMN") {
+				k++
+			}
+			if word(k, "IF") && word(k+1, "NOT") && word(k+2, "EXISTS") {
+				a.ifNot = true
+				k += 3
+			}
+			// R+ keeps the rows of every request, so it cannot have keys; the
+			// redirect triggers only know the keys of the existing indexes
+			for j := k + 1; j < end; j++ {
+				for _, w := range []string{"PRIMARY", "UNIQUE", "REFERENCES", "GENERATED", "EXCLUDE", "SERIAL", "BIGSERIAL", "SMALLSERIAL"} {
+					if stmt.tokens[j].is(w) {
+						return unsupported(w + " columns")
+					}
+				}
+			}
+		case word(start, "DROP"):
+			a.kind = "DROP"
+			if word(k, "CONSTRAINT") {
+				return unsupported("dropping constraints")
+			}
+			if word(k, "COLUMN") {
+				k++
+			}
+			if word(k, "IF") && word(k+1, "EXISTS") {
+				a.ifNot = true
+				k += 2
+			}
+			if word(k+1, "CASCADE") {
+				a.cascade = true
+			} else if k+1 < end && !word(k+1, "RESTRICT") {
+				return nil, fmt.Errorf("failed to parse %q", stmt.sql)
+			}
+		default:
+			return unsupported(fmt.Sprintf("ALTER TABLE %s", stmt.span(start, end)))
+		}
+		if k >= end {
+			return nil, fmt.Errorf("failed to parse %q", stmt.sql)
+		}
+		column, ok := stmt.tokens[k].ident()
+		if !ok {
+			return nil, fmt.Errorf("failed to parse %q", stmt.sql)
+		}
+		a.column = column
+		actions = append(actions, a)
+		start = end + 1
+	}
+	return actions, nil
+}
+
+// alterTable applies actions to the R+, R- and base tables of t and recreates
+// its R' view and redirect triggers. R' reads the rows the branch did not
+// write through baseQuery, so the rows of the production table are not
+// copied. It runs in the transaction of migrate.
+func (c *cloneDdl) alterTable(ctx context.Context, t *clonedTable, actions []alterAction) error {
+	// the R' views of a hierarchy read the columns of each other
+	if len(t.Snapshot.Inherits) > 0 || t.Hierarchy != nil {
+		return fmt.Errorf("table %s is inherited or partitioned and cannot be altered in a branch", t.Snapshot.qualifiedName())
+	}
+
+	// check the actions against the schema as it changes, like postgres
+	snapshot := t.Snapshot.clone()
+	var applied []alterAction
+	for _, a := range actions {
+		_, exists := snapshot.Cols[a.column]
+		switch a.kind {
+		case "ADD":
+			if exists {
+				if a.ifNot {
+					continue
+				}
+				return fmt.Errorf("column %s already exists", a.column)
+			}
+			if a.column == c.counter.Colname {
+				return fmt.Errorf("column %s is reserved for the request id", a.column)
+			}
+			snapshot.Cols[a.column] = column{Name: a.column}
+		case "DROP":
+			if !exists {
+				if a.ifNot {
+					continue
+				}
+				return fmt.Errorf("column %s does not exist", a.column)
+			}
+			if len(snapshot.Cols) == 1 {
+				return fmt.Errorf("cannot drop the last column %s", a.column)
+			}
+			for _, ref := range snapshot.References {
+				if slices.Contains(ref.BeRefedColumnNames, a.column) && !a.cascade {
+					return fmt.Errorf("cannot drop column %s because constraint %s on table %s depends on it", a.column, ref.ConstraintName, ref.ForeignKeyTableName)
+				}
+			}
+			snapshot.dropColumn(t.Snapshot.key(), a.column)
+		case "RENAME":
+			if !exists {
+				return fmt.Errorf("column %s does not exist", a.column)
+			}
+			if _, ok := snapshot.Cols[a.newName]; ok || a.newName == c.counter.Colname {
+				return fmt.Errorf("column %s already exists", a.newName)
+			}
+			snapshot.renameColumn(t.Snapshot.key(), a.column, a.newName)
+		}
+		applied = append(applied, a)
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+
+	// R' of a lazy table is recreated over R+/R- directly
+	if err := materialize(ctx, c.conn(), t); err != nil {
+		return err
+	}
+
+	// R' depends on the columns, it is recreated below together with its
+	// triggers and rules
+	if _, err := c.conn().Exec(ctx, fmt.Sprintf("DROP VIEW %s CASCADE;%s", t.View.qualifiedName(), dropStubStmt(t))); err != nil {
+		return err
+	}
+
+	base, exprs := t.Base, maps.Clone(t.BaseExprs)
+	if base == nil {
+		// the copy takes the structure and constraints of the closest table
+		// with the current schema, but none of its rows or defaults: the
+		// defaults of the production table may draw from production
+		// sequences
+		base = &table{Schema: t.Plus.Schema, Name: t.Snapshot.Name + "base"}
+		like := t.Snapshot.qualifiedName()
+		for p := t.Parent; p != nil; p = p.Parent {
+			if p.Base != nil {
+				like = p.Base.qualifiedName()
+				break
+			}
+		}
+		if _, err := c.conn().Exec(ctx, fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING CONSTRAINTS INCLUDING GENERATED);", base.qualifiedName(), like)); err != nil {
+			return fmt.Errorf("failed to copy the structure of %s: %w", like, err)
+		}
+		exprs = map[string]string{}
+		for name := range t.Snapshot.Cols {
+			exprs[name] = quoteIdent(name)
+		}
+	}
+
+	cols := redirectColNames(t)
+	added := map[string]bool{}
+	for _, a := range applied {
+		// base is empty, so it takes the change before R+: an added default
+		// is evaluated once, and a volatile one is refused before R+ draws
+		// from it
+		if _, err := c.conn().Exec(ctx, fmt.Sprintf("ALTER TABLE %s %s;", base.qualifiedName(), a.sql)); err != nil {
+			return err
+		}
+		switch a.kind {
+		case "ADD":
+			value, err := c.addedValue(ctx, base, a.column)
+			if err != nil {
+				return err
+			}
+			exprs[a.column] = value
+			added[a.column] = true
+		case "DROP":
+			delete(exprs, a.column)
+			delete(added, a.column)
+		case "RENAME":
+			exprs[a.newName] = exprs[a.column]
+			delete(exprs, a.column)
+			added[a.newName] = added[a.column]
+			delete(added, a.column)
+		}
+		if _, err := c.conn().Exec(ctx, fmt.Sprintf("ALTER TABLE %s %s;", t.Plus.qualifiedName(), a.sql)); err != nil {
+			return err
+		}
+		if a.kind != "ADD" {
+			if _, err := c.conn().Exec(ctx, fmt.Sprintf("ALTER TABLE %s %s;", t.Minus.qualifiedName(), a.sql)); err != nil {
+				return err
+			}
+			cols = slices.DeleteFunc(cols, func(col string) bool { return col == a.column })
+			if a.kind == "RENAME" {
+				cols = append(cols, a.newName)
+			}
+			continue
+		}
+
+		// R- identifies the deleted rows by all their columns, so a new
+		// column of R- takes the value the deleted row got in R' or R+, which
+		// may come from a volatile default
+		var colType string
+		if err := c.conn().QueryRow(ctx, `
+		SELECT format_type(a.atttypid, a.atttypmod) || CASE WHEN a.attcollation <> t.typcollation THEN ' COLLATE ' || quote_ident(cn.nspname) || '.' || quote_ident(co.collname) ELSE '' END
+		FROM pg_attribute a
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_collation co ON co.oid = a.attcollation
+		LEFT JOIN pg_namespace cn ON cn.oid = co.collnamespace
+		WHERE a.attrelid = $1::regclass AND a.attname = $2`, base.qualifiedName(), a.column).Scan(&colType); err != nil {
+			return fmt.Errorf("failed to get the type of %s: %w", a.column, err)
+		}
+		column := quoteIdent(a.column)
+		if _, err := c.conn().Exec(ctx, fmt.Sprintf(`
+		ALTER TABLE %s ADD COLUMN %s %s;
+		UPDATE %s AS m SET %s = s.%s FROM (
+			SELECT %s, %s FROM %s
+			UNION ALL
+			SELECT %s, %s FROM %s
+		) AS s WHERE (%s) IS NOT DISTINCT FROM (%s);`,
+			t.Minus.qualifiedName(), column, colType,
+			t.Minus.qualifiedName(), column, column,
+			identList("", cols), column, baseQuery(t, exprs),
+			identList("", cols), column, t.Plus.qualifiedName(),
+			identList("m.", cols), identList("s.", cols))); err != nil {
+			return fmt.Errorf("failed to add %s to R-: %w", a.column, err)
+		}
+		cols = append(cols, a.column)
+	}
+
+	// the types, defaults and check constraints of the changed columns are
+	// those postgres gave the base copy; the other columns keep their
+	// defaults
+	baseCols, err := c.database.getTableCols(ctx, c.conn(), base.Schema, base.Name)
+	if err != nil {
+		return err
+	}
+	for name, col := range baseCols {
+		if !added[name] {
+			col.Default = snapshot.Cols[name].Default
+		}
+		col.IdGenerator = snapshot.Cols[name].IdGenerator
+		col.Sequence = snapshot.Cols[name].Sequence
+		baseCols[name] = col
+	}
+	snapshot.Cols = baseCols
+	if snapshot.CheckConstraints, err = c.database.getTableCheckConstraints(ctx, c.conn(), base.Schema, base.Name); err != nil {
+		return err
+	}
+	if err := c.checkAddedColumns(ctx, t, snapshot, exprs, added); err != nil {
+		return err
+	}
+	t.Base = &table{Schema: base.Schema, Name: base.Name, Cols: baseCols}
+	t.BaseExprs = exprs
+	t.Snapshot = snapshot
+	plus, minus := *t.Plus, *t.Minus
+	plus.Cols, minus.Cols = map[string]column{}, map[string]column{}
+	for name, col := range snapshot.Cols {
+		plus.Cols[name] = col
+		minus.Cols[name] = col
+	}
+	t.Plus, t.Minus = &plus, &minus
+
+	if t.View, t.Sequences, err = c.createView(ctx, snapshot, baseQuery(t, exprs), t.Plus, t.Minus); err != nil {
+		return err
+	}
+	t.Stub, t.Materialize = nil, ""
+	if err := c.applyRules(ctx, snapshot, t.View); err != nil {
+		return fmt.Errorf("failed to apply rules: %w", err)
+	}
+	t.Triggers, t.Functions = nil, nil
+	if err := createTriggers(ctx, c.conn(), t); err != nil {
+		return err
+	}
+	if err := c.attachUserTriggers(ctx, t); err != nil {
+		return err
+	}
+	// the views of the branch that read from R' were dropped with it
+	if err := c.cloneRelations(ctx); err != nil {
+		return err
+	}
+
+	// the foreign keys between t and the other tables refer to the columns
+	// by name
+	for _, other := range c.clonedTables {
+		if other == t {
+			continue
+		}
+		changed := other.Snapshot.clone()
+		modified := false
+		for _, a := range applied {
+			switch a.kind {
+			case "DROP":
+				modified = changed.dropColumn(t.Snapshot.key(), a.column) || modified
+			case "RENAME":
+				modified = changed.renameColumn(t.Snapshot.key(), a.column, a.newName) || modified
+			}
+		}
+		if modified {
+			other.Snapshot = changed
+			if err := c.recreateTriggers(ctx, other); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// baseQuery returns the relation R' of t reads the rows from that the branch
+// did not write: the production table, or R' of the parent branch, with the
+// columns of base computed by exprs.
+func baseQuery(t *clonedTable, exprs map[string]string) string {
+	source := t.Snapshot.qualifiedName()
+	if t.Parent != nil {
+		source = t.Parent.View.qualifiedName()
+	}
+	names := maps.Keys(exprs)
+	sort.Strings(names)
+	cols := make([]string, len(names))
+	for i, name := range names {
+		cols[i] = exprs[name] + " AS " + quoteIdent(name)
+	}
+	return fmt.Sprintf("(SELECT %s FROM %s) AS %s", strings.Join(cols, ", "), source, quoteIdent(t.Snapshot.Name+"base"))
+}
+
+// addedValue returns the expression of the column added to base for the rows
+// R' reads from the production table. Like postgres, it evaluates the default
+// of the column once, when the column is added; postgres keeps the value as
+// the missing value of the column. A volatile default, e.g. a nextval, would
+// need a value for every row and is not supported.
+func (c *cloneDdl) addedValue(ctx context.Context, base *table, column string) (string, error) {
+	var colType string
+	var hasDefault, hasMissing bool
+	if err := c.conn().QueryRow(ctx, `
+	SELECT format_type(atttypid, atttypmod), atthasdef, atthasmissing FROM pg_attribute
+	WHERE attrelid = $1::regclass AND attname = $2`, base.qualifiedName(), column).Scan(&colType, &hasDefault, &hasMissing); err != nil {
+		return "", fmt.Errorf("failed to get the default of %s: %w", column, err)
+	}
+	if !hasDefault {
+		return "NULL::" + colType, nil
+	}
+	if !hasMissing {
+		return "", fmt.Errorf("column %s has a volatile default, which is not supported in a branch", column)
+	}
+	var value string
+	if err := c.conn().QueryRow(ctx, fmt.Sprintf(`
+	SELECT (attmissingval::text::%s[])[1]::text FROM pg_attribute
+	WHERE attrelid = $1::regclass AND attname = $2`, colType), base.qualifiedName(), column).Scan(&value); err != nil {
+		return "", fmt.Errorf("failed to get the default of %s: %w", column, err)
+	}
+	return quoteLiteral(value) + "::" + colType, nil
+}
+
+// checkAddedColumns checks the rows R' of t reads from the production table
+// against the NOT NULL and CHECK constraints of the added columns, which
+// postgres could not do on the empty base table.
+func (c *cloneDdl) checkAddedColumns(ctx context.Context, t *clonedTable, snapshot *table, exprs map[string]string, added map[string]bool) error {
+	if len(added) == 0 {
+		return nil
+	}
+	rows := baseQuery(t, exprs)
+	var violated bool
+	for name := range added {
+		if snapshot.Cols[name].Nullable != "NO" {
+			continue
+		}
+		if err := c.conn().QueryRow(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s IS NULL);", rows, quoteIdent(name))).Scan(&violated); err != nil {
+			return err
+		}
+		if violated {
+			return fmt.Errorf("column %s of relation %s contains null values", name, t.Snapshot.Name)
+		}
+	}
+
+	existing := map[string]bool{}
+	for _, constraint := range t.Snapshot.CheckConstraints {
+		existing[constraint.Name] = true
+	}
+	for _, constraint := range snapshot.CheckConstraints {
+		if existing[constraint.Name] {
+			continue
+		}
+		if err := c.conn().QueryRow(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE NOT (%s));", rows, constraint.Expression)).Scan(&violated); err != nil {
+			return err
+		}
+		if violated {
+			return fmt.Errorf("check constraint %s of relation %s is violated by some row", constraint.Name, t.Snapshot.Name)
+		}
+	}
+	return nil
+}
+
+// recreateTriggers replaces the redirect triggers of t, e.g. after the
+// metadata they check changed.
+func (c *cloneDdl) recreateTriggers(ctx context.Context, t *clonedTable) error {
+	for _, trigger := range t.Triggers {
+		if err := dropTrigger(ctx, c.conn(), quoteIdent(trigger), t.View.qualifiedName()); err != nil {
+			return err
+		}
+	}
+	for _, trigger := range t.RouteTriggers {
+		if err := dropTrigger(ctx, c.conn(), quoteIdent(trigger), t.Hierarchy.qualifiedName()); err != nil {
+			return err
+		}
+	}
+	t.Triggers, t.RouteTriggers, t.Functions = nil, nil, nil
+	return createTriggers(ctx, c.conn(), t)
+}
+
+// createIndex applies
+//
+//	CREATE [UNIQUE] INDEX [CONCURRENTLY] [[IF NOT EXISTS] name] ON [ONLY] table [USING method] (column [, ...])
+//
+// to the branch. R+ and R- get a plain index, a unique index is enforced by
+// the redirect triggers.
+func (b *Branch) createIndex(ctx context.Context, stmt statement) error {
+	word := func(k int, w string) bool {
+		return k < len(stmt.tokens) && stmt.tokens[k].is(w)
+	}
+	unique := word(1, "UNIQUE")
+	i := stmt.find(1, "INDEX") + 1
+	if word(i, "CONCURRENTLY") {
+		i++
+	}
+	ifNotExists := false
+	if word(i, "IF") && word(i+1, "NOT") && word(i+2, "EXISTS") {
+		ifNotExists = true
+		i += 3
+	}
+	name := ""
+	if i < len(stmt.tokens) && !word(i, "ON") {
+		var ok bool
+		if name, ok = stmt.tokens[i].ident(); !ok {
+			return fmt.Errorf("failed to parse %q", stmt.sql)
+		}
+		i++
+	}
+	if !word(i, "ON") {
+		return fmt.Errorf("failed to parse %q", stmt.sql)
+	}
+	i++
+	if word(i, "ONLY") {
+		i++
+	}
+	schema, tablename, i, ok := stmt.name(i)
+	if !ok {
+		return fmt.Errorf("failed to parse %q", stmt.sql)
+	}
+	method := ""
+	if word(i, "USING") && i+1 < len(stmt.tokens) {
+		method = " USING " + stmt.tokens[i+1].text
+		i += 2
+	}
+	cols, i, ok := stmt.identList(i)
+	if !ok || i != len(stmt.tokens) {
+		return fmt.Errorf("only indexes on plain columns are supported in a branch: %q", stmt.sql)
+	}
+
+	t := b.resolveTable(schema, tablename)
+	if t == nil {
+		return fmt.Errorf("table %s is not branched", tablename)
+	}
+	for _, col := range cols {
+		if _, ok := t.Snapshot.Cols[col]; !ok {
+			return fmt.Errorf("column %s does not exist", col)
+		}
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s_%s_idx", t.Snapshot.Name, strings.Join(cols, "_"))
+	}
+	for _, idx := range t.Snapshot.Indexes {
+		if idx.Name == name {
+			if ifNotExists {
+				return nil
+			}
+			return fmt.Errorf("relation %s already exists", name)
+		}
+	}
+	return b.clonedDdl.createIndex(ctx, t, index{Name: name, IndexDef: stmt.sql, IsUnique: unique, ColumnNames: cols}, method)
+}
+
+// createIndex indexes R+ and R- of t. It runs in the transaction of migrate.
+func (c *cloneDdl) createIndex(ctx context.Context, t *clonedTable, idx index, method string) error {
+	if err := materialize(ctx, c.conn(), t); err != nil {
+		return err
+	}
+	if idx.IsUnique {
+		var duplicate bool
+		err := c.conn().QueryRow(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE (%s) IS NOT NULL GROUP BY %s HAVING count(*) > 1);",
+			t.View.qualifiedName(), identList("", idx.ColumnNames), identList("", idx.ColumnNames))).Scan(&duplicate)
+		if err != nil {
+			return err
+		}
+		if duplicate {
+			return fmt.Errorf("could not create unique index %s: the key is duplicated", idx.Name)
+		}
+	}
+	for _, rel := range []*table{t.Plus, t.Minus} {
+		if _, err := c.conn().Exec(ctx, fmt.Sprintf("CREATE INDEX ON %s%s (%s);", rel.qualifiedName(), method, identList("", idx.ColumnNames))); err != nil {
+			return fmt.Errorf("failed to create index %s: %w", idx.Name, err)
+		}
+	}
+
+	snapshot := t.Snapshot.clone()
+	snapshot.Indexes = append(snapshot.Indexes, idx)
+	t.Snapshot = snapshot
+	return c.recreateTriggers(ctx, t)
+}
+
+// clone returns a copy of t whose metadata can be changed without changing t,
+// which may be shared with the production database or other branches.
+func (t *table) clone() *table {
+	c := *t
+	c.Cols = map[string]column{}
+	for name, col := range t.Cols {
+		c.Cols[name] = col
+	}
+	c.Indexes = slices.Clone(t.Indexes)
+	for i := range c.Indexes {
+		c.Indexes[i].ColumnNames = slices.Clone(c.Indexes[i].ColumnNames)
+	}
+	c.References = slices.Clone(t.References)
+	for i := range c.References {
+		c.References[i].BeRefedColumnNames = slices.Clone(c.References[i].BeRefedColumnNames)
+		c.References[i].ForeignKeyColumnNames = slices.Clone(c.References[i].ForeignKeyColumnNames)
+	}
+	c.ForeignKeyConstraints = slices.Clone(t.ForeignKeyConstraints)
+	for i := range c.ForeignKeyConstraints {
+		c.ForeignKeyConstraints[i].ColumnNames = slices.Clone(c.ForeignKeyConstraints[i].ColumnNames)
+		c.ForeignKeyConstraints[i].RefColumnNames = slices.Clone(c.ForeignKeyConstraints[i].RefColumnNames)
+	}
+	c.CheckConstraints = slices.Clone(t.CheckConstraints)
+	c.ExclusionConstraints = slices.Clone(t.ExclusionConstraints)
+	for i := range c.ExclusionConstraints {
+		c.ExclusionConstraints[i].ColumnNames = slices.Clone(c.ExclusionConstraints[i].ColumnNames)
+	}
+	c.Rules = slices.Clone(t.Rules)
+	c.Triggers = slices.Clone(t.Triggers)
+	c.Inherits = slices.Clone(t.Inherits)
+	return &c
+}
+
+// renameColumn renames the column old of the table key to new wherever the
+// metadata of t refers to it, and reports whether it did.
+func (t *table) renameColumn(key, old, new string) bool {
+	changed := false
+	rename := func(cols []string) {
+		for i, col := range cols {
+			if col == old {
+				cols[i] = new
+				changed = true
+			}
+		}
+	}
+	if t.key() == key {
+		if col, ok := t.Cols[old]; ok {
+			delete(t.Cols, old)
+			col.Name = new
+			t.Cols[new] = col
+		}
+		for _, idx := range t.Indexes {
+			rename(idx.ColumnNames)
+		}
+		for _, constraint := range t.ExclusionConstraints {
+			rename(constraint.ColumnNames)
+		}
+	}
+	for _, constraint := range t.ForeignKeyConstraints {
+		if tableKey(constraint.TableSchema, constraint.TableName) == key {
+			rename(constraint.ColumnNames)
+		}
+		if tableKey(constraint.RefTableSchema, constraint.RefTableName) == key {
+			rename(constraint.RefColumnNames)
+		}
+	}
+	for _, ref := range t.References {
+		if tableKey(ref.BeRefedTableSchema, ref.BeRefedTableName) == key {
+			rename(ref.BeRefedColumnNames)
+		}
+		if tableKey(ref.ForeignKeyTableSchema, ref.ForeignKeyTableName) == key {
+			rename(ref.ForeignKeyColumnNames)
+		}
+	}
+	return changed
+}
+
+// dropColumn removes the column col of the table key from the metadata of t,
+// together with the indexes and constraints on it, and reports whether it
+// did.
+func (t *table) dropColumn(key, col string) bool {
+	n := len(t.Indexes) + len(t.ExclusionConstraints) + len(t.ForeignKeyConstraints) + len(t.References)
+	if t.key() == key {
+		delete(t.Cols, col)
+		t.Indexes = slices.DeleteFunc(t.Indexes, func(idx index) bool {
+			return slices.Contains(idx.ColumnNames, col)
+		})
+		t.ExclusionConstraints = slices.DeleteFunc(t.ExclusionConstraints, func(constraint exclusionConstraint) bool {
+			return slices.Contains(constraint.ColumnNames, col)
+		})
+	}
+	t.ForeignKeyConstraints = slices.DeleteFunc(t.ForeignKeyConstraints, func(constraint foreignKeyConstraint) bool {
+		return (tableKey(constraint.TableSchema, constraint.TableName) == key && slices.Contains(constraint.ColumnNames, col)) ||
+			(tableKey(constraint.RefTableSchema, constraint.RefTableName) == key && slices.Contains(constraint.RefColumnNames, col))
+	})
+	t.References = slices.DeleteFunc(t.References, func(ref reference) bool {
+		return (tableKey(ref.BeRefedTableSchema, ref.BeRefedTableName) == key && slices.Contains(ref.BeRefedColumnNames, col)) ||
+			(tableKey(ref.ForeignKeyTableSchema, ref.ForeignKeyTableName) == key && slices.Contains(ref.ForeignKeyColumnNames, col))
+	})
+	return n != len(t.Indexes)+len(t.ExclusionConstraints)+len(t.ForeignKeyConstraints)+len(t.References)
+}
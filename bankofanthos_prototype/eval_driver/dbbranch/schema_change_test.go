@@ -0,0 +1,258 @@
+package dbbranch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `
+	INSERT INTO users(accountid, username, passhash, birthday) VALUES
+	('101122611122', 'alice', '1234', '2000-01-01');
+	INSERT INTO contacts(username, account_num, is_external) VALUES
+	('alice', '103362343333', true);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := brancher.Branch(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Migrate(ctx, `
+	ALTER TABLE users ADD COLUMN email TEXT, DROP COLUMN birthday;
+	CREATE UNIQUE INDEX ON users (email);
+	ALTER TABLE contacts RENAME COLUMN is_external TO external;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Branch", func(t *testing.T) {
+		_, err := connPool.Exec(ctx, `
+		INSERT INTO b.users(accountid, username, passhash, email) VALUES
+		('103362343333', 'bob', '2345', 'bob@example.com');
+		UPDATE b.contacts SET external = false WHERE username = 'alice';
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = connPool.Exec(ctx, `
+		INSERT INTO b.users(accountid, username, passhash, email) VALUES
+		('107744137744', 'eve', '3456', 'bob@example.com');
+		`)
+		if err == nil {
+			t.Fatal("inserted a duplicate email")
+		}
+
+		var email *string
+		if err := connPool.QueryRow(ctx, `SELECT email FROM b.users WHERE username = 'alice'`).Scan(&email); err != nil {
+			t.Fatal(err)
+		}
+		if email != nil {
+			t.Errorf("email of an existing row: got %q, want NULL", *email)
+		}
+	})
+
+	t.Run("Production", func(t *testing.T) {
+		var n int
+		err := connPool.QueryRow(ctx, `
+		SELECT count(*) FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = 'users' AND column_name = 'email'
+		`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Error("the production table has the new column")
+		}
+
+		var birthday any
+		if err := connPool.QueryRow(ctx, `SELECT birthday FROM a.users WHERE username = 'alice'`).Scan(&birthday); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		diffs, err := brancher.ComputeDiffAtN(ctx, a, b, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantUsers := []string{
+			`column "birthday" only in A: date`,
+			`column "email" only in B: text`,
+			`index "users_email_idx" only in B: UNIQUE ("email")`,
+		}
+		if diff := cmp.Diff(wantUsers, diffs["users"].SchemaDiff.Lines()); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"accountid", "passhash", "username"}, diffs["users"].ColNames); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+		if got, want := len(diffs["users"].Experimental), 1; got != want {
+			t.Errorf("rows only in B: got %d, want %d", got, want)
+		}
+
+		wantContacts := []string{
+			`column "external" only in B: boolean NOT NULL`,
+			`column "is_external" only in A: boolean NOT NULL`,
+		}
+		if diff := cmp.Diff(wantContacts, diffs["contacts"].SchemaDiff.Lines()); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("SchemaDiff", func(t *testing.T) {
+		got, err := brancher.ComputeSchemaDiff(ctx, a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &SchemaDiff{Tables: []*TableSchemaDiff{
+			{
+				Table:   "contacts",
+				Change:  Changed,
+				Columns: []ObjectChange{{Name: "external", Change: Added, B: "boolean NOT NULL"}, {Name: "is_external", Change: Removed, A: "boolean NOT NULL"}},
+			},
+			{
+				Table:   "users",
+				Change:  Changed,
+				Columns: []ObjectChange{{Name: "birthday", Change: Removed, A: "date"}, {Name: "email", Change: Added, B: "text"}},
+				Indexes: []ObjectChange{{Name: "users_email_idx", Change: Added, B: `UNIQUE ("email")`}},
+			},
+		}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("Fork", func(t *testing.T) {
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Migrate(ctx, `ALTER TABLE users DROP COLUMN email`); err == nil {
+			t.Error("changed the schema of a committed branch")
+		}
+
+		child, err := b.Fork(ctx, "child")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = connPool.Exec(ctx, `
+		INSERT INTO child.users(accountid, username, passhash, email) VALUES
+		('107744137744', 'eve', '3456', 'eve@example.com');
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diffs, err := brancher.ComputeDiffAtN(ctx, b, child, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := diffs["users"].SchemaDiff; got != nil {
+			t.Errorf("schema differences of a fork: %v", got.Lines())
+		}
+		if diff := cmp.Diff([]string{"accountid", "email", "passhash", "username"}, diffs["users"].ColNames); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+	t.Run("AddColumn", func(t *testing.T) {
+		c, err := brancher.Branch(ctx, "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sql := range []string{
+			`ALTER TABLE users ADD COLUMN score int DEFAULT 7; ALTER TABLE users DROP COLUMN missing`,
+			`ALTER TABLE users ADD COLUMN score int NOT NULL`,
+			`ALTER TABLE users ADD COLUMN score int DEFAULT 7 CHECK (score > 10)`,
+			`ALTER TABLE users ADD COLUMN score float DEFAULT random()`,
+		} {
+			if err := c.Migrate(ctx, sql); err == nil {
+				t.Errorf("Migrate(%q) succeeded", sql)
+			}
+		}
+		if _, err := connPool.Exec(ctx, `SELECT score FROM c.users`); err == nil {
+			t.Error("a failed schema change added a column")
+		}
+
+		if err := c.Migrate(ctx, `ALTER TABLE users ADD COLUMN score int NOT NULL DEFAULT 7`); err != nil {
+			t.Fatal(err)
+		}
+		var score, copied int
+		if err := connPool.QueryRow(ctx, `SELECT score FROM c.users WHERE username = 'alice'`).Scan(&score); err != nil {
+			t.Fatal(err)
+		}
+		if score != 7 {
+			t.Errorf("score = %d, want 7", score)
+		}
+		if err := connPool.QueryRow(ctx, `SELECT count(*) FROM c.usersbase`).Scan(&copied); err != nil {
+			t.Fatal(err)
+		}
+		if copied != 0 {
+			t.Errorf("the schema change copied %d production rows", copied)
+		}
+	})
+	t.Run("Intercept", func(t *testing.T) {
+		sql, err := a.Intercept(ctx, `
+		ALTER TABLE users ADD COLUMN nickname TEXT;
+		INSERT INTO users(accountid, username, passhash, nickname) VALUES
+		('102233422233', 'bob', '2345', 'bobby')
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := connPool.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Release()
+		if _, err := conn.Exec(ctx, "SET search_path TO "+a.SearchPath()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+		var nickname string
+		if err := connPool.QueryRow(ctx, `SELECT nickname FROM a.users WHERE username = 'bob'`).Scan(&nickname); err != nil {
+			t.Fatal(err)
+		}
+		if nickname != "bobby" {
+			t.Errorf("nickname = %q, want bobby", nickname)
+		}
+		if _, err := connPool.Exec(ctx, `SELECT nickname FROM public.users`); err == nil {
+			t.Error("intercepted schema change applied to production")
+		}
+		if err := a.RollbackTo(ctx, -1); err == nil {
+			t.Error("rolled back a branch with schema changes")
+		}
+	})
+}
@@ -0,0 +1,250 @@
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/exp/maps"
+)
+
+// ChangeKind tells how a table, or an object of a table, differs between
+// branches A and B.
+type ChangeKind int
+
+const (
+	Added   ChangeKind = iota + 1 // only in B
+	Removed                       // only in A
+	Changed                       // in both, with different definitions
+)
+
+func (c ChangeKind) String() string {
+	return [...]string{"Added", "Removed", "Changed"}[c-1]
+}
+
+// ObjectChange is a column, index, constraint or trigger of a table that
+// differs between A and B.
+type ObjectChange struct {
+	Name   string
+	Change ChangeKind
+	A      string // definition in A, e.g. bigint NOT NULL for a column; empty if Added
+	B      string // definition in B; empty if Removed
+}
+
+// TableSchemaDiff is the schema difference of one table. Added and removed
+// tables list no objects.
+type TableSchemaDiff struct {
+	Table       string // tableKey of the production table
+	Change      ChangeKind
+	Columns     []ObjectChange
+	Indexes     []ObjectChange
+	Constraints []ObjectChange
+	Triggers    []ObjectChange
+}
+
+// Lines describes the difference, one line per object, e.g.
+// column "email" only in B: text.
+func (t *TableSchemaDiff) Lines() []string {
+	switch t.Change {
+	case Added:
+		return []string{"table only in B"}
+	case Removed:
+		return []string{"table only in A"}
+	}
+
+	var lines []string
+	for _, group := range []struct {
+		kind    string
+		changes []ObjectChange
+	}{
+		{"column", t.Columns},
+		{"index", t.Indexes},
+		{"constraint", t.Constraints},
+		{"trigger", t.Triggers},
+	} {
+		for _, c := range group.changes {
+			switch c.Change {
+			case Added:
+				lines = append(lines, fmt.Sprintf("%s %s only in B: %s", group.kind, quoteIdent(c.Name), c.B))
+			case Removed:
+				lines = append(lines, fmt.Sprintf("%s %s only in A: %s", group.kind, quoteIdent(c.Name), c.A))
+			case Changed:
+				lines = append(lines, fmt.Sprintf("%s %s: %s in A, %s in B", group.kind, quoteIdent(c.Name), c.A, c.B))
+			}
+		}
+	}
+	return lines
+}
+
+// SchemaDiff is the schema difference of two branches.
+type SchemaDiff struct {
+	Tables []*TableSchemaDiff // the tables that differ, sorted by name
+}
+
+// ComputeSchemaDiff returns the tables, columns, indexes, constraints and
+// triggers that were added, removed or changed in B relative to A.
+func (b *Brancher) ComputeSchemaDiff(ctx context.Context, A *Branch, B *Branch) (*SchemaDiff, error) {
+	names := maps.Keys(A.clonedDdl.clonedTables)
+	for name := range B.clonedDdl.clonedTables {
+		if _, ok := A.clonedDdl.clonedTables[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	schemaDiff := &SchemaDiff{}
+	for _, name := range names {
+		tableDiff, err := tableSchemaDiff(ctx, b.db, name, A.clonedDdl.clonedTables[name], B.clonedDdl.clonedTables[name])
+		if err != nil {
+			return nil, err
+		}
+		if tableDiff != nil {
+			schemaDiff.Tables = append(schemaDiff.Tables, tableDiff)
+		}
+	}
+	return schemaDiff, nil
+}
+
+// tableSchemaDiff returns the schema difference of the table name between A
+// and B, either of which may be nil, or nil if the schemas are the same.
+func tableSchemaDiff(ctx context.Context, connPool *pgxpool.Pool, name string, a *clonedTable, b *clonedTable) (*TableSchemaDiff, error) {
+	switch {
+	case a == nil:
+		return &TableSchemaDiff{Table: name, Change: Added}, nil
+	case b == nil:
+		return &TableSchemaDiff{Table: name, Change: Removed}, nil
+	}
+
+	triggersA, err := userTriggers(ctx, connPool, a)
+	if err != nil {
+		return nil, err
+	}
+	triggersB, err := userTriggers(ctx, connPool, b)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &TableSchemaDiff{
+		Table:       name,
+		Change:      Changed,
+		Columns:     diffObjects(columnDefs(a.Snapshot), columnDefs(b.Snapshot)),
+		Indexes:     diffObjects(indexDefs(a.Snapshot), indexDefs(b.Snapshot)),
+		Constraints: diffObjects(constraintDefs(a.Snapshot), constraintDefs(b.Snapshot)),
+		Triggers:    diffObjects(triggersA, triggersB),
+	}
+	if len(d.Columns) == 0 && len(d.Indexes) == 0 && len(d.Constraints) == 0 && len(d.Triggers) == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// diffObjects compares the definitions of the objects of a table in A and B,
+// keyed by name.
+func diffObjects(a map[string]string, b map[string]string) []ObjectChange {
+	names := maps.Keys(a)
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []ObjectChange
+	for _, name := range names {
+		defA, inA := a[name]
+		defB, inB := b[name]
+		switch {
+		case !inA:
+			changes = append(changes, ObjectChange{Name: name, Change: Added, B: defB})
+		case !inB:
+			changes = append(changes, ObjectChange{Name: name, Change: Removed, A: defA})
+		case defA != defB:
+			changes = append(changes, ObjectChange{Name: name, Change: Changed, A: defA, B: defB})
+		}
+	}
+	return changes
+}
+
+func columnDefs(t *table) map[string]string {
+	defs := map[string]string{}
+	for name, col := range t.Cols {
+		def := columnType(col)
+		if col.Collation != "" {
+			def += " COLLATE " + col.Collation
+		}
+		if col.Nullable == "NO" {
+			def += " NOT NULL"
+		}
+		if col.Generated != "" {
+			def += " GENERATED ALWAYS AS (" + col.Generated + ") STORED"
+		} else if col.Default != "" {
+			def += " DEFAULT " + col.Default
+		}
+		defs[name] = def
+	}
+	return defs
+}
+
+func indexDefs(t *table) map[string]string {
+	defs := map[string]string{}
+	for _, idx := range t.Indexes {
+		def := "(" + identList("", idx.ColumnNames) + ")"
+		if idx.IsUnique {
+			def = "UNIQUE " + def
+		}
+		defs[idx.Name] = def
+	}
+	return defs
+}
+
+func constraintDefs(t *table) map[string]string {
+	defs := map[string]string{}
+	for _, c := range t.ForeignKeyConstraints {
+		defs[c.ConstraintName] = fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s(%s) ON DELETE %s ON UPDATE %s",
+			identList("", c.ColumnNames), qualify(c.RefTableSchema, c.RefTableName), identList("", c.RefColumnNames), c.OnDelete, c.OnUpdate)
+	}
+	for _, c := range t.CheckConstraints {
+		defs[c.Name] = "CHECK " + c.Expression
+	}
+	for _, c := range t.ExclusionConstraints {
+		elements := make([]string, len(c.ColumnNames))
+		for i, col := range c.ColumnNames {
+			elements[i] = quoteIdent(col) + " WITH " + c.Operators[i]
+		}
+		defs[c.Name] = "EXCLUDE (" + strings.Join(elements, ", ") + ")"
+	}
+	return defs
+}
+
+// userTriggers returns the definitions of the triggers on R' of t that the
+// branch does not manage itself, keyed by name. The view is left unqualified
+// in the definitions so that they compare across branches.
+func userTriggers(ctx context.Context, connPool *pgxpool.Pool, t *clonedTable) (map[string]string, error) {
+	rows, err := connPool.Query(ctx, `
+	SELECT t.tgname, replace(pg_get_triggerdef(t.oid), ' ON ' || quote_ident(n.nspname) || '.', ' ON ')
+	FROM pg_trigger t
+	JOIN pg_class c ON c.oid = t.tgrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE n.nspname = $1 AND c.relname = $2 AND NOT t.tgisinternal
+	`, t.View.Schema, t.View.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the triggers of %s: %w", t.View.qualifiedName(), err)
+	}
+	defer rows.Close()
+
+	defs := map[string]string{}
+	for rows.Next() {
+		var name, def string
+		if err := rows.Scan(&name, &def); err != nil {
+			return nil, err
+		}
+		if slices.Contains(t.Triggers, name) {
+			continue
+		}
+		defs[name] = def
+	}
+	return defs, rows.Err()
+}
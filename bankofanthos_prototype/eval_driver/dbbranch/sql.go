@@ -0,0 +1,167 @@
+// This file builds the pieces of SQL that dbbranch generates. Names and
+// literals are never put into a statement as is, but quoted here.
+package dbbranch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// quoteIdent quotes a schema, table, view, column, trigger or function name
+// so that it can be put into generated SQL as is.
+func quoteIdent(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// qualify returns the quoted name of a relation or function in schema. The
+// name is left unqualified if schema is empty.
+func qualify(schema, name string) string {
+	if schema == "" {
+		return quoteIdent(name)
+	}
+	return pgx.Identifier{schema, name}.Sanitize()
+}
+
+// identPattern returns a regular expression that matches name the way
+// postgres prints it, i.e. quoted or not.
+func identPattern(name string) string {
+	return "(?:" + regexp.QuoteMeta(name) + "|" + regexp.QuoteMeta(quoteIdent(name)) + ")"
+}
+
+// identList quotes names and joins them with commas, each prefixed with
+// prefix, e.g. identList("NEW.", []string{"a", "b"}) returns NEW."a", NEW."b".
+func identList(prefix string, names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = prefix + quoteIdent(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// quoteLiteral quotes s as a string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// raiseMessage returns the format string of a RAISE statement that prints msg
+// as is.
+func raiseMessage(msg string) string {
+	return quoteLiteral(strings.ReplaceAll(msg, "%", "%%"))
+}
+
+// violation describes an error that a trigger raises in place of the native
+// check of a constraint, so that clients see the same SQLSTATE and fields.
+type violation struct {
+	Code       string // SQLSTATE, e.g. 23514
+	Message    string
+	Schema     string
+	Table      string
+	Column     string
+	Constraint string
+	Detail     string // SQL expression that evaluates to the detail text, empty for none
+}
+
+// raise returns the RAISE statement that reports v.
+func (v violation) raise() string {
+	opts := []string{"ERRCODE = " + quoteLiteral(v.Code)}
+	for _, opt := range []struct{ name, value string }{
+		{"SCHEMA", v.Schema},
+		{"TABLE", v.Table},
+		{"COLUMN", v.Column},
+		{"CONSTRAINT", v.Constraint},
+	} {
+		if opt.value != "" {
+			opts = append(opts, opt.name+" = "+quoteLiteral(opt.value))
+		}
+	}
+	if v.Detail != "" {
+		opts = append(opts, "DETAIL = "+v.Detail)
+	}
+	return fmt.Sprintf("RAISE EXCEPTION %s USING %s;", raiseMessage(v.Message), strings.Join(opts, ", "))
+}
+
+// keyDetail returns the SQL expression for the detail of a key violation, in
+// the words postgres uses, e.g. Key (username)=(alice) already exists. The
+// values are read from the fields cols of record, e.g. NEW, and text follows
+// the key.
+func keyDetail(record string, cols []string, text string) string {
+	names := make([]string, len(cols))
+	values := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = "quote_ident(" + quoteLiteral(col) + ")"
+		values[i] = fmt.Sprintf("COALESCE(%s.%s::text, 'null')", record, quoteIdent(col))
+	}
+	return fmt.Sprintf("'Key (' || concat_ws(', ', %s) || ')=(' || concat_ws(', ', %s) || ')' || %s", strings.Join(names, ", "), strings.Join(values, ", "), quoteLiteral(" "+text))
+}
+
+// dollarQuote quotes a function body with a dollar quote tag that does not
+// occur in the body.
+func dollarQuote(body string) string {
+	tag := "$$"
+	for i := 0; strings.Contains(body, tag); i++ {
+		tag = fmt.Sprintf("$q%d$", i)
+	}
+	return tag + body + tag
+}
+
+// columnType renders the type of col, e.g. character varying(64).
+func columnType(col column) string {
+	if col.Type != "" {
+		return col.Type
+	}
+	if col.CharacterMaximumLength > 0 {
+		return fmt.Sprintf("%s(%d)", col.DataType, col.CharacterMaximumLength)
+	}
+	return col.DataType
+}
+
+// columnDefault returns the DEFAULT expression of col that can be copied to
+// a branch. Defaults that draw from a sequence are left out, since evaluating
+// them in a branch would advance the production sequence. The branch fills
+// those columns from its own copy of the sequence instead.
+func columnDefault(col column) string {
+	if strings.Contains(col.Default, "nextval(") {
+		return ""
+	}
+	return col.Default
+}
+
+// columnDef renders the definition of col in a CREATE TABLE statement.
+func columnDef(col column) string {
+	def := quoteIdent(col.Name) + " " + columnType(col)
+	if col.Collation != "" {
+		def += " COLLATE " + col.Collation
+	}
+	if d := columnDefault(col); d != "" {
+		def += " DEFAULT " + d
+	}
+	if col.Nullable == "NO" {
+		def += " NOT NULL"
+	}
+	return def
+}
+
+// createTriggerFunctionStmt returns the statement that creates the plpgsql
+// trigger function name, e.g. "ns"."t_redirect_insert"(), with body.
+func createTriggerFunctionStmt(name, body string) string {
+	return fmt.Sprintf(`
+	CREATE OR REPLACE FUNCTION %s
+	RETURNS TRIGGER
+	LANGUAGE plpgsql
+	AS %s;
+	`, name, dollarQuote(body))
+}
+
+// createTriggerStmt returns the statement that creates the row trigger name
+// on the view, which runs function instead of event.
+func createTriggerStmt(name, event, view, function string) string {
+	return fmt.Sprintf(`
+	CREATE OR REPLACE TRIGGER %s
+	INSTEAD OF %s ON %s
+	FOR EACH ROW
+	EXECUTE PROCEDURE %s;
+`, quoteIdent(name), event, view, function)
+}
@@ -0,0 +1,36 @@
+package dbbranch
+
+import (
+	"testing"
+)
+
+func TestQuoting(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"Ident", quoteIdent("users"), `"users"`},
+		{"ReservedIdent", quoteIdent("order"), `"order"`},
+		{"IdentWithQuote", quoteIdent(`my "table"`), `"my ""table"""`},
+		{"Qualify", qualify("Billing", "Invoices"), `"Billing"."Invoices"`},
+		{"Unqualified", qualify("", "Invoices"), `"Invoices"`},
+		{"IdentList", identList("NEW.", []string{"id", "user"}), `NEW."id", NEW."user"`},
+		{"Literal", quoteLiteral("it's"), `'it''s'`},
+		{"RaiseMessage", raiseMessage("100% o'clock"), `'100%% o''clock'`},
+		{"DollarQuote", dollarQuote(" BEGIN END; "), "$$ BEGIN END; $$"},
+		{"NestedDollarQuote", dollarQuote(` SELECT 1 FROM "a$$b"; `), `$q0$ SELECT 1 FROM "a$$b"; $q0$`},
+		{"ColumnDef", columnDef(column{Name: "User Name", DataType: "character varying", CharacterMaximumLength: 64, Nullable: "NO"}), `"User Name" character varying(64) NOT NULL`},
+		{"NullableColumnDef", columnDef(column{Name: "birthday", DataType: "date", Nullable: "YES"}), `"birthday" date`},
+		{"FullColumnDef", columnDef(column{Name: "label", DataType: "text", Nullable: "NO", Type: "text", Collation: `"pg_catalog"."C"`, Default: "'none'::text"}), `"label" text COLLATE "pg_catalog"."C" DEFAULT 'none'::text NOT NULL`},
+		{"Violation", violation{Code: "23514", Message: `new row for relation "it's" violates check constraint "100%"`, Table: "it's", Constraint: "100%"}.raise(), `RAISE EXCEPTION 'new row for relation "it''s" violates check constraint "100%%"' USING ERRCODE = '23514', TABLE = 'it''s', CONSTRAINT = '100%';`},
+		{"KeyDetail", keyDetail("NEW", []string{"a", "B"}, "already exists."), `'Key (' || concat_ws(', ', quote_ident('a'), quote_ident('B')) || ')=(' || concat_ws(', ', COALESCE(NEW."a"::text, 'null'), COALESCE(NEW."B"::text, 'null')) || ')' || ' already exists.'`},
+		{"SequenceDefault", columnDef(column{Name: "id", DataType: "integer", Nullable: "NO", Type: "integer", Default: "nextval('items_id_seq'::regclass)"}), `"id" integer NOT NULL`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.got != test.want {
+				t.Errorf("got %s, want %s", test.got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,713 @@
+// This file rewrites the statements that postgres cannot run against an R'
+// view into statements that it can. TRUNCATE only works on tables, and
+// INSERT ... ON CONFLICT needs a unique index on its target, which views do not
+// have.
+package dbbranch
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/exp/maps"
+)
+
+type tokenKind int
+
+const (
+	tokSpace  tokenKind = iota // whitespace and comments
+	tokWord                    // unquoted identifier or keyword
+	tokQuoted                  // quoted identifier
+	tokString                  // string constant, including dollar quoted ones
+	tokOther                   // numbers, parameters, operators and punctuation
+)
+
+type token struct {
+	kind  tokenKind
+	text  string // as written in the statement
+	start int    // byte offset in the statement
+}
+
+// is reports whether t is the keyword or punctuation word.
+func (t token) is(word string) bool {
+	if t.kind == tokWord {
+		return strings.EqualFold(t.text, word)
+	}
+	return t.kind == tokOther && t.text == word
+}
+
+// ident returns the name t stands for: quoted identifiers as is, unquoted ones
+// folded to lower case.
+func (t token) ident() (string, bool) {
+	switch t.kind {
+	case tokWord:
+		return strings.ToLower(t.text), true
+	case tokQuoted:
+		return strings.ReplaceAll(t.text[1:len(t.text)-1], `""`, `"`), true
+	}
+	return "", false
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r >= utf8.RuneSelf || unicode.IsLetter(r)
+}
+
+func isIdentChar(r rune) bool {
+	return isIdentStart(r) || r == '$' || unicode.IsDigit(r)
+}
+
+// lex splits sql into tokens. It knows just enough of the lexical structure
+// of postgres to find keywords, names and statement boundaries; it does not
+// validate anything.
+func lex(sql string) []token {
+	var tokens []token
+	for i := 0; i < len(sql); {
+		start := i
+		kind := tokOther
+		r, size := utf8.DecodeRuneInString(sql[i:])
+		switch {
+		case unicode.IsSpace(r):
+			kind = tokSpace
+			for i < len(sql) {
+				r, size := utf8.DecodeRuneInString(sql[i:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				i += size
+			}
+		case strings.HasPrefix(sql[i:], "--"):
+			kind = tokSpace
+			if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(sql)
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			kind = tokSpace
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+		case r == '\'':
+			kind = tokString
+			i = endOfQuoted(sql, i, '\'', false)
+		case (r == 'E' || r == 'e') && strings.HasPrefix(sql[i+1:], "'"):
+			kind = tokString
+			i = endOfQuoted(sql, i+1, '\'', true)
+		case strings.ContainsRune("BbXxNn", r) && strings.HasPrefix(sql[i+1:], "'"):
+			kind = tokString
+			i = endOfQuoted(sql, i+1, '\'', false)
+		case r == '"':
+			kind = tokQuoted
+			i = endOfQuoted(sql, i, '"', false)
+		case r == '$' && dollarTag(sql[i:]) != "":
+			kind = tokString
+			tag := dollarTag(sql[i:])
+			if end := strings.Index(sql[i+len(tag):], tag); end >= 0 {
+				i += len(tag) + end + len(tag)
+			} else {
+				i = len(sql)
+			}
+		case isIdentStart(r):
+			kind = tokWord
+			for i < len(sql) {
+				r, size := utf8.DecodeRuneInString(sql[i:])
+				if !isIdentChar(r) {
+					break
+				}
+				i += size
+			}
+		case unicode.IsDigit(r) || r == '$':
+			i += size
+			for i < len(sql) && (sql[i] == '.' || unicode.IsDigit(rune(sql[i])) || unicode.IsLetter(rune(sql[i]))) {
+				i++
+			}
+		default:
+			i += size
+		}
+		tokens = append(tokens, token{kind: kind, text: sql[start:i], start: start})
+	}
+	return tokens
+}
+
+// endOfQuoted returns the offset after the quoted string that starts at
+// sql[i]. A doubled quote stands for itself; so does an escaped one in
+// backslash strings.
+func endOfQuoted(sql string, i int, quote byte, backslash bool) int {
+	for i++; i < len(sql); i++ {
+		switch {
+		case backslash && sql[i] == '\\':
+			i++
+		case sql[i] == quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+// dollarTag returns the tag of the dollar quoted string s starts with, e.g.
+// $body$, or "" if s does not start with one.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '$' {
+			return s[:i+1]
+		}
+		r, _ := utf8.DecodeRuneInString(s[i:])
+		if !isIdentChar(r) || r == '$' || (i == 1 && unicode.IsDigit(r)) {
+			return ""
+		}
+	}
+	return ""
+}
+
+// statement is one SQL statement with its tokens, whitespace and comments
+// left out.
+type statement struct {
+	sql    string
+	tokens []token
+}
+
+// splitStatements splits sql at the semicolons outside of parentheses.
+func splitStatements(sql string) []statement {
+	var stmts []statement
+	start, depth := 0, 0
+	var tokens []token
+	for _, t := range lex(sql) {
+		switch {
+		case t.kind == tokSpace:
+			continue
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case t.is(";") && depth == 0:
+			stmts = append(stmts, newStatement(sql[start:t.start], tokens, start))
+			start, tokens = t.start+1, nil
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	if strings.TrimSpace(sql[start:]) != "" {
+		stmts = append(stmts, newStatement(sql[start:], tokens, start))
+	}
+	return stmts
+}
+
+func newStatement(sql string, tokens []token, offset int) statement {
+	for i := range tokens {
+		tokens[i].start -= offset
+	}
+	return statement{sql: sql, tokens: tokens}
+}
+
+// span returns the text of the tokens [i, j).
+func (s statement) span(i, j int) string {
+	if i >= len(s.tokens) {
+		return ""
+	}
+	if j >= len(s.tokens) {
+		return strings.TrimSpace(s.sql[s.tokens[i].start:])
+	}
+	return strings.TrimSpace(s.sql[s.tokens[i].start:s.tokens[j].start])
+}
+
+// find returns the index of the first token at or after i that is word and
+// outside of parentheses, or len(s.tokens) if there is none.
+func (s statement) find(i int, words ...string) int {
+	depth := 0
+	for ; i < len(s.tokens); i++ {
+		t := s.tokens[i]
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth == 0 && t.is(words[0]):
+			match := true
+			for k, w := range words[1:] {
+				if i+1+k >= len(s.tokens) || !s.tokens[i+1+k].is(w) {
+					match = false
+					break
+				}
+			}
+			if match {
+				return i
+			}
+		}
+	}
+	return len(s.tokens)
+}
+
+// closing returns the index of the parenthesis that closes the one at i.
+func (s statement) closing(i int) int {
+	depth := 0
+	for ; i < len(s.tokens); i++ {
+		if s.tokens[i].is("(") {
+			depth++
+		} else if s.tokens[i].is(")") {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s.tokens)
+}
+
+// name parses a possibly schema qualified name at i.
+func (s statement) name(i int) (schema, name string, next int, ok bool) {
+	if i >= len(s.tokens) {
+		return "", "", i, false
+	}
+	if name, ok = s.tokens[i].ident(); !ok {
+		return "", "", i, false
+	}
+	if i+2 < len(s.tokens) && s.tokens[i+1].is(".") {
+		if n, ok := s.tokens[i+2].ident(); ok {
+			return name, n, i + 3, true
+		}
+	}
+	return "", name, i + 1, true
+}
+
+// identList parses a parenthesized list of names at i, e.g. (a, "B").
+func (s statement) identList(i int) (names []string, next int, ok bool) {
+	if i >= len(s.tokens) || !s.tokens[i].is("(") {
+		return nil, i, false
+	}
+	end := s.closing(i)
+	for k := i + 1; k < end; k += 2 {
+		name, ok := s.tokens[k].ident()
+		if !ok || (k+1 < end && !s.tokens[k+1].is(",")) {
+			return nil, i, false
+		}
+		names = append(names, name)
+	}
+	return names, end + 1, len(names) > 0
+}
+
+// Rewrite returns sql with the statements that cannot run against the R'
+// views of the branch rewritten into ones that can:
+//
+//   - TRUNCATE deletes all rows through the R' views, referencing tables
+//     first, and restarts the sequences of the branch for RESTART IDENTITY.
+//   - INSERT ... ON CONFLICT, also after a WITH clause, updates the rows
+//     that conflict and inserts the others in one statement. Like the
+//     original, it counts the inserted and updated rows in its command tag,
+//     and fails if DO UPDATE would affect a row twice.
+//
+// sql is expected to use the search_path of the branch (see SearchPath).
+// Statements on tables that are not branched are returned unchanged.
+func (b *Branch) Rewrite(sql string) (string, error) {
+	stmts := splitStatements(sql)
+	rewritten := false
+	out := make([]string, len(stmts))
+	for i, stmt := range stmts {
+		out[i] = stmt.sql
+		if len(stmt.tokens) == 0 {
+			continue
+		}
+		var s string
+		var err error
+		switch {
+		case stmt.tokens[0].is("TRUNCATE"):
+			s, err = b.rewriteTruncate(stmt)
+		case stmt.tokens[0].is("INSERT") && stmt.find(0, "ON", "CONFLICT") < len(stmt.tokens):
+			s, err = b.rewriteUpsert(stmt, 0)
+		case stmt.tokens[0].is("WITH") && stmt.find(stmt.find(1, "INSERT"), "ON", "CONFLICT") < len(stmt.tokens):
+			// the queries of the WITH clause are in parentheses, so the first
+			// INSERT outside of them starts the statement
+			s, err = b.rewriteUpsert(stmt, stmt.find(1, "INSERT"))
+		default:
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if s != "" {
+			out[i] = s
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return sql, nil
+	}
+	return strings.Join(out, ";") + ";", nil
+}
+
+// resolveTable returns the branched table that schema.name stands for in the
+// search_path of the branch, or nil if it is not branched.
+func (b *Branch) resolveTable(schema, name string) *clonedTable {
+	tables := b.clonedDdl.clonedTables
+	sources := b.clonedDdl.database.schemas()
+	if schema == "" {
+		for _, s := range sources {
+			if t, ok := tables[tableKey(s, name)]; ok {
+				return t
+			}
+		}
+		return nil
+	}
+	for _, s := range sources {
+		if schema == branchSchema(b.namespace, s) {
+			return tables[tableKey(s, name)]
+		}
+	}
+	return tables[tableKey(schema, name)]
+}
+
+// rewriteTruncate rewrites
+//
+//	TRUNCATE [TABLE] [ONLY] name [*] [, ...] [RESTART IDENTITY | CONTINUE IDENTITY] [CASCADE | RESTRICT]
+//
+// or returns "" if none of the tables is branched.
+func (b *Branch) rewriteTruncate(stmt statement) (string, error) {
+	i := 1
+	if i < len(stmt.tokens) && stmt.tokens[i].is("TABLE") {
+		i++
+	}
+	var tables []*clonedTable
+	unbranched := 0
+	for {
+		if i < len(stmt.tokens) && stmt.tokens[i].is("ONLY") {
+			i++
+		}
+		schema, name, next, ok := stmt.name(i)
+		if !ok {
+			return "", fmt.Errorf("failed to parse %q", stmt.sql)
+		}
+		i = next
+		if i < len(stmt.tokens) && stmt.tokens[i].is("*") {
+			i++
+		}
+		if t := b.resolveTable(schema, name); t != nil {
+			tables = append(tables, t)
+		} else {
+			unbranched++
+		}
+		if i >= len(stmt.tokens) || !stmt.tokens[i].is(",") {
+			break
+		}
+		i++
+	}
+	restart, cascade := false, false
+	for ; i < len(stmt.tokens); i++ {
+		switch {
+		case stmt.tokens[i].is("RESTART"):
+			restart = true
+		case stmt.tokens[i].is("CASCADE"):
+			cascade = true
+		case stmt.tokens[i].is("CONTINUE"), stmt.tokens[i].is("IDENTITY"), stmt.tokens[i].is("RESTRICT"):
+		default:
+			return "", fmt.Errorf("failed to parse %q", stmt.sql)
+		}
+	}
+	if len(tables) == 0 {
+		return "", nil
+	}
+	if unbranched > 0 {
+		return "", fmt.Errorf("cannot truncate branched and unbranched tables in one statement: %q", stmt.sql)
+	}
+
+	truncated := map[string]*clonedTable{}
+	for _, t := range tables {
+		truncated[t.Snapshot.key()] = t
+	}
+	// like postgres, refuse to truncate a referenced table alone, or truncate
+	// the referencing tables too with CASCADE
+	for queue := tables; len(queue) > 0; queue = queue[1:] {
+		for _, ref := range queue[0].Snapshot.References {
+			key := tableKey(ref.ForeignKeyTableSchema, ref.ForeignKeyTableName)
+			if _, ok := truncated[key]; ok {
+				continue
+			}
+			child, ok := b.clonedDdl.clonedTables[key]
+			if !ok {
+				continue
+			}
+			if !cascade {
+				return fmt.Sprintf("DO %s", dollarQuote(fmt.Sprintf("BEGIN %s END;", violation{
+					Code:    "0A000",
+					Message: "cannot truncate a table referenced in a foreign key constraint",
+					Detail:  quoteLiteral(fmt.Sprintf("Table \"%s\" references \"%s\".", ref.ForeignKeyTableName, ref.BeRefedTableName)),
+				}.raise()))), nil
+			}
+			truncated[key] = child
+			queue = append(queue, child)
+		}
+	}
+
+	var stmts []string
+	for _, t := range deleteOrder(truncated) {
+		stmts = append(stmts, "DELETE FROM "+hierarchyView(t).qualifiedName())
+	}
+	if restart {
+		var sequences []string
+		for _, t := range truncated {
+			for _, seq := range t.Sequences {
+				sequences = append(sequences, seq.qualifiedName())
+			}
+		}
+		sort.Strings(sequences)
+		for _, seq := range sequences {
+			stmts = append(stmts, "ALTER SEQUENCE "+seq+" RESTART")
+		}
+	}
+	return strings.Join(stmts, ";\n"), nil
+}
+
+// deleteOrder orders tables so that every table comes after the tables that
+// reference it, as far as the references are not cyclic.
+func deleteOrder(tables map[string]*clonedTable) []*clonedTable {
+	keys := make([]string, 0, len(tables))
+	for key := range tables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var order []*clonedTable
+	done := map[string]bool{}
+	for len(order) < len(keys) {
+		progress := false
+		for _, key := range keys {
+			if done[key] {
+				continue
+			}
+			ready := true
+			for _, ref := range tables[key].Snapshot.References {
+				child := tableKey(ref.ForeignKeyTableSchema, ref.ForeignKeyTableName)
+				if _, ok := tables[child]; ok && child != key && !done[child] {
+					ready = false
+				}
+			}
+			if ready {
+				order = append(order, tables[key])
+				done[key] = true
+				progress = true
+			}
+		}
+		if !progress {
+			// a cycle, delete the rest in any order
+			for _, key := range keys {
+				if !done[key] {
+					order = append(order, tables[key])
+					done[key] = true
+				}
+			}
+		}
+	}
+	return order
+}
+
+// rewriteUpsert rewrites
+//
+//	[WITH ...] INSERT INTO name [AS alias] [(column, ...)] query
+//	ON CONFLICT [(column, ...) | ON CONSTRAINT constraint] DO NOTHING | DO UPDATE SET ... [WHERE condition]
+//	[RETURNING ...]
+//
+// whose INSERT is at token at into a statement whose data modifying CTEs
+// update the rows that conflict and insert the rest, or returns "" if the
+// table is not branched. The queries of the WITH clause come first among the
+// CTEs. Only conflict targets that name columns or constraints are supported.
+//
+// The new rows are checked against the rows of the table before the
+// statement, so new rows that conflict with each other are handled apart:
+// DO NOTHING skips all but the first, as the conflict with the first would
+// skip them, and DO UPDATE fails with the error of postgres.
+func (b *Branch) rewriteUpsert(stmt statement, at int) (string, error) {
+	fail := func(reason string) (string, error) {
+		return "", fmt.Errorf("cannot run %q in branch %s: %s", stmt.sql, b.namespace, reason)
+	}
+	if len(stmt.tokens) < at+2 || !stmt.tokens[at+1].is("INTO") {
+		return fail("not an INSERT INTO")
+	}
+	schema, name, i, ok := stmt.name(at + 2)
+	if !ok {
+		return fail("no table name")
+	}
+	t := b.resolveTable(schema, name)
+	if t == nil {
+		return "", nil
+	}
+
+	alias := quoteIdent(name)
+	if i < len(stmt.tokens) && stmt.tokens[i].is("AS") {
+		a, ok := stmt.tokens[i+1].ident()
+		if !ok {
+			return fail("no alias")
+		}
+		alias = quoteIdent(a)
+		i += 2
+	}
+
+	// without a column list the columns are those of the view, in order
+	cols := maps.Keys(t.View.Cols)
+	sort.Strings(cols)
+	if i < len(stmt.tokens) && stmt.tokens[i].is("(") && i+1 < len(stmt.tokens) && !stmt.tokens[i+1].is("SELECT") && !stmt.tokens[i+1].is("VALUES") && !stmt.tokens[i+1].is("WITH") {
+		if cols, i, ok = stmt.identList(i); !ok {
+			return fail("cannot parse the column list")
+		}
+	}
+	for _, col := range cols {
+		if _, ok := t.View.Cols[col]; !ok {
+			return fail(fmt.Sprintf("column %s does not exist", col))
+		}
+	}
+	if i < len(stmt.tokens) && stmt.tokens[i].is("OVERRIDING") {
+		i += 3
+	}
+
+	onConflict := stmt.find(i, "ON", "CONFLICT")
+	if i >= onConflict || stmt.tokens[i].is("DEFAULT") {
+		return fail("DEFAULT VALUES is not supported")
+	}
+	query := stmt.span(i, onConflict)
+
+	// the keys the new rows may conflict on
+	var keys [][]string
+	i = onConflict + 2
+	switch {
+	case i < len(stmt.tokens) && stmt.tokens[i].is("("):
+		target, next, ok := stmt.identList(i)
+		if !ok {
+			return fail("only columns are supported as conflict target")
+		}
+		keys, i = [][]string{target}, next
+	case i+2 < len(stmt.tokens) && stmt.tokens[i].is("ON") && stmt.tokens[i+1].is("CONSTRAINT"):
+		constraint, ok := stmt.tokens[i+2].ident()
+		if !ok {
+			return fail("no constraint name")
+		}
+		for _, index := range t.Snapshot.Indexes {
+			if index.IsUnique && index.Name == constraint {
+				keys = append(keys, index.ColumnNames)
+			}
+		}
+		if len(keys) == 0 {
+			return fail(fmt.Sprintf("constraint %s does not exist", constraint))
+		}
+		i += 3
+	}
+	inserted := map[string]bool{}
+	for _, col := range cols {
+		inserted[col] = true
+	}
+	if keys == nil {
+		// without a conflict target the new rows conflict on any unique key
+		// whose columns they set; the other columns take their defaults,
+		// which are new serial or identity values or NULLs that never conflict
+		for _, index := range t.Snapshot.Indexes {
+			if index.IsUnique && !slices.ContainsFunc(index.ColumnNames, func(col string) bool { return !inserted[col] }) {
+				keys = append(keys, index.ColumnNames)
+			}
+		}
+	}
+	for _, key := range keys {
+		for _, col := range key {
+			if !inserted[col] {
+				return fail(fmt.Sprintf("conflict column %s is not inserted", col))
+			}
+		}
+	}
+
+	if i+1 >= len(stmt.tokens) || !stmt.tokens[i].is("DO") {
+		return fail("no conflict action")
+	}
+	doUpdate := stmt.tokens[i+1].is("UPDATE")
+	returning := stmt.find(i, "RETURNING")
+	var set, where string
+	if doUpdate {
+		if i+2 >= len(stmt.tokens) || !stmt.tokens[i+2].is("SET") {
+			return fail("no SET clause")
+		}
+		whereAt := stmt.find(i+3, "WHERE")
+		if whereAt > returning {
+			whereAt = returning
+		}
+		set = stmt.span(i+3, whereAt)
+		if whereAt < returning {
+			where = stmt.span(whereAt+1, returning)
+		}
+	}
+
+	// the new rows are cast to the column types, as an INSERT would do, and
+	// numbered in the order of the query
+	casts := make([]string, len(cols))
+	for k, col := range cols {
+		casts[k] = fmt.Sprintf("CAST(%s AS %s) AS %s", qualify("source", col), columnType(t.View.Cols[col]), quoteIdent(col))
+	}
+	// conflicts returns the condition that the rows a and b agree on a key
+	conflicts := func(a, b string) string {
+		var conds []string
+		for _, key := range keys {
+			conds = append(conds, fmt.Sprintf("(%s) = (%s)", identList(a+".", key), identList(b+".", key)))
+		}
+		if len(conds) == 0 {
+			return "false"
+		}
+		return strings.Join(conds, " OR ")
+	}
+	// duplicate is the condition that a new row conflicts with an earlier one;
+	// for DO UPDATE it raises the error instead, and CASE keeps the error
+	// from being raised for any other pair of rows
+	duplicate := fmt.Sprintf(`"earlier"."$row" < "numbered"."$row" AND (%s)`, conflicts(`"earlier"`, `"numbered"`))
+	if doUpdate {
+		duplicate = fmt.Sprintf("CASE WHEN %s THEN %s ELSE false END", duplicate,
+			b.clonedDdl.raise("21000", "ON CONFLICT DO UPDATE command cannot affect row a second time"))
+	}
+
+	view := hierarchyView(t).qualifiedName()
+	var ctes []string
+	if at > 0 {
+		ctes = append(ctes, stmt.span(1, at))
+	}
+	ctes = append(ctes,
+		fmt.Sprintf(`"source"(%s) AS (%s)`, identList("", cols), query),
+		fmt.Sprintf(`"numbered" AS (SELECT row_number() OVER () AS "$row", %s FROM "source")`, strings.Join(casts, ", ")),
+		fmt.Sprintf(`"excluded"(%s) AS (SELECT %s FROM "numbered" WHERE NOT EXISTS (SELECT 1 FROM "numbered" AS "earlier" WHERE %s))`,
+			identList("", cols), identList("", cols), duplicate),
+	)
+	insert := fmt.Sprintf(`INSERT INTO %s AS %s (%s) SELECT * FROM "excluded" WHERE NOT EXISTS (SELECT 1 FROM %s AS "existing" WHERE %s)`,
+		view, alias, identList("", cols), view, conflicts(`"existing"`, `"excluded"`))
+	if doUpdate {
+		update := fmt.Sprintf(`UPDATE %s AS %s SET %s FROM "excluded" WHERE (%s)`, view, alias, set, conflicts(alias, `"excluded"`))
+		if where != "" {
+			update += fmt.Sprintf(" AND (%s)", where)
+		}
+		ctes = append(ctes, fmt.Sprintf(`"updated" AS (%s RETURNING %s.*)`, update, alias))
+	}
+
+	if returning == len(stmt.tokens) && !doUpdate {
+		return fmt.Sprintf("WITH %s\n%s", strings.Join(ctes, ",\n"), insert), nil
+	}
+	if returning == len(stmt.tokens) {
+		// the command tag counts the rows inserted into the upserts view
+		ctes = append(ctes, fmt.Sprintf(`"inserted" AS (%s RETURNING 1)`, insert))
+		return fmt.Sprintf(`WITH %s
+INSERT INTO %s SELECT true FROM (SELECT 1 FROM "updated" UNION ALL SELECT 1 FROM "inserted") AS "upserted"`, strings.Join(ctes, ",\n"), b.clonedDdl.upserts()), nil
+	}
+	if !doUpdate {
+		return fmt.Sprintf("WITH %s\n%s RETURNING %s", strings.Join(ctes, ",\n"), insert, stmt.span(returning+1, len(stmt.tokens))), nil
+	}
+	ctes = append(ctes, fmt.Sprintf(`"inserted" AS (%s RETURNING %s.*)`, insert, alias))
+	return fmt.Sprintf(`WITH %s
+SELECT %s FROM (SELECT * FROM "updated" UNION ALL SELECT * FROM "inserted") AS %s`, strings.Join(ctes, ",\n"), stmt.span(returning+1, len(stmt.tokens)), alias), nil
+}
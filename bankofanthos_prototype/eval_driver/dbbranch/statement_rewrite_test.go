@@ -0,0 +1,214 @@
+package dbbranch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jackc/pgconn"
+)
+
+func TestSplitStatements(t *testing.T) {
+	sql := `SELECT 'a;b', "c;d" FROM t; -- one; two
+	/* x; /* nested; */ y; */ INSERT INTO t VALUES ($1, $tag$;$tag$, E'\';');
+	DO $$ BEGIN PERFORM 1; END $$`
+	var got []string
+	for _, stmt := range splitStatements(sql) {
+		got = append(got, stmt.span(0, len(stmt.tokens)))
+	}
+	want := []string{
+		`SELECT 'a;b', "c;d" FROM t`,
+		`INSERT INTO t VALUES ($1, $tag$;$tag$, E'\';')`,
+		`DO $$ BEGIN PERFORM 1; END $$`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+}
+
+func TestRewriteStatements(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE accounts (
+		id    SERIAL PRIMARY KEY,
+		email TEXT UNIQUE NOT NULL,
+		name  TEXT,
+		label TEXT GENERATED ALWAYS AS (upper(name)) STORED
+	);
+	CREATE TABLE orders (
+		id         INT PRIMARY KEY,
+		account_id INT REFERENCES accounts(id)
+	);
+	CREATE TABLE logs (msg TEXT);
+	INSERT INTO accounts(email, name) VALUES ('a@x', 'alice'), ('b@x', 'bob');
+	INSERT INTO orders VALUES (1, 1);
+	INSERT INTO logs VALUES ('start');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete(ctx)
+
+	conn, err := connPool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SET search_path TO "+b.SearchPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(t *testing.T, sql string) []string {
+		t.Helper()
+		rewritten, err := b.Rewrite(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := conn.Query(ctx, rewritten)
+		if err != nil {
+			t.Fatalf("%s: %v", rewritten, err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			values, err := rows.Values()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprint(values...))
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("%s: %v", rewritten, err)
+		}
+		return got
+	}
+	exec := func(t *testing.T, sql string) {
+		t.Helper()
+		rewritten, err := b.Rewrite(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Exec(ctx, rewritten); err != nil {
+			t.Fatalf("%s: %v", rewritten, err)
+		}
+	}
+
+	t.Run("UpsertReturning", func(t *testing.T) {
+		got := query(t, `INSERT INTO accounts AS a (email, name) VALUES ('a@x', 'alicia'), ('c@x', 'carol')
+		ON CONFLICT (email) DO UPDATE SET name = excluded.name WHERE a.name <> excluded.name
+		RETURNING a.email, a.name, a.label`)
+		want := []string{"a@xaliciaALICIA", "c@xcarolCAROL"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("UpsertDoNothing", func(t *testing.T) {
+		got := query(t, `INSERT INTO accounts (email, name) VALUES ('b@x', 'robert'), ('d@x', 'dave') ON CONFLICT DO NOTHING RETURNING email`)
+		if diff := cmp.Diff([]string{"d@x"}, got); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("UpsertCommandTag", func(t *testing.T) {
+		rewritten, err := b.Rewrite(`INSERT INTO accounts (email, name) VALUES ('a@x', 'ann'), ('f@x', 'fay')
+		ON CONFLICT (email) DO UPDATE SET name = excluded.name`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, err := conn.Exec(ctx, rewritten)
+		if err != nil {
+			t.Fatalf("%s: %v", rewritten, err)
+		}
+		// one row updated and one inserted
+		if !tag.Insert() || tag.RowsAffected() != 2 {
+			t.Errorf("command tag: got %s, want INSERT 0 2", tag)
+		}
+	})
+
+	t.Run("UpsertDuplicateKeys", func(t *testing.T) {
+		rewritten, err := b.Rewrite(`INSERT INTO accounts (email, name) VALUES ('g@x', 'gus'), ('g@x', 'gina')
+		ON CONFLICT (email) DO UPDATE SET name = excluded.name`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Exec(ctx, rewritten)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "21000" {
+			t.Errorf("got %v, want cardinality_violation", err)
+		}
+
+		got := query(t, `INSERT INTO accounts (email, name) VALUES ('h@x', 'hal'), ('h@x', 'hank') ON CONFLICT DO NOTHING RETURNING name`)
+		if diff := cmp.Diff([]string{"hal"}, got); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("UpsertWith", func(t *testing.T) {
+		got := query(t, `WITH input(email, name) AS (VALUES ('a@x', 'anna'))
+		INSERT INTO accounts (email, name) SELECT email, name FROM input
+		ON CONFLICT (email) DO UPDATE SET name = excluded.name RETURNING label`)
+		if diff := cmp.Diff([]string{"ANNA"}, got); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("UpdateReturningGenerated", func(t *testing.T) {
+		got := query(t, `UPDATE accounts SET name = 'bobby' WHERE email = 'b@x' RETURNING label`)
+		if diff := cmp.Diff([]string{"BOBBY"}, got); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("TruncateReferenced", func(t *testing.T) {
+		rewritten, err := b.Rewrite("TRUNCATE accounts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Exec(ctx, rewritten)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "0A000" {
+			t.Errorf("got %v, want feature_not_supported", err)
+		}
+	})
+
+	t.Run("TruncateCascade", func(t *testing.T) {
+		exec(t, "TRUNCATE TABLE accounts RESTART IDENTITY CASCADE; TRUNCATE logs")
+		for _, table := range []string{"accounts", "orders", "logs"} {
+			if got := query(t, "SELECT count(*) FROM "+table); got[0] != "0" {
+				t.Errorf("%s: got %s rows, want 0", table, got[0])
+			}
+		}
+		if got := query(t, "INSERT INTO accounts(email) VALUES ('e@x') RETURNING id"); got[0] != "1" {
+			t.Errorf("id after RESTART IDENTITY: got %s, want 1", got[0])
+		}
+	})
+
+	// production is untouched
+	var count int
+	if err := connPool.QueryRow(ctx, "SELECT count(*) FROM public.accounts").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("production accounts: got %d rows, want 2", count)
+	}
+}
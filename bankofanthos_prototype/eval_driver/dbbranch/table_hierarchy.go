@@ -0,0 +1,243 @@
+// This file branches the tables that other tables inherit from, among them
+// partitioned tables. Every table of a hierarchy gets its own R+/R- and an R'
+// of the rows stored in the table itself, which reads ONLY the production
+// table. A table with children also gets an R' of the hierarchy, named like
+// the production table, that adds the rows of the children; its triggers
+// route the writes to the R' that holds the row, and inserts into a
+// partitioned table to the partition whose bound the row satisfies.
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// createHierarchyViews creates the R' of the hierarchy of every table with
+// children, children first since the R' of a parent reads theirs. c.mu must
+// be held.
+func (c *cloneDdl) createHierarchyViews(ctx context.Context) error {
+	var parents []*clonedTable
+	for _, t := range c.clonedTables {
+		t.Children = nil
+		for _, child := range c.database.children(t.Snapshot) {
+			t.Children = append(t.Children, c.clonedTables[child.key()])
+		}
+		if len(t.Children) > 0 {
+			parents = append(parents, t)
+		}
+	}
+	sort.Slice(parents, func(i, j int) bool {
+		di, dj := c.database.depth(parents[i].Snapshot), c.database.depth(parents[j].Snapshot)
+		if di != dj {
+			return di > dj
+		}
+		return parents[i].Snapshot.key() < parents[j].Snapshot.key()
+	})
+
+	for _, t := range parents {
+		names := maps.Keys(t.View.Cols)
+		sort.Strings(names)
+		cols := identList("", names)
+
+		// the children may have more columns than t
+		var selects []string
+		if !t.Snapshot.Partitioned {
+			selects = append(selects, fmt.Sprintf("SELECT %s FROM %s", cols, t.View.qualifiedName()))
+		}
+		for _, child := range t.Children {
+			selects = append(selects, fmt.Sprintf("SELECT %s FROM %s", cols, hierarchyView(child).qualifiedName()))
+		}
+
+		t.Hierarchy = &view{Schema: t.View.Schema, Name: t.Snapshot.Name, Cols: t.View.Cols}
+		query := fmt.Sprintf("CREATE OR REPLACE VIEW %s AS %s;", t.Hierarchy.qualifiedName(), strings.Join(selects, "\nUNION ALL\n"))
+		if _, err := c.conn().Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to create R' of the hierarchy of %s: %w", t.Snapshot.qualifiedName(), err)
+		}
+
+		// an INSERT routed to a child has the defaults of t filled in already
+		for _, name := range names {
+			d := columnDefault(t.View.Cols[name])
+			if seq, ok := t.Sequences[name]; ok {
+				d = fmt.Sprintf("nextval(%s::regclass)", quoteLiteral(seq.qualifiedName()))
+			}
+			if d == "" {
+				continue
+			}
+			if _, err := c.conn().Exec(ctx, fmt.Sprintf("ALTER VIEW %s ALTER COLUMN %s SET DEFAULT %s;", t.Hierarchy.qualifiedName(), quoteIdent(name), d)); err != nil {
+				return fmt.Errorf("failed to set default of %s, %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hierarchyView returns the R' of t that queries of the branch read: the R'
+// of its hierarchy if it has children, else its R'.
+func hierarchyView(t *clonedTable) *view {
+	if t.Hierarchy != nil {
+		return t.Hierarchy
+	}
+	return t.View
+}
+
+// inherits reports whether t inherits from, or is a partition of, another
+// table of the branch.
+func (c *cloneDdl) inherits(t *clonedTable) bool {
+	for _, key := range t.Snapshot.Inherits {
+		if _, ok := c.clonedTables[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// members returns t and the tables that inherit from it, directly or not,
+// each once.
+func members(t *clonedTable) []*clonedTable {
+	seen := map[*clonedTable]bool{}
+	var all []*clonedTable
+	var visit func(t *clonedTable)
+	visit = func(t *clonedTable) {
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		all = append(all, t)
+		for _, child := range t.Children {
+			visit(child)
+		}
+	}
+	visit(t)
+	return all
+}
+
+// onlyName returns the name that refers to the rows of the production table
+// of t itself, without the rows of its children.
+func onlyName(t *clonedTable) string {
+	if t.Hierarchy != nil {
+		return "ONLY " + t.Snapshot.qualifiedName()
+	}
+	return t.Snapshot.qualifiedName()
+}
+
+// partitionCheck returns the condition that the NEW row satisfies the bound
+// of the partition t, or "" if t is not a partition.
+func partitionCheck(t *clonedTable) string {
+	if t.Snapshot.PartitionBound == "" {
+		return ""
+	}
+	return fmt.Sprintf("(SELECT %s FROM (SELECT NEW.*) AS t) IS TRUE", t.Snapshot.PartitionBound)
+}
+
+// createRouteTriggers creates the triggers that route the writes to the R' of
+// the hierarchy of t to the R' of the table that holds the row. A row is
+// found by the values of the columns of t, and the rows with the same values
+// are changed together; the later trigger calls for them find no row.
+func createRouteTriggers(ctx context.Context, conn execer, t *clonedTable) error {
+	names := maps.Keys(t.View.Cols)
+	sort.Strings(names)
+	cols := identList("", names)
+	match := fmt.Sprintf("WHERE (%s) IS NOT DISTINCT FROM (%s)", cols, identList("OLD.", names))
+	returning := fmt.Sprintf("RETURNING %s INTO %s", cols, identList("NEW.", names))
+
+	var targets []*clonedTable
+	if !t.Snapshot.Partitioned {
+		targets = append(targets, t)
+	}
+	targets = append(targets, t.Children...)
+	target := func(m *clonedTable) string {
+		if m == t {
+			return t.View.qualifiedName()
+		}
+		return hierarchyView(m).qualifiedName()
+	}
+
+	// INSERT
+	insert := "\n\tBEGIN"
+	if t.Snapshot.Partitioned {
+		for _, child := range t.Children {
+			check := partitionCheck(child)
+			if check == "" {
+				check = "true"
+			}
+			insert += fmt.Sprintf(`
+	IF %s THEN
+		INSERT INTO %s (%s) VALUES (%s) %s;
+		IF NOT FOUND THEN
+			RETURN NULL;
+		END IF;
+		RETURN NEW;
+	END IF;`, check, target(child), cols, identList("NEW.", names), returning)
+		}
+		insert += "\n\t" + violation{
+			Code:    checkViolation,
+			Message: fmt.Sprintf("no partition of relation \"%s\" found for row", t.Snapshot.Name),
+			Schema:  t.Snapshot.Schema,
+			Table:   t.Snapshot.Name,
+		}.raise()
+	} else {
+		insert += fmt.Sprintf(`
+	INSERT INTO %s (%s) VALUES (%s) %s;
+	IF NOT FOUND THEN
+		RETURN NULL;
+	END IF;
+	RETURN NEW;`, t.View.qualifiedName(), cols, identList("NEW.", names), returning)
+	}
+	insert += "\n\tEND;\n\t"
+
+	// UPDATE: a row whose partition key changes moves to another partition
+	update := "\n\tBEGIN"
+	for _, m := range targets {
+		move := ""
+		if check := partitionCheck(m); check != "" && m != t {
+			move = fmt.Sprintf(`
+		IF NOT %s THEN
+			DELETE FROM %s %s;
+			INSERT INTO %s (%s) VALUES (%s) %s;
+			RETURN NEW;
+		END IF;`, check, target(m), match, t.Hierarchy.qualifiedName(), cols, identList("NEW.", names), returning)
+		}
+		update += fmt.Sprintf(`
+	IF EXISTS (SELECT * FROM %s %s) THEN%s
+		UPDATE %s SET (%s) = ROW(%s) %s %s;
+		RETURN NEW;
+	END IF;`, target(m), match, move, target(m), cols, identList("NEW.", names), match, returning)
+	}
+	update += "\n\tRETURN NULL;\n\tEND;\n\t"
+
+	// DELETE
+	del := "\n\tBEGIN"
+	for _, m := range targets {
+		del += fmt.Sprintf(`
+	DELETE FROM %s %s;
+	IF FOUND THEN
+		RETURN OLD;
+	END IF;`, target(m), match)
+	}
+	del += "\n\tRETURN NULL;\n\tEND;\n\t"
+
+	for _, route := range []struct {
+		event, body string
+	}{
+		{"INSERT", insert},
+		{"UPDATE", update},
+		{"DELETE", del},
+	} {
+		suffix := "_route_" + strings.ToLower(route.event)
+		functionName := qualify(t.Hierarchy.Schema, t.Snapshot.Name+suffix) + "()"
+		triggerName := t.Snapshot.Name + suffix + "_trigger"
+		if _, err := conn.Exec(ctx, createTriggerFunctionStmt(functionName, route.body)); err != nil {
+			return err
+		}
+		if _, err := conn.Exec(ctx, createTriggerStmt(triggerName, route.event, t.Hierarchy.qualifiedName(), functionName)); err != nil {
+			return err
+		}
+		t.RouteTriggers = append(t.RouteTriggers, triggerName)
+		t.Functions = append(t.Functions, functionName)
+	}
+	return nil
+}
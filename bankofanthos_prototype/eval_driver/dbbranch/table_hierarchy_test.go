@@ -0,0 +1,144 @@
+package dbbranch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTableHierarchy(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE ledger (id INT, day DATE NOT NULL, amount INT, PRIMARY KEY (id, day)) PARTITION BY RANGE (day);
+	CREATE TABLE ledger_2023 PARTITION OF ledger FOR VALUES FROM ('2023-01-01') TO ('2024-01-01');
+	CREATE TABLE ledger_2024 PARTITION OF ledger FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+	CREATE TABLE ledger_other PARTITION OF ledger DEFAULT;
+
+	CREATE TABLE events (name TEXT);
+	CREATE TABLE alerts (level INT) INHERITS (events);
+
+	INSERT INTO ledger VALUES (1, '2023-06-01', 10), (2, '2024-06-01', 20);
+	INSERT INTO events VALUES ('start');
+	INSERT INTO alerts VALUES ('disk', 2);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := brancher.Branch(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(relation string) int {
+		t.Helper()
+		var n int
+		if err := connPool.QueryRow(ctx, "SELECT count(*) FROM "+relation).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	t.Run("Read", func(t *testing.T) {
+		for _, test := range []struct {
+			relation string
+			want     int
+		}{
+			{"b.ledger", 2},
+			{"b.ledger_2023", 1},
+			{"b.events", 2},
+			{"b.alerts", 1},
+		} {
+			if got := count(test.relation); got != test.want {
+				t.Errorf("rows of %s: got %d, want %d", test.relation, got, test.want)
+			}
+		}
+	})
+
+	t.Run("Route", func(t *testing.T) {
+		_, err := connPool.Exec(ctx, `
+		INSERT INTO b.ledger VALUES (3, '2024-02-01', 30), (4, '2030-01-01', 40);
+		UPDATE b.ledger SET day = '2024-03-01' WHERE id = 1;
+		DELETE FROM b.events WHERE name = 'disk';
+		INSERT INTO b.events VALUES ('stop');
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			relation string
+			want     int
+		}{
+			{"b.ledger", 4},
+			{"b.ledger_2023", 0},
+			{"b.ledger_2024", 3},
+			{"b.ledger_other", 1},
+			{"b.events", 2},
+			{"b.alerts", 0},
+			{"public.ledger", 2},
+			{"public.alerts", 1},
+		} {
+			if got := count(test.relation); got != test.want {
+				t.Errorf("rows of %s: got %d, want %d", test.relation, got, test.want)
+			}
+		}
+	})
+
+	t.Run("PartitionConstraint", func(t *testing.T) {
+		if _, err := connPool.Exec(ctx, `INSERT INTO b.ledger_2023 VALUES (5, '2024-01-01', 50)`); err == nil {
+			t.Error("inserted a row outside of the bound of the partition")
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		diffs, err := brancher.ComputeDiffAtN(ctx, a, b, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"ledger_2023", "ledger_2024", "ledger_other", "alerts"} {
+			if _, ok := diffs[name]; ok {
+				t.Errorf("diff of the member %s reported on its own", name)
+			}
+		}
+
+		// (1, 2023) moved to 2024, (3) and (4) were inserted
+		if got, want := len(diffs["ledger"].Experimental), 4; got != want {
+			t.Errorf("rows of the ledger diff: got %d, want %d", got, want)
+		}
+		var inserted, deleted []any
+		events := diffs["events"]
+		for i := range events.Experimental {
+			control, experimental := (*events.Control[i])[0], (*events.Experimental[i])[0]
+			switch {
+			case control == nil && experimental != nil:
+				inserted = append(inserted, experimental)
+			case control != nil && experimental == nil:
+				deleted = append(deleted, control)
+			}
+		}
+		if diff := cmp.Diff([]any{"stop"}, inserted); diff != "" {
+			t.Errorf("rows inserted into B (-want,+got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]any{"disk"}, deleted); diff != "" {
+			t.Errorf("rows deleted from B (-want,+got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,276 @@
+// This file re-attaches the triggers of the production tables to a branch.
+// Postgres only allows INSTEAD OF row triggers on a view, so the BEFORE and
+// AFTER row triggers go to a hook table that has the columns of the
+// production table. The redirect triggers write the row to the hook table
+// before and after they redirect it, which fires the triggers with the OLD and
+// NEW rows postgres would pass them; a WHEN condition on a setting keeps the
+// triggers quiet while the hook table is staged and cleared. Statement
+// triggers are allowed on a view and go to R' directly.
+package dbbranch
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// hooksSetting names the setting that tells which triggers of which hook
+// table may fire, e.g. BEFORE "b1$$hooks".users.
+const hooksSetting = "dbbranch.hooks"
+
+// hooksTable returns the quoted name of the hook table of t.
+func hooksTable(t *clonedTable) string {
+	return qualify(hooksSchema(t.Namespace, t.Snapshot.Schema), t.Snapshot.Name)
+}
+
+// hookGate returns the condition under which the timing row triggers of the
+// hook table of t fire.
+func hookGate(t *clonedTable, timing string) string {
+	return fmt.Sprintf("current_setting(%s, true) = %s", quoteLiteral(hooksSetting), quoteLiteral(timing+" "+hooksTable(t)))
+}
+
+// hasRowTriggers reports whether the production table of t has row triggers
+// for event at timing. The row triggers of a partitioned table fire through
+// their copies on the partitions.
+func hasRowTriggers(t *clonedTable, timing, event string) bool {
+	if t.Snapshot.Partitioned {
+		return false
+	}
+	for _, trigger := range t.Snapshot.Triggers {
+		if trigger.Row && trigger.Before == (timing == "BEFORE") && slices.Contains(trigger.Events, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// hookPhase returns the block of a redirect trigger function that fires the
+// timing row triggers of event on the hook table of t. BEFORE triggers may
+// change the NEW row, or return NULL to skip the row, which the block passes
+// on by returning NULL itself. The setting is restored afterwards, since the
+// triggers may write to other tables whose hooks use it too.
+func hookPhase(t *clonedTable, timing, event string) string {
+	if !hasRowTriggers(t, timing, event) {
+		return ""
+	}
+	cols := redirectColNames(t)
+	hooks := hooksTable(t)
+	set := func(value string) string {
+		return fmt.Sprintf(`
+		PERFORM set_config(%s, %s, true);`, quoteLiteral(hooksSetting), value)
+	}
+	fire := set(quoteLiteral(timing + " " + hooks))
+	quiet := set("''")
+
+	// the UPDATE and DELETE triggers need the OLD row in the hook table
+	stage := ""
+	if event != "INSERT" {
+		stage = quiet + fmt.Sprintf(`
+		INSERT INTO %s (%s) VALUES (%s) RETURNING ctid INTO staged;`, hooks, identList("", cols), identList("OLD.", cols))
+	}
+
+	into := ""
+	if timing == "BEFORE" && event != "DELETE" {
+		into = ", " + identList("", cols) + " INTO changed, " + identList("NEW.", cols)
+	} else {
+		into = " INTO changed"
+	}
+	var statement string
+	switch event {
+	case "INSERT":
+		statement = fmt.Sprintf(`
+		INSERT INTO %s (%s) VALUES (%s) RETURNING ctid%s;`, hooks, identList("", cols), identList("NEW.", cols), into)
+	case "UPDATE":
+		statement = fmt.Sprintf(`
+		UPDATE %s SET (%s) = ROW(%s) WHERE ctid = staged RETURNING ctid%s;`, hooks, identList("", cols), identList("NEW.", cols), into)
+	case "DELETE":
+		statement = fmt.Sprintf(`
+		DELETE FROM %s WHERE ctid = staged RETURNING ctid%s;`, hooks, into)
+	}
+
+	skip := ""
+	if timing == "BEFORE" {
+		skip = `
+		IF skipped THEN
+			RETURN NULL;
+		END IF;`
+	}
+
+	return fmt.Sprintf(`
+	DECLARE
+		hooks text := coalesce(current_setting(%s, true), '');
+		staged tid;
+		changed tid;
+		skipped boolean;
+	BEGIN%s%s%s
+		skipped := NOT FOUND;%s
+		DELETE FROM %s WHERE ctid = staged OR ctid = changed;%s%s
+	END;`, quoteLiteral(hooksSetting), stage, fire, statement, quiet, hooks, set("hooks"), skip)
+}
+
+// attachUserTriggers creates the hook table of t and re-attaches the triggers
+// of the production table. The trigger functions are copied to the hook
+// schema with the search_path of the branch, so that their writes to other
+// tables go to the branch as well; writes to schema qualified tables still
+// go to production. Statement triggers on TRUNCATE or with transition tables
+// are not supported on views and are left out.
+func (c *cloneDdl) attachUserTriggers(ctx context.Context, t *clonedTable) error {
+	if len(t.Snapshot.Triggers) == 0 {
+		return nil
+	}
+	schema := hooksSchema(c.namespace, t.Snapshot.Schema)
+
+	var cols []string
+	for _, name := range redirectColNames(t) {
+		col := t.Snapshot.Cols[name]
+		def := quoteIdent(name) + " " + columnType(col)
+		if col.Collation != "" {
+			def += " COLLATE " + col.Collation
+		}
+		cols = append(cols, def)
+	}
+	_, err := c.conn().Exec(ctx, fmt.Sprintf(`
+	DROP TABLE IF EXISTS %s;
+	CREATE TABLE %s (%s);`, hooksTable(t), hooksTable(t), strings.Join(cols, ", ")))
+	if err != nil {
+		return fmt.Errorf("failed to create hook table of %s: %w", t.Snapshot.qualifiedName(), err)
+	}
+
+	for _, trigger := range t.Snapshot.Triggers {
+		if !trigger.Row && (trigger.Transition || slices.Contains(trigger.Events, "TRUNCATE")) {
+			continue
+		}
+		if trigger.Row && t.Snapshot.Partitioned {
+			continue
+		}
+
+		// functions written in C or internal cannot be copied by an ordinary
+		// user, and do not write to other tables
+		function := qualify(trigger.FunctionSchema, trigger.FunctionName)
+		if trigger.FunctionSchema != "pg_catalog" {
+			function = qualify(schema, trigger.FunctionName)
+			def, err := replaceName(trigger.FunctionDef, "FUNCTION", function)
+			if err != nil {
+				return err
+			}
+			if _, err := c.conn().Exec(ctx, def); err != nil {
+				return fmt.Errorf("failed to copy function %s: %w", trigger.FunctionName, err)
+			}
+			if _, err := c.conn().Exec(ctx, fmt.Sprintf("ALTER FUNCTION %s() SET search_path TO %s;", function, c.searchPath())); err != nil {
+				return fmt.Errorf("failed to set the search_path of %s: %w", function, err)
+			}
+		}
+
+		target, gate := hierarchyView(t).qualifiedName(), ""
+		if trigger.Row {
+			timing := "AFTER"
+			if trigger.Before {
+				timing = "BEFORE"
+			}
+			target, gate = hooksTable(t), hookGate(t, timing)
+		}
+		def, err := retargetTrigger(trigger.Definition, target, function, gate)
+		if err != nil {
+			return err
+		}
+		if _, err := c.conn().Exec(ctx, def); err != nil {
+			return fmt.Errorf("failed to attach trigger %s: %w", trigger.Name, err)
+		}
+	}
+	return nil
+}
+
+// edit replaces the bytes [start, end) of a statement with text.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// applyEdits applies edits, which must be ordered and must not overlap, to
+// sql.
+func applyEdits(sql string, edits []edit) string {
+	var b strings.Builder
+	last := 0
+	for _, e := range edits {
+		b.WriteString(sql[last:e.start])
+		b.WriteString(e.text)
+		last = e.end
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+// nameSpan returns the bytes the possibly qualified name at token i of stmt
+// takes up, and the index of the token after it.
+func nameSpan(stmt statement, i int) (int, int, int, bool) {
+	_, _, next, ok := stmt.name(i)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	last := stmt.tokens[next-1]
+	return stmt.tokens[i].start, last.start + len(last.text), next, true
+}
+
+// replaceName replaces the name that follows the keyword in the definition
+// def, e.g. the function of a CREATE FUNCTION statement.
+func replaceName(def, keyword, name string) (string, error) {
+	stmts := splitStatements(def)
+	if len(stmts) != 1 {
+		return "", fmt.Errorf("failed to parse %q", def)
+	}
+	stmt := stmts[0]
+	start, end, _, ok := nameSpan(stmt, stmt.find(0, keyword)+1)
+	if !ok {
+		return "", fmt.Errorf("failed to parse %q", def)
+	}
+	return applyEdits(stmt.sql, []edit{{start, end, name}}), nil
+}
+
+// retargetTrigger rewrites the trigger definition def to fire on target and
+// run function. A non-empty gate is added to the WHEN condition. Triggers
+// other than constraint triggers are created OR REPLACE, since the R' view
+// keeps its statement triggers when its redirect triggers are recreated.
+func retargetTrigger(def, target, function, gate string) (string, error) {
+	stmts := splitStatements(def)
+	if len(stmts) != 1 || len(stmts[0].tokens) < 2 {
+		return "", fmt.Errorf("failed to parse %q", def)
+	}
+	stmt := stmts[0]
+
+	var edits []edit
+	if stmt.tokens[1].is("TRIGGER") {
+		end := stmt.tokens[0].start + len(stmt.tokens[0].text)
+		edits = append(edits, edit{end, end, " OR REPLACE"})
+	}
+
+	on := stmt.find(0, "ON")
+	start, end, next, ok := nameSpan(stmt, on+1)
+	if !ok {
+		return "", fmt.Errorf("failed to parse %q", def)
+	}
+	edits = append(edits, edit{start, end, target})
+
+	execute := stmt.find(next, "EXECUTE")
+	if gate != "" {
+		if when := stmt.find(next, "WHEN"); when < execute {
+			open, close := when+1, stmt.closing(when+1)
+			if close >= len(stmt.tokens) {
+				return "", fmt.Errorf("failed to parse %q", def)
+			}
+			after := stmt.tokens[open].start + 1
+			edits = append(edits, edit{after, after, gate + " AND ("}, edit{stmt.tokens[close].start, stmt.tokens[close].start, ")"})
+		} else if execute < len(stmt.tokens) {
+			at := stmt.tokens[execute].start
+			edits = append(edits, edit{at, at, "WHEN (" + gate + ") "})
+		}
+	}
+
+	// EXECUTE FUNCTION or EXECUTE PROCEDURE
+	start, end, _, ok = nameSpan(stmt, execute+2)
+	if !ok {
+		return "", fmt.Errorf("failed to parse %q", def)
+	}
+	edits = append(edits, edit{start, end, function})
+	return applyEdits(stmt.sql, edits), nil
+}
@@ -0,0 +1,184 @@
+package dbbranch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRetargetTrigger(t *testing.T) {
+	for _, test := range []struct {
+		def      string
+		function string
+		gate     string
+		want     string
+	}{
+		{
+			"CREATE TRIGGER touch BEFORE UPDATE ON public.users FOR EACH ROW EXECUTE FUNCTION public.touch()",
+			`"b1$$hooks".touch`,
+			"g",
+			`CREATE OR REPLACE TRIGGER touch BEFORE UPDATE ON "b1$$hooks".users FOR EACH ROW WHEN (g) EXECUTE FUNCTION "b1$$hooks".touch()`,
+		},
+		{
+			"CREATE TRIGGER audit AFTER INSERT ON public.users FOR EACH ROW WHEN ((new.username <> 'root'::text)) EXECUTE FUNCTION public.audit('users')",
+			`"b1$$hooks".audit`,
+			"g",
+			`CREATE OR REPLACE TRIGGER audit AFTER INSERT ON "b1$$hooks".users FOR EACH ROW WHEN (g AND ((new.username <> 'root'::text))) EXECUTE FUNCTION "b1$$hooks".audit('users')`,
+		},
+		{
+			"CREATE CONSTRAINT TRIGGER late AFTER DELETE ON public.users DEFERRABLE INITIALLY DEFERRED FOR EACH ROW EXECUTE FUNCTION public.late()",
+			`"b1$$hooks".late`,
+			"g",
+			`CREATE CONSTRAINT TRIGGER late AFTER DELETE ON "b1$$hooks".users DEFERRABLE INITIALLY DEFERRED FOR EACH ROW WHEN (g) EXECUTE FUNCTION "b1$$hooks".late()`,
+		},
+		{
+			// statement triggers go to R' without a gate
+			"CREATE TRIGGER log AFTER INSERT ON public.users FOR EACH STATEMENT EXECUTE FUNCTION public.log()",
+			`"b1$$hooks".log`,
+			"",
+			`CREATE OR REPLACE TRIGGER log AFTER INSERT ON "b1$$hooks".users FOR EACH STATEMENT EXECUTE FUNCTION "b1$$hooks".log()`,
+		},
+	} {
+		got, err := retargetTrigger(test.def, `"b1$$hooks".users`, test.function, test.gate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("retargetTrigger(%q) (-want,+got):\n%s", test.def, diff)
+		}
+	}
+}
+
+func TestUserTriggers(t *testing.T) {
+	ctx := context.Background()
+
+	// Setup database
+	dbContainer, connPool, _, err := SetupTestDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbContainer.Terminate(ctx)
+
+	err = createTables(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = connPool.Exec(ctx, `
+	CREATE TABLE audit (username TEXT, op TEXT);
+
+	CREATE FUNCTION lower_name() RETURNS trigger AS $$
+	BEGIN
+		NEW.username := lower(NEW.username);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE FUNCTION keep_root() RETURNS trigger AS $$
+	BEGIN
+		IF OLD.username = 'root' THEN
+			RETURN NULL;
+		END IF;
+		RETURN OLD;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE FUNCTION audit_users() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO audit VALUES (OLD.username, TG_TABLE_NAME || ' ' || TG_OP);
+		ELSE
+			INSERT INTO audit VALUES (NEW.username, TG_TABLE_NAME || ' ' || TG_OP);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE TRIGGER lower_name BEFORE INSERT OR UPDATE ON users FOR EACH ROW EXECUTE FUNCTION lower_name();
+	CREATE TRIGGER keep_root BEFORE DELETE ON users FOR EACH ROW EXECUTE FUNCTION keep_root();
+	CREATE TRIGGER audit_users AFTER INSERT OR UPDATE OR DELETE ON users FOR EACH ROW EXECUTE FUNCTION audit_users();
+
+	INSERT INTO users(accountid, username, passhash) VALUES
+	('101122611122', 'root', '1234');
+	DELETE FROM audit;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brancher, err := NewBrancher(ctx, connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := brancher.Branch(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := connPool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SET search_path TO "+b.SearchPath()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(ctx, `
+	INSERT INTO users(accountid, username, passhash) VALUES ('103362343333', 'Bob', '2345');
+	UPDATE users SET username = 'EVE' WHERE username = 'bob';
+	DELETE FROM users;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(sql string) []string {
+		t.Helper()
+		rows, err := connPool.Query(ctx, sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, s)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	t.Run("Before", func(t *testing.T) {
+		// the DELETE skipped root
+		if diff := cmp.Diff([]string{"root"}, query(`SELECT username FROM b.users`)); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("After", func(t *testing.T) {
+		want := []string{"bob users INSERT", "eve users DELETE", "eve users UPDATE"}
+		if diff := cmp.Diff(want, query(`SELECT username || ' ' || op FROM b.audit ORDER BY 1`)); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("Production", func(t *testing.T) {
+		if got := query(`SELECT username FROM public.audit`); len(got) != 0 {
+			t.Errorf("audit rows in production: %v", got)
+		}
+		if diff := cmp.Diff([]string{"root"}, query(`SELECT username FROM public.users`)); diff != "" {
+			t.Errorf("(-want,+got):\n%s", diff)
+		}
+	})
+
+	t.Run("Hooks", func(t *testing.T) {
+		if got := query(`SELECT username FROM "b$$hooks".users`); len(got) != 0 {
+			t.Errorf("rows left in the hook table: %v", got)
+		}
+	})
+}
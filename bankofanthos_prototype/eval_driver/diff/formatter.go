@@ -31,7 +31,9 @@ func (a atom) String() string {
 	return b.String()
 }
 
-func boldUnequalColumns(baseline, control, experimental []atom) {
+// boldUnequalColumns bolds the columns of the rows that are not equal, as
+// told by equal, which applies the diff rules of the table.
+func boldUnequalColumns(baseline, control, experimental []atom, equal func(col int) bool) {
 	var rows [][]atom
 	for _, row := range [][]atom{baseline, control, experimental} {
 		if len(row) > 0 {
@@ -40,14 +42,7 @@ func boldUnequalColumns(baseline, control, experimental []atom) {
 	}
 
 	for col := range rows[0] {
-		allEqual := true
-		for _, row := range rows {
-			if row[col] != rows[0][col] {
-				allEqual = false
-				break
-			}
-		}
-		if !allEqual {
+		if !equal(col) {
 			for _, row := range rows {
 				row[col].Bold = true
 				row[col].Color = Reset
@@ -108,6 +103,9 @@ func stringifyRows(left []*dbbranch.Row, middle []*dbbranch.Row, right []*dbbran
 func DisplayDiff(branchDiffs map[string]*dbbranch.Diff, displayInlineDiff bool) (string, error) {
 	var b strings.Builder
 	for tableName, tableDiff := range branchDiffs {
+		if tableDiff.SchemaDiff != nil {
+			writeSchemaDiff(&b, tableName, tableDiff.SchemaDiff.Lines())
+		}
 		if len(tableDiff.Control) == 0 && len(tableDiff.Experimental) == 0 && len(tableDiff.Baseline) == 0 {
 			continue
 		}
@@ -128,3 +126,12 @@ func DisplayDiff(branchDiffs map[string]*dbbranch.Diff, displayInlineDiff bool)
 
 	return b.String(), nil
 }
+
+// writeSchemaDiff writes the schema differences of a table, which come before
+// its rows.
+func writeSchemaDiff(b *strings.Builder, tableName string, schemaDiff []string) {
+	fmt.Fprintf(b, "%s schema:\n", strings.ToUpper(tableName))
+	for _, line := range schemaDiff {
+		fmt.Fprintf(b, "  %s\n", line)
+	}
+}
@@ -127,3 +127,26 @@ USER
 	}
 	fmt.Println(output)
 }
+
+func TestSchemaDiffFormat(t *testing.T) {
+	output, err := DisplayDiff(map[string]*dbbranch.Diff{"user": {SchemaDiff: &dbbranch.TableSchemaDiff{
+		Table:   "user",
+		Change:  dbbranch.Changed,
+		Columns: []dbbranch.ObjectChange{{Name: "age", Change: dbbranch.Added, B: "integer"}, {Name: "name", Change: dbbranch.Changed, A: "text", B: "character varying(64)"}},
+		Indexes: []dbbranch.ObjectChange{{Name: "user_age_idx", Change: dbbranch.Removed, A: `("age")`}},
+	}}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedString := `
+USER schema:
+  column "age" only in B: integer
+  column "name": text in A, character varying(64) in B
+  index "user_age_idx" only in A: ("age")
+`
+
+	if diff := cmp.Diff(expectedString[1:], removeColorCodes(output)); diff != "" {
+		t.Errorf("(-want,+got):\n%s", diff)
+	}
+}
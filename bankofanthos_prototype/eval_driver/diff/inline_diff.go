@@ -92,7 +92,9 @@ func (i *inlineFormatter) format() error {
 	// for each row
 	prefix := []string{baselinePrefix, controlPrefix, experimentalPrefix}
 	for r := 0; r < len(i.baseline); r++ {
-		boldUnequalColumns(i.baseline[r], i.control[r], i.experimental[r])
+		boldUnequalColumns(i.baseline[r], i.control[r], i.experimental[r], func(col int) bool {
+			return i.tableDiff.Equal(r, col)
+		})
 
 		texts := [][]atom{i.baseline[r], i.control[r], i.experimental[r]}
 		for p, text := range texts {
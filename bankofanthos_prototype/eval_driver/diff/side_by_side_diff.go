@@ -88,7 +88,9 @@ func (s *sideBySideDiffFormatter) format() error {
 
 	// for each row
 	for r := 0; r < len(s.baseline); r++ {
-		boldUnequalColumns(s.baseline[r], s.control[r], s.experimental[r])
+		boldUnequalColumns(s.baseline[r], s.control[r], s.experimental[r], func(col int) bool {
+			return s.tableDiff.Equal(r, col)
+		})
 
 		texts := [][]atom{s.control[r], s.baseline[r], s.experimental[r]}
 		for i, text := range texts {
@@ -5,8 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"strings"
 
+	"bankofanthos_prototype/eval_driver/branchproxy"
 	"bankofanthos_prototype/eval_driver/dbbranch"
 	"bankofanthos_prototype/eval_driver/diff"
 	"bankofanthos_prototype/eval_driver/service"
@@ -15,10 +19,15 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-func runTrail(ctx context.Context, trail *utility.Trail, branchers map[string]*dbbranch.Brancher, v1ProdService, v2ProdService *utility.ProdService, req *service.Request, configLoader *utility.ConfigLoader) (*service.Service, error) {
+func runTrail(ctx context.Context, trail *utility.Trail, branchers map[string]*dbbranch.Brancher, proxies map[string]*dbProxy, v1ProdService, v2ProdService *utility.ProdService, req *service.Request, configLoader *utility.ConfigLoader, lazyBranches bool) (*service.Service, error) {
 	branchMap := map[string]*dbbranch.Branch{}
+	proxyAddrs := map[string]string{}
 	for name, brancher := range branchers {
-		b, err := brancher.Branch(ctx, trail.Name)
+		branch := brancher.Branch
+		if lazyBranches {
+			branch = brancher.LazyBranch
+		}
+		b, err := branch(ctx, trail.Name)
 		if err != nil {
 			return nil, fmt.Errorf("branch %s failed: %v", trail.Name, err)
 		}
@@ -30,6 +39,8 @@ func runTrail(ctx context.Context, trail *utility.Trail, branchers map[string]*d
 		}()
 
 		branchMap[name] = b
+		proxies[name].AddBranch(proxies[name].database, b)
+		proxyAddrs[name] = proxies[name].addr
 	}
 
 	// only run binaries is needed for each run
@@ -42,7 +53,7 @@ func runTrail(ctx context.Context, trail *utility.Trail, branchers map[string]*d
 		prodServices = []*utility.ProdService{v1ProdService, v2ProdService}
 	}
 
-	s, err := service.Init(trail.Cnt, prodServices, trail.ReqPorts, branchMap, req, configLoader)
+	s, err := service.Init(trail.Cnt, prodServices, trail.ReqPorts, branchMap, proxyAddrs, req, configLoader)
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +63,44 @@ func runTrail(ctx context.Context, trail *utility.Trail, branchers map[string]*d
 	return s, nil
 }
 
+// dbProxy serves the connections of the services to the branches of a
+// database, see branchproxy.
+type dbProxy struct {
+	*branchproxy.Proxy
+	addr     string // address the proxy listens on
+	database string // name of the database in its url
+}
+
+// startProxies starts a proxy per database that routes the connections whose
+// application_name is the name of a trail to the branch of the trail. The
+// services reach their branches through the proxies, which rewrite the
+// statements the R' views of a branch cannot run.
+func startProxies(ctx context.Context, prodDbs map[string]*utility.Database, trails []*utility.Trail) (map[string]*dbProxy, error) {
+	var routes []branchproxy.Route
+	for _, trail := range trails {
+		routes = append(routes, branchproxy.Route{Param: "application_name", Value: trail.Name, Namespace: trail.Name})
+	}
+
+	proxies := map[string]*dbProxy{}
+	for name, prodDb := range prodDbs {
+		u, err := url.Parse(prodDb.Url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse url of DB %s: %w", name, err)
+		}
+		p, err := branchproxy.New(prodDb.Url, routes)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return nil, err
+		}
+		go p.Serve(ctx, ln)
+		proxies[name] = &dbProxy{Proxy: p, addr: ln.Addr().String(), database: strings.TrimPrefix(u.Path, "/")}
+	}
+	return proxies, nil
+}
+
 func printDbDiffs(ctx context.Context, branchers map[string]*dbbranch.Brancher, runName, outPath string, branchA, branchB map[string]*dbbranch.Branch, inlineDiff bool, reqCnt int) {
 	f, err := os.Create(fmt.Sprintf("%sDiffPerReq_%s", outPath, runName))
 	if err != nil {
@@ -75,6 +124,10 @@ func printDbDiffs(ctx context.Context, branchers map[string]*dbbranch.Brancher,
 			log.Panicf("failed to compute diff: %v", err)
 		}
 		for n, diffPerReq := range branchDiffPerReqs {
+			// most requests of a long trail do not write the database
+			if len(diffPerReq) == 0 {
+				continue
+			}
 			dbDiffOutPerReq, err := diff.DisplayDiff(diffPerReq, inlineDiff)
 			if err != nil {
 				log.Panicf("failed to display diff per req: %v", err)
@@ -87,11 +140,12 @@ func printDbDiffs(ctx context.Context, branchers map[string]*dbbranch.Brancher,
 func main() {
 	// parse flags
 	var configFile string
-	var deleteBranches, inlineDiff, respDiff bool
+	var deleteBranches, inlineDiff, respDiff, lazyBranches bool
 	flag.StringVar(&configFile, "configFile", "config.toml", "Config file for eval")
 	flag.BoolVar(&deleteBranches, "deleteBranches", true, "Delete branches at the end of eval run, only set false for investigation purpose")
 	flag.BoolVar(&inlineDiff, "inlineDiff", false, "Whether to use inline diff or side by side diff")
 	flag.BoolVar(&respDiff, "respDiff", true, "Whether to show response diff or not")
+	flag.BoolVar(&lazyBranches, "lazyBranches", false, "Whether to create the R+/R- tables of a table only when a trail first writes it")
 	flag.Parse()
 
 	configLoader, err := utility.LoadConfig(configFile)
@@ -125,12 +179,23 @@ func main() {
 		if err != nil {
 			log.Panicf("Create new branch for DB %s failed with %s: %v", prodDb.Name, prodDb.Url, err)
 		}
+		if err := brancher.SetDiffRules(configLoader.GetDiffRules(prodDb.Name)); err != nil {
+			log.Panicf("Set diff rules for DB %s failed: %v", prodDb.Name, err)
+		}
 		branchers[prodDb.Name] = brancher
 	}
 
+	proxies, err := startProxies(ctx, prodDbs, trails)
+	if err != nil {
+		log.Panicf("Start proxies failed: %v", err)
+	}
+	for _, p := range proxies {
+		defer p.Close()
+	}
+
 	var controlService *service.Service
 	for _, trail := range trails {
-		service, err := runTrail(ctx, trail, branchers, v1ProdService, v2ProdService, request, configLoader)
+		service, err := runTrail(ctx, trail, branchers, proxies, v1ProdService, v2ProdService, request, configLoader, lazyBranches)
 		if err != nil {
 			log.Panicf("trail run failed: %v", err)
 		}
@@ -13,6 +13,7 @@ import (
 	"syscall"
 	"time"
 
+	"bankofanthos_prototype/eval_driver/branchproxy"
 	"bankofanthos_prototype/eval_driver/dbbranch"
 	"bankofanthos_prototype/eval_driver/utility"
 
@@ -26,18 +27,20 @@ type Service struct {
 	LogPath      string
 	ProdServices []*utility.ProdService
 	Branches     map[string]*dbbranch.Branch
+	ProxyAddrs   map[string]string // addresses of the proxies to the branches by database, see branchproxy
 
 	ReqPorts []string
 	Request  *Request
 }
 
-func Init(curRun int, prodServices []*utility.ProdService, reqPorts []string, branches map[string]*dbbranch.Branch, request *Request, configLoader *utility.ConfigLoader) (*Service, error) {
+func Init(curRun int, prodServices []*utility.ProdService, reqPorts []string, branches map[string]*dbbranch.Branch, proxyAddrs map[string]string, request *Request, configLoader *utility.ConfigLoader) (*Service, error) {
 	service := &Service{
 		Runs:         fmt.Sprintf("%d", curRun),
 		LogPath:      fmt.Sprintf("%slog%d", configLoader.GetLogPath(), curRun),
 		OutputPath:   fmt.Sprintf("%sresp%d", configLoader.GetOutPath(), curRun),
 		ProdServices: prodServices,
 		Branches:     branches,
+		ProxyAddrs:   proxyAddrs,
 		ReqPorts:     reqPorts,
 		Request:      request,
 	}
@@ -47,8 +50,9 @@ func Init(curRun int, prodServices []*utility.ProdService, reqPorts []string, br
 	}
 
 	// generate config
+	prodDbs := configLoader.GetProdDbs()
 	for i := 0; i < len(prodServices); i++ {
-		err := service.generateConfig(service.ConfigPaths[i], prodServices[i].TestListenPort, prodServices[i])
+		err := service.generateConfig(service.ConfigPaths[i], prodServices[i].TestListenPort, prodServices[i], prodDbs)
 		if err != nil {
 			return service, err
 		}
@@ -72,14 +76,32 @@ func (s *Service) writeOutput(output, outPath string) error {
 	return nil
 }
 
-// generateConfig creates a config file for each run with snapshot database url
-func (s *Service) generateConfig(configPath, listenPort string, prodService *utility.ProdService) error {
+// generateConfig creates a config file for each run whose database urls point at the run's branches
+func (s *Service) generateConfig(configPath, listenPort string, prodService *utility.ProdService, prodDbs map[string]*utility.Database) error {
 	configByte, err := os.ReadFile(prodService.ConfigPath)
 	if err != nil {
 		return err
 	}
 
 	configStr := strings.ReplaceAll(string(configByte), prodService.ListenPort, listenPort)
+	for name, branch := range s.Branches {
+		prodDb, ok := prodDbs[name]
+		if !ok {
+			return fmt.Errorf("no prod database for branch %s", name)
+		}
+		var branchUrl string
+		var err error
+		if addr, ok := s.ProxyAddrs[name]; ok {
+			// the proxy sets the search_path and rewrites the statements
+			branchUrl, err = branchproxy.ConnString(prodDb.Url, addr, branch.Namespace())
+		} else {
+			branchUrl, err = branch.ConnString(prodDb.Url)
+		}
+		if err != nil {
+			return err
+		}
+		configStr = strings.ReplaceAll(configStr, prodDb.Url, branchUrl)
+	}
 
 	file, err := os.Create(configPath)
 	if err != nil {
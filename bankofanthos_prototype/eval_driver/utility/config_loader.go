@@ -3,6 +3,8 @@ package utility
 import (
 	"os"
 
+	"bankofanthos_prototype/eval_driver/dbbranch"
+
 	"github.com/pelletier/go-toml"
 )
 
@@ -30,6 +32,7 @@ type ConfigLoader struct {
 	Info          info
 	Stable        testService
 	Canary        testService
+	DiffRules     map[string]dbbranch.DiffRules // by database name
 }
 
 func (c *ConfigLoader) createGeneatedDir() error {
@@ -90,6 +93,12 @@ func (c *ConfigLoader) GetStableService() *ProdService {
 	}
 }
 
+// GetDiffRules returns the rules for diffing the branches of the database
+// name, or nil if it has none.
+func (c *ConfigLoader) GetDiffRules(name string) dbbranch.DiffRules {
+	return c.DiffRules[name]
+}
+
 func (c *ConfigLoader) GetOrigProdPort() string {
 	return c.Info.ProdPort
 }